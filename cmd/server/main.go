@@ -10,14 +10,20 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/salman0ansari/whatsbox/internal/broadcast"
 	"github.com/salman0ansari/whatsbox/internal/config"
 	"github.com/salman0ansari/whatsbox/internal/database"
 	"github.com/salman0ansari/whatsbox/internal/frontend"
 	"github.com/salman0ansari/whatsbox/internal/handlers"
 	"github.com/salman0ansari/whatsbox/internal/jobs"
 	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/metrics"
 	"github.com/salman0ansari/whatsbox/internal/middleware"
+	"github.com/salman0ansari/whatsbox/internal/ratelimit"
 	"github.com/salman0ansari/whatsbox/internal/stats"
+	"github.com/salman0ansari/whatsbox/internal/storage"
+	"github.com/salman0ansari/whatsbox/internal/utils"
+	"github.com/salman0ansari/whatsbox/internal/webhooks"
 	"github.com/salman0ansari/whatsbox/internal/whatsapp"
 	"go.uber.org/zap"
 )
@@ -50,52 +56,103 @@ func main() {
 	}
 	defer database.Close()
 
-	// Setup WhatsApp client
-	waClient, err := whatsapp.NewClient(cfg)
+	// Initialize webhooks and live events before WhatsApp so connection events are delivered
+	webhooks.Init(cfg)
+	broadcast.Init()
+
+	// Setup WhatsApp accounts
+	waPool, err := whatsapp.NewPool(cfg)
 	if err != nil {
 		logging.Fatal("Failed to create WhatsApp client", zap.Error(err))
 	}
-	defer waClient.Close()
+	defer waPool.Close()
 
-	// Connect to WhatsApp if already logged in
-	if err := waClient.Connect(context.Background()); err != nil {
+	// Connect every linked account
+	if err := waPool.Connect(context.Background()); err != nil {
 		logging.Error("Failed to connect to WhatsApp", zap.Error(err))
 	}
 
-	// Start auto-reconnect
-	waClient.AutoReconnect()
+	// Keep the accounts connected until shutdown
+	superviseCtx, stopSupervisor := context.WithCancel(context.Background())
+	defer stopSupervisor()
+	waPool.Supervise(superviseCtx)
+
+	// Set up storage backends
+	storageManager, err := storage.NewManager(cfg, waPool)
+	if err != nil {
+		logging.Fatal("Failed to set up storage", zap.Error(err))
+	}
 
 	// Initialize stats collector
 	stats.Init()
 
+	// Initialize rate limiter
+	ratelimit.Init(cfg)
+
+	// Media is only kept alive past WhatsApp's retention by the refresh job
+	if !cfg.MediaRefreshEnabled && time.Duration(cfg.MaxExpiryDays)*24*time.Hour > whatsapp.MediaRetention {
+		logging.Warn("MAX_EXPIRY_DAYS exceeds WhatsApp media retention with media refresh disabled; long-lived files will become undownloadable",
+			zap.Int("max_expiry_days", cfg.MaxExpiryDays))
+	}
+
 	// Start background job scheduler
-	scheduler := jobs.NewScheduler(cfg)
+	scheduler := jobs.NewScheduler(cfg, waPool, storageManager)
 	scheduler.Start()
 	defer scheduler.Stop()
 
 	// Create Fiber app
+	// Bodies larger than ChunkSize are streamed instead of buffered in memory.
+	// Multipart forms are parsed by the upload handlers, after auth and rate
+	// limits, and BodyLimit caps every body before it is read.
 	app := fiber.New(fiber.Config{
-		BodyLimit:             int(cfg.MaxUploadSize),
-		DisableStartupMessage: true,
-		ErrorHandler:          errorHandler,
+		BodyLimit:                    int(cfg.ChunkSize),
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+		DisableStartupMessage:        true,
+		ErrorHandler:                 errorHandler,
+
+		// Take client IPs from the reverse proxy's header, only trusting it
+		// from TRUSTED_PROXIES when those are set
+		ProxyHeader:             cfg.ProxyHeader,
+		EnableIPValidation:      cfg.ProxyHeader != "",
+		EnableTrustedProxyCheck: len(cfg.TrustedProxies) > 0,
+		TrustedProxies:          cfg.TrustedProxies,
 	})
 
+	// Restrict who may upload
+	uploadPolicy, err := middleware.UploadPolicy(cfg)
+	if err != nil {
+		logging.Fatal("Invalid upload policy", zap.Error(err))
+	}
+
+	if err := utils.ValidateIDScheme(cfg.IDScheme); err != nil {
+		logging.Fatal("Invalid ID scheme", zap.Error(err))
+	}
+
 	// Middleware
 	app.Use(middleware.RequestID())
 	app.Use(middleware.Recovery())
 	app.Use(middleware.Logger())
+	app.Use(middleware.BodyLimit(cfg))
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:  "*",
 		AllowMethods:  "GET,POST,PUT,PATCH,DELETE,OPTIONS,HEAD",
-		AllowHeaders:  "Origin,Content-Type,Accept,Authorization,X-Request-ID,X-Password,Upload-Length,Upload-Offset,Tus-Resumable,Upload-Metadata",
-		ExposeHeaders: "Upload-Offset,Upload-Length,Tus-Version,Tus-Resumable,Tus-Max-Size,Tus-Extension,Location,X-Request-ID",
+		AllowHeaders:  "Origin,Content-Type,Accept,Authorization,X-Request-ID,X-Password,X-Upload-Token,X-Management-Token,Upload-Length,Upload-Offset,Tus-Resumable,Upload-Metadata,Upload-Checksum,Upload-Concat,Upload-Defer-Length,Range,If-Range,If-None-Match,If-Modified-Since",
+		ExposeHeaders: "X-Management-Token,Upload-Offset,Upload-Length,Upload-Metadata,Upload-Expires,Upload-Concat,Upload-Defer-Length,Tus-Version,Tus-Resumable,Tus-Max-Size,Tus-Extension,Tus-Checksum-Algorithm,Location,X-Request-ID,Accept-Ranges,Content-Range,Content-Length,ETag,Last-Modified,Retry-After",
 	}))
 
 	// Health handlers
-	healthHandler := handlers.NewHealthHandler(waClient.IsConnected)
+	healthHandler := handlers.NewHealthHandler(waPool.IsConnected)
 	app.Get("/health", healthHandler.Health)
 	app.Get("/ready", healthHandler.Ready)
 
+	// Prometheus metrics
+	if cfg.MetricsEnabled {
+		metrics.Register(waPool)
+		metricsHandler := handlers.NewMetricsHandler(cfg)
+		app.Get("/metrics", metricsHandler.Metrics)
+	}
+
 	// API routes
 	api := app.Group("/api")
 
@@ -103,47 +160,114 @@ func main() {
 	api.Get("/status", healthHandler.Status)
 
 	// Admin routes
-	adminHandler := handlers.NewAdminHandler(waClient)
+	adminHandler := handlers.NewAdminHandler(waPool, cfg)
 	admin := api.Group("/admin")
 
 	// Auth routes (no auth required)
 	admin.Post("/login", middleware.Login(cfg))
 	admin.Get("/me", middleware.CheckAuth(cfg))
 
+	// Stats routes (admin session or API key with the stats scope)
+	statsHandler := handlers.NewStatsHandler()
+	statsAuth := middleware.AdminAuth(cfg, database.ScopeStats)
+	admin.Get("/stats", statsAuth, statsHandler.GetStats)
+	admin.Get("/stats/hourly", statsAuth, statsHandler.GetHourlyStats)
+	admin.Get("/stats/daily", statsAuth, statsHandler.GetDailyStats)
+
 	// Protected admin routes
 	adminProtected := admin.Group("")
 	adminProtected.Use(middleware.AdminAuth(cfg))
 	adminProtected.Get("/qr", adminHandler.GetQR)
+	adminProtected.Post("/pair-phone", adminHandler.PairPhone)
+	adminProtected.Get("/pairing", adminHandler.GetPairing)
 	adminProtected.Get("/status", adminHandler.GetStatus)
 	adminProtected.Post("/logout", adminHandler.Logout)
+	adminProtected.Get("/accounts", adminHandler.ListAccounts)
+	adminProtected.Post("/accounts", adminHandler.AddAccount)
+	adminProtected.Delete("/accounts/:id", adminHandler.RemoveAccount)
 	adminProtected.Post("/logout-session", middleware.LogoutSession())
 
-	// Stats routes (protected)
-	statsHandler := handlers.NewStatsHandler()
-	adminProtected.Get("/stats", statsHandler.GetStats)
-	adminProtected.Get("/stats/hourly", statsHandler.GetHourlyStats)
-	adminProtected.Get("/stats/daily", statsHandler.GetDailyStats)
+	// Live updates for the dashboard
+	eventsHandler := handlers.NewEventsHandler(waPool)
+	adminProtected.Get("/events", eventsHandler.Stream)
+
+	// API key management
+	apiKeyHandler := handlers.NewAPIKeyHandler()
+	adminProtected.Get("/api-keys", apiKeyHandler.List)
+	adminProtected.Post("/api-keys", apiKeyHandler.Create)
+	adminProtected.Delete("/api-keys/:id", apiKeyHandler.Revoke)
+
+	// Upload token management
+	uploadTokenHandler := handlers.NewUploadTokenHandler(cfg)
+	adminProtected.Get("/upload-tokens", uploadTokenHandler.List)
+	adminProtected.Post("/upload-tokens", uploadTokenHandler.Create)
+	adminProtected.Delete("/upload-tokens/:id", uploadTokenHandler.Revoke)
+
+	// User management
+	userHandler := handlers.NewUserHandler(cfg)
+	adminProtected.Get("/users", userHandler.List)
+	adminProtected.Post("/users", userHandler.Create)
+	adminProtected.Patch("/users/:id", userHandler.Update)
+	adminProtected.Delete("/users/:id", userHandler.Delete)
+
+	// Webhook management
+	webhookHandler := handlers.NewWebhookHandler()
+	adminProtected.Get("/webhooks", webhookHandler.List)
+	adminProtected.Post("/webhooks", webhookHandler.Create)
+	adminProtected.Get("/webhooks/:id", webhookHandler.Get)
+	adminProtected.Patch("/webhooks/:id", webhookHandler.Update)
+	adminProtected.Delete("/webhooks/:id", webhookHandler.Delete)
+	adminProtected.Post("/webhooks/:id/test", webhookHandler.Test)
+	adminProtected.Get("/webhooks/:id/deliveries", webhookHandler.Deliveries)
+	adminProtected.Post("/webhooks/:id/deliveries/:delivery_id/redeliver", webhookHandler.Redeliver)
+
+	// User auth routes
+	auth := api.Group("/auth")
+	auth.Post("/register", userHandler.Register)
+	auth.Post("/login", userHandler.Login)
+	auth.Post("/logout", middleware.LogoutSession())
 
 	// File routes
-	fileHandler := handlers.NewFileHandler(waClient, cfg)
+	fileHandler := handlers.NewFileHandler(storageManager, cfg)
 	files := api.Group("/files")
-	files.Post("/", fileHandler.Upload)
+	files.Post("/", middleware.OptionalAPIKey(database.ScopeUpload), middleware.OptionalUser(cfg), uploadPolicy, middleware.UploadRateLimit(), fileHandler.Upload)
+	files.Post("/archive", middleware.DownloadRateLimit(), fileHandler.Archive)
 	files.Get("/:id", fileHandler.Get)
-	files.Get("/:id/download", fileHandler.Download)
-
-	// Protected file routes (admin only)
-	filesProtected := files.Group("", middleware.AdminAuth(cfg))
-	filesProtected.Get("/", fileHandler.List)
-	filesProtected.Delete("/:id", fileHandler.Delete)
+	files.Get("/:id/download", middleware.DownloadRateLimit(), fileHandler.Download)
+
+	// Protected file routes (admin session or API key with the matching scope).
+	// Uploaders can also manage a file with its management token.
+	files.Get("/", middleware.AdminAuth(cfg, database.ScopeRead), fileHandler.List)
+	files.Get("/:id/stats", middleware.AdminAuthOrManagementToken(cfg, database.ScopeStats), fileHandler.Stats)
+	files.Patch("/:id", middleware.AdminAuthOrManagementToken(cfg), fileHandler.Update)
+	files.Delete("/:id", middleware.AdminAuthOrManagementToken(cfg, database.ScopeDelete), fileHandler.Delete)
+
+	// Collection routes
+	collectionHandler := handlers.NewCollectionHandler(fileHandler, cfg)
+	collections := api.Group("/collections")
+	collections.Post("/", middleware.OptionalAPIKey(database.ScopeUpload), middleware.OptionalUser(cfg), uploadPolicy, middleware.UploadRateLimit(), collectionHandler.Create)
+	collections.Get("/:id", collectionHandler.Get)
+	collections.Get("/:id/download", middleware.DownloadRateLimit(), collectionHandler.Download)
+	collections.Get("/:id/files/:file_id/download", middleware.DownloadRateLimit(), collectionHandler.DownloadFile)
 
 	// Tus chunked upload routes
-	tusHandler := handlers.NewTusHandler(waClient, cfg)
-	upload := api.Group("/upload")
+	tusHandler := handlers.NewTusHandler(storageManager, cfg)
+	upload := api.Group("/upload", middleware.OptionalAPIKey(database.ScopeUpload), middleware.OptionalUser(cfg))
 	upload.Options("/", tusHandler.Options)
-	upload.Post("/", tusHandler.Create)
+	upload.Post("/", uploadPolicy, middleware.UploadRateLimit(), tusHandler.Create)
 	upload.Head("/:id", tusHandler.Head)
-	upload.Patch("/:id", tusHandler.Patch)
+	upload.Patch("/:id", middleware.UploadRateLimit(), tusHandler.Patch)
 	upload.Delete("/:id", tusHandler.Delete)
+	upload.Get("/:id/result", tusHandler.Result)
+	upload.Post("/:id/retry", tusHandler.Retry)
+
+	// Signed-in user routes
+	me := api.Group("/me", middleware.UserAuth(cfg))
+	me.Get("/", userHandler.Me)
+	me.Get("/files", fileHandler.ListMine)
+	me.Patch("/files/:id", fileHandler.UpdateMine)
+	me.Delete("/files/:id", fileHandler.DeleteMine)
+	me.Get("/files/:id/stats", fileHandler.StatsMine)
 
 	// Serve embedded frontend (SPA with fallback to index.html)
 	app.Use("/", frontend.Handler())
@@ -164,15 +288,23 @@ func main() {
 
 	logging.Info("Shutting down server...")
 
-	// Wait for active transfers to complete (with timeout)
+	// Stop accepting requests; in-flight requests, including streaming
+	// downloads, get until the timeout to finish
+	shutdownStart := time.Now()
+	broadcast.Get().Close()
+	if err := app.ShutdownWithTimeout(cfg.ShutdownTimeout); err != nil {
+		logging.Error("Server forced to shutdown", zap.Error(err))
+	}
+
+	// Wait for transfers still running in the background, such as completed
+	// tus uploads being stored, before WhatsApp is disconnected
 	collector := stats.Get()
-	waitStart := time.Now()
 	for {
 		active := collector.GetActiveTransfers()
 		if active == 0 {
 			break
 		}
-		if time.Since(waitStart) > cfg.ShutdownTimeout {
+		if time.Since(shutdownStart) > cfg.ShutdownTimeout {
 			logging.Warn("Shutdown timeout reached with active transfers",
 				zap.Int64("active_transfers", active))
 			break
@@ -182,13 +314,9 @@ func main() {
 		time.Sleep(1 * time.Second)
 	}
 
-	// Disconnect WhatsApp
-	waClient.Disconnect()
-
-	// Shutdown Fiber
-	if err := app.ShutdownWithTimeout(cfg.ShutdownTimeout); err != nil {
-		logging.Error("Server forced to shutdown", zap.Error(err))
-	}
+	// Disconnect WhatsApp without reconnecting
+	stopSupervisor()
+	waPool.Disconnect()
 
 	logging.Info("Server stopped")
 }
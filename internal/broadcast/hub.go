@@ -0,0 +1,131 @@
+package broadcast
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types pushed to live subscribers
+const (
+	EventWhatsApp = "whatsapp"
+	EventQR       = "qr"
+	EventPairing  = "pairing"
+	EventUpload   = "upload"
+	EventDownload = "download"
+)
+
+// subscriberBuffer is how many events a subscriber can fall behind before
+// further events are dropped for it
+const subscriberBuffer = 64
+
+// Event is a live update for subscribers such as the admin dashboard. IDs
+// increase by one, so a gap tells a subscriber it missed events.
+type Event struct {
+	ID   int64
+	Type string
+	Time time.Time
+	Data interface{}
+}
+
+// Hub fans events out to every subscriber. Publishing never blocks: a
+// subscriber that can't keep up misses events rather than slowing the
+// server down.
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	closed      bool
+	lastID      int64
+}
+
+// Global hub instance
+var hub *Hub
+
+// Init initializes the global hub
+func Init() *Hub {
+	hub = &Hub{subscribers: make(map[chan Event]struct{})}
+	return hub
+}
+
+// Get returns the global hub, or nil if it wasn't initialized
+func Get() *Hub {
+	return hub
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// and a function to stop the subscription. The channel is closed when the
+// subscription stops or the hub is closed.
+func (h *Hub) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	h.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[ch]; ok {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Publish sends an event to every subscriber. It is safe to call on a nil hub.
+func (h *Hub) Publish(eventType string, data interface{}) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed || len(h.subscribers) == 0 {
+		return
+	}
+
+	h.lastID++
+	evt := Event{
+		ID:   h.lastID,
+		Type: eventType,
+		Time: time.Now().UTC(),
+		Data: data,
+	}
+	for ch := range h.subscribers {
+		select {
+		case ch <- evt:
+		default:
+		}
+	}
+}
+
+// Subscribers returns the number of active subscribers
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+// Close ends every subscription, e.g. so open streams don't hold up shutdown
+func (h *Hub) Close() {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
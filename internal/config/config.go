@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -16,20 +17,48 @@ type Config struct {
 	Port string
 	Host string
 
+	// Reverse proxy
+	ProxyHeader    string
+	TrustedProxies []string
+
 	// Database
 	DatabasePath  string
 	WASessionPath string
 
+	// WhatsApp accounts
+	WAAccountStrategy string
+
 	// Storage
 	TempDir       string
 	MaxUploadSize int64
 	ChunkSize     int64
 
+	// Storage backends
+	StorageBackend  string
+	StorageFallback string
+	DiskStoragePath string
+	S3Endpoint      string
+	S3Region        string
+	S3Bucket        string
+	S3AccessKey     string
+	S3SecretKey     string
+	S3UseSSL        bool
+	S3PathStyle     bool
+
 	// File settings
 	DefaultExpiryDays int
 	MaxExpiryDays     int
 	ShortIDLength     int
 
+	// IDScheme picks how file and collection IDs are generated: short, long, uuid or ulid
+	IDScheme string
+
+	// CustomSlugsEnabled lets uploaders choose their own IDs
+	CustomSlugsEnabled bool
+
+	// CollectionMaxFiles caps how many files a collection may hold
+	CollectionMaxFiles int
+
 	// Logging
 	LogLevel          string
 	LogFormat         string
@@ -46,6 +75,12 @@ type Config struct {
 	CleanupInterval     time.Duration
 	IncompleteUploadTTL time.Duration
 
+	// Media refresh
+	MediaRefreshEnabled     bool
+	MediaRefreshInterval    time.Duration
+	MediaRefreshAge         time.Duration
+	MediaRefreshMaxFailures int
+
 	// Graceful shutdown
 	ShutdownTimeout time.Duration
 
@@ -53,6 +88,34 @@ type Config struct {
 	AdminPassword      string
 	AdminSessionSecret string
 	AdminSessionMaxAge int
+
+	// User accounts
+	RegistrationEnabled bool
+	UserStorageQuota    int64
+	UserBandwidthQuota  int64
+
+	// Upload policy
+	UploadPolicy     string
+	UploadAllowedIPs []string
+
+	// Rate limiting
+	RateLimitEnabled          bool
+	RateLimitUploads          int64
+	RateLimitUploadBytes      int64
+	RateLimitDownloads        int64
+	RateLimitPasswordAttempts int
+	RateLimitLockout          time.Duration
+	RateLimitMaxLockout       time.Duration
+	RateLimitPersist          bool
+
+	// Metrics
+	MetricsEnabled bool
+	MetricsToken   string
+
+	// Webhooks
+	WebhookTimeout      time.Duration
+	WebhookMaxAttempts  int
+	WebhookLogRetention time.Duration
 }
 
 func Load() *Config {
@@ -64,20 +127,44 @@ func Load() *Config {
 		Port: getEnv("PORT", "3000"),
 		Host: getEnv("HOST", "0.0.0.0"),
 
+		// Reverse proxy
+		ProxyHeader:    getEnv("PROXY_HEADER", ""),
+		TrustedProxies: getEnvList("TRUSTED_PROXIES"),
+
 		// Database
 		DatabasePath:  getEnv("DATABASE_PATH", "./data/whatsbox.db"),
 		WASessionPath: getEnv("WA_SESSION_PATH", "./data/wa_session.db"),
 
+		// WhatsApp accounts
+		WAAccountStrategy: getEnv("WA_ACCOUNT_STRATEGY", "round_robin"),
+
 		// Storage
 		TempDir:       getEnv("TEMP_DIR", "./data/temp"),
 		MaxUploadSize: getEnvInt64("MAX_UPLOAD_SIZE", 2147483648), // 2GB
 		ChunkSize:     getEnvInt64("CHUNK_SIZE", 10485760),        // 10MB
 
+		// Storage backends
+		StorageBackend:  getEnv("STORAGE_BACKEND", "whatsapp"),
+		StorageFallback: getEnv("STORAGE_FALLBACK", ""),
+		DiskStoragePath: getEnv("DISK_STORAGE_PATH", "./data/files"),
+		S3Endpoint:      getEnv("S3_ENDPOINT", ""),
+		S3Region:        getEnv("S3_REGION", "us-east-1"),
+		S3Bucket:        getEnv("S3_BUCKET", ""),
+		S3AccessKey:     getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:     getEnv("S3_SECRET_KEY", ""),
+		S3UseSSL:        getEnvBool("S3_USE_SSL", true),
+		S3PathStyle:     getEnvBool("S3_PATH_STYLE", true),
+
 		// File settings
 		DefaultExpiryDays: getEnvInt("DEFAULT_EXPIRY_DAYS", 30),
 		MaxExpiryDays:     getEnvInt("MAX_EXPIRY_DAYS", 30),
 		ShortIDLength:     getEnvInt("SHORT_ID_LENGTH", 6),
 
+		IDScheme:           getEnv("ID_SCHEME", "short"),
+		CustomSlugsEnabled: getEnvBool("CUSTOM_SLUGS_ENABLED", true),
+
+		CollectionMaxFiles: getEnvInt("COLLECTION_MAX_FILES", 100),
+
 		// Logging
 		LogLevel:          getEnv("LOG_LEVEL", "info"),
 		LogFormat:         getEnv("LOG_FORMAT", "json"),
@@ -94,6 +181,12 @@ func Load() *Config {
 		CleanupInterval:     time.Duration(getEnvInt("CLEANUP_INTERVAL", 3600)) * time.Second,
 		IncompleteUploadTTL: time.Duration(getEnvInt("INCOMPLETE_UPLOAD_TTL", 86400)) * time.Second,
 
+		// Media refresh
+		MediaRefreshEnabled:     getEnvBool("MEDIA_REFRESH_ENABLED", true),
+		MediaRefreshInterval:    time.Duration(getEnvInt("MEDIA_REFRESH_INTERVAL", 3600)) * time.Second,
+		MediaRefreshAge:         time.Duration(getEnvInt("MEDIA_REFRESH_AGE_DAYS", 25)) * 24 * time.Hour,
+		MediaRefreshMaxFailures: getEnvInt("MEDIA_REFRESH_MAX_FAILURES", 5),
+
 		// Graceful shutdown
 		ShutdownTimeout: time.Duration(getEnvInt("SHUTDOWN_TIMEOUT", 300)) * time.Second,
 
@@ -101,6 +194,34 @@ func Load() *Config {
 		AdminPassword:      getEnv("ADMIN_PASSWORD", ""),
 		AdminSessionSecret: getEnv("ADMIN_SESSION_SECRET", generateDefaultSecret()),
 		AdminSessionMaxAge: getEnvInt("ADMIN_SESSION_MAX_AGE", 86400), // 24 hours
+
+		// User accounts
+		RegistrationEnabled: getEnvBool("REGISTRATION_ENABLED", false),
+		UserStorageQuota:    getEnvInt64("USER_STORAGE_QUOTA", 0),   // 0 = unlimited
+		UserBandwidthQuota:  getEnvInt64("USER_BANDWIDTH_QUOTA", 0), // bytes per 30 days, 0 = unlimited
+
+		// Upload policy
+		UploadPolicy:     getEnv("UPLOAD_POLICY", "public"),
+		UploadAllowedIPs: getEnvList("UPLOAD_ALLOWED_IPS"),
+
+		// Rate limiting (per client per hour, 0 = unlimited)
+		RateLimitEnabled:          getEnvBool("RATE_LIMIT_ENABLED", true),
+		RateLimitUploads:          getEnvInt64("RATE_LIMIT_UPLOADS", 100),
+		RateLimitUploadBytes:      getEnvInt64("RATE_LIMIT_UPLOAD_BYTES", 10737418240), // 10GB
+		RateLimitDownloads:        getEnvInt64("RATE_LIMIT_DOWNLOADS", 1000),
+		RateLimitPasswordAttempts: getEnvInt("RATE_LIMIT_PASSWORD_ATTEMPTS", 5),
+		RateLimitLockout:          time.Duration(getEnvInt("RATE_LIMIT_LOCKOUT", 60)) * time.Second,
+		RateLimitMaxLockout:       time.Duration(getEnvInt("RATE_LIMIT_MAX_LOCKOUT", 86400)) * time.Second,
+		RateLimitPersist:          getEnvBool("RATE_LIMIT_PERSIST", false),
+
+		// Metrics
+		MetricsEnabled: getEnvBool("METRICS_ENABLED", false),
+		MetricsToken:   getEnv("METRICS_TOKEN", ""),
+
+		// Webhooks
+		WebhookTimeout:      time.Duration(getEnvInt("WEBHOOK_TIMEOUT", 10)) * time.Second,
+		WebhookMaxAttempts:  getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		WebhookLogRetention: time.Duration(getEnvInt("WEBHOOK_LOG_RETENTION_DAYS", 30)) * 24 * time.Hour,
 	}
 }
 
@@ -111,6 +232,16 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
 func getEnvInt(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
 		if intValue, err := strconv.Atoi(value); err == nil {
@@ -129,6 +260,15 @@ func getEnvInt64(key string, defaultValue int64) int64 {
 	return defaultValue
 }
 
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
 func generateDefaultSecret() string {
 	bytes := make([]byte, 32)
 	if _, err := rand.Read(bytes); err != nil {
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// API key scopes
+const (
+	ScopeUpload = "upload"
+	ScopeRead   = "read"
+	ScopeDelete = "delete"
+	ScopeStats  = "stats"
+	ScopeAdmin  = "admin"
+)
+
+// Scopes lists every API key scope
+var Scopes = []string{ScopeUpload, ScopeRead, ScopeDelete, ScopeStats, ScopeAdmin}
+
+// APIKey is a credential for programmatic access. Only a hash of the key is stored.
+type APIKey struct {
+	ID         string
+	Name       string
+	KeyHash    string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  sql.NullTime
+	LastUsedAt sql.NullTime
+	LastUsedIP sql.NullString
+	RevokedAt  sql.NullTime
+}
+
+// HasScope reports whether the key grants scope. The admin scope grants every scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether the key is neither revoked nor expired
+func (k *APIKey) Active() bool {
+	if k.RevokedAt.Valid {
+		return false
+	}
+	return !k.ExpiresAt.Valid || time.Now().Before(k.ExpiresAt.Time)
+}
+
+// APIKeyRepository handles API key database operations
+type APIKeyRepository struct{}
+
+func NewAPIKeyRepository() *APIKeyRepository {
+	return &APIKeyRepository{}
+}
+
+const apiKeyColumns = `id, name, key_hash, scopes, created_at, expires_at, last_used_at, last_used_ip, revoked_at`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	k := &APIKey{}
+	var scopes string
+	err := row.Scan(&k.ID, &k.Name, &k.KeyHash, &scopes, &k.CreatedAt, &k.ExpiresAt,
+		&k.LastUsedAt, &k.LastUsedIP, &k.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	k.Scopes = strings.Split(scopes, ",")
+	return k, nil
+}
+
+// Create inserts a new API key
+func (r *APIKeyRepository) Create(k *APIKey) error {
+	_, err := DB.Exec(`
+		INSERT INTO api_keys (id, name, key_hash, scopes, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		k.ID, k.Name, k.KeyHash, strings.Join(k.Scopes, ","), k.CreatedAt, k.ExpiresAt)
+	return err
+}
+
+// GetByID retrieves an API key by its ID
+func (r *APIKeyRepository) GetByID(id string) (*APIKey, error) {
+	return scanAPIKey(DB.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id))
+}
+
+// List returns every API key, newest first
+func (r *APIKeyRepository) List() ([]*APIKey, error) {
+	rows, err := DB.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// Revoke revokes an API key. It returns false if the key doesn't exist or was already revoked.
+func (r *APIKeyRepository) Revoke(id string) (bool, error) {
+	result, err := DB.Exec(`
+		UPDATE api_keys SET revoked_at = ?
+		WHERE id = ? AND revoked_at IS NULL`, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// RecordUse records when and from where an API key was last used
+func (r *APIKeyRepository) RecordUse(id, ip string) error {
+	_, err := DB.Exec(`
+		UPDATE api_keys SET last_used_at = ?, last_used_ip = ?
+		WHERE id = ?`, time.Now(), ip, id)
+	return err
+}
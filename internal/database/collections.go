@@ -0,0 +1,129 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrFilesUnavailable is returned when files can't be added to a collection
+// because they are missing, no longer active or already in a collection
+var ErrFilesUnavailable = errors.New("files are not available for a collection")
+
+// Collection groups files shared under one link. Its password, expiry and
+// download limit apply to every file in it.
+type Collection struct {
+	ID            string
+	Title         sql.NullString
+	Description   sql.NullString
+	PasswordHash  sql.NullString
+	MaxDownloads  sql.NullInt64
+	DownloadCount int64
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+	Status        string
+	OwnerID       sql.NullString
+}
+
+// CollectionRepository handles collection database operations
+type CollectionRepository struct{}
+
+func NewCollectionRepository() *CollectionRepository {
+	return &CollectionRepository{}
+}
+
+const collectionColumns = `id, title, description, password_hash, max_downloads, download_count,
+	created_at, expires_at, status, owner_id`
+
+func scanCollection(row rowScanner) (*Collection, error) {
+	col := &Collection{}
+	err := row.Scan(&col.ID, &col.Title, &col.Description, &col.PasswordHash, &col.MaxDownloads,
+		&col.DownloadCount, &col.CreatedAt, &col.ExpiresAt, &col.Status, &col.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	return col, nil
+}
+
+// Create inserts a collection and adds existing files to it, giving them the
+// collection's password and expiry. It fails with ErrDuplicateID if the ID is
+// taken, or ErrFilesUnavailable if any listed file is not active or is already
+// in a collection.
+func (r *CollectionRepository) Create(col *Collection, fileIDs []string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO collections (id, title, description, password_hash, max_downloads,
+			download_count, created_at, expires_at, status, owner_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		col.ID, col.Title, col.Description, col.PasswordHash, col.MaxDownloads,
+		col.DownloadCount, col.CreatedAt, col.ExpiresAt, col.Status, col.OwnerID)
+	if err != nil {
+		return duplicateIDError(err)
+	}
+
+	if len(fileIDs) > 0 {
+		args := []interface{}{col.ID, col.PasswordHash, col.ExpiresAt}
+		for _, id := range fileIDs {
+			args = append(args, id)
+		}
+		result, err := tx.Exec(`
+			UPDATE files SET collection_id = ?, password_hash = ?, expires_at = ?
+			WHERE id IN (?`+strings.Repeat(", ?", len(fileIDs)-1)+`)
+				AND status = 'active' AND collection_id IS NULL`, args...)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows != int64(len(fileIDs)) {
+			return ErrFilesUnavailable
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Exists reports whether a collection with the ID exists, in any status
+func (r *CollectionRepository) Exists(id string) (bool, error) {
+	var exists bool
+	err := DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM collections WHERE id = ?)`, id).Scan(&exists)
+	return exists, err
+}
+
+// GetByID retrieves a collection by its ID
+func (r *CollectionRepository) GetByID(id string) (*Collection, error) {
+	return scanCollection(DB.QueryRow(`SELECT `+collectionColumns+` FROM collections WHERE id = ?`, id))
+}
+
+// ListFiles retrieves the files in a collection in the order they were added,
+// leaving out deleted ones
+func (r *CollectionRepository) ListFiles(id string) ([]*File, error) {
+	rows, err := DB.Query(`
+		SELECT `+fileColumns+`
+		FROM files
+		WHERE collection_id = ? AND status != 'deleted'
+		ORDER BY created_at ASC, filename ASC`, id)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// MarkExpired marks all collections past expiry as expired
+func (r *CollectionRepository) MarkExpired() (int64, error) {
+	result, err := DB.Exec(`
+		UPDATE collections SET status = 'expired'
+		WHERE status = 'active' AND expires_at < CURRENT_TIMESTAMP`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -1,6 +1,8 @@
 package database
 
 import (
+	"fmt"
+
 	"github.com/salman0ansari/whatsbox/internal/logging"
 	"go.uber.org/zap"
 )
@@ -34,6 +36,7 @@ func migrate() error {
 		`CREATE INDEX IF NOT EXISTS idx_files_hash ON files(file_hash)`,
 		`CREATE INDEX IF NOT EXISTS idx_files_expires_at ON files(expires_at)`,
 		`CREATE INDEX IF NOT EXISTS idx_files_status ON files(status)`,
+		`CREATE INDEX IF NOT EXISTS idx_files_direct_path ON files(direct_path)`,
 
 		// Chunked uploads tracking
 		`CREATE TABLE IF NOT EXISTS uploads (
@@ -80,6 +83,101 @@ func migrate() error {
 		// Indexes for access_log
 		`CREATE INDEX IF NOT EXISTS idx_access_log_file_id ON access_log(file_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_access_log_created_at ON access_log(created_at)`,
+
+		// API keys for programmatic access
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id              TEXT PRIMARY KEY,
+			name            TEXT NOT NULL,
+			key_hash        TEXT NOT NULL,
+			scopes          TEXT NOT NULL,
+			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at      DATETIME,
+			last_used_at    DATETIME,
+			last_used_ip    TEXT,
+			revoked_at      DATETIME
+		)`,
+
+		// Rate limiter state, persisted across restarts when enabled
+		`CREATE TABLE IF NOT EXISTS rate_limits (
+			key             TEXT PRIMARY KEY,
+			tokens          REAL NOT NULL DEFAULT 0,
+			failures        INTEGER NOT NULL DEFAULT 0,
+			locked_until    DATETIME,
+			updated_at      DATETIME NOT NULL,
+			expires_at      DATETIME NOT NULL
+		)`,
+
+		// Limited-use tokens for uploading under a restricted upload policy
+		`CREATE TABLE IF NOT EXISTS upload_tokens (
+			id              TEXT PRIMARY KEY,
+			name            TEXT NOT NULL,
+			token_hash      TEXT NOT NULL,
+			max_uses        INTEGER,
+			uses            INTEGER NOT NULL DEFAULT 0,
+			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at      DATETIME,
+			last_used_at    DATETIME,
+			revoked_at      DATETIME
+		)`,
+
+		// User accounts
+		`CREATE TABLE IF NOT EXISTS users (
+			id              TEXT PRIMARY KEY,
+			username        TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			password_hash   TEXT NOT NULL,
+			role            TEXT NOT NULL DEFAULT 'user',
+			storage_quota   INTEGER,
+			bandwidth_quota INTEGER,
+			disabled        INTEGER NOT NULL DEFAULT 0,
+			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_login_at   DATETIME
+		)`,
+
+		// Outgoing webhook endpoints
+		`CREATE TABLE IF NOT EXISTS webhooks (
+			id              TEXT PRIMARY KEY,
+			url             TEXT NOT NULL,
+			secret          TEXT NOT NULL,
+			events          TEXT NOT NULL,
+			description     TEXT,
+			enabled         INTEGER NOT NULL DEFAULT 1,
+			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at      DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Webhook delivery queue, kept as a delivery log once finished
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id      TEXT NOT NULL,
+			event           TEXT NOT NULL,
+			payload         TEXT NOT NULL,
+			status          TEXT NOT NULL DEFAULT 'pending',
+			attempts        INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME,
+			last_attempt_at DATETIME,
+			response_status INTEGER,
+			response_body   TEXT,
+			error           TEXT,
+			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+			delivered_at    DATETIME
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_status ON webhook_deliveries(status, next_attempt_at)`,
+
+		// Collections of files shared under one link
+		`CREATE TABLE IF NOT EXISTS collections (
+			id              TEXT PRIMARY KEY,
+			title           TEXT,
+			description     TEXT,
+			password_hash   TEXT,
+			max_downloads   INTEGER,
+			download_count  INTEGER DEFAULT 0,
+			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at      DATETIME NOT NULL,
+			status          TEXT DEFAULT 'active',
+			owner_id        TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_collections_expires_at ON collections(expires_at)`,
 	}
 
 	for _, migration := range migrations {
@@ -94,30 +192,93 @@ func migrate() error {
 		return err
 	}
 
+	// Indexes on migrated columns
+	for _, index := range []string{
+		`CREATE INDEX IF NOT EXISTS idx_files_owner_id ON files(owner_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_files_collection_id ON files(collection_id)`,
+	} {
+		if _, err := DB.Exec(index); err != nil {
+			logging.Error("Migration failed", zap.Error(err), zap.String("sql", index))
+			return err
+		}
+	}
+
 	logging.Info("Database migrations completed successfully")
 	return nil
 }
 
+// columnMigration describes a column added to an existing table
+type columnMigration struct {
+	table      string
+	column     string
+	definition string
+	backfill   string
+}
+
+// columnMigrations are applied in order to databases created before the column existed
+var columnMigrations = []columnMigration{
+	{table: "files", column: "file_sha256", definition: "BLOB"},
+	{
+		table:      "files",
+		column:     "media_uploaded_at",
+		definition: "DATETIME",
+		// Files sharing deduplicated media inherit the first upload's time
+		backfill: `UPDATE files SET media_uploaded_at = (
+			SELECT MIN(f.created_at) FROM files f WHERE f.direct_path = files.direct_path
+		) WHERE media_uploaded_at IS NULL`,
+	},
+	{table: "files", column: "last_refreshed_at", definition: "DATETIME"},
+	{table: "files", column: "refresh_failures", definition: "INTEGER NOT NULL DEFAULT 0"},
+	{table: "files", column: "refresh_error", definition: "TEXT"},
+	{table: "files", column: "backend", definition: "TEXT NOT NULL DEFAULT 'whatsapp'"},
+	{table: "files", column: "purged_at", definition: "DATETIME"},
+	{table: "files", column: "account", definition: "TEXT"},
+	{table: "uploads", column: "status", definition: "TEXT NOT NULL DEFAULT 'uploading'"},
+	{table: "uploads", column: "file_id", definition: "TEXT"},
+	{table: "uploads", column: "error", definition: "TEXT"},
+	{table: "uploads", column: "concat", definition: "TEXT"},
+	{table: "uploads", column: "lock_owner", definition: "TEXT"},
+	{table: "uploads", column: "lock_expires_at", definition: "DATETIME"},
+	{table: "files", column: "owner_id", definition: "TEXT"},
+	{table: "uploads", column: "owner_id", definition: "TEXT"},
+	{table: "files", column: "collection_id", definition: "TEXT"},
+	{
+		table:      "files",
+		column:     "updated_at",
+		definition: "DATETIME",
+		backfill:   `UPDATE files SET updated_at = created_at WHERE updated_at IS NULL`,
+	},
+	{table: "files", column: "management_token_hash", definition: "TEXT"},
+	{table: "uploads", column: "management_token_hash", definition: "TEXT"},
+	{table: "uploads", column: "duplicate", definition: "INTEGER NOT NULL DEFAULT 0"},
+}
+
 // migrateColumns handles ALTER TABLE migrations that may fail if column already exists
 func migrateColumns() error {
-	// Check if file_sha256 column exists
-	var colCount int
-	err := DB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('files') WHERE name = 'file_sha256'`).Scan(&colCount)
-	if err != nil {
-		logging.Error("Failed to check if file_sha256 column exists", zap.Error(err))
-		return err
-	}
-
-	if colCount == 0 {
-		// Column doesn't exist, add it
-		_, err = DB.Exec(`ALTER TABLE files ADD COLUMN file_sha256 BLOB`)
+	for _, m := range columnMigrations {
+		var colCount int
+		err := DB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, m.table, m.column).Scan(&colCount)
 		if err != nil {
-			logging.Error("Failed to add file_sha256 column", zap.Error(err))
+			logging.Error("Failed to check if column exists", zap.String("column", m.column), zap.Error(err))
 			return err
 		}
-		logging.Info("Added file_sha256 column to files table")
-	} else {
-		logging.Debug("file_sha256 column already exists, skipping migration")
+
+		if colCount > 0 {
+			logging.Debug("Column already exists, skipping migration", zap.String("column", m.column))
+			continue
+		}
+
+		if _, err := DB.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, m.table, m.column, m.definition)); err != nil {
+			logging.Error("Failed to add column", zap.String("column", m.column), zap.Error(err))
+			return err
+		}
+		if m.backfill != "" {
+			if _, err := DB.Exec(m.backfill); err != nil {
+				logging.Error("Failed to backfill column", zap.String("column", m.column), zap.Error(err))
+				return err
+			}
+		}
+		logging.Info("Added column", zap.String("table", m.table), zap.String("column", m.column))
 	}
 
 	return nil
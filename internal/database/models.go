@@ -2,10 +2,43 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
+
+	"github.com/mattn/go-sqlite3"
 )
 
+// ErrDownloadLimitReached is returned when a file or collection has no downloads left
+var ErrDownloadLimitReached = errors.New("download limit reached")
+
+// CollectionLimitError is returned when a download is refused because the
+// collection holding a file has no downloads left
+type CollectionLimitError struct {
+	CollectionID string
+	MaxDownloads int64
+}
+
+func (e *CollectionLimitError) Error() string {
+	return fmt.Sprintf("collection %s: %v", e.CollectionID, ErrDownloadLimitReached)
+}
+
+func (e *CollectionLimitError) Unwrap() error {
+	return ErrDownloadLimitReached
+}
+
+// ErrDuplicateID is returned when a file or collection is created with an ID already in use
+var ErrDuplicateID = errors.New("id already in use")
+
+// duplicateIDError converts a primary key violation to ErrDuplicateID
+func duplicateIDError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return ErrDuplicateID
+	}
+	return err
+}
+
 // File represents a stored file
 type File struct {
 	ID            string
@@ -22,8 +55,32 @@ type File struct {
 	MaxDownloads  sql.NullInt64
 	DownloadCount int64
 	CreatedAt     time.Time
+	UpdatedAt     time.Time
 	ExpiresAt     time.Time
 	Status        string
+
+	// Backend is the storage backend holding the content. DirectPath is the
+	// object key for non-WhatsApp backends, which leave the media fields empty.
+	Backend string
+
+	// Account is the WhatsApp account that uploaded the media, if known
+	Account sql.NullString
+
+	// OwnerID is the user who uploaded the file, if signed in
+	OwnerID sql.NullString
+
+	// CollectionID is the collection the file was shared in, if any
+	CollectionID sql.NullString
+
+	// ManagementTokenHash is the hash of the token given to the uploader for
+	// managing the file without an account
+	ManagementTokenHash sql.NullString
+
+	// Media refresh tracking
+	MediaUploadedAt time.Time
+	LastRefreshedAt sql.NullTime
+	RefreshFailures int64
+	RefreshError    sql.NullString
 }
 
 // Upload represents an in-progress chunked upload
@@ -35,7 +92,27 @@ type Upload struct {
 	Metadata  sql.NullString
 	CreatedAt time.Time
 	UpdatedAt time.Time
-}
+	Status    string
+	FileID    sql.NullString
+	Error     sql.NullString
+	Concat    sql.NullString
+	OwnerID   sql.NullString
+
+	// ManagementTokenHash is issued once the upload is complete and passed on
+	// to the file created from it
+	ManagementTokenHash sql.NullString
+
+	// Duplicate reports whether the file reused content already in storage
+	Duplicate bool
+}
+
+// Upload statuses
+const (
+	UploadStatusUploading  = "uploading"
+	UploadStatusProcessing = "processing"
+	UploadStatusSucceeded  = "succeeded"
+	UploadStatusFailed     = "failed"
+)
 
 // StatsHourly represents hourly aggregated stats
 type StatsHourly struct {
@@ -75,111 +152,285 @@ func NewFileRepository() *FileRepository {
 	return &FileRepository{}
 }
 
-// Create inserts a new file record
-func (r *FileRepository) Create(f *File) error {
-	_, err := DB.Exec(`
-		INSERT INTO files (id, filename, mime_type, file_size, file_hash, description,
-			direct_path, media_key, file_enc_hash, file_sha256, password_hash, max_downloads,
-			download_count, created_at, expires_at, status)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		f.ID, f.Filename, f.MimeType, f.FileSize, f.FileHash, f.Description,
-		f.DirectPath, f.MediaKey, f.FileEncHash, f.FileSHA256, f.PasswordHash, f.MaxDownloads,
-		f.DownloadCount, f.CreatedAt, f.ExpiresAt, f.Status)
-	return err
+// fileColumns lists the columns read by scanFile, in order
+const fileColumns = `id, filename, mime_type, file_size, file_hash, description,
+	direct_path, media_key, file_enc_hash, file_sha256, password_hash, max_downloads,
+	download_count, created_at, updated_at, expires_at, status,
+	media_uploaded_at, last_refreshed_at, refresh_failures, refresh_error, backend, account, owner_id, collection_id,
+	management_token_hash`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
-// GetByID retrieves a file by its ID
-func (r *FileRepository) GetByID(id string) (*File, error) {
+// scanFile scans a row selected with fileColumns
+func scanFile(row rowScanner) (*File, error) {
 	f := &File{}
-	err := DB.QueryRow(`
-		SELECT id, filename, mime_type, file_size, file_hash, description,
-			direct_path, media_key, file_enc_hash, file_sha256, password_hash, max_downloads,
-			download_count, created_at, expires_at, status
-		FROM files WHERE id = ?`, id).Scan(
+	err := row.Scan(
 		&f.ID, &f.Filename, &f.MimeType, &f.FileSize, &f.FileHash, &f.Description,
 		&f.DirectPath, &f.MediaKey, &f.FileEncHash, &f.FileSHA256, &f.PasswordHash, &f.MaxDownloads,
-		&f.DownloadCount, &f.CreatedAt, &f.ExpiresAt, &f.Status)
+		&f.DownloadCount, &f.CreatedAt, &f.UpdatedAt, &f.ExpiresAt, &f.Status,
+		&f.MediaUploadedAt, &f.LastRefreshedAt, &f.RefreshFailures, &f.RefreshError, &f.Backend, &f.Account, &f.OwnerID, &f.CollectionID,
+		&f.ManagementTokenHash)
 	if err != nil {
 		return nil, err
 	}
 	return f, nil
 }
 
+// scanFiles scans all rows selected with fileColumns
+func scanFiles(rows *sql.Rows) ([]*File, error) {
+	defer rows.Close()
+
+	var files []*File
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// Exists reports whether a file with the ID exists, in any status
+func (r *FileRepository) Exists(id string) (bool, error) {
+	var exists bool
+	err := DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM files WHERE id = ?)`, id).Scan(&exists)
+	return exists, err
+}
+
+// Create inserts a new file record. It fails with ErrDuplicateID if the ID is taken.
+func (r *FileRepository) Create(f *File) error {
+	// media_key and file_enc_hash are NOT NULL but only set for WhatsApp media
+	mediaKey, fileEncHash := f.MediaKey, f.FileEncHash
+	if mediaKey == nil {
+		mediaKey = []byte{}
+	}
+	if fileEncHash == nil {
+		fileEncHash = []byte{}
+	}
+
+	_, err := DB.Exec(`
+		INSERT INTO files (id, filename, mime_type, file_size, file_hash, description,
+			direct_path, media_key, file_enc_hash, file_sha256, password_hash, max_downloads,
+			download_count, created_at, updated_at, expires_at, status, media_uploaded_at, backend, account, owner_id, collection_id,
+			management_token_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		f.ID, f.Filename, f.MimeType, f.FileSize, f.FileHash, f.Description,
+		f.DirectPath, mediaKey, fileEncHash, f.FileSHA256, f.PasswordHash, f.MaxDownloads,
+		f.DownloadCount, f.CreatedAt, f.UpdatedAt, f.ExpiresAt, f.Status, f.MediaUploadedAt, f.Backend, f.Account, f.OwnerID, f.CollectionID,
+		f.ManagementTokenHash)
+	return duplicateIDError(err)
+}
+
+// GetByID retrieves a file by its ID
+func (r *FileRepository) GetByID(id string) (*File, error) {
+	return scanFile(DB.QueryRow(`SELECT `+fileColumns+` FROM files WHERE id = ?`, id))
+}
+
 // GetByHash retrieves an active file by its hash (for deduplication)
 func (r *FileRepository) GetByHash(hash string) (*File, error) {
-	f := &File{}
-	err := DB.QueryRow(`
-		SELECT id, filename, mime_type, file_size, file_hash, description,
-			direct_path, media_key, file_enc_hash, file_sha256, password_hash, max_downloads,
-			download_count, created_at, expires_at, status
-		FROM files WHERE file_hash = ? AND status = 'active'`, hash).Scan(
-		&f.ID, &f.Filename, &f.MimeType, &f.FileSize, &f.FileHash, &f.Description,
-		&f.DirectPath, &f.MediaKey, &f.FileEncHash, &f.FileSHA256, &f.PasswordHash, &f.MaxDownloads,
-		&f.DownloadCount, &f.CreatedAt, &f.ExpiresAt, &f.Status)
+	return scanFile(DB.QueryRow(`
+		SELECT `+fileColumns+`
+		FROM files WHERE file_hash = ? AND status = 'active'
+		ORDER BY created_at DESC
+		LIMIT 1`, hash))
+}
+
+// FindReusableMedia retrieves an active file with the given hash whose stored content
+// can be shared by a new file. WhatsApp media must have been uploaded no earlier
+// than notBefore; other backends keep content until it is deleted.
+func (r *FileRepository) FindReusableMedia(hash string, notBefore time.Time) (*File, error) {
+	return scanFile(DB.QueryRow(`
+		SELECT `+fileColumns+`
+		FROM files
+		WHERE file_hash = ? AND status = 'active' AND (backend != 'whatsapp' OR media_uploaded_at >= ?)
+		ORDER BY media_uploaded_at DESC
+		LIMIT 1`, hash, notBefore))
+}
+
+// CountMediaRefs returns how many active files reference the given stored content
+func (r *FileRepository) CountMediaRefs(backend, directPath string) (int64, error) {
+	var count int64
+	err := DB.QueryRow(`SELECT COUNT(*) FROM files WHERE backend = ? AND direct_path = ? AND status = 'active'`,
+		backend, directPath).Scan(&count)
+	return count, err
+}
+
+// ListUnreferencedObjects retrieves one file for each object in a deletable backend
+// that is no longer referenced by an active file and has not been purged yet.
+// WhatsApp media is skipped since it lapses on its own.
+func (r *FileRepository) ListUnreferencedObjects(limit int) ([]*File, error) {
+	rows, err := DB.Query(`
+		SELECT `+fileColumns+`
+		FROM files f
+		WHERE backend != 'whatsapp' AND status != 'active' AND purged_at IS NULL
+			AND NOT EXISTS (
+				SELECT 1 FROM files a
+				WHERE a.backend = f.backend AND a.direct_path = f.direct_path AND a.status = 'active'
+			)
+		GROUP BY backend, direct_path
+		LIMIT ?`, limit)
 	if err != nil {
 		return nil, err
 	}
-	return f, nil
+	return scanFiles(rows)
+}
+
+// MarkPurged records that a stored object was removed from its backend
+func (r *FileRepository) MarkPurged(backend, directPath string) error {
+	_, err := DB.Exec(`UPDATE files SET purged_at = ? WHERE backend = ? AND direct_path = ? AND status != 'active'`,
+		time.Now(), backend, directPath)
+	return err
 }
 
 // List retrieves all files with pagination
 func (r *FileRepository) List(limit, offset int) ([]*File, error) {
 	rows, err := DB.Query(`
-		SELECT id, filename, mime_type, file_size, file_hash, description,
-			direct_path, media_key, file_enc_hash, file_sha256, password_hash, max_downloads,
-			download_count, created_at, expires_at, status
+		SELECT `+fileColumns+`
 		FROM files
 		ORDER BY created_at DESC
 		LIMIT ? OFFSET ?`, limit, offset)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return scanFiles(rows)
+}
 
-	var files []*File
-	for rows.Next() {
-		f := &File{}
-		err := rows.Scan(
-			&f.ID, &f.Filename, &f.MimeType, &f.FileSize, &f.FileHash, &f.Description,
-			&f.DirectPath, &f.MediaKey, &f.FileEncHash, &f.FileSHA256, &f.PasswordHash, &f.MaxDownloads,
-			&f.DownloadCount, &f.CreatedAt, &f.ExpiresAt, &f.Status)
-		if err != nil {
-			return nil, err
-		}
-		files = append(files, f)
+// ListByOwner retrieves a user's files with pagination, leaving out deleted ones
+func (r *FileRepository) ListByOwner(ownerID string, limit, offset int) ([]*File, error) {
+	rows, err := DB.Query(`
+		SELECT `+fileColumns+`
+		FROM files
+		WHERE owner_id = ? AND status != 'deleted'
+		ORDER BY created_at DESC
+		LIMIT ? OFFSET ?`, ownerID, limit, offset)
+	if err != nil {
+		return nil, err
 	}
-	return files, nil
+	return scanFiles(rows)
 }
 
-// IncrementDownloadCountAtomically increments the download counter and checks limit atomically
-// Returns error if download limit would be exceeded
-func (r *FileRepository) IncrementDownloadCountAtomically(id string) error {
+// ListMediaDueForRefresh retrieves active files whose WhatsApp media was uploaded before the
+// given time and would be dropped by WhatsApp after retention but before the file
+// expires, skipping media that has failed to refresh maxFailures times
+func (r *FileRepository) ListMediaDueForRefresh(uploadedBefore time.Time, retention time.Duration, maxFailures, limit int) ([]*File, error) {
+	rows, err := DB.Query(`
+		SELECT `+fileColumns+`
+		FROM files
+		WHERE status = 'active' AND backend = 'whatsapp' AND media_uploaded_at < ? AND refresh_failures < ?
+			AND julianday(expires_at) > julianday(media_uploaded_at) + ?
+		ORDER BY media_uploaded_at ASC
+		LIMIT ?`, uploadedBefore, maxFailures, retention.Hours()/24, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// UpdateMedia points every file sharing oldDirectPath at freshly uploaded media
+func (r *FileRepository) UpdateMedia(oldDirectPath, account, directPath string, mediaKey, fileEncHash []byte, uploadedAt time.Time) (int64, error) {
+	result, err := DB.Exec(`
+		UPDATE files SET account = ?, direct_path = ?, media_key = ?, file_enc_hash = ?,
+			media_uploaded_at = ?, last_refreshed_at = ?, refresh_failures = 0, refresh_error = NULL
+		WHERE backend = 'whatsapp' AND direct_path = ?`,
+		account, directPath, mediaKey, fileEncHash, uploadedAt, uploadedAt, oldDirectPath)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// RecordRefreshFailure records a failed refresh for every file sharing the media
+func (r *FileRepository) RecordRefreshFailure(directPath, reason string) error {
+	_, err := DB.Exec(`
+		UPDATE files SET refresh_failures = refresh_failures + 1, refresh_error = ?
+		WHERE backend = 'whatsapp' AND direct_path = ?`, reason, directPath)
+	return err
+}
+
+// IncrementDownloadCounts counts a download of each file and one of each
+// collection holding them, checking every limit in a single transaction. Files
+// with no downloads left are skipped; the new counts of the others are
+// returned. Nothing is counted if no file can be, which fails with
+// ErrDownloadLimitReached, or if a collection has no downloads left, which
+// fails with a *CollectionLimitError.
+func (r *FileRepository) IncrementDownloadCounts(files []*File) (map[string]int64, error) {
 	tx, err := DB.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
 
-	// Get current download count and max downloads
+	counts := make(map[string]int64, len(files))
+	collections := make(map[string]bool)
+	for _, f := range files {
+		count, _, err := incrementDownloadCount(tx, "files", f.ID)
+		if errors.Is(err, ErrDownloadLimitReached) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		counts[f.ID] = count
+
+		if !f.CollectionID.Valid || collections[f.CollectionID.String] {
+			continue
+		}
+		collections[f.CollectionID.String] = true
+		_, maxDownloads, err := incrementDownloadCount(tx, "collections", f.CollectionID.String)
+		if errors.Is(err, ErrDownloadLimitReached) {
+			return nil, &CollectionLimitError{CollectionID: f.CollectionID.String, MaxDownloads: maxDownloads}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(counts) == 0 {
+		return nil, ErrDownloadLimitReached
+	}
+
+	return counts, tx.Commit()
+}
+
+// incrementDownloadCount increments the download counter of an active row of
+// table within tx unless it has reached its limit. It returns the new count
+// and the limit, which is 0 if there is none.
+func incrementDownloadCount(tx *sql.Tx, table, id string) (int64, int64, error) {
 	var downloadCount int64
 	var maxDownloads sql.NullInt64
-	err = tx.QueryRow(`SELECT download_count, max_downloads FROM files WHERE id = ? AND status = 'active'`, id).Scan(&downloadCount, &maxDownloads)
+	err := tx.QueryRow(`SELECT download_count, max_downloads FROM `+table+` WHERE id = ? AND status = 'active'`, id).Scan(&downloadCount, &maxDownloads)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
-	// Check download limit
 	if maxDownloads.Valid && downloadCount >= maxDownloads.Int64 {
-		return fmt.Errorf("download limit reached")
+		return 0, maxDownloads.Int64, ErrDownloadLimitReached
 	}
 
-	// Increment count
-	_, err = tx.Exec(`UPDATE files SET download_count = download_count + 1 WHERE id = ?`, id)
+	_, err = tx.Exec(`UPDATE `+table+` SET download_count = download_count + 1 WHERE id = ?`, id)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
+	return downloadCount + 1, maxDownloads.Int64, nil
+}
 
-	return tx.Commit()
+// Update saves a file's editable metadata. It returns false if the file is no
+// longer active.
+func (r *FileRepository) Update(f *File) (bool, error) {
+	result, err := DB.Exec(`
+		UPDATE files SET filename = ?, description = ?, mime_type = ?, password_hash = ?,
+			max_downloads = ?, expires_at = ?, updated_at = ?
+		WHERE id = ? AND status = 'active'`,
+		f.Filename, f.Description, f.MimeType, f.PasswordHash,
+		f.MaxDownloads, f.ExpiresAt, f.UpdatedAt, f.ID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
 }
 
 // UpdateStatus updates the file status
@@ -193,15 +444,16 @@ func (r *FileRepository) Delete(id string) error {
 	return r.UpdateStatus(id, "deleted")
 }
 
-// MarkExpired marks all files past expiry as expired
-func (r *FileRepository) MarkExpired() (int64, error) {
-	result, err := DB.Exec(`
+// MarkExpired marks all files past expiry as expired and returns them
+func (r *FileRepository) MarkExpired() ([]*File, error) {
+	rows, err := DB.Query(`
 		UPDATE files SET status = 'expired'
-		WHERE status = 'active' AND expires_at < CURRENT_TIMESTAMP`)
+		WHERE status = 'active' AND expires_at < CURRENT_TIMESTAMP
+		RETURNING ` + fileColumns)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	return result.RowsAffected()
+	return scanFiles(rows)
 }
 
 // Count returns total file count by status
@@ -217,6 +469,26 @@ func (r *FileRepository) Count(status string) (int64, error) {
 	return count, err
 }
 
+// CountByStatus returns the number of files in each status
+func (r *FileRepository) CountByStatus() (map[string]int64, error) {
+	rows, err := DB.Query(`SELECT status, COUNT(*) FROM files GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var status string
+		var count int64
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	return counts, rows.Err()
+}
+
 // TotalSize returns total size of all active files
 func (r *FileRepository) TotalSize() (int64, error) {
 	var size sql.NullInt64
@@ -237,9 +509,9 @@ func NewUploadRepository() *UploadRepository {
 // Create inserts a new upload record
 func (r *UploadRepository) Create(u *Upload) error {
 	_, err := DB.Exec(`
-		INSERT INTO uploads (id, filename, file_size, offset, metadata, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		u.ID, u.Filename, u.FileSize, u.Offset, u.Metadata, u.CreatedAt, u.UpdatedAt)
+		INSERT INTO uploads (id, filename, file_size, offset, metadata, created_at, updated_at, status, concat, owner_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.ID, u.Filename, u.FileSize, u.Offset, u.Metadata, u.CreatedAt, u.UpdatedAt, UploadStatusUploading, u.Concat, u.OwnerID)
 	return err
 }
 
@@ -247,9 +519,11 @@ func (r *UploadRepository) Create(u *Upload) error {
 func (r *UploadRepository) GetByID(id string) (*Upload, error) {
 	u := &Upload{}
 	err := DB.QueryRow(`
-		SELECT id, filename, file_size, offset, metadata, created_at, updated_at
+		SELECT id, filename, file_size, offset, metadata, created_at, updated_at, status, file_id, error, concat, owner_id,
+			management_token_hash, duplicate
 		FROM uploads WHERE id = ?`, id).Scan(
-		&u.ID, &u.Filename, &u.FileSize, &u.Offset, &u.Metadata, &u.CreatedAt, &u.UpdatedAt)
+		&u.ID, &u.Filename, &u.FileSize, &u.Offset, &u.Metadata, &u.CreatedAt, &u.UpdatedAt,
+		&u.Status, &u.FileID, &u.Error, &u.Concat, &u.OwnerID, &u.ManagementTokenHash, &u.Duplicate)
 	if err != nil {
 		return nil, err
 	}
@@ -264,15 +538,110 @@ func (r *UploadRepository) UpdateOffset(id string, offset int64) error {
 	return err
 }
 
+// AcquireLease takes the write lease on an upload for owner until expiresAt.
+// It returns false if another owner holds an unexpired lease.
+func (r *UploadRepository) AcquireLease(id, owner string, expiresAt time.Time) (bool, error) {
+	result, err := DB.Exec(`
+		UPDATE uploads SET lock_owner = ?, lock_expires_at = ?
+		WHERE id = ? AND (lock_owner IS NULL OR lock_owner = ? OR julianday(lock_expires_at) < julianday(?))`,
+		owner, expiresAt, id, owner, time.Now())
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// RenewLease extends a lease still held by owner
+func (r *UploadRepository) RenewLease(id, owner string, expiresAt time.Time) error {
+	_, err := DB.Exec(`
+		UPDATE uploads SET lock_expires_at = ?
+		WHERE id = ? AND lock_owner = ?`, expiresAt, id, owner)
+	return err
+}
+
+// ReleaseLease gives up a lease held by owner
+func (r *UploadRepository) ReleaseLease(id, owner string) error {
+	_, err := DB.Exec(`
+		UPDATE uploads SET lock_owner = NULL, lock_expires_at = NULL
+		WHERE id = ? AND lock_owner = ?`, id, owner)
+	return err
+}
+
+// SetLength sets the length of an upload created with a deferred length
+func (r *UploadRepository) SetLength(id string, length int64) error {
+	_, err := DB.Exec(`
+		UPDATE uploads SET file_size = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND file_size IS NULL`, length, id)
+	return err
+}
+
+// SetManagementTokenHash records the hash of an upload's management token.
+// It returns false if a token was already issued for the upload.
+func (r *UploadRepository) SetManagementTokenHash(id, hash string) (bool, error) {
+	result, err := DB.Exec(`
+		UPDATE uploads SET management_token_hash = ?
+		WHERE id = ? AND management_token_hash IS NULL`, hash, id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// StartProcessing moves an upload that has received all its data, or whose
+// processing failed, to processing. It returns false if the upload is not in
+// one of those states, so only one caller processes it.
+func (r *UploadRepository) StartProcessing(id string) (bool, error) {
+	result, err := DB.Exec(`
+		UPDATE uploads SET status = ?, error = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status IN (?, ?)`,
+		UploadStatusProcessing, id, UploadStatusUploading, UploadStatusFailed)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// MarkSucceeded records the file created from an upload and whether it reused
+// content already in storage
+func (r *UploadRepository) MarkSucceeded(id, fileID string, duplicate bool) error {
+	_, err := DB.Exec(`
+		UPDATE uploads SET status = ?, file_id = ?, duplicate = ?, error = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`, UploadStatusSucceeded, fileID, duplicate, id)
+	return err
+}
+
+// MarkFailed records why processing an upload failed
+func (r *UploadRepository) MarkFailed(id, reason string) error {
+	_, err := DB.Exec(`
+		UPDATE uploads SET status = ?, error = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`, UploadStatusFailed, reason, id)
+	return err
+}
+
+// FailInterrupted marks uploads left processing by a previous run as failed
+func (r *UploadRepository) FailInterrupted() (int64, error) {
+	result, err := DB.Exec(`
+		UPDATE uploads SET status = ?, error = 'interrupted by server restart', updated_at = CURRENT_TIMESTAMP
+		WHERE status = ?`, UploadStatusFailed, UploadStatusProcessing)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 // Delete removes an upload record
 func (r *UploadRepository) Delete(id string) error {
 	_, err := DB.Exec(`DELETE FROM uploads WHERE id = ?`, id)
 	return err
 }
 
-// DeleteOld removes uploads older than the given duration
+// DeleteOld removes uploads that have not changed since before. Uploads being
+// processed are kept until processing finishes.
 func (r *UploadRepository) DeleteOld(before time.Time) (int64, error) {
-	result, err := DB.Exec(`DELETE FROM uploads WHERE created_at < ?`, before)
+	result, err := DB.Exec(`DELETE FROM uploads WHERE julianday(updated_at) < julianday(?) AND status != ?`, before, UploadStatusProcessing)
 	if err != nil {
 		return 0, err
 	}
@@ -302,6 +671,38 @@ func (r *AccessLogRepository) CountByFileID(fileID string) (int64, error) {
 	return count, err
 }
 
+// CountActionsByFileID counts a file's access logs by action
+func (r *AccessLogRepository) CountActionsByFileID(fileID string) (map[string]int64, error) {
+	rows, err := DB.Query(`SELECT action, COUNT(*) FROM access_log WHERE file_id = ? GROUP BY action`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var action string
+		var count int64
+		if err := rows.Scan(&action, &count); err != nil {
+			return nil, err
+		}
+		counts[action] = count
+	}
+	return counts, rows.Err()
+}
+
+// LastByFileID returns when a file was last accessed with action
+func (r *AccessLogRepository) LastByFileID(fileID, action string) (sql.NullTime, error) {
+	var last sql.NullTime
+	err := DB.QueryRow(`
+		SELECT created_at FROM access_log WHERE file_id = ? AND action = ?
+		ORDER BY id DESC LIMIT 1`, fileID, action).Scan(&last)
+	if err == sql.ErrNoRows {
+		return last, nil
+	}
+	return last, err
+}
+
 // DeleteOld removes access logs older than the given time
 func (r *AccessLogRepository) DeleteOld(before time.Time) (int64, error) {
 	result, err := DB.Exec(`DELETE FROM access_log WHERE created_at < ?`, before)
@@ -426,3 +827,33 @@ func (r *StatsRepository) DeleteOldHourly(before time.Time) (int64, error) {
 	}
 	return result.RowsAffected()
 }
+
+// AccountUsage summarises the files stored through a WhatsApp account
+type AccountUsage struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// UsageByAccount returns the active files and bytes stored through each WhatsApp account
+func (r *FileRepository) UsageByAccount() (map[string]AccountUsage, error) {
+	rows, err := DB.Query(`
+		SELECT account, COUNT(*), COALESCE(SUM(file_size), 0)
+		FROM files
+		WHERE status = 'active' AND backend = 'whatsapp' AND account IS NOT NULL
+		GROUP BY account`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[string]AccountUsage)
+	for rows.Next() {
+		var account string
+		var u AccountUsage
+		if err := rows.Scan(&account, &u.Files, &u.Bytes); err != nil {
+			return nil, err
+		}
+		usage[account] = u
+	}
+	return usage, rows.Err()
+}
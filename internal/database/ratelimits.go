@@ -0,0 +1,87 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RateLimit is the persisted state of one rate limiter key
+type RateLimit struct {
+	Key         string
+	Tokens      float64
+	Failures    int
+	LockedUntil sql.NullTime
+	UpdatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// RateLimitRepository handles rate limiter persistence
+type RateLimitRepository struct{}
+
+func NewRateLimitRepository() *RateLimitRepository {
+	return &RateLimitRepository{}
+}
+
+// ListActive returns every rate limit entry that hasn't expired
+func (r *RateLimitRepository) ListActive(now time.Time) ([]*RateLimit, error) {
+	rows, err := DB.Query(`
+		SELECT key, tokens, failures, locked_until, updated_at, expires_at
+		FROM rate_limits
+		WHERE julianday(expires_at) > julianday(?)`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var limits []*RateLimit
+	for rows.Next() {
+		l := &RateLimit{}
+		if err := rows.Scan(&l.Key, &l.Tokens, &l.Failures, &l.LockedUntil, &l.UpdatedAt, &l.ExpiresAt); err != nil {
+			return nil, err
+		}
+		limits = append(limits, l)
+	}
+	return limits, rows.Err()
+}
+
+// Save stores entries and removes the given keys in one transaction
+func (r *RateLimitRepository) Save(limits []*RateLimit, deleted []string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, l := range limits {
+		_, err := tx.Exec(`
+			INSERT INTO rate_limits (key, tokens, failures, locked_until, updated_at, expires_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(key) DO UPDATE SET
+				tokens = excluded.tokens,
+				failures = excluded.failures,
+				locked_until = excluded.locked_until,
+				updated_at = excluded.updated_at,
+				expires_at = excluded.expires_at`,
+			l.Key, l.Tokens, l.Failures, l.LockedUntil, l.UpdatedAt, l.ExpiresAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range deleted {
+		if _, err := tx.Exec(`DELETE FROM rate_limits WHERE key = ?`, key); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteExpired removes entries that have expired
+func (r *RateLimitRepository) DeleteExpired(now time.Time) (int64, error) {
+	result, err := DB.Exec(`DELETE FROM rate_limits WHERE julianday(expires_at) <= julianday(?)`, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
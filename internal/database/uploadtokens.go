@@ -0,0 +1,118 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// UploadToken lets someone without an account upload a limited number of files.
+// Only a hash of the token is stored.
+type UploadToken struct {
+	ID         string
+	Name       string
+	TokenHash  string
+	MaxUses    sql.NullInt64
+	Uses       int64
+	CreatedAt  time.Time
+	ExpiresAt  sql.NullTime
+	LastUsedAt sql.NullTime
+	RevokedAt  sql.NullTime
+}
+
+// Active reports whether the token is not revoked, expired or used up
+func (t *UploadToken) Active() bool {
+	if t.RevokedAt.Valid {
+		return false
+	}
+	if t.ExpiresAt.Valid && !time.Now().Before(t.ExpiresAt.Time) {
+		return false
+	}
+	return !t.MaxUses.Valid || t.Uses < t.MaxUses.Int64
+}
+
+// UploadTokenRepository handles upload token database operations
+type UploadTokenRepository struct{}
+
+func NewUploadTokenRepository() *UploadTokenRepository {
+	return &UploadTokenRepository{}
+}
+
+const uploadTokenColumns = `id, name, token_hash, max_uses, uses, created_at, expires_at, last_used_at, revoked_at`
+
+func scanUploadToken(row rowScanner) (*UploadToken, error) {
+	t := &UploadToken{}
+	err := row.Scan(&t.ID, &t.Name, &t.TokenHash, &t.MaxUses, &t.Uses, &t.CreatedAt,
+		&t.ExpiresAt, &t.LastUsedAt, &t.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Create inserts a new upload token
+func (r *UploadTokenRepository) Create(t *UploadToken) error {
+	_, err := DB.Exec(`
+		INSERT INTO upload_tokens (id, name, token_hash, max_uses, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		t.ID, t.Name, t.TokenHash, t.MaxUses, t.CreatedAt, t.ExpiresAt)
+	return err
+}
+
+// GetByID retrieves an upload token by its ID
+func (r *UploadTokenRepository) GetByID(id string) (*UploadToken, error) {
+	return scanUploadToken(DB.QueryRow(`SELECT `+uploadTokenColumns+` FROM upload_tokens WHERE id = ?`, id))
+}
+
+// List returns every upload token, newest first
+func (r *UploadTokenRepository) List() ([]*UploadToken, error) {
+	rows, err := DB.Query(`SELECT ` + uploadTokenColumns + ` FROM upload_tokens ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*UploadToken
+	for rows.Next() {
+		t, err := scanUploadToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// Use records one use of a token. It returns false if the token is revoked,
+// expired or used up, so concurrent uploads can't exceed max_uses.
+func (r *UploadTokenRepository) Use(id string) (bool, error) {
+	now := time.Now()
+	result, err := DB.Exec(`
+		UPDATE upload_tokens SET uses = uses + 1, last_used_at = ?
+		WHERE id = ? AND revoked_at IS NULL
+			AND (max_uses IS NULL OR uses < max_uses)
+			AND (expires_at IS NULL OR julianday(expires_at) > julianday(?))`,
+		now, id, now)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// Release gives back a use recorded by Use, e.g. when the upload was rejected
+func (r *UploadTokenRepository) Release(id string) error {
+	_, err := DB.Exec(`UPDATE upload_tokens SET uses = uses - 1 WHERE id = ? AND uses > 0`, id)
+	return err
+}
+
+// Revoke revokes an upload token. It returns false if the token doesn't exist or was already revoked.
+func (r *UploadTokenRepository) Revoke(id string) (bool, error) {
+	result, err := DB.Exec(`
+		UPDATE upload_tokens SET revoked_at = ?
+		WHERE id = ? AND revoked_at IS NULL`, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
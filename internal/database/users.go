@@ -0,0 +1,139 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// User roles
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// User is a person who can sign in to upload and manage their own files
+type User struct {
+	ID           string
+	Username     string
+	PasswordHash string
+	Role         string
+	Disabled     bool
+	CreatedAt    time.Time
+	LastLoginAt  sql.NullTime
+
+	// Quotas in bytes, overriding the configured defaults when set. Zero means unlimited.
+	StorageQuota   sql.NullInt64
+	BandwidthQuota sql.NullInt64
+}
+
+// UserUsage summarises what a user stores and has uploaded
+type UserUsage struct {
+	StoredFiles   int64 `json:"stored_files"`
+	StoredBytes   int64 `json:"stored_bytes"`
+	UploadedBytes int64 `json:"uploaded_bytes"`
+}
+
+// UserRepository handles user database operations
+type UserRepository struct{}
+
+func NewUserRepository() *UserRepository {
+	return &UserRepository{}
+}
+
+const userColumns = `id, username, password_hash, role, storage_quota, bandwidth_quota, disabled, created_at, last_login_at`
+
+func scanUser(row rowScanner) (*User, error) {
+	u := &User{}
+	err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.StorageQuota, &u.BandwidthQuota,
+		&u.Disabled, &u.CreatedAt, &u.LastLoginAt)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Create inserts a new user
+func (r *UserRepository) Create(u *User) error {
+	_, err := DB.Exec(`
+		INSERT INTO users (id, username, password_hash, role, storage_quota, bandwidth_quota, disabled, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.ID, u.Username, u.PasswordHash, u.Role, u.StorageQuota, u.BandwidthQuota, u.Disabled, u.CreatedAt)
+	return err
+}
+
+// GetByID retrieves a user by ID
+func (r *UserRepository) GetByID(id string) (*User, error) {
+	return scanUser(DB.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+}
+
+// GetByUsername retrieves a user by username, ignoring case
+func (r *UserRepository) GetByUsername(username string) (*User, error) {
+	return scanUser(DB.QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ?`, username))
+}
+
+// List returns every user ordered by username
+func (r *UserRepository) List() ([]*User, error) {
+	rows, err := DB.Query(`SELECT ` + userColumns + ` FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// Update saves a user's password, role, quotas and disabled flag
+func (r *UserRepository) Update(u *User) error {
+	_, err := DB.Exec(`
+		UPDATE users SET password_hash = ?, role = ?, storage_quota = ?, bandwidth_quota = ?, disabled = ?
+		WHERE id = ?`,
+		u.PasswordHash, u.Role, u.StorageQuota, u.BandwidthQuota, u.Disabled, u.ID)
+	return err
+}
+
+// Delete removes a user. Their files remain until they expire.
+func (r *UserRepository) Delete(id string) (bool, error) {
+	result, err := DB.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// RecordLogin records when a user last signed in
+func (r *UserRepository) RecordLogin(id string) error {
+	_, err := DB.Exec(`UPDATE users SET last_login_at = ? WHERE id = ?`, time.Now(), id)
+	return err
+}
+
+// Usage returns what a user stores and has uploaded since the given time.
+// Chunked uploads still in progress count towards both, so parallel uploads
+// can't get around a quota.
+func (r *UserRepository) Usage(id string, since time.Time) (*UserUsage, error) {
+	u := &UserUsage{}
+	var pending int64
+	err := DB.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM files WHERE owner_id = ? AND status = 'active'),
+			(SELECT COALESCE(SUM(file_size), 0) FROM files WHERE owner_id = ? AND status = 'active'),
+			(SELECT COALESCE(SUM(file_size), 0) FROM files WHERE owner_id = ? AND julianday(created_at) >= julianday(?)),
+			(SELECT COALESCE(SUM(file_size), 0) FROM uploads WHERE owner_id = ? AND status IN (?, ?))`,
+		id, id, id, since, id, UploadStatusUploading, UploadStatusProcessing).Scan(
+		&u.StoredFiles, &u.StoredBytes, &u.UploadedBytes, &pending)
+	if err != nil {
+		return nil, err
+	}
+
+	u.StoredBytes += pending
+	u.UploadedBytes += pending
+	return u, nil
+}
@@ -0,0 +1,262 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// WebhookEventAll subscribes a webhook to every event
+const WebhookEventAll = "*"
+
+// Webhook delivery statuses
+const (
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusSucceeded = "succeeded"
+	DeliveryStatusFailed    = "failed"
+)
+
+// Webhook is an endpoint notified when subscribed events happen. The secret
+// signs each payload, so it is stored as is rather than hashed.
+type Webhook struct {
+	ID          string
+	URL         string
+	Secret      string
+	Events      []string
+	Description sql.NullString
+	Enabled     bool
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Subscribed reports whether the webhook wants the event
+func (w *Webhook) Subscribed(event string) bool {
+	for _, e := range w.Events {
+		if e == event || e == WebhookEventAll {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is a queued or finished delivery of an event to a webhook
+type WebhookDelivery struct {
+	ID             int64
+	WebhookID      string
+	Event          string
+	Payload        string
+	Status         string
+	Attempts       int
+	NextAttemptAt  sql.NullTime
+	LastAttemptAt  sql.NullTime
+	ResponseStatus sql.NullInt64
+	ResponseBody   sql.NullString
+	Error          sql.NullString
+	CreatedAt      time.Time
+	DeliveredAt    sql.NullTime
+}
+
+// WebhookRepository handles webhook and delivery database operations
+type WebhookRepository struct{}
+
+func NewWebhookRepository() *WebhookRepository {
+	return &WebhookRepository{}
+}
+
+const webhookColumns = `id, url, secret, events, description, enabled, created_at, updated_at`
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	w := &Webhook{}
+	var events string
+	err := row.Scan(&w.ID, &w.URL, &w.Secret, &events, &w.Description, &w.Enabled, &w.CreatedAt, &w.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	w.Events = strings.Split(events, ",")
+	return w, nil
+}
+
+func scanWebhooks(rows *sql.Rows) ([]*Webhook, error) {
+	defer rows.Close()
+
+	var webhooks []*Webhook
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+// Create inserts a new webhook
+func (r *WebhookRepository) Create(w *Webhook) error {
+	_, err := DB.Exec(`
+		INSERT INTO webhooks (id, url, secret, events, description, enabled, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		w.ID, w.URL, w.Secret, strings.Join(w.Events, ","), w.Description, w.Enabled, w.CreatedAt, w.UpdatedAt)
+	return err
+}
+
+// GetByID retrieves a webhook by ID
+func (r *WebhookRepository) GetByID(id string) (*Webhook, error) {
+	return scanWebhook(DB.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id = ?`, id))
+}
+
+// List returns every webhook, oldest first
+func (r *WebhookRepository) List() ([]*Webhook, error) {
+	rows, err := DB.Query(`SELECT ` + webhookColumns + ` FROM webhooks ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhooks(rows)
+}
+
+// ListEnabled returns the webhooks that receive events
+func (r *WebhookRepository) ListEnabled() ([]*Webhook, error) {
+	rows, err := DB.Query(`SELECT ` + webhookColumns + ` FROM webhooks WHERE enabled = 1 ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhooks(rows)
+}
+
+// Update saves a webhook's URL, secret, events, description and enabled flag
+func (r *WebhookRepository) Update(w *Webhook) error {
+	_, err := DB.Exec(`
+		UPDATE webhooks SET url = ?, secret = ?, events = ?, description = ?, enabled = ?, updated_at = ?
+		WHERE id = ?`,
+		w.URL, w.Secret, strings.Join(w.Events, ","), w.Description, w.Enabled, w.UpdatedAt, w.ID)
+	return err
+}
+
+// Delete removes a webhook along with its deliveries
+func (r *WebhookRepository) Delete(id string) (bool, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil || rows == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+const webhookDeliveryColumns = `id, webhook_id, event, payload, status, attempts, next_attempt_at, last_attempt_at,
+	response_status, response_body, error, created_at, delivered_at`
+
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	d := &WebhookDelivery{}
+	err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+		&d.LastAttemptAt, &d.ResponseStatus, &d.ResponseBody, &d.Error, &d.CreatedAt, &d.DeliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]*WebhookDelivery, error) {
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Enqueue queues an event for immediate delivery to a webhook
+func (r *WebhookRepository) Enqueue(webhookID, event, payload string) (int64, error) {
+	now := time.Now()
+	result, err := DB.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		webhookID, event, payload, DeliveryStatusPending, now, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// GetDelivery retrieves a webhook delivery by ID
+func (r *WebhookRepository) GetDelivery(id int64) (*WebhookDelivery, error) {
+	return scanWebhookDelivery(DB.QueryRow(`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries WHERE id = ?`, id))
+}
+
+// ListDeliveries returns a webhook's deliveries, newest first
+func (r *WebhookRepository) ListDeliveries(webhookID string, limit, offset int) ([]*WebhookDelivery, error) {
+	rows, err := DB.Query(`
+		SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries
+		WHERE webhook_id = ?
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?`, webhookID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// ListDue returns pending deliveries whose next attempt is due, oldest first
+func (r *WebhookRepository) ListDue(now time.Time, limit int) ([]*WebhookDelivery, error) {
+	rows, err := DB.Query(`
+		SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries
+		WHERE status = ? AND julianday(next_attempt_at) <= julianday(?)
+		ORDER BY next_attempt_at, id
+		LIMIT ?`, DeliveryStatusPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// RecordAttempt saves the outcome of a delivery attempt
+func (r *WebhookRepository) RecordAttempt(d *WebhookDelivery) error {
+	_, err := DB.Exec(`
+		UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_attempt_at = ?,
+			response_status = ?, response_body = ?, error = ?, delivered_at = ?
+		WHERE id = ?`,
+		d.Status, d.Attempts, d.NextAttemptAt, d.LastAttemptAt,
+		d.ResponseStatus, d.ResponseBody, d.Error, d.DeliveredAt, d.ID)
+	return err
+}
+
+// Redeliver queues a finished delivery to be sent again. It returns false if
+// the delivery doesn't exist or is still pending.
+func (r *WebhookRepository) Redeliver(id int64) (bool, error) {
+	result, err := DB.Exec(`
+		UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = ?
+		WHERE id = ? AND status != ?`,
+		DeliveryStatusPending, time.Now(), id, DeliveryStatusPending)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// DeleteOldDeliveries removes finished deliveries created before the given time
+func (r *WebhookRepository) DeleteOldDeliveries(before time.Time) (int64, error) {
+	result, err := DB.Exec(`
+		DELETE FROM webhook_deliveries
+		WHERE status != ? AND julianday(created_at) < julianday(?)`,
+		DeliveryStatusPending, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -2,39 +2,174 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/database"
 	"github.com/salman0ansari/whatsbox/internal/logging"
 	"github.com/salman0ansari/whatsbox/internal/whatsapp"
+	"go.mau.fi/whatsmeow"
 	"go.uber.org/zap"
 )
 
 // AdminHandler handles admin-related endpoints
 type AdminHandler struct {
-	waClient *whatsapp.Client
+	waPool   *whatsapp.Pool
+	fileRepo *database.FileRepository
+	cfg      *config.Config
 }
 
 // NewAdminHandler creates a new admin handler
-func NewAdminHandler(waClient *whatsapp.Client) *AdminHandler {
+func NewAdminHandler(waPool *whatsapp.Pool, cfg *config.Config) *AdminHandler {
 	return &AdminHandler{
-		waClient: waClient,
+		waPool:   waPool,
+		fileRepo: database.NewFileRepository(),
+		cfg:      cfg,
 	}
 }
 
+// AccountResponse represents a linked WhatsApp account in API responses
+type AccountResponse struct {
+	whatsapp.AccountStatus
+	StoredFiles int64 `json:"stored_files"`
+	StoredBytes int64 `json:"stored_bytes"`
+}
+
 // GetQR returns a QR code for WhatsApp login
 func (h *AdminHandler) GetQR(c *fiber.Ctx) error {
-	if h.waClient.IsLoggedIn() {
+	if h.waPool.IsLoggedIn() {
 		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
 			"error":   "already_logged_in",
-			"message": "WhatsApp is already logged in. Use /api/admin/logout first.",
+			"message": "WhatsApp is already logged in. Use /api/admin/accounts to link another account.",
 		})
 	}
 
+	return h.pairingQR(c)
+}
+
+// ListAccounts returns every linked WhatsApp account with its health and usage
+func (h *AdminHandler) ListAccounts(c *fiber.Ctx) error {
+	usage, err := h.fileRepo.UsageByAccount()
+	if err != nil {
+		logging.Warn("Failed to get account usage", zap.Error(err))
+	}
+
+	status := h.waPool.GetStatus()
+	accounts := make([]AccountResponse, len(status.Accounts))
+	for i, account := range status.Accounts {
+		accounts[i] = AccountResponse{
+			AccountStatus: account,
+			StoredFiles:   usage[account.ID].Files,
+			StoredBytes:   usage[account.ID].Bytes,
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"accounts": accounts,
+		"strategy": h.cfg.WAAccountStrategy,
+	})
+}
+
+// AddAccount starts linking another WhatsApp account and returns its QR code
+func (h *AdminHandler) AddAccount(c *fiber.Ctx) error {
+	return h.pairingQR(c)
+}
+
+// PairPhoneRequest represents a request to link an account by phone number
+type PairPhoneRequest struct {
+	Phone string `json:"phone"`
+}
+
+// PairPhone starts linking a WhatsApp account by phone number and returns the
+// pairing code to enter on that phone, for servers without a screen to show a QR code
+func (h *AdminHandler) PairPhone(c *fiber.Ctx) error {
+	var req PairPhoneRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_request",
+			"message": "Invalid request body",
+		})
+	}
+
+	req.Phone = strings.TrimSpace(req.Phone)
+	if req.Phone == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "missing_phone",
+			"message": "Phone number is required",
+		})
+	}
+
+	// Like QR pairing, the login connection has to outlive this HTTP request
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	time.AfterFunc(2*time.Minute, cancel)
+
+	pairing, err := h.waPool.PairPhone(ctx, req.Phone)
+	if err != nil {
+		if errors.Is(err, whatsmeow.ErrPhoneNumberTooShort) || errors.Is(err, whatsmeow.ErrPhoneNumberIsNotInternational) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid_phone",
+				"message": "Phone number must be in international format with country code, e.g. +15551234567",
+			})
+		}
+		logging.Error("Failed to get pairing code", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "pairing_failed",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(pairing)
+}
+
+// GetPairing returns the state of the current or last pairing attempt
+func (h *AdminHandler) GetPairing(c *fiber.Ctx) error {
+	return c.JSON(h.waPool.PairingStatus())
+}
+
+// RemoveAccount unlinks a WhatsApp account
+func (h *AdminHandler) RemoveAccount(c *fiber.Ctx) error {
+	id, err := url.PathUnescape(c.Params("id"))
+	if err != nil || id == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "missing_id",
+			"message": "Account ID is required",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), 30*time.Second)
+	defer cancel()
+
+	if err := h.waPool.Remove(ctx, id); err != nil {
+		if errors.Is(err, whatsapp.ErrAccountNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   "not_found",
+				"message": "Account not found",
+			})
+		}
+		logging.Error("Failed to remove account", zap.Error(err), zap.String("account", id))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "remove_failed",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Account removed successfully",
+		"id":      id,
+	})
+}
+
+// pairingQR returns a QR code for linking a new device
+func (h *AdminHandler) pairingQR(c *fiber.Ctx) error {
 	// Keep QR pairing session alive beyond this HTTP request.
-	ctx, _ := context.WithTimeout(context.Background(), 2*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	time.AfterFunc(2*time.Minute, cancel)
 
-	qr, err := h.waClient.GetQR(ctx)
+	qr, err := h.waPool.PairingClient().GetQR(ctx)
 	if err != nil {
 		logging.Error("Failed to get QR code", zap.Error(err))
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -51,13 +186,13 @@ func (h *AdminHandler) GetQR(c *fiber.Ctx) error {
 
 // GetStatus returns the WhatsApp connection status
 func (h *AdminHandler) GetStatus(c *fiber.Ctx) error {
-	status := h.waClient.GetStatus()
+	status := h.waPool.GetStatus()
 	return c.JSON(status)
 }
 
-// Logout logs out from WhatsApp
+// Logout logs out every linked WhatsApp account
 func (h *AdminHandler) Logout(c *fiber.Ctx) error {
-	if !h.waClient.IsLoggedIn() {
+	if !h.waPool.IsLoggedIn() {
 		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
 			"error":   "not_logged_in",
 			"message": "WhatsApp is not logged in",
@@ -67,7 +202,7 @@ func (h *AdminHandler) Logout(c *fiber.Ctx) error {
 	ctx, cancel := context.WithTimeout(c.Context(), 30*time.Second)
 	defer cancel()
 
-	if err := h.waClient.Logout(ctx); err != nil {
+	if err := h.waPool.Logout(ctx); err != nil {
 		logging.Error("Failed to logout", zap.Error(err))
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error":   "logout_failed",
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"database/sql"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/utils"
+	"go.uber.org/zap"
+)
+
+// APIKeyHandler handles API key management endpoints
+type APIKeyHandler struct {
+	apiKeyRepo *database.APIKeyRepository
+}
+
+// NewAPIKeyHandler creates a new API key handler
+func NewAPIKeyHandler() *APIKeyHandler {
+	return &APIKeyHandler{
+		apiKeyRepo: database.NewAPIKeyRepository(),
+	}
+}
+
+// APIKeyResponse represents an API key in API responses. The key itself is
+// only included when it is created.
+type APIKeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Key        string     `json:"key,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	Active     bool       `json:"active"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// List returns every API key
+func (h *APIKeyHandler) List(c *fiber.Ctx) error {
+	keys, err := h.apiKeyRepo.List()
+	if err != nil {
+		logging.Error("Failed to list API keys", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "list_failed",
+			"message": "Failed to list API keys",
+		})
+	}
+
+	responses := make([]APIKeyResponse, len(keys))
+	for i, k := range keys {
+		responses[i] = toAPIKeyResponse(k)
+	}
+
+	return c.JSON(fiber.Map{
+		"api_keys": responses,
+		"scopes":   database.Scopes,
+	})
+}
+
+// Create creates an API key and returns it. The key cannot be retrieved again.
+func (h *APIKeyHandler) Create(c *fiber.Ctx) error {
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_request",
+			"message": "Invalid request body",
+		})
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_name",
+			"message": "Name is required and must be at most 100 characters",
+		})
+	}
+
+	if len(req.Scopes) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_scopes",
+			"message": "At least one scope is required",
+		})
+	}
+	var scopes []string
+	for _, scope := range req.Scopes {
+		if !slices.Contains(database.Scopes, scope) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid_scopes",
+				"message": "Unknown scope: " + scope,
+			})
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if req.ExpiresInDays < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_expiry",
+			"message": "expires_in_days must not be negative",
+		})
+	}
+	var expiresAt sql.NullTime
+	if req.ExpiresInDays > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour), Valid: true}
+	}
+
+	id, key, err := utils.GenerateAPIKey()
+	if err != nil {
+		logging.Error("Failed to generate API key", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "key_generation_failed",
+			"message": "Failed to generate API key",
+		})
+	}
+
+	apiKey := &database.APIKey{
+		ID:        id,
+		Name:      name,
+		KeyHash:   utils.HashToken(key),
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+
+	if err := h.apiKeyRepo.Create(apiKey); err != nil {
+		logging.Error("Failed to save API key", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "create_failed",
+			"message": "Failed to create API key",
+		})
+	}
+
+	logging.Info("API key created",
+		zap.String("key_id", id),
+		zap.String("name", name),
+		zap.Strings("scopes", scopes),
+	)
+
+	resp := toAPIKeyResponse(apiKey)
+	resp.Key = key
+	return c.Status(fiber.StatusCreated).JSON(resp)
+}
+
+// Revoke revokes an API key
+func (h *APIKeyHandler) Revoke(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if id == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "missing_id",
+			"message": "API key ID is required",
+		})
+	}
+
+	revoked, err := h.apiKeyRepo.Revoke(id)
+	if err != nil {
+		logging.Error("Failed to revoke API key", zap.Error(err), zap.String("key_id", id))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "revoke_failed",
+			"message": "Failed to revoke API key",
+		})
+	}
+	if !revoked {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error":   "not_found",
+			"message": "API key not found or already revoked",
+		})
+	}
+
+	logging.Info("API key revoked", zap.String("key_id", id))
+
+	return c.JSON(fiber.Map{
+		"message": "API key revoked successfully",
+		"id":      id,
+	})
+}
+
+// toAPIKeyResponse converts a database API key to an API response
+func toAPIKeyResponse(k *database.APIKey) APIKeyResponse {
+	resp := APIKeyResponse{
+		ID:        k.ID,
+		Name:      k.Name,
+		Scopes:    k.Scopes,
+		Active:    k.Active(),
+		CreatedAt: k.CreatedAt,
+	}
+
+	if k.ExpiresAt.Valid {
+		resp.ExpiresAt = &k.ExpiresAt.Time
+	}
+	if k.LastUsedAt.Valid {
+		resp.LastUsedAt = &k.LastUsedAt.Time
+	}
+	if k.LastUsedIP.Valid {
+		resp.LastUsedIP = k.LastUsedIP.String
+	}
+	if k.RevokedAt.Valid {
+		resp.RevokedAt = &k.RevokedAt.Time
+	}
+
+	return resp
+}
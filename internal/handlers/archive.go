@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/storage"
+	"go.uber.org/zap"
+)
+
+// ArchiveRequest selects files to download as one ZIP archive
+type ArchiveRequest struct {
+	Files []string `json:"files"`
+
+	// Passwords maps file IDs to their passwords. Protected files without an
+	// entry are checked against the X-Password header.
+	Passwords map[string]string `json:"passwords"`
+}
+
+// Archive streams the selected files as a ZIP archive
+func (h *FileHandler) Archive(c *fiber.Ctx) error {
+	defer h.countFailure(c, h.collector.IncrementDownloadErrors)
+
+	var req ArchiveRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_request",
+			"message": "Invalid request body",
+		})
+	}
+
+	ids := uniqueIDs(req.Files)
+	if len(ids) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "missing_files",
+			"message": "At least one file is required",
+		})
+	}
+	if len(ids) > h.cfg.CollectionMaxFiles {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "too_many_files",
+			"message": fmt.Sprintf("An archive can hold at most %d files", h.cfg.CollectionMaxFiles),
+		})
+	}
+
+	files := make([]*database.File, 0, len(ids))
+	for _, id := range ids {
+		file, err := h.fileRepo.GetByID(id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error":   "not_found",
+					"message": "File not found: " + id,
+				})
+			}
+			logging.Error("Failed to get file", zap.Error(err), zap.String("file_id", id))
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":   "get_failed",
+				"message": "Failed to get file",
+			})
+		}
+		files = append(files, file)
+	}
+
+	defaultPassword := requestPassword(c)
+	backends, err := h.prepareArchive(c, files, func(id string) string {
+		if password, ok := req.Passwords[id]; ok {
+			return password
+		}
+		return defaultPassword
+	})
+	if backends == nil {
+		return err
+	}
+
+	return h.streamArchive(c, "whatsbox-files.zip", files, backends)
+}
+
+// prepareArchive checks that files can be downloaded the way a single download
+// checks them, with passwordFor returning the password given for each file. It
+// returns the backends holding the files, or nil once an error response has been sent.
+func (h *FileHandler) prepareArchive(c *fiber.Ctx, files []*database.File, passwordFor func(fileID string) string) (map[string]storage.Backend, error) {
+	// Files sharing a password, like those in a collection, are only checked once
+	verified := make(map[string]string)
+	backends := make(map[string]storage.Backend)
+
+	for _, file := range files {
+		if file.Status == "expired" || time.Now().After(file.ExpiresAt) {
+			return nil, c.Status(fiber.StatusGone).JSON(fiber.Map{
+				"error":      "file_expired",
+				"message":    "File " + file.ID + " has expired and is no longer available",
+				"file_id":    file.ID,
+				"expired_at": file.ExpiresAt,
+			})
+		}
+		if file.Status == "deleted" {
+			return nil, c.Status(fiber.StatusGone).JSON(fiber.Map{
+				"error":   "file_deleted",
+				"message": "File " + file.ID + " has been deleted",
+				"file_id": file.ID,
+			})
+		}
+
+		if file.PasswordHash.Valid {
+			password := passwordFor(file.ID)
+			if password == "" || verified[file.PasswordHash.String] != password {
+				if ok, err := h.checkPassword(c, "file", file.ID, file.PasswordHash.String, password); !ok {
+					return nil, err
+				}
+				verified[file.PasswordHash.String] = password
+			}
+		}
+
+		// Checked again atomically once the archive is sent
+		if file.MaxDownloads.Valid && file.DownloadCount >= file.MaxDownloads.Int64 {
+			return nil, c.Status(fiber.StatusGone).JSON(fiber.Map{
+				"error":         "download_limit_reached",
+				"message":       "File " + file.ID + " has reached its maximum download count",
+				"file_id":       file.ID,
+				"max_downloads": file.MaxDownloads.Int64,
+			})
+		}
+
+		if _, ok := backends[file.Backend]; !ok {
+			backend, err := h.storage.Get(file.Backend)
+			if err != nil || !backend.Available() {
+				return nil, c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+					"error":   "storage_unavailable",
+					"message": "The storage backend holding file " + file.ID + " is unavailable. Cannot download archive.",
+				})
+			}
+			backends[file.Backend] = backend
+		}
+	}
+
+	return backends, nil
+}
+
+// streamArchive counts a download of each file, and one of each collection
+// holding them, and streams them as a ZIP archive named name. Members are
+// stored uncompressed and fetched from storage one at a time as the archive is
+// written, so it is never held in full.
+func (h *FileHandler) streamArchive(c *fiber.Ctx, name string, files []*database.File, backends map[string]storage.Backend) error {
+	counts, err := h.fileRepo.IncrementDownloadCounts(files)
+	if err != nil {
+		var collectionErr *database.CollectionLimitError
+		if errors.As(err, &collectionErr) {
+			return c.Status(fiber.StatusGone).JSON(fiber.Map{
+				"error":         "download_limit_reached",
+				"message":       "Collection " + collectionErr.CollectionID + " has reached its maximum download count",
+				"collection_id": collectionErr.CollectionID,
+				"max_downloads": collectionErr.MaxDownloads,
+			})
+		}
+		if errors.Is(err, database.ErrDownloadLimitReached) {
+			return c.Status(fiber.StatusGone).JSON(fiber.Map{
+				"error":   "download_limit_reached",
+				"message": "The selected files have reached their maximum download count",
+			})
+		}
+		// Nothing was counted, so nothing may be sent
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusGone).JSON(fiber.Map{
+				"error":   "file_unavailable",
+				"message": "A selected file expired or was deleted while the archive was being prepared",
+			})
+		}
+		logging.Error("Failed to increment download counts", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "count_failed",
+			"message": "Failed to count download",
+		})
+	}
+
+	// Files that ran out of downloads since they were checked are left out
+	members := make([]*database.File, 0, len(files))
+	for _, file := range files {
+		downloadCount, ok := counts[file.ID]
+		if !ok {
+			logging.Warn("Leaving file out of archive, download limit reached", zap.String("file_id", file.ID))
+			continue
+		}
+		h.recordDownload(c, file, downloadCount)
+		members = append(members, file)
+	}
+
+	pr, pw := io.Pipe()
+	zw := zip.NewWriter(pw)
+
+	go func() {
+		names := make(map[string]bool)
+		for _, file := range members {
+			if err := writeArchiveMember(zw, backends[file.Backend], file, archiveName(names, file.Filename)); err != nil {
+				logging.Error("Failed to add file to archive", zap.Error(err), zap.String("file_id", file.ID))
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(zw.Close())
+	}()
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, "attachment; filename=\""+name+"\"")
+	return c.SendStream(newCountingStream(pr, h.collector))
+}
+
+// writeArchiveMember copies a file from storage into the archive
+func writeArchiveMember(zw *zip.Writer, backend storage.Backend, file *database.File, name string) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: file.CreatedAt,
+		Comment:  file.Description.String,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	stream, err := backend.Get(ctx, objectFromFile(file))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	_, err = io.Copy(w, stream)
+	return err
+}
+
+// archiveName returns a name for a file in an archive that isn't used yet,
+// numbering files that share a name
+func archiveName(used map[string]bool, filename string) string {
+	name := filename
+	ext := path.Ext(filename)
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(filename, ext), i, ext)
+	}
+	used[name] = true
+	return name
+}
+
+// uniqueIDs returns the non-empty IDs in order, without repeats
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	var unique []string
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id != "" && !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,573 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/broadcast"
+	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/middleware"
+	"github.com/salman0ansari/whatsbox/internal/utils"
+	"github.com/salman0ansari/whatsbox/internal/webhooks"
+	"go.uber.org/zap"
+)
+
+// CollectionHandler handles collections of files shared under one link
+type CollectionHandler struct {
+	files          *FileHandler
+	collectionRepo *database.CollectionRepository
+	uploadRepo     *database.UploadRepository
+	cfg            *config.Config
+}
+
+// NewCollectionHandler creates a new collection handler. Files are stored and
+// sent by the file handler.
+func NewCollectionHandler(fileHandler *FileHandler, cfg *config.Config) *CollectionHandler {
+	return &CollectionHandler{
+		files:          fileHandler,
+		collectionRepo: database.NewCollectionRepository(),
+		uploadRepo:     database.NewUploadRepository(),
+		cfg:            cfg,
+	}
+}
+
+// CollectionResponse represents a collection in API responses
+type CollectionResponse struct {
+	ID                string         `json:"id"`
+	Title             string         `json:"title,omitempty"`
+	Description       string         `json:"description,omitempty"`
+	URL               string         `json:"url"`
+	PasswordProtected bool           `json:"password_protected"`
+	MaxDownloads      *int64         `json:"max_downloads,omitempty"`
+	DownloadCount     int64          `json:"download_count"`
+	CreatedAt         time.Time      `json:"created_at"`
+	ExpiresAt         time.Time      `json:"expires_at"`
+	Status            string         `json:"status"`
+	FileCount         int            `json:"file_count"`
+	TotalSize         int64          `json:"total_size"`
+	Files             []FileResponse `json:"files"`
+}
+
+// CreateCollectionRequest groups completed chunked uploads into a collection
+type CreateCollectionRequest struct {
+	Uploads      []string `json:"uploads"`
+	Title        string   `json:"title"`
+	Description  string   `json:"description"`
+	Password     string   `json:"password"`
+	MaxDownloads int64    `json:"max_downloads"`
+	ExpiresIn    int64    `json:"expires_in"`
+	Slug         string   `json:"slug"`
+}
+
+// Create creates a collection, either from files uploaded with a multipart
+// request or from completed chunked uploads listed in a JSON body
+func (h *CollectionHandler) Create(c *fiber.Ctx) error {
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		return h.createFromFiles(c)
+	}
+	return h.createFromUploads(c)
+}
+
+// createFromFiles stores every file of a multipart upload in a new collection
+func (h *CollectionHandler) createFromFiles(c *fiber.Ctx) error {
+	collector := h.files.collector
+	collector.IncrementActiveUploads()
+	defer collector.DecrementActiveUploads()
+	defer h.files.countFailure(c, collector.IncrementUploadErrors)
+
+	// Pick where the files will be stored
+	backend, err := h.files.storage.ForUpload()
+	if err != nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error":   "storage_unavailable",
+			"message": "No storage backend is available. Please scan QR code first.",
+		})
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_request",
+			"message": "Invalid multipart form",
+		})
+	}
+	fileHeaders := append(form.File["files"], form.File["file"]...)
+	if len(fileHeaders) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "missing_file",
+			"message": "No files provided",
+		})
+	}
+	if apiErr := h.checkFileCount(len(fileHeaders)); apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	// The body has been received, whether or not the files are accepted
+	var totalSize int64
+	for _, fileHeader := range fileHeaders {
+		totalSize += fileHeader.Size
+	}
+	collector.AddBytesUploaded(totalSize)
+
+	for _, fileHeader := range fileHeaders {
+		// Sanitize filename to prevent path traversal
+		var apiErr *apiError
+		if fileHeader.Filename, apiErr = validateFilename(fileHeader.Filename); apiErr != nil {
+			return apiErr.send(c)
+		}
+
+		if fileHeader.Size > h.cfg.MaxUploadSize {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+				"error":   "file_too_large",
+				"message": fmt.Sprintf("%s exceeds maximum size of %d bytes", fileHeader.Filename, h.cfg.MaxUploadSize),
+			})
+		}
+	}
+
+	// Enforce the signed-in user's quotas
+	user := middleware.GetUser(c)
+	if user != nil {
+		if apiErr := checkQuota(h.cfg, h.files.userRepo, user, totalSize); apiErr != nil {
+			return apiErr.send(c)
+		}
+	}
+
+	col, apiErr := h.newCollection(c, formValue(form))
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	// Every file shares the collection's password and expiry. The files are
+	// added to the collection once its ID is settled.
+	stored := make([]*database.File, 0, len(fileHeaders))
+	fileIDs := make([]string, 0, len(fileHeaders))
+	var duplicates []bool
+	for _, fileHeader := range fileHeaders {
+		dbFile := &database.File{
+			PasswordHash: col.PasswordHash,
+			ExpiresAt:    col.ExpiresAt,
+			OwnerID:      col.OwnerID,
+		}
+		duplicate, apiErr := h.files.storeFile(c.Context(), backend, fileHeader, dbFile)
+		if apiErr != nil {
+			h.discardFiles(stored)
+			return apiErr.send(c)
+		}
+		stored = append(stored, dbFile)
+		fileIDs = append(fileIDs, dbFile.ID)
+		duplicates = append(duplicates, duplicate)
+	}
+
+	if apiErr := h.saveCollection(col, fileIDs); apiErr != nil {
+		h.discardFiles(stored)
+		return apiErr.send(c)
+	}
+	for _, dbFile := range stored {
+		dbFile.CollectionID = sql.NullString{String: col.ID, Valid: true}
+	}
+
+	for i, dbFile := range stored {
+		collector.IncrementUploads()
+		webhooks.Get().Emit(webhooks.EventFileUploaded, webhooks.NewFile(dbFile))
+		broadcast.Get().Publish(broadcast.EventUpload, toFileResponse(dbFile, duplicates[i]))
+	}
+
+	logging.Info("Collection uploaded successfully",
+		zap.String("collection_id", col.ID),
+		zap.Int("files", len(stored)),
+		zap.Int64("size", totalSize),
+		zap.String("backend", backend.Name()),
+	)
+
+	return c.Status(fiber.StatusCreated).JSON(toCollectionResponse(col, stored))
+}
+
+// createFromUploads groups the files of completed chunked uploads into a new collection
+func (h *CollectionHandler) createFromUploads(c *fiber.Ctx) error {
+	var req CreateCollectionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_request",
+			"message": "Invalid request body",
+		})
+	}
+
+	if len(req.Uploads) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "missing_uploads",
+			"message": "At least one upload is required",
+		})
+	}
+	if apiErr := h.checkFileCount(len(req.Uploads)); apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	// Only the uploader may share a signed-in user's upload
+	user := middleware.GetUser(c)
+	var fileIDs []string
+	seen := make(map[string]bool)
+	for _, uploadURL := range req.Uploads {
+		uploadID := uploadIDFromURL(uploadURL)
+		upload, err := h.uploadRepo.GetByID(uploadID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error":   "upload_not_found",
+					"message": "Upload not found: " + uploadID,
+				})
+			}
+			logging.Error("Failed to get upload", zap.Error(err), zap.String("upload_id", uploadID))
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":   "get_failed",
+				"message": "Failed to get upload",
+			})
+		}
+
+		if upload.OwnerID.Valid && (user == nil || user.ID != upload.OwnerID.String) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error":   "forbidden",
+				"message": "Upload belongs to another user: " + uploadID,
+			})
+		}
+		if upload.Status != database.UploadStatusSucceeded || !upload.FileID.Valid {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error":   "upload_not_complete",
+				"message": "Upload has not been stored yet: " + uploadID,
+			})
+		}
+
+		if !seen[upload.FileID.String] {
+			seen[upload.FileID.String] = true
+			fileIDs = append(fileIDs, upload.FileID.String)
+		}
+	}
+
+	col, apiErr := h.newCollection(c, func(key string) string {
+		switch key {
+		case "title":
+			return req.Title
+		case "description":
+			return req.Description
+		case "password":
+			return req.Password
+		case "max_downloads":
+			return strconv.FormatInt(req.MaxDownloads, 10)
+		case "expires_in":
+			return strconv.FormatInt(req.ExpiresIn, 10)
+		case "slug":
+			return req.Slug
+		}
+		return ""
+	})
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	if apiErr := h.saveCollection(col, fileIDs); apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	files, err := h.collectionRepo.ListFiles(col.ID)
+	if err != nil {
+		logging.Error("Failed to list collection files", zap.Error(err), zap.String("collection_id", col.ID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "list_failed",
+			"message": "Failed to list collection files",
+		})
+	}
+
+	logging.Info("Collection created from uploads",
+		zap.String("collection_id", col.ID),
+		zap.Int("files", len(files)),
+	)
+
+	return c.Status(fiber.StatusCreated).JSON(toCollectionResponse(col, files))
+}
+
+// Get returns a collection and the files in it
+func (h *CollectionHandler) Get(c *fiber.Ctx) error {
+	col, err := h.activeCollection(c, c.Params("id"))
+	if col == nil {
+		return err
+	}
+
+	// The file list is as private as the files
+	if col.PasswordHash.Valid {
+		if ok, err := h.files.requirePassword(c, "collection", col.ID, col.PasswordHash.String); !ok {
+			return err
+		}
+	}
+
+	files, err := h.collectionRepo.ListFiles(col.ID)
+	if err != nil {
+		logging.Error("Failed to list collection files", zap.Error(err), zap.String("collection_id", col.ID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "list_failed",
+			"message": "Failed to list collection files",
+		})
+	}
+
+	return c.JSON(toCollectionResponse(col, files))
+}
+
+// DownloadFile downloads one file of a collection. The file's password is the
+// collection's, and the download counts towards both their limits.
+func (h *CollectionHandler) DownloadFile(c *fiber.Ctx) error {
+	defer h.files.countFailure(c, h.files.collector.IncrementDownloadErrors)
+
+	col, err := h.activeCollection(c, c.Params("id"))
+	if col == nil {
+		return err
+	}
+
+	fileID := c.Params("file_id")
+	file, err := h.files.fileRepo.GetByID(fileID)
+	if err != nil && err != sql.ErrNoRows {
+		logging.Error("Failed to get file", zap.Error(err), zap.String("file_id", fileID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "get_failed",
+			"message": "Failed to get file",
+		})
+	}
+	if file == nil || file.CollectionID.String != col.ID {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error":   "not_found",
+			"message": "File not found in this collection",
+		})
+	}
+
+	return h.files.download(c, fileID)
+}
+
+// Download streams the files of a collection, or those selected with
+// ?files=, as a ZIP archive. The archive counts as one download of the
+// collection and one of each file in it.
+func (h *CollectionHandler) Download(c *fiber.Ctx) error {
+	defer h.files.countFailure(c, h.files.collector.IncrementDownloadErrors)
+
+	col, err := h.activeCollection(c, c.Params("id"))
+	if col == nil {
+		return err
+	}
+
+	password := requestPassword(c)
+	if col.PasswordHash.Valid {
+		if ok, err := h.files.checkPassword(c, "collection", col.ID, col.PasswordHash.String, password); !ok {
+			return err
+		}
+	}
+
+	files, err := h.collectionRepo.ListFiles(col.ID)
+	if err != nil {
+		logging.Error("Failed to list collection files", zap.Error(err), zap.String("collection_id", col.ID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "list_failed",
+			"message": "Failed to list collection files",
+		})
+	}
+
+	if selection := c.Query("files"); selection != "" {
+		byID := make(map[string]*database.File, len(files))
+		for _, f := range files {
+			byID[f.ID] = f
+		}
+		files = files[:0]
+		for _, id := range uniqueIDs(strings.Split(selection, ",")) {
+			f, ok := byID[id]
+			if !ok {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error":   "not_found",
+					"message": "File not found in this collection: " + id,
+				})
+			}
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error":   "empty_collection",
+			"message": "This collection has no files to download",
+		})
+	}
+
+	// A file's own password may differ from the collection's; it is checked
+	// against the same password
+	backends, err := h.files.prepareArchive(c, files, func(string) string { return password })
+	if backends == nil {
+		return err
+	}
+
+	name := col.ID
+	if col.Title.Valid {
+		name = utils.SanitizeFilename(col.Title.String)
+	}
+	return h.files.streamArchive(c, name+".zip", files, backends)
+}
+
+// activeCollection returns the collection with the given ID if it can still
+// be downloaded from. Otherwise the response has been sent and it returns nil.
+func (h *CollectionHandler) activeCollection(c *fiber.Ctx, id string) (*database.Collection, error) {
+	if id == "" {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "missing_id",
+			"message": "Collection ID is required",
+		})
+	}
+
+	col, err := h.collectionRepo.GetByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   "not_found",
+				"message": "Collection not found",
+			})
+		}
+		logging.Error("Failed to get collection", zap.Error(err), zap.String("collection_id", id))
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "get_failed",
+			"message": "Failed to get collection",
+		})
+	}
+
+	if col.Status == "expired" || time.Now().After(col.ExpiresAt) {
+		return nil, c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error":      "collection_expired",
+			"message":    "This collection has expired and is no longer available",
+			"expired_at": col.ExpiresAt,
+		})
+	}
+	if col.Status == "deleted" {
+		return nil, c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error":   "collection_deleted",
+			"message": "This collection has been deleted",
+		})
+	}
+
+	return col, nil
+}
+
+// newCollection builds a collection owned by the signed-in user from the
+// settings looked up with get. Its ID is the chosen slug, if any; otherwise
+// it is generated when the collection is saved.
+func (h *CollectionHandler) newCollection(c *fiber.Ctx, get func(key string) string) (*database.Collection, *apiError) {
+	title := get("title")
+	if len(title) > maxFilenameLength {
+		return nil, &apiError{fiber.StatusBadRequest, "invalid_title",
+			fmt.Sprintf("Title must be at most %d bytes", maxFilenameLength)}
+	}
+
+	opts, apiErr := parseUploadOptions(h.cfg, get)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	if apiErr := checkSlugAvailable(opts.slug, h.collectionRepo.Exists); apiErr != nil {
+		return nil, apiErr
+	}
+
+	col := &database.Collection{
+		ID:           opts.slug,
+		Title:        sql.NullString{String: title, Valid: title != ""},
+		Description:  opts.description,
+		PasswordHash: opts.passwordHash,
+		MaxDownloads: opts.maxDownloads,
+		CreatedAt:    time.Now(),
+		ExpiresAt:    opts.expiresAt,
+		Status:       "active",
+	}
+	if user := middleware.GetUser(c); user != nil {
+		col.OwnerID = sql.NullString{String: user.ID, Valid: true}
+	}
+	return col, nil
+}
+
+// saveCollection creates a collection holding the listed files, under its
+// slug if one was chosen or else under a generated ID
+func (h *CollectionHandler) saveCollection(col *database.Collection, fileIDs []string) *apiError {
+	slug := col.ID
+	err := createWithID(h.cfg, slug, func(id string) error {
+		col.ID = id
+		return h.collectionRepo.Create(col, fileIDs)
+	})
+	switch {
+	case err == nil:
+		return nil
+	case slug != "" && errors.Is(err, database.ErrDuplicateID):
+		return errSlugTaken
+	case errors.Is(err, database.ErrFilesUnavailable):
+		return &apiError{fiber.StatusConflict, "files_unavailable",
+			"Some uploaded files have expired, been deleted or already belong to a collection"}
+	}
+	logging.Error("Failed to save collection", zap.Error(err))
+	return &apiError{fiber.StatusInternalServerError, "save_failed", "Failed to save collection"}
+}
+
+// checkFileCount returns an error if a collection would hold too many files
+func (h *CollectionHandler) checkFileCount(count int) *apiError {
+	if count > h.cfg.CollectionMaxFiles {
+		return &apiError{fiber.StatusBadRequest, "too_many_files",
+			fmt.Sprintf("A collection can hold at most %d files", h.cfg.CollectionMaxFiles)}
+	}
+	return nil
+}
+
+// discardFiles deletes the files stored for a collection that could not be created
+func (h *CollectionHandler) discardFiles(files []*database.File) {
+	for _, f := range files {
+		if err := h.files.fileRepo.Delete(f.ID); err != nil {
+			logging.Warn("Failed to delete file of failed collection", zap.Error(err), zap.String("file_id", f.ID))
+		}
+	}
+}
+
+// formValue returns a lookup of the first value of each multipart form field
+func formValue(form *multipart.Form) func(key string) string {
+	return func(key string) string {
+		if values := form.Value[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+}
+
+// toCollectionResponse converts a collection and its files to an API response.
+// Files are downloaded through the collection.
+func toCollectionResponse(col *database.Collection, files []*database.File) CollectionResponse {
+	resp := CollectionResponse{
+		ID:                col.ID,
+		URL:               "/api/collections/" + col.ID,
+		PasswordProtected: col.PasswordHash.Valid,
+		DownloadCount:     col.DownloadCount,
+		CreatedAt:         col.CreatedAt,
+		ExpiresAt:         col.ExpiresAt,
+		Status:            col.Status,
+		FileCount:         len(files),
+		Files:             make([]FileResponse, len(files)),
+	}
+
+	if col.Title.Valid {
+		resp.Title = col.Title.String
+	}
+	if col.Description.Valid {
+		resp.Description = col.Description.String
+	}
+	if col.MaxDownloads.Valid {
+		resp.MaxDownloads = &col.MaxDownloads.Int64
+	}
+
+	for i, f := range files {
+		resp.TotalSize += f.FileSize
+		resp.Files[i] = toFileResponse(f, false)
+		resp.Files[i].DownloadURL = "/api/collections/" + col.ID + "/files/" + f.ID + "/download"
+	}
+
+	return resp
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/broadcast"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/stats"
+	"github.com/salman0ansari/whatsbox/internal/whatsapp"
+	"go.uber.org/zap"
+)
+
+const (
+	// eventsStatsInterval is how often stats changes are pushed
+	eventsStatsInterval = 2 * time.Second
+
+	// eventsKeepAlive is how often an idle stream gets a comment, so proxies
+	// keep it open and closed connections are noticed
+	eventsKeepAlive = 15 * time.Second
+)
+
+// EventsHandler streams live updates to the admin dashboard as Server-Sent Events
+type EventsHandler struct {
+	waPool    *whatsapp.Pool
+	collector *stats.Collector
+}
+
+// NewEventsHandler creates a new events handler
+func NewEventsHandler(waPool *whatsapp.Pool) *EventsHandler {
+	return &EventsHandler{
+		waPool:    waPool,
+		collector: stats.Get(),
+	}
+}
+
+// StatsDelta is the change in stats counters since the previous stats event,
+// along with the current number of active transfers
+type StatsDelta struct {
+	Uploads         int64 `json:"uploads"`
+	Downloads       int64 `json:"downloads"`
+	BytesUploaded   int64 `json:"bytes_uploaded"`
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+	UploadErrors    int64 `json:"upload_errors"`
+	DownloadErrors  int64 `json:"download_errors"`
+	Requests        int64 `json:"requests"`
+	ActiveUploads   int64 `json:"active_uploads"`
+	ActiveDownloads int64 `json:"active_downloads"`
+}
+
+// Stream sends the WhatsApp status and stats, then pushes connection state
+// changes, QR code rotations, uploads, downloads and stats deltas as they happen
+func (h *EventsHandler) Stream(c *fiber.Ctx) error {
+	hub := broadcast.Get()
+	if hub == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error":   "events_unavailable",
+			"message": "Live events are not available",
+		})
+	}
+
+	// Subscribe before taking the snapshots so no change is missed in between
+	events, unsubscribe := hub.Subscribe()
+	status := h.waPool.GetStatus()
+	snapshot := h.collector.GetStats()
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	// Stop nginx from buffering the stream
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+
+		fmt.Fprint(w, "retry: 3000\n\n")
+		writeSSE(w, 0, "status", status)
+		writeSSE(w, 0, "realtime", snapshot)
+		if err := w.Flush(); err != nil {
+			return
+		}
+
+		statsTicker := time.NewTicker(eventsStatsInterval)
+		defer statsTicker.Stop()
+		keepAlive := time.NewTicker(eventsKeepAlive)
+		defer keepAlive.Stop()
+
+		last := snapshot
+		for {
+			select {
+			case evt, ok := <-events:
+				if !ok {
+					// The server is shutting down
+					return
+				}
+				writeSSE(w, evt.ID, evt.Type, evt.Data)
+
+			case <-statsTicker.C:
+				current := h.collector.GetStats()
+				delta := statsDelta(last, current)
+				// Nothing happened if no counter moved and the active transfers are the same
+				idle := StatsDelta{ActiveUploads: last.ActiveUploads, ActiveDownloads: last.ActiveDownloads}
+				last = current
+				if delta == idle {
+					continue
+				}
+				writeSSE(w, 0, "stats", delta)
+
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			}
+
+			if err := w.Flush(); err != nil {
+				// The client went away
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// statsDelta returns the change between two stats snapshots
+func statsDelta(prev, cur *stats.Stats) StatsDelta {
+	return StatsDelta{
+		Uploads:         cur.UploadsTotal - prev.UploadsTotal,
+		Downloads:       cur.DownloadsTotal - prev.DownloadsTotal,
+		BytesUploaded:   cur.BytesUploaded - prev.BytesUploaded,
+		BytesDownloaded: cur.BytesDownloaded - prev.BytesDownloaded,
+		UploadErrors:    cur.UploadErrors - prev.UploadErrors,
+		DownloadErrors:  cur.DownloadErrors - prev.DownloadErrors,
+		Requests:        cur.Requests - prev.Requests,
+		ActiveUploads:   cur.ActiveUploads,
+		ActiveDownloads: cur.ActiveDownloads,
+	}
+}
+
+// writeSSE writes one Server-Sent Event with a JSON payload. IDs of zero are omitted.
+func writeSSE(w *bufio.Writer, id int64, event string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		logging.Error("Failed to encode live event", zap.Error(err), zap.String("event", event))
+		return
+	}
+	if id > 0 {
+		fmt.Fprintf(w, "id: %d\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}
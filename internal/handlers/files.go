@@ -2,36 +2,55 @@ package handlers
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
+	"errors"
+	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/broadcast"
 	"github.com/salman0ansari/whatsbox/internal/config"
 	"github.com/salman0ansari/whatsbox/internal/database"
 	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/middleware"
+	"github.com/salman0ansari/whatsbox/internal/ratelimit"
+	"github.com/salman0ansari/whatsbox/internal/stats"
+	"github.com/salman0ansari/whatsbox/internal/storage"
 	"github.com/salman0ansari/whatsbox/internal/utils"
+	"github.com/salman0ansari/whatsbox/internal/webhooks"
 	"github.com/salman0ansari/whatsbox/internal/whatsapp"
 	"go.uber.org/zap"
 )
 
 // FileHandler handles file-related endpoints
 type FileHandler struct {
-	waClient *whatsapp.Client
-	fileRepo *database.FileRepository
-	logRepo  *database.AccessLogRepository
-	cfg      *config.Config
+	storage        *storage.Manager
+	fileRepo       *database.FileRepository
+	collectionRepo *database.CollectionRepository
+	logRepo        *database.AccessLogRepository
+	userRepo       *database.UserRepository
+	collector      *stats.Collector
+	cfg            *config.Config
 }
 
 // NewFileHandler creates a new file handler
-func NewFileHandler(waClient *whatsapp.Client, cfg *config.Config) *FileHandler {
+func NewFileHandler(storageManager *storage.Manager, cfg *config.Config) *FileHandler {
 	return &FileHandler{
-		waClient: waClient,
-		fileRepo: database.NewFileRepository(),
-		logRepo:  database.NewAccessLogRepository(),
-		cfg:      cfg,
+		storage:        storageManager,
+		fileRepo:       database.NewFileRepository(),
+		collectionRepo: database.NewCollectionRepository(),
+		logRepo:        database.NewAccessLogRepository(),
+		userRepo:       database.NewUserRepository(),
+		collector:      stats.Get(),
+		cfg:            cfg,
 	}
 }
 
@@ -47,18 +66,32 @@ type FileResponse struct {
 	MaxDownloads      *int64    `json:"max_downloads,omitempty"`
 	DownloadCount     int64     `json:"download_count"`
 	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
 	ExpiresAt         time.Time `json:"expires_at"`
 	Status            string    `json:"status"`
 	Duplicate         bool      `json:"duplicate,omitempty"`
+	Backend           string    `json:"backend"`
+	CollectionID      string    `json:"collection_id,omitempty"`
+
+	MediaRefreshedAt *time.Time `json:"media_refreshed_at,omitempty"`
+	RefreshFailures  int64      `json:"refresh_failures,omitempty"`
+
+	// ManagementToken is only returned to the uploader
+	ManagementToken string `json:"management_token,omitempty"`
 }
 
 // Upload handles file uploads
 func (h *FileHandler) Upload(c *fiber.Ctx) error {
-	// Check WhatsApp connection
-	if !h.waClient.IsConnected() {
+	h.collector.IncrementActiveUploads()
+	defer h.collector.DecrementActiveUploads()
+	defer h.countFailure(c, h.collector.IncrementUploadErrors)
+
+	// Pick where the file will be stored
+	backend, err := h.storage.ForUpload()
+	if err != nil {
 		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
-			"error":   "whatsapp_not_connected",
-			"message": "WhatsApp is not connected. Please scan QR code first.",
+			"error":   "storage_unavailable",
+			"message": "No storage backend is available. Please scan QR code first.",
 		})
 	}
 
@@ -71,8 +104,15 @@ func (h *FileHandler) Upload(c *fiber.Ctx) error {
 		})
 	}
 
+	// The body has been received, whether or not the file is accepted
+	h.collector.AddBytesUploaded(fileHeader.Size)
+
 	// Sanitize filename to prevent path traversal
-	fileHeader.Filename = utils.SanitizeFilename(fileHeader.Filename)
+	var apiErr *apiError
+	fileHeader.Filename, apiErr = validateFilename(fileHeader.Filename)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
 
 	// Check file size
 	if fileHeader.Size > h.cfg.MaxUploadSize {
@@ -82,72 +122,97 @@ func (h *FileHandler) Upload(c *fiber.Ctx) error {
 		})
 	}
 
-	// Open file
-	file, err := fileHeader.Open()
-	if err != nil {
-		logging.Error("Failed to open uploaded file", zap.Error(err))
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "file_open_failed",
-			"message": "Failed to open uploaded file",
-		})
+	// Enforce the signed-in user's quotas
+	user := middleware.GetUser(c)
+	if user != nil {
+		if apiErr := checkQuota(h.cfg, h.userRepo, user, fileHeader.Size); apiErr != nil {
+			return apiErr.send(c)
+		}
+	}
+
+	opts, apiErr := parseUploadOptions(h.cfg, func(key string) string { return c.FormValue(key) })
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+	if apiErr := checkSlugAvailable(opts.slug, h.fileRepo.Exists); apiErr != nil {
+		return apiErr.send(c)
 	}
-	defer file.Close()
 
-	// Read file content
-	fileData, err := io.ReadAll(file)
+	dbFile := &database.File{
+		ID:           opts.slug,
+		Description:  opts.description,
+		PasswordHash: opts.passwordHash,
+		MaxDownloads: opts.maxDownloads,
+		ExpiresAt:    opts.expiresAt,
+	}
+	if user != nil {
+		dbFile.OwnerID = sql.NullString{String: user.ID, Valid: true}
+	}
+
+	// The uploader can manage the file with this token, which is only stored hashed
+	managementToken, err := utils.GenerateManagementToken()
 	if err != nil {
-		logging.Error("Failed to read uploaded file", zap.Error(err))
+		logging.Error("Failed to generate management token", zap.Error(err))
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "file_read_failed",
-			"message": "Failed to read uploaded file",
+			"error":   "token_generation_failed",
+			"message": "Failed to generate management token",
 		})
 	}
+	dbFile.ManagementTokenHash = sql.NullString{String: utils.HashToken(managementToken), Valid: true}
+
+	duplicate, apiErr := h.storeFile(c.Context(), backend, fileHeader, dbFile)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	h.collector.IncrementUploads()
+	webhooks.Get().Emit(webhooks.EventFileUploaded, webhooks.NewFile(dbFile))
+	broadcast.Get().Publish(broadcast.EventUpload, toFileResponse(dbFile, duplicate))
 
-	// Calculate file hash for tracking purposes
-	fileHash := utils.HashFile(fileData)
+	logging.Info("File uploaded successfully",
+		zap.String("file_id", dbFile.ID),
+		zap.String("filename", dbFile.Filename),
+		zap.Int64("size", dbFile.FileSize),
+		zap.String("backend", dbFile.Backend),
+		zap.Bool("duplicate", duplicate),
+	)
 
-	// Get optional metadata from form
-	description := c.FormValue("description", "")
-	password := c.FormValue("password", "")
-	maxDownloadsStr := c.FormValue("max_downloads", "")
-	expiresInStr := c.FormValue("expires_in", "")
+	resp := toFileResponse(dbFile, duplicate)
+	resp.ManagementToken = managementToken
+	return c.Status(fiber.StatusCreated).JSON(resp)
+}
 
-	// Parse max downloads
-	var maxDownloads sql.NullInt64
-	if maxDownloadsStr != "" {
-		if val, err := strconv.ParseInt(maxDownloadsStr, 10, 64); err == nil && val > 0 {
-			maxDownloads = sql.NullInt64{Int64: val, Valid: true}
-		}
+// storeFile stores the content of an uploaded file and creates its record.
+// dbFile holds the settings chosen by the uploader, including the ID if they
+// chose a slug, and is filled in with the rest. It reports whether content already in storage was reused.
+func (h *FileHandler) storeFile(ctx context.Context, backend storage.Backend, fileHeader *multipart.FileHeader, dbFile *database.File) (bool, *apiError) {
+	// Open file
+	file, err := fileHeader.Open()
+	if err != nil {
+		logging.Error("Failed to open uploaded file", zap.Error(err))
+		return false, &apiError{fiber.StatusInternalServerError, "file_open_failed", "Failed to open uploaded file"}
 	}
+	defer file.Close()
 
-	// Calculate expiry time
-	expiryDays := h.cfg.DefaultExpiryDays
-	if expiresInStr != "" {
-		if seconds, err := strconv.ParseInt(expiresInStr, 10, 64); err == nil && seconds > 0 {
-			days := int(seconds / 86400)
-			if days > 0 && days <= h.cfg.MaxExpiryDays {
-				expiryDays = days
-			}
-		}
+	// Hash the file first so identical content can be deduplicated
+	fileHash, err := utils.HashReader(file)
+	if err != nil {
+		logging.Error("Failed to read uploaded file", zap.Error(err))
+		return false, &apiError{fiber.StatusInternalServerError, "file_read_failed", "Failed to read uploaded file"}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		logging.Error("Failed to rewind uploaded file", zap.Error(err))
+		return false, &apiError{fiber.StatusInternalServerError, "file_read_failed", "Failed to read uploaded file"}
 	}
-	expiresAt := time.Now().Add(time.Duration(expiryDays) * 24 * time.Hour)
 
-	// Hash password if provided
-	var passwordHash sql.NullString
-	if password != "" {
-		hash, err := utils.HashPassword(password)
-		if err != nil {
-			logging.Error("Failed to hash password", zap.Error(err))
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error":   "password_hash_failed",
-				"message": "Failed to process password",
-			})
-		}
-		passwordHash = sql.NullString{String: hash, Valid: true}
+	// Sniff the MIME type from the start of the file without buffering the rest
+	mimeType, fileReader, err := utils.DetectContentType(file)
+	if err != nil {
+		logging.Error("Failed to read uploaded file", zap.Error(err))
+		return false, &apiError{fiber.StatusInternalServerError, "file_read_failed", "Failed to read uploaded file"}
 	}
 
-	// Detect MIME type
-	mimeType := http.DetectContentType(fileData)
+	// Fall back to the declared content type if sniffing was inconclusive
 	if mimeType == "application/octet-stream" {
 		// Try to use the content type from the form
 		mimeType = fileHeader.Header.Get("Content-Type")
@@ -156,71 +221,75 @@ func (h *FileHandler) Upload(c *fiber.Ctx) error {
 		}
 	}
 
-	// Get correct media type for WhatsApp
-	mediaType := utils.GetMediaType(mimeType)
+	// Reuse content already in storage for identical uploads
+	existing := findReusableMedia(h.fileRepo, h.cfg, fileHash, dbFile.ExpiresAt)
 
-	// Upload to WhatsApp
-	ctx, cancel := context.WithTimeout(c.Context(), 5*time.Minute)
-	defer cancel()
+	var obj *storage.Object
+	backendName := backend.Name()
+	mediaUploadedAt := time.Now()
+	if existing != nil {
+		// The media keys depend on the media type, so keep the original MIME type
+		mimeType = existing.MimeType
+		obj = objectFromFile(existing)
+		backendName = existing.Backend
+		mediaUploadedAt = existing.MediaUploadedAt
+	} else {
+		// Upload to storage
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		defer cancel()
 
-	uploadResp, err := h.waClient.Upload(ctx, fileData, mediaType)
-	if err != nil {
-		logging.Error("Failed to upload to WhatsApp", zap.Error(err))
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "upload_failed",
-			"message": "Failed to upload file to storage",
-		})
+		obj, err = backend.Put(ctx, fileReader, fileHeader.Size, mimeType)
+		if err != nil {
+			logging.Error("Failed to upload to storage", zap.Error(err), zap.String("backend", backendName))
+			return false, &apiError{fiber.StatusInternalServerError, "upload_failed", "Failed to upload file to storage"}
+		}
 	}
 
-	// Generate short ID
-	fileID, err := utils.GenerateShortID(h.cfg.ShortIDLength)
-	if err != nil {
-		logging.Error("Failed to generate file ID", zap.Error(err))
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "id_generation_failed",
-			"message": "Failed to generate file ID",
-		})
-	}
+	// Fill in the file record
+	dbFile.Filename = fileHeader.Filename
+	dbFile.MimeType = mimeType
+	dbFile.FileSize = fileHeader.Size
+	dbFile.FileHash = fileHash
+	dbFile.DirectPath = obj.Key
+	dbFile.MediaKey = obj.MediaKey
+	dbFile.FileEncHash = obj.FileEncHash
+	dbFile.FileSHA256 = obj.FileSHA256
+	dbFile.DownloadCount = 0
+	dbFile.CreatedAt = time.Now()
+	dbFile.UpdatedAt = dbFile.CreatedAt
+	dbFile.Status = "active"
+	dbFile.Backend = backendName
+	dbFile.Account = sql.NullString{String: obj.Account, Valid: obj.Account != ""}
+	dbFile.MediaUploadedAt = mediaUploadedAt
 
-	// Create file record
-	dbFile := &database.File{
-		ID:            fileID,
-		Filename:      fileHeader.Filename,
-		MimeType:      mimeType,
-		FileSize:      fileHeader.Size,
-		FileHash:      fileHash,
-		Description:   sql.NullString{String: description, Valid: description != ""},
-		DirectPath:    uploadResp.DirectPath,
-		MediaKey:      uploadResp.MediaKey,
-		FileEncHash:   uploadResp.FileEncHash,
-		FileSHA256:    uploadResp.FileSHA256,
-		PasswordHash:  passwordHash,
-		MaxDownloads:  maxDownloads,
-		DownloadCount: 0,
-		CreatedAt:     time.Now(),
-		ExpiresAt:     expiresAt,
-		Status:        "active",
-	}
-
-	if err := h.fileRepo.Create(dbFile); err != nil {
+	slug := dbFile.ID
+	err = createWithID(h.cfg, slug, func(id string) error {
+		dbFile.ID = id
+		return h.fileRepo.Create(dbFile)
+	})
+	if err != nil {
+		if slug != "" && errors.Is(err, database.ErrDuplicateID) {
+			return false, errSlugTaken
+		}
 		logging.Error("Failed to save file record", zap.Error(err))
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "save_failed",
-			"message": "Failed to save file record",
-		})
+		return false, &apiError{fiber.StatusInternalServerError, "save_failed", "Failed to save file record"}
 	}
 
-	logging.Info("File uploaded successfully",
-		zap.String("file_id", fileID),
-		zap.String("filename", fileHeader.Filename),
-		zap.Int64("size", fileHeader.Size),
-	)
-
-	return c.Status(fiber.StatusCreated).JSON(h.toFileResponse(dbFile, false))
+	return existing != nil, nil
 }
 
-// List returns all files
+// List returns all files, or only those owned by the user given in ?owner=
 func (h *FileHandler) List(c *fiber.Ctx) error {
+	return h.listFiles(c, c.Query("owner"))
+}
+
+// ListMine returns the signed-in user's files
+func (h *FileHandler) ListMine(c *fiber.Ctx) error {
+	return h.listFiles(c, middleware.GetUser(c).ID)
+}
+
+// listFiles returns a page of files, restricted to an owner if one is given
+func (h *FileHandler) listFiles(c *fiber.Ctx, ownerID string) error {
 	limit := c.QueryInt("limit", 100)
 	offset := c.QueryInt("offset", 0)
 
@@ -228,7 +297,13 @@ func (h *FileHandler) List(c *fiber.Ctx) error {
 		limit = 1000
 	}
 
-	files, err := h.fileRepo.List(limit, offset)
+	var files []*database.File
+	var err error
+	if ownerID != "" {
+		files, err = h.fileRepo.ListByOwner(ownerID, limit, offset)
+	} else {
+		files, err = h.fileRepo.List(limit, offset)
+	}
 	if err != nil {
 		logging.Error("Failed to list files", zap.Error(err))
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -239,7 +314,7 @@ func (h *FileHandler) List(c *fiber.Ctx) error {
 
 	responses := make([]FileResponse, len(files))
 	for i, f := range files {
-		responses[i] = h.toFileResponse(f, false)
+		responses[i] = toFileResponse(f, false)
 	}
 
 	return c.JSON(fiber.Map{
@@ -275,11 +350,151 @@ func (h *FileHandler) Get(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.JSON(h.toFileResponse(file, false))
+	return c.JSON(toFileResponse(file, false))
+}
+
+// UpdateFileRequest changes a file's metadata. Omitted fields are left as
+// they are; an empty description or password and a max_downloads of 0 clear them.
+type UpdateFileRequest struct {
+	Filename     *string    `json:"filename"`
+	Description  *string    `json:"description"`
+	Password     *string    `json:"password"`
+	MaxDownloads *int64     `json:"max_downloads"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MimeType     *string    `json:"mime_type"`
+}
+
+// Update changes a file's metadata, as an admin or with the file's management token
+func (h *FileHandler) Update(c *fiber.Ctx) error {
+	return h.updateFile(c, "")
+}
+
+// UpdateMine changes the metadata of a file owned by the signed-in user
+func (h *FileHandler) UpdateMine(c *fiber.Ctx) error {
+	return h.updateFile(c, middleware.GetUser(c).ID)
+}
+
+// updateFile changes a file's metadata, validated like the settings given on
+// upload. The file must belong to ownerID if one is given.
+func (h *FileHandler) updateFile(c *fiber.Ctx, ownerID string) error {
+	fileID := c.Params("id")
+	if fileID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "missing_id",
+			"message": "File ID is required",
+		})
+	}
+
+	var req UpdateFileRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_request",
+			"message": "Invalid request body",
+		})
+	}
+
+	file, apiErr := h.managedFile(c, fileID, ownerID)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	// Expired content may already be gone, so expired files can't be revived
+	if file.Status == "expired" || time.Now().After(file.ExpiresAt) {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error":      "file_expired",
+			"message":    "This file has expired and can no longer be changed",
+			"expired_at": file.ExpiresAt,
+		})
+	}
+	if file.Status == "deleted" {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error":   "file_deleted",
+			"message": "This file has been deleted",
+		})
+	}
+
+	if req.Filename != nil {
+		filename, apiErr := validateFilename(*req.Filename)
+		if apiErr != nil {
+			return apiErr.send(c)
+		}
+		file.Filename = filename
+	}
+	if req.Description != nil {
+		if apiErr := validateDescription(*req.Description); apiErr != nil {
+			return apiErr.send(c)
+		}
+		file.Description = sql.NullString{String: *req.Description, Valid: *req.Description != ""}
+	}
+	if req.MimeType != nil {
+		mimeType, apiErr := validateMimeType(file, *req.MimeType)
+		if apiErr != nil {
+			return apiErr.send(c)
+		}
+		file.MimeType = mimeType
+	}
+	if req.MaxDownloads != nil {
+		maxDownloads, err := maxDownloadsValue(*req.MaxDownloads)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid_max_downloads",
+				"message": err.Error(),
+			})
+		}
+		file.MaxDownloads = maxDownloads
+	}
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(time.Now()) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid_expires_at",
+				"message": "expires_at must be in the future",
+			})
+		}
+		file.ExpiresAt = clampFileExpiry(h.cfg, file, *req.ExpiresAt)
+	}
+	if req.Password != nil {
+		file.PasswordHash = sql.NullString{}
+		if *req.Password != "" {
+			hash, err := utils.HashPassword(*req.Password)
+			if err != nil {
+				logging.Error("Failed to hash password", zap.Error(err))
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error":   "password_hash_failed",
+					"message": "Failed to process password",
+				})
+			}
+			file.PasswordHash = sql.NullString{String: hash, Valid: true}
+		}
+	}
+
+	file.UpdatedAt = time.Now()
+	updated, err := h.fileRepo.Update(file)
+	if err != nil {
+		logging.Error("Failed to update file", zap.Error(err), zap.String("file_id", fileID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "update_failed",
+			"message": "Failed to update file",
+		})
+	}
+	if !updated {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error":   "file_unavailable",
+			"message": "This file expired or was deleted while it was being changed",
+		})
+	}
+
+	logging.Info("File updated",
+		zap.String("file_id", fileID),
+		zap.String("ip", c.IP()),
+	)
+
+	return c.JSON(toFileResponse(file, false))
 }
 
 // Download handles file downloads
 func (h *FileHandler) Download(c *fiber.Ctx) error {
+	defer h.countFailure(c, h.collector.IncrementDownloadErrors)
+
 	fileID := c.Params("id")
 	if fileID == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -288,6 +503,12 @@ func (h *FileHandler) Download(c *fiber.Ctx) error {
 		})
 	}
 
+	return h.download(c, fileID)
+}
+
+// download sends a file, enforcing its expiry, password and download limit,
+// along with those of the collection it belongs to
+func (h *FileHandler) download(c *fiber.Ctx, fileID string) error {
 	// Get file metadata
 	file, err := h.fileRepo.GetByID(fileID)
 	if err != nil {
@@ -321,81 +542,174 @@ func (h *FileHandler) Download(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check download limit - will be validated atomically during download
+	// Files out of downloads can't be fetched in any part. The limit is
+	// checked again atomically when a download is counted.
+	if file.MaxDownloads.Valid && file.DownloadCount >= file.MaxDownloads.Int64 {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error":         "download_limit_reached",
+			"message":       "This file has reached its maximum download count",
+			"max_downloads": file.MaxDownloads.Int64,
+		})
+	}
 
 	// Check password if required
 	if file.PasswordHash.Valid {
-		password := c.Get("X-Password", "")
-		if password == "" {
-			password = c.Query("password", "")
-		}
-		if password == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error":   "password_required",
-				"message": "This file is password protected. Provide password via X-Password header or password query parameter.",
-			})
-		}
-		if !utils.CheckPassword(password, file.PasswordHash.String) {
-			// Log failed attempt
-			h.logRepo.Create(&database.AccessLog{
-				FileID:    fileID,
-				Action:    "password_fail",
-				IPAddress: sql.NullString{String: c.IP(), Valid: true},
-				UserAgent: sql.NullString{String: c.Get("User-Agent"), Valid: true},
-				CreatedAt: time.Now(),
-			})
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error":   "invalid_password",
-				"message": "Incorrect password",
-			})
+		if ok, err := h.requirePassword(c, "file", fileID, file.PasswordHash.String); !ok {
+			return err
 		}
 	}
 
-	// Check WhatsApp connection
-	if !h.waClient.IsConnected() {
+	// Stored content never changes, so the content hash is a strong validator
+	etag := "\"" + file.FileHash + "\""
+	lastModified := file.CreatedAt.UTC()
+
+	if notModified(c, etag, lastModified) {
+		setValidatorHeaders(c, etag, lastModified)
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	// Parse requested byte ranges
+	ranges, err := requestedRanges(c, file.FileSize, etag, lastModified)
+	if err != nil {
+		c.Set(fiber.HeaderContentRange, "bytes */"+strconv.FormatInt(file.FileSize, 10))
+		return c.Status(fiber.StatusRequestedRangeNotSatisfiable).JSON(fiber.Map{
+			"error":   "range_not_satisfiable",
+			"message": "Requested range is outside the file",
+		})
+	}
+
+	// HEAD only describes the file, e.g. for download managers probing range support
+	if c.Method() == fiber.MethodHead {
+		setValidatorHeaders(c, etag, lastModified)
+		c.Set(fiber.HeaderContentType, file.MimeType)
+		c.Response().Header.SetContentLength(int(file.FileSize))
+		c.Status(fiber.StatusOK)
+		return nil
+	}
+
+	// Requests for the start of the file count as a download. Seeking in a
+	// video player or resuming a transfer is free, except on files with a
+	// download limit, where every range counts so the file can't be fetched in
+	// pieces.
+	counted := coversStart(ranges) || h.downloadLimited(file)
+	if ok, wait := middleware.AllowDeferredDownload(c, fileID, counted, rangesLength(ranges), file.FileSize); !ok {
+		return middleware.RateLimited(c, wait, "download_rate_limited", "Download limit reached. Try again later.")
+	}
+
+	// Check the backend holding the file is reachable
+	backend, err := h.storage.Get(file.Backend)
+	if err != nil || !backend.Available() {
 		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
-			"error":   "whatsapp_not_connected",
-			"message": "WhatsApp is not connected. Cannot download file.",
+			"error":   "storage_unavailable",
+			"message": "The storage backend holding this file is unavailable. Cannot download file.",
 		})
 	}
 
-	// Download from WhatsApp
+	// Download from storage
 	ctx, cancel := context.WithTimeout(c.Context(), 5*time.Minute)
 	defer cancel()
 
-	downloadReq := &whatsapp.DownloadRequest{
-		DirectPath:  file.DirectPath,
-		MediaKey:    file.MediaKey,
-		FileEncHash: file.FileEncHash,
-		FileSHA256:  file.FileSHA256,
-		FileLength:  uint64(file.FileSize),
-		MimeType:    file.MimeType,
-	}
+	obj := objectFromFile(file)
 
-	data, err := h.waClient.Download(ctx, downloadReq)
+	// Multi-range responses open their streams while the body is written
+	var stream io.ReadCloser
+	switch len(ranges) {
+	case 0:
+		stream, err = backend.Get(ctx, obj)
+	case 1:
+		stream, err = backend.GetRange(ctx, obj, ranges[0].start, ranges[0].length())
+	}
 	if err != nil {
-		logging.Error("Failed to download from WhatsApp", zap.Error(err), zap.String("file_id", fileID))
+		logging.Error("Failed to download from storage", zap.Error(err), zap.String("file_id", fileID))
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error":   "download_failed",
 			"message": "Failed to download file from storage",
 		})
 	}
 
-	// Increment download count atomically
-	if err := h.fileRepo.IncrementDownloadCountAtomically(fileID); err != nil {
-		if err.Error() == "download limit reached" {
-			return c.Status(fiber.StatusGone).JSON(fiber.Map{
-				"error":         "download_limit_reached",
-				"message":       "This file has reached its maximum download count",
-				"max_downloads": file.MaxDownloads.Int64,
+	if counted {
+		// Files in a collection also use up the collection's downloads; neither
+		// is counted if either has none left
+		counts, err := h.fileRepo.IncrementDownloadCounts([]*database.File{file})
+		if err != nil {
+			var collectionErr *database.CollectionLimitError
+			if errors.As(err, &collectionErr) {
+				if stream != nil {
+					stream.Close()
+				}
+				return c.Status(fiber.StatusGone).JSON(fiber.Map{
+					"error":   "download_limit_reached",
+					"message": "This collection has reached its maximum download count",
+				})
+			}
+			if errors.Is(err, database.ErrDownloadLimitReached) {
+				if stream != nil {
+					stream.Close()
+				}
+				return c.Status(fiber.StatusGone).JSON(fiber.Map{
+					"error":         "download_limit_reached",
+					"message":       "This file has reached its maximum download count",
+					"max_downloads": file.MaxDownloads.Int64,
+				})
+			}
+			if stream != nil {
+				stream.Close()
+			}
+			if err == sql.ErrNoRows {
+				return c.Status(fiber.StatusGone).JSON(fiber.Map{
+					"error":   "file_unavailable",
+					"message": "This file expired or was deleted while it was being downloaded",
+				})
+			}
+			logging.Error("Failed to increment download count", zap.Error(err), zap.String("file_id", fileID))
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":   "count_failed",
+				"message": "Failed to count download",
 			})
 		}
-		logging.Warn("Failed to increment download count", zap.Error(err), zap.String("file_id", fileID))
+		downloadCount := counts[fileID]
+
+		h.recordDownload(c, file, downloadCount)
+	}
+
+	// Set headers and stream the file; the body is decrypted as it is sent
+	// and the stream is closed by fasthttp once the response is written
+	setValidatorHeaders(c, etag, lastModified)
+	c.Set("Content-Disposition", "attachment; filename=\""+file.Filename+"\"")
+
+	switch len(ranges) {
+	case 0:
+		c.Set("Content-Type", file.MimeType)
+		return c.SendStream(newCountingStream(stream, h.collector), int(file.FileSize))
+	case 1:
+		c.Set("Content-Type", file.MimeType)
+		c.Set(fiber.HeaderContentRange, ranges[0].contentRange(file.FileSize))
+		c.Status(fiber.StatusPartialContent)
+		return c.SendStream(newCountingStream(stream, h.collector), int(ranges[0].length()))
+	default:
+		return h.sendMultipartRanges(c, file, backend, obj, ranges)
+	}
+}
+
+// recordDownload counts a download of file in the stats, notifies webhooks and
+// the dashboard, and logs the access. downloadCount is the file's new download
+// count, or 0 if it could not be updated.
+func (h *FileHandler) recordDownload(c *fiber.Ctx, file *database.File, downloadCount int64) {
+	h.collector.IncrementDownloads()
+
+	if downloadCount > 0 {
+		file.DownloadCount = downloadCount
+	}
+	dispatcher := webhooks.Get()
+	dispatcher.Emit(webhooks.EventFileDownloaded, webhooks.NewFile(file))
+	broadcast.Get().Publish(broadcast.EventDownload, toFileResponse(file, false))
+	if file.MaxDownloads.Valid && downloadCount == file.MaxDownloads.Int64 {
+		dispatcher.Emit(webhooks.EventFileLimitReached, webhooks.NewFile(file))
 	}
 
 	// Log access
 	h.logRepo.Create(&database.AccessLog{
-		FileID:    fileID,
+		FileID:    file.ID,
 		Action:    "download",
 		IPAddress: sql.NullString{String: c.IP(), Valid: true},
 		UserAgent: sql.NullString{String: c.Get("User-Agent"), Valid: true},
@@ -403,20 +717,165 @@ func (h *FileHandler) Download(c *fiber.Ctx) error {
 	})
 
 	logging.Info("File downloaded",
-		zap.String("file_id", fileID),
+		zap.String("file_id", file.ID),
 		zap.String("ip", c.IP()),
 	)
+}
 
-	// Set headers and return file
-	c.Set("Content-Type", file.MimeType)
-	c.Set("Content-Disposition", "attachment; filename=\""+file.Filename+"\"")
-	c.Set("Content-Length", strconv.FormatInt(file.FileSize, 10))
+// requirePassword checks the password sent with a request for the file or
+// collection with the given ID, which is protected by hash. Guessing is slowed
+// down per file or collection, and failed attempts on files are recorded in
+// the access log. If the password is missing or wrong, the response has been
+// sent and ok is false.
+func (h *FileHandler) requirePassword(c *fiber.Ctx, kind, id, hash string) (ok bool, err error) {
+	return h.checkPassword(c, kind, id, hash, requestPassword(c))
+}
+
+// requestPassword returns the password sent with a request, if any
+func requestPassword(c *fiber.Ctx) string {
+	password := c.Get("X-Password", "")
+	if password == "" {
+		password = c.Query("password", "")
+	}
+	return password
+}
+
+// checkPassword is requirePassword for a password given some other way
+func (h *FileHandler) checkPassword(c *fiber.Ctx, kind, id, hash, password string) (ok bool, err error) {
+	if password == "" {
+		return false, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error":   "password_required",
+			"message": "This " + kind + " is password protected. Provide password via X-Password header or password query parameter.",
+		})
+	}
+
+	// Slow down password guessing
+	limiter := ratelimit.Get()
+	subject := middleware.PasswordSubject(c, kind+":"+id)
+	if wait := limiter.Locked(ratelimit.ScopeFilePassword, subject); wait > 0 {
+		return false, middleware.RateLimited(c, wait, "too_many_attempts", "Too many incorrect passwords. Try again later.")
+	}
+
+	if !utils.CheckPassword(password, hash) {
+		// Log failed attempt
+		if kind == "file" {
+			h.logRepo.Create(&database.AccessLog{
+				FileID:    id,
+				Action:    "password_fail",
+				IPAddress: sql.NullString{String: c.IP(), Valid: true},
+				UserAgent: sql.NullString{String: c.Get("User-Agent"), Valid: true},
+				CreatedAt: time.Now(),
+			})
+		}
+		if lockout := limiter.Fail(ratelimit.ScopeFilePassword, subject); lockout > 0 {
+			logging.Warn("Password locked out after failed attempts",
+				zap.String(kind+"_id", id), zap.String("ip", c.IP()), zap.Duration("lockout", lockout))
+		}
+		return false, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error":   "invalid_password",
+			"message": "Incorrect password",
+		})
+	}
+	limiter.Succeed(ratelimit.ScopeFilePassword, subject)
+	return true, nil
+}
 
-	return c.Send(data)
+// sendMultipartRanges streams several ranges of a file as a multipart/byteranges body
+func (h *FileHandler) sendMultipartRanges(c *fiber.Ctx, file *database.File, backend storage.Backend, obj *storage.Object, ranges []byteRange) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		for _, r := range ranges {
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":  {file.MimeType},
+				"Content-Range": {r.contentRange(file.FileSize)},
+			})
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			stream, err := backend.GetRange(ctx, obj, r.start, r.length())
+			cancel()
+			if err != nil {
+				logging.Error("Failed to download range from storage", zap.Error(err), zap.String("file_id", file.ID))
+				pw.CloseWithError(err)
+				return
+			}
+
+			_, err = io.Copy(part, stream)
+			stream.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+
+	c.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	c.Status(fiber.StatusPartialContent)
+	return c.SendStream(newCountingStream(pr, h.collector))
+}
+
+// countFailure calls record if the handler responded with a server error
+func (h *FileHandler) countFailure(c *fiber.Ctx, record func()) {
+	if c.Response().StatusCode() >= fiber.StatusInternalServerError {
+		record()
+	}
+}
+
+// countingStream tracks a download in the stats collector while it is sent.
+// The bytes sent, and whether reading from storage failed, are recorded once
+// fasthttp closes the stream.
+type countingStream struct {
+	io.ReadCloser
+	collector *stats.Collector
+	bytes     int64
+	failed    bool
+	closeOnce sync.Once
+}
+
+func newCountingStream(rc io.ReadCloser, collector *stats.Collector) *countingStream {
+	collector.IncrementActiveDownloads()
+	return &countingStream{ReadCloser: rc, collector: collector}
+}
+
+func (s *countingStream) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		s.failed = true
+	}
+	return n, err
+}
+
+func (s *countingStream) Close() error {
+	err := s.ReadCloser.Close()
+	s.closeOnce.Do(func() {
+		s.collector.AddBytesDownloaded(s.bytes)
+		if s.failed {
+			s.collector.IncrementDownloadErrors()
+		}
+		s.collector.DecrementActiveDownloads()
+	})
+	return err
 }
 
-// Delete soft-deletes a file
+// Delete soft-deletes a file, as an admin or with the file's management token
 func (h *FileHandler) Delete(c *fiber.Ctx) error {
+	return h.deleteFile(c, "")
+}
+
+// DeleteMine soft-deletes a file owned by the signed-in user
+func (h *FileHandler) DeleteMine(c *fiber.Ctx) error {
+	return h.deleteFile(c, middleware.GetUser(c).ID)
+}
+
+// deleteFile soft-deletes a file, which must belong to ownerID if one is given
+func (h *FileHandler) deleteFile(c *fiber.Ctx, ownerID string) error {
 	fileID := c.Params("id")
 	if fileID == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -425,20 +884,9 @@ func (h *FileHandler) Delete(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if file exists
-	file, err := h.fileRepo.GetByID(fileID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error":   "not_found",
-				"message": "File not found",
-			})
-		}
-		logging.Error("Failed to get file", zap.Error(err), zap.String("file_id", fileID))
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "get_failed",
-			"message": "Failed to get file",
-		})
+	file, apiErr := h.managedFile(c, fileID, ownerID)
+	if apiErr != nil {
+		return apiErr.send(c)
 	}
 
 	if file.Status == "deleted" {
@@ -456,7 +904,21 @@ func (h *FileHandler) Delete(c *fiber.Ctx) error {
 		})
 	}
 
-	logging.Info("File deleted", zap.String("file_id", fileID))
+	// Other files may share the same stored content through deduplication
+	refs, err := h.fileRepo.CountMediaRefs(file.Backend, file.DirectPath)
+	if err != nil {
+		logging.Warn("Failed to count media references", zap.Error(err), zap.String("file_id", fileID))
+	} else if refs == 0 {
+		h.purgeObject(file)
+	}
+
+	file.Status = "deleted"
+	webhooks.Get().Emit(webhooks.EventFileDeleted, webhooks.NewFile(file))
+
+	logging.Info("File deleted",
+		zap.String("file_id", fileID),
+		zap.Int64("remaining_media_refs", refs),
+	)
 
 	return c.JSON(fiber.Map{
 		"message": "File deleted successfully",
@@ -464,8 +926,167 @@ func (h *FileHandler) Delete(c *fiber.Ctx) error {
 	})
 }
 
+// FileStatsResponse reports how a file has been accessed
+type FileStatsResponse struct {
+	ID               string     `json:"id"`
+	Status           string     `json:"status"`
+	DownloadCount    int64      `json:"download_count"`
+	MaxDownloads     *int64     `json:"max_downloads,omitempty"`
+	PasswordFailures int64      `json:"password_failures"`
+	LastDownloadedAt *time.Time `json:"last_downloaded_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+}
+
+// Stats returns a file's access stats, as an admin or with the file's management token
+func (h *FileHandler) Stats(c *fiber.Ctx) error {
+	return h.fileStats(c, "")
+}
+
+// StatsMine returns the access stats of a file owned by the signed-in user
+func (h *FileHandler) StatsMine(c *fiber.Ctx) error {
+	return h.fileStats(c, middleware.GetUser(c).ID)
+}
+
+// fileStats returns a file's access stats. The file must belong to ownerID if one is given.
+func (h *FileHandler) fileStats(c *fiber.Ctx, ownerID string) error {
+	fileID := c.Params("id")
+	if fileID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "missing_id",
+			"message": "File ID is required",
+		})
+	}
+
+	file, apiErr := h.managedFile(c, fileID, ownerID)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	counts, err := h.logRepo.CountActionsByFileID(fileID)
+	if err != nil {
+		logging.Error("Failed to count file accesses", zap.Error(err), zap.String("file_id", fileID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "stats_failed",
+			"message": "Failed to get file stats",
+		})
+	}
+	lastDownload, err := h.logRepo.LastByFileID(fileID, "download")
+	if err != nil {
+		logging.Error("Failed to get last download", zap.Error(err), zap.String("file_id", fileID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "stats_failed",
+			"message": "Failed to get file stats",
+		})
+	}
+
+	resp := FileStatsResponse{
+		ID:               file.ID,
+		Status:           file.Status,
+		DownloadCount:    file.DownloadCount,
+		PasswordFailures: counts["password_fail"],
+		CreatedAt:        file.CreatedAt,
+		ExpiresAt:        file.ExpiresAt,
+	}
+	if file.MaxDownloads.Valid {
+		resp.MaxDownloads = &file.MaxDownloads.Int64
+	}
+	if lastDownload.Valid {
+		resp.LastDownloadedAt = &lastDownload.Time
+	}
+
+	return c.JSON(resp)
+}
+
+// managedFile gets a file for a request that changes or inspects it. Files
+// owned by someone other than ownerID, if given, are reported as missing.
+// Without an owner, a management token sent with the request must be the file's.
+func (h *FileHandler) managedFile(c *fiber.Ctx, fileID, ownerID string) (*database.File, *apiError) {
+	file, err := h.fileRepo.GetByID(fileID)
+	if err == nil && ownerID != "" && file.OwnerID.String != ownerID {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &apiError{fiber.StatusNotFound, "not_found", "File not found"}
+		}
+		logging.Error("Failed to get file", zap.Error(err), zap.String("file_id", fileID))
+		return nil, &apiError{fiber.StatusInternalServerError, "get_failed", "Failed to get file"}
+	}
+
+	if token := c.Get(middleware.ManagementTokenHeader); ownerID == "" && token != "" && !validManagementToken(file, token) {
+		return nil, &apiError{fiber.StatusForbidden, "invalid_management_token", "Invalid management token for this file"}
+	}
+	return file, nil
+}
+
+// validManagementToken reports whether token is the file's management token
+func validManagementToken(f *database.File, token string) bool {
+	return f.ManagementTokenHash.Valid &&
+		subtle.ConstantTimeCompare([]byte(utils.HashToken(token)), []byte(f.ManagementTokenHash.String)) == 1
+}
+
+// findReusableMedia looks up content already in storage for identical uploads
+// that will remain available until expiresAt. It returns nil if the file must be uploaded.
+func findReusableMedia(fileRepo *database.FileRepository, cfg *config.Config, fileHash string, expiresAt time.Time) *database.File {
+	notBefore := expiresAt.Add(-whatsapp.MediaRetention)
+	if cfg.MediaRefreshEnabled {
+		// Media that is not yet due for refresh will be kept alive by the refresh job
+		if refreshDue := time.Now().Add(-cfg.MediaRefreshAge); refreshDue.Before(notBefore) {
+			notBefore = refreshDue
+		}
+	}
+
+	existing, err := fileRepo.FindReusableMedia(fileHash, notBefore)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logging.Warn("Failed to look up duplicate file", zap.Error(err), zap.String("file_hash", fileHash))
+		}
+		return nil
+	}
+	return existing
+}
+
+// purgeObject removes a deleted file's content from its backend. Failures are left
+// for the cleanup job to retry.
+func (h *FileHandler) purgeObject(f *database.File) {
+	if f.Backend == storage.BackendWhatsApp {
+		return
+	}
+
+	backend, err := h.storage.Get(f.Backend)
+	if err != nil {
+		logging.Warn("Cannot purge file content", zap.Error(err), zap.String("file_id", f.ID))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := backend.Delete(ctx, objectFromFile(f)); err != nil {
+		logging.Warn("Failed to purge file content", zap.Error(err), zap.String("file_id", f.ID))
+		return
+	}
+	if err := h.fileRepo.MarkPurged(f.Backend, f.DirectPath); err != nil {
+		logging.Warn("Failed to mark file content purged", zap.Error(err), zap.String("file_id", f.ID))
+	}
+}
+
+// objectFromFile returns the stored object referenced by a file
+func objectFromFile(f *database.File) *storage.Object {
+	return &storage.Object{
+		Key:         f.DirectPath,
+		Account:     f.Account.String,
+		MediaKey:    f.MediaKey,
+		FileEncHash: f.FileEncHash,
+		FileSHA256:  f.FileSHA256,
+		Size:        f.FileSize,
+		MimeType:    f.MimeType,
+	}
+}
+
 // toFileResponse converts a database file to an API response
-func (h *FileHandler) toFileResponse(f *database.File, duplicate bool) FileResponse {
+func toFileResponse(f *database.File, duplicate bool) FileResponse {
 	resp := FileResponse{
 		ID:                f.ID,
 		Filename:          f.Filename,
@@ -475,14 +1096,23 @@ func (h *FileHandler) toFileResponse(f *database.File, duplicate bool) FileRespo
 		PasswordProtected: f.PasswordHash.Valid,
 		DownloadCount:     f.DownloadCount,
 		CreatedAt:         f.CreatedAt,
+		UpdatedAt:         f.UpdatedAt,
 		ExpiresAt:         f.ExpiresAt,
 		Status:            f.Status,
 		Duplicate:         duplicate,
+		Backend:           f.Backend,
+		RefreshFailures:   f.RefreshFailures,
 	}
 
 	if f.Description.Valid {
 		resp.Description = f.Description.String
 	}
+	if f.CollectionID.Valid {
+		resp.CollectionID = f.CollectionID.String
+	}
+	if f.LastRefreshedAt.Valid {
+		resp.MediaRefreshedAt = &f.LastRefreshedAt.Time
+	}
 
 	if f.MaxDownloads.Valid {
 		resp.MaxDownloads = &f.MaxDownloads.Int64
@@ -490,3 +1120,124 @@ func (h *FileHandler) toFileResponse(f *database.File, duplicate bool) FileRespo
 
 	return resp
 }
+
+// maxRanges caps how many ranges a single request may ask for; larger
+// requests are answered with the whole file
+const maxRanges = 16
+
+// byteRange is an inclusive range of bytes within a file
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+func (r byteRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// requestedRanges returns the byte ranges asked for in the Range header, or nil
+// when the whole file should be sent. It fails with fiber.ErrRangeUnsatisfiable
+// if none of the ranges overlap the file.
+func requestedRanges(c *fiber.Ctx, size int64, etag string, lastModified time.Time) ([]byteRange, error) {
+	if c.Get(fiber.HeaderRange) == "" || size == 0 {
+		return nil, nil
+	}
+
+	// Honour If-Range only when the client's copy is still current
+	if ifRange := c.Get(fiber.HeaderIfRange); ifRange != "" {
+		if strings.HasPrefix(ifRange, "\"") || strings.HasPrefix(ifRange, "W/") {
+			if ifRange != etag {
+				return nil, nil
+			}
+		} else if t, err := http.ParseTime(ifRange); err != nil || !lastModified.Truncate(time.Second).Equal(t) {
+			return nil, nil
+		}
+	}
+
+	parsed, err := c.Range(int(size))
+	if err == fiber.ErrRangeUnsatisfiable {
+		return nil, err
+	}
+	if err != nil || parsed.Type != "bytes" || len(parsed.Ranges) > maxRanges {
+		return nil, nil
+	}
+
+	ranges := make([]byteRange, len(parsed.Ranges))
+	for i, r := range parsed.Ranges {
+		ranges[i] = byteRange{start: int64(r.Start), end: int64(r.End)}
+	}
+	return ranges, nil
+}
+
+// coversStart reports whether a response with ranges includes the first byte
+// of the file. No ranges means the whole file.
+func coversStart(ranges []byteRange) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if r.start == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// rangesLength returns the number of bytes in ranges
+func rangesLength(ranges []byteRange) int64 {
+	var n int64
+	for _, r := range ranges {
+		n += r.length()
+	}
+	return n
+}
+
+// downloadLimited reports whether a file, or the collection holding it, has a
+// download limit. If the collection can't be read it is assumed to have one.
+func (h *FileHandler) downloadLimited(file *database.File) bool {
+	if file.MaxDownloads.Valid {
+		return true
+	}
+	if !file.CollectionID.Valid {
+		return false
+	}
+	col, err := h.collectionRepo.GetByID(file.CollectionID.String)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logging.Warn("Failed to get collection", zap.Error(err), zap.String("collection_id", file.CollectionID.String))
+		}
+		return err != sql.ErrNoRows
+	}
+	return col.MaxDownloads.Valid
+}
+
+// notModified reports whether the client's cached copy is still valid
+func notModified(c *fiber.Ctx, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := c.Get(fiber.HeaderIfNoneMatch); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := c.Get(fiber.HeaderIfModifiedSince); ifModifiedSince != "" {
+		t, err := http.ParseTime(ifModifiedSince)
+		return err == nil && !lastModified.Truncate(time.Second).After(t)
+	}
+
+	return false
+}
+
+// setValidatorHeaders sets the caching and range headers shared by every download response
+func setValidatorHeaders(c *fiber.Ctx, etag string, lastModified time.Time) {
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderLastModified, lastModified.Format(http.TimeFormat))
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+}
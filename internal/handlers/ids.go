@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/utils"
+	"go.uber.org/zap"
+)
+
+// maxIDAttempts is how many generated IDs are tried before creating a record fails
+const maxIDAttempts = 5
+
+// errSlugTaken is the response to a slug that is already in use
+var errSlugTaken = &apiError{fiber.StatusConflict, "slug_taken", "This slug is already in use"}
+
+// createWithID creates a record with create under the slug chosen by the
+// uploader, or else under a generated ID. Generated IDs found in use are
+// replaced and retried; a slug in use fails with database.ErrDuplicateID.
+func createWithID(cfg *config.Config, slug string, create func(id string) error) error {
+	if slug != "" {
+		return create(slug)
+	}
+
+	for attempt := 0; ; attempt++ {
+		id, err := utils.GenerateID(cfg.IDScheme, cfg.ShortIDLength, attempt)
+		if err != nil {
+			return err
+		}
+		err = create(id)
+		if !errors.Is(err, database.ErrDuplicateID) || attempt+1 >= maxIDAttempts {
+			return err
+		}
+		logging.Warn("Generated ID already in use, retrying", zap.String("id", id), zap.Int("attempt", attempt+1))
+	}
+}
+
+// checkSlugAvailable returns errSlugTaken if exists reports the slug is in use.
+func checkSlugAvailable(slug string, exists func(id string) (bool, error)) *apiError {
+	if slug == "" {
+		return nil
+	}
+	taken, err := exists(slug)
+	if err != nil {
+		logging.Error("Failed to check slug", zap.Error(err), zap.String("slug", slug))
+		return &apiError{fiber.StatusInternalServerError, "slug_check_failed", "Failed to check slug"}
+	}
+	if taken {
+		return errSlugTaken
+	}
+	return nil
+}
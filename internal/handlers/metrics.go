@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/metrics"
+)
+
+// MetricsHandler serves Prometheus metrics
+type MetricsHandler struct {
+	token   string
+	handler fiber.Handler
+}
+
+// NewMetricsHandler creates a new metrics handler
+func NewMetricsHandler(cfg *config.Config) *MetricsHandler {
+	return &MetricsHandler{
+		token:   cfg.MetricsToken,
+		handler: adaptor.HTTPHandler(promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{})),
+	}
+}
+
+// Metrics returns metrics in the Prometheus exposition format, requiring the
+// bearer token if one is configured
+func (h *MetricsHandler) Metrics(c *fiber.Ctx) error {
+	if h.token != "" {
+		scheme, token, _ := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+		if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+			c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error":   "unauthorized",
+				"message": "A valid metrics token is required",
+			})
+		}
+	}
+
+	return h.handler(c)
+}
@@ -1,50 +1,89 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/broadcast"
 	"github.com/salman0ansari/whatsbox/internal/config"
 	"github.com/salman0ansari/whatsbox/internal/database"
 	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/middleware"
+	"github.com/salman0ansari/whatsbox/internal/stats"
+	"github.com/salman0ansari/whatsbox/internal/storage"
 	"github.com/salman0ansari/whatsbox/internal/utils"
-	"github.com/salman0ansari/whatsbox/internal/whatsapp"
+	"github.com/salman0ansari/whatsbox/internal/webhooks"
 	"go.uber.org/zap"
 )
 
 const (
-	tusVersion    = "1.0.0"
-	tusExtensions = "creation,termination"
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,creation-with-upload,creation-defer-length,termination,checksum,concatenation,expiration"
+	tusChecksumAlgorithms = "md5,sha1,sha256"
+
+	tusContentType = "application/offset+octet-stream"
+
+	// statusChecksumMismatch is the tus status for a chunk failing its checksum
+	statusChecksumMismatch = 460
+
+	concatPartial = "partial"
+	concatFinal   = "final;"
 )
 
 // TusHandler handles chunked uploads using the tus protocol
 type TusHandler struct {
-	waClient   *whatsapp.Client
+	storage    *storage.Manager
 	uploadRepo *database.UploadRepository
 	fileRepo   *database.FileRepository
+	userRepo   *database.UserRepository
+	locks      *uploadLocks
+	collector  *stats.Collector
 	cfg        *config.Config
 }
 
 // NewTusHandler creates a new tus handler
-func NewTusHandler(waClient *whatsapp.Client, cfg *config.Config) *TusHandler {
+func NewTusHandler(storageManager *storage.Manager, cfg *config.Config) *TusHandler {
 	// Ensure temp directory exists
 	os.MkdirAll(cfg.TempDir, 0755)
 
-	return &TusHandler{
-		waClient:   waClient,
-		uploadRepo: database.NewUploadRepository(),
+	uploadRepo := database.NewUploadRepository()
+	h := &TusHandler{
+		storage:    storageManager,
+		uploadRepo: uploadRepo,
 		fileRepo:   database.NewFileRepository(),
+		userRepo:   database.NewUserRepository(),
+		locks:      newUploadLocks(uploadRepo),
+		collector:  stats.Get(),
 		cfg:        cfg,
 	}
+
+	// Processing stops with the server; those uploads can be retried
+	if count, err := h.uploadRepo.FailInterrupted(); err != nil {
+		logging.Error("Failed to mark interrupted uploads", zap.Error(err))
+	} else if count > 0 {
+		logging.Warn("Uploads interrupted during processing marked as failed", zap.Int64("count", count))
+	}
+
+	return h
 }
 
 // Options handles the OPTIONS request for tus protocol discovery
@@ -53,6 +92,7 @@ func (h *TusHandler) Options(c *fiber.Ctx) error {
 	c.Set("Tus-Version", tusVersion)
 	c.Set("Tus-Extension", tusExtensions)
 	c.Set("Tus-Max-Size", strconv.FormatInt(h.cfg.MaxUploadSize, 10))
+	c.Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
@@ -66,28 +106,60 @@ func (h *TusHandler) Create(c *fiber.Ctx) error {
 		})
 	}
 
-	// Get upload length
-	uploadLength, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
-	if err != nil || uploadLength <= 0 {
+	// Final uploads are assembled from partial uploads instead of receiving data
+	concat := c.Get("Upload-Concat")
+	if strings.HasPrefix(concat, concatFinal) {
+		return h.createFinal(c, concat)
+	}
+	if concat != "" && concat != concatPartial {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error":   "invalid_length",
-			"message": "Invalid or missing Upload-Length header",
+			"error":   "invalid_concat",
+			"message": "Upload-Concat must be partial or final",
 		})
 	}
 
-	// Check max size
-	if uploadLength > h.cfg.MaxUploadSize {
-		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
-			"error":   "file_too_large",
-			"message": fmt.Sprintf("File exceeds maximum size of %d bytes", h.cfg.MaxUploadSize),
-		})
+	// Get upload length, which may be sent with a later PATCH instead
+	var fileSize sql.NullInt64
+	deferLength := c.Get("Upload-Length") == "" && c.Get("Upload-Defer-Length") == "1"
+	if !deferLength {
+		uploadLength, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+		if err != nil || uploadLength <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid_length",
+				"message": "Invalid or missing Upload-Length header",
+			})
+		}
+
+		// Check max size
+		if uploadLength > h.cfg.MaxUploadSize {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+				"error":   "file_too_large",
+				"message": fmt.Sprintf("File exceeds maximum size of %d bytes", h.cfg.MaxUploadSize),
+			})
+		}
+		fileSize = sql.NullInt64{Int64: uploadLength, Valid: true}
 	}
 
-	// Parse metadata
+	// Enforce the signed-in user's quotas. Deferred lengths are checked once declared.
+	user := middleware.GetUser(c)
+	if user != nil && fileSize.Valid {
+		if apiErr := checkQuota(h.cfg, h.userRepo, user, fileSize.Int64); apiErr != nil {
+			return apiErr.send(c)
+		}
+	}
+
+	// Parse metadata, rejecting bad settings before any data is sent
 	metadata := parseUploadMetadata(c.Get("Upload-Metadata"))
-	filename := utils.SanitizeFilename(metadata["filename"])
-	if filename == "" {
-		filename = "unnamed_file"
+	filename, apiErr := validateFilename(metadata["filename"])
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+	opts, apiErr := validateUploadOptions(h.cfg, func(key string) string { return metadata[key] })
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+	if apiErr := checkSlugAvailable(opts.slug, h.fileRepo.Exists); apiErr != nil {
+		return apiErr.send(c)
 	}
 
 	// Generate upload ID
@@ -104,11 +176,16 @@ func (h *TusHandler) Create(c *fiber.Ctx) error {
 	upload := &database.Upload{
 		ID:        uploadID,
 		Filename:  sql.NullString{String: filename, Valid: true},
-		FileSize:  sql.NullInt64{Int64: uploadLength, Valid: true},
+		FileSize:  fileSize,
 		Offset:    0,
 		Metadata:  sql.NullString{String: c.Get("Upload-Metadata"), Valid: true},
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
+		Status:    database.UploadStatusUploading,
+		Concat:    sql.NullString{String: concat, Valid: concat != ""},
+	}
+	if user != nil {
+		upload.OwnerID = sql.NullString{String: user.ID, Valid: true}
 	}
 
 	if err := h.uploadRepo.Create(upload); err != nil {
@@ -132,19 +209,293 @@ func (h *TusHandler) Create(c *fiber.Ctx) error {
 	}
 	file.Close()
 
+	// The first chunk may be sent along with the creation request
+	if c.Get("Content-Type") == tusContentType {
+		newOffset, apiErr := h.writeChunk(c, upload)
+		if apiErr != nil {
+			os.Remove(tempPath)
+			h.uploadRepo.Delete(uploadID)
+			return apiErr.send(c)
+		}
+		upload.Offset = newOffset
+		c.Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+
+		if err := h.completeIfDone(c, upload); err != nil {
+			logging.Error("Failed to start processing upload", zap.Error(err), zap.String("upload_id", uploadID))
+		}
+	}
+
 	logging.Info("Upload created",
 		zap.String("upload_id", uploadID),
 		zap.String("filename", filename),
-		zap.Int64("size", uploadLength),
+		zap.Int64("size", fileSize.Int64),
+		zap.Bool("deferred_length", deferLength),
+		zap.Bool("partial", concat == concatPartial),
 	)
 
 	// Return location
+	location := fmt.Sprintf("/api/upload/%s", uploadID)
+	c.Set("Location", location)
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Upload-Expires", h.expiresAt(time.Now()).UTC().Format(http.TimeFormat))
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// createFinal creates an upload by concatenating completed partial uploads
+// in the order they are listed, then processes it like any completed upload
+func (h *TusHandler) createFinal(c *fiber.Ctx, concat string) error {
+	urls := strings.Fields(strings.TrimPrefix(concat, concatFinal))
+	if len(urls) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_concat",
+			"message": "Upload-Concat must list the partial uploads to concatenate",
+		})
+	}
+
+	// Check every partial upload is complete before touching any data. The
+	// final upload belongs to the owner of the partials, who must be the
+	// caller, so nobody else can take over their data or management token.
+	user := middleware.GetUser(c)
+	partials := make([]*database.Upload, len(urls))
+	seen := make(map[string]bool, len(urls))
+	var owner sql.NullString
+	var totalSize int64
+	for i, partialURL := range urls {
+		partialID := uploadIDFromURL(partialURL)
+		if seen[partialID] {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "duplicate_partial",
+				"message": fmt.Sprintf("Partial upload %s is listed more than once", partialID),
+			})
+		}
+		seen[partialID] = true
+
+		partial, err := h.uploadRepo.GetByID(partialID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error":   "invalid_partial",
+					"message": fmt.Sprintf("Partial upload %s not found", partialID),
+				})
+			}
+			logging.Error("Failed to get upload", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":   "get_failed",
+				"message": "Failed to get upload",
+			})
+		}
+
+		if partial.Concat.String != concatPartial {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid_partial",
+				"message": fmt.Sprintf("Upload %s is not a partial upload", partialID),
+			})
+		}
+		if partial.OwnerID.Valid {
+			if user == nil || user.ID != partial.OwnerID.String {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+					"error":   "forbidden",
+					"message": fmt.Sprintf("Partial upload %s belongs to another user", partialID),
+				})
+			}
+			owner = partial.OwnerID
+		}
+		if !partial.FileSize.Valid || partial.Offset != partial.FileSize.Int64 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "partial_incomplete",
+				"message": fmt.Sprintf("Partial upload %s is not complete", partialID),
+			})
+		}
+
+		partials[i] = partial
+		totalSize += partial.FileSize.Int64
+	}
+
+	if totalSize <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_length",
+			"message": "Concatenated upload is empty",
+		})
+	}
+	if totalSize > h.cfg.MaxUploadSize {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error":   "file_too_large",
+			"message": fmt.Sprintf("File exceeds maximum size of %d bytes", h.cfg.MaxUploadSize),
+		})
+	}
+
+	// Parse metadata, rejecting bad settings before any data is sent
+	metadata := parseUploadMetadata(c.Get("Upload-Metadata"))
+	filename, apiErr := validateFilename(metadata["filename"])
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+	opts, apiErr := validateUploadOptions(h.cfg, func(key string) string { return metadata[key] })
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+	if apiErr := checkSlugAvailable(opts.slug, h.fileRepo.Exists); apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	// Lock the partials so no other request writes, deletes or concatenates
+	// them, then check they didn't change before the locks were taken
+	release, err := h.lockPartials(partials)
+	if err != nil {
+		if errors.Is(err, errUploadLocked) {
+			return uploadLockedResponse(c)
+		}
+		logging.Error("Failed to lock upload", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "lock_failed",
+			"message": "Failed to lock upload",
+		})
+	}
+	defer release()
+
+	for i, partial := range partials {
+		current, err := h.uploadRepo.GetByID(partial.ID)
+		if err != nil && err != sql.ErrNoRows {
+			logging.Error("Failed to get upload", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":   "get_failed",
+				"message": "Failed to get upload",
+			})
+		}
+		if current == nil || current.Status != database.UploadStatusUploading || current.Offset != partial.Offset {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error":   "partial_changed",
+				"message": fmt.Sprintf("Partial upload %s changed while being concatenated", partial.ID),
+			})
+		}
+		partials[i] = current
+	}
+
+	// Generate upload ID
+	uploadID, err := utils.GenerateShortID(12)
+	if err != nil {
+		logging.Error("Failed to generate upload ID", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "id_generation_failed",
+			"message": "Failed to generate upload ID",
+		})
+	}
+
+	// Concatenate the partial data into the final upload's temp file
+	tempPath := h.getTempPath(uploadID)
+	if err := h.concatenate(tempPath, partials); err != nil {
+		logging.Error("Failed to concatenate uploads", zap.Error(err), zap.String("upload_id", uploadID))
+		os.Remove(tempPath)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "concat_failed",
+			"message": "Failed to concatenate partial uploads",
+		})
+	}
+
+	partialURLs := make([]string, len(partials))
+	for i, partial := range partials {
+		partialURLs[i] = "/api/upload/" + partial.ID
+	}
+
+	// Create upload record
+	upload := &database.Upload{
+		ID:        uploadID,
+		Filename:  sql.NullString{String: filename, Valid: true},
+		FileSize:  sql.NullInt64{Int64: totalSize, Valid: true},
+		Offset:    totalSize,
+		Metadata:  sql.NullString{String: c.Get("Upload-Metadata"), Valid: true},
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Status:    database.UploadStatusUploading,
+		Concat:    sql.NullString{String: concatFinal + strings.Join(partialURLs, " "), Valid: true},
+	}
+	// The partials were checked against their owner's quota when they were created
+	upload.OwnerID = owner
+
+	if err := h.uploadRepo.Create(upload); err != nil {
+		logging.Error("Failed to create upload record", zap.Error(err))
+		os.Remove(tempPath)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "create_failed",
+			"message": "Failed to create upload",
+		})
+	}
+
+	// The partial uploads have served their purpose. They are removed while
+	// still locked, so no other request can concatenate them again.
+	for _, partial := range partials {
+		os.Remove(h.getTempPath(partial.ID))
+		h.uploadRepo.Delete(partial.ID)
+	}
+
+	if err := h.completeIfDone(c, upload); err != nil {
+		logging.Error("Failed to start processing upload", zap.Error(err), zap.String("upload_id", uploadID))
+	}
+
+	logging.Info("Upload concatenated",
+		zap.String("upload_id", uploadID),
+		zap.String("filename", filename),
+		zap.Int64("size", totalSize),
+		zap.Int("partials", len(partials)),
+	)
+
 	location := fmt.Sprintf("/api/upload/%s", uploadID)
 	c.Set("Location", location)
 	c.Set("Tus-Resumable", tusVersion)
 	return c.SendStatus(fiber.StatusCreated)
 }
 
+// lockPartials locks each distinct partial upload, in ID order, and returns
+// the function releasing them all. It fails with errUploadLocked if any of
+// them is locked by another request.
+func (h *TusHandler) lockPartials(partials []*database.Upload) (func(), error) {
+	ids := make([]string, 0, len(partials))
+	for _, partial := range partials {
+		ids = append(ids, partial.ID)
+	}
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+
+	releases := make([]func(), 0, len(ids))
+	releaseAll := func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+	for _, id := range ids {
+		release, err := h.locks.acquire(id)
+		if err != nil {
+			releaseAll()
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+	return releaseAll, nil
+}
+
+// concatenate writes the data of the partial uploads, in order, to path
+func (h *TusHandler) concatenate(path string, partials []*database.Upload) error {
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	for _, partial := range partials {
+		src, err := os.Open(h.getTempPath(partial.ID))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, io.LimitReader(src, partial.Offset))
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return dst.Sync()
+}
+
 // Head handles HEAD requests to get upload offset
 func (h *TusHandler) Head(c *fiber.Ctx) error {
 	uploadID := c.Params("id")
@@ -170,10 +521,46 @@ func (h *TusHandler) Head(c *fiber.Ctx) error {
 		})
 	}
 
+	if h.expired(upload) {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error":   "upload_expired",
+			"message": "Upload has expired",
+		})
+	}
+
+	// Correct the offset from the data on disk unless a chunk is being
+	// written, in which case the recorded offset is the last confirmed one
+	release, err := h.locks.acquire(uploadID)
+	if err == nil {
+		upload, err = h.reconcileOffset(c, uploadID)
+		release()
+		if err != nil {
+			logging.Error("Failed to reconcile upload offset", zap.Error(err), zap.String("upload_id", uploadID))
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":   "get_failed",
+				"message": "Failed to get upload",
+			})
+		}
+	} else if !errors.Is(err, errUploadLocked) {
+		logging.Warn("Failed to lock upload", zap.Error(err), zap.String("upload_id", uploadID))
+	}
+
 	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Cache-Control", "no-store")
 	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
 	if upload.FileSize.Valid {
 		c.Set("Upload-Length", strconv.FormatInt(upload.FileSize.Int64, 10))
+	} else {
+		c.Set("Upload-Defer-Length", "1")
+	}
+	if upload.Metadata.String != "" {
+		c.Set("Upload-Metadata", upload.Metadata.String)
+	}
+	if upload.Concat.Valid {
+		c.Set("Upload-Concat", upload.Concat.String)
+	}
+	if upload.Status == database.UploadStatusUploading {
+		c.Set("Upload-Expires", h.expiresAt(upload.UpdatedAt).UTC().Format(http.TimeFormat))
 	}
 
 	return c.SendStatus(fiber.StatusOK)
@@ -213,6 +600,51 @@ func (h *TusHandler) Patch(c *fiber.Ctx) error {
 		})
 	}
 
+	if h.expired(upload) {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error":   "upload_expired",
+			"message": "Upload has expired",
+		})
+	}
+
+	// Final uploads are assembled from partial uploads
+	if strings.HasPrefix(upload.Concat.String, concatFinal) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error":   "final_upload",
+			"message": "Concatenated uploads cannot be patched",
+		})
+	}
+
+	// Only one request may write to an upload at a time
+	release, err := h.locks.acquire(uploadID)
+	if err != nil {
+		if errors.Is(err, errUploadLocked) {
+			return uploadLockedResponse(c)
+		}
+		logging.Error("Failed to lock upload", zap.Error(err), zap.String("upload_id", uploadID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "lock_failed",
+			"message": "Failed to lock upload",
+		})
+	}
+	defer release()
+
+	// Re-read the upload now that no other request can change it
+	upload, err = h.reconcileOffset(c, uploadID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   "not_found",
+				"message": "Upload not found",
+			})
+		}
+		logging.Error("Failed to reconcile upload offset", zap.Error(err), zap.String("upload_id", uploadID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "get_failed",
+			"message": "Failed to get upload",
+		})
+	}
+
 	// Verify offset
 	clientOffset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
 	if err != nil {
@@ -232,61 +664,275 @@ func (h *TusHandler) Patch(c *fiber.Ctx) error {
 
 	// Verify content type
 	contentType := c.Get("Content-Type")
-	if contentType != "application/offset+octet-stream" {
+	if contentType != tusContentType {
 		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
 			"error":   "invalid_content_type",
 			"message": "Content-Type must be application/offset+octet-stream",
 		})
 	}
 
+	// A deferred length is set once, by any PATCH request
+	if lengthHeader := c.Get("Upload-Length"); lengthHeader != "" {
+		uploadLength, err := strconv.ParseInt(lengthHeader, 10, 64)
+		if err != nil || uploadLength <= 0 || uploadLength < upload.Offset {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid_length",
+				"message": "Invalid Upload-Length header",
+			})
+		}
+		if upload.FileSize.Valid && upload.FileSize.Int64 != uploadLength {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "length_already_set",
+				"message": "Upload-Length cannot be changed once set",
+			})
+		}
+		if uploadLength > h.cfg.MaxUploadSize {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+				"error":   "file_too_large",
+				"message": fmt.Sprintf("File exceeds maximum size of %d bytes", h.cfg.MaxUploadSize),
+			})
+		}
+
+		if !upload.FileSize.Valid {
+			if apiErr := h.checkOwnerQuota(upload, uploadLength); apiErr != nil {
+				return apiErr.send(c)
+			}
+			if err := h.uploadRepo.SetLength(uploadID, uploadLength); err != nil {
+				logging.Error("Failed to set upload length", zap.Error(err))
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error":   "update_failed",
+					"message": "Failed to set upload length",
+				})
+			}
+			upload.FileSize = sql.NullInt64{Int64: uploadLength, Valid: true}
+		}
+	}
+
+	newOffset, apiErr := h.writeChunk(c, upload)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+	upload.Offset = newOffset
+
+	// Check if upload is complete
+	if err := h.completeIfDone(c, upload); err != nil {
+		logging.Error("Failed to start processing upload", zap.Error(err), zap.String("upload_id", uploadID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "update_failed",
+			"message": "Failed to start processing upload",
+		})
+	}
+
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	c.Set("Upload-Expires", h.expiresAt(time.Now()).UTC().Format(http.TimeFormat))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// apiError is a failed request and the response describing why
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) send(c *fiber.Ctx) error {
+	return c.Status(e.status).JSON(fiber.Map{
+		"error":   e.code,
+		"message": e.message,
+	})
+}
+
+// writeChunk appends the request body to the upload's temp file and records
+// the new offset. A chunk failing its Upload-Checksum is discarded.
+func (h *TusHandler) writeChunk(c *fiber.Ctx, upload *database.Upload) (int64, *apiError) {
+	checksum, expected, err := parseUploadChecksum(c.Get("Upload-Checksum"))
+	if err != nil {
+		return 0, &apiError{fiber.StatusBadRequest, "invalid_checksum", "Invalid Upload-Checksum header: " + err.Error()}
+	}
+
+	h.collector.IncrementActiveUploads()
+	defer h.collector.DecrementActiveUploads()
+
 	// Open temp file for appending
-	tempPath := h.getTempPath(uploadID)
+	tempPath := h.getTempPath(upload.ID)
 	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
+		h.collector.IncrementUploadErrors()
 		logging.Error("Failed to open temp file", zap.Error(err))
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "temp_file_failed",
-			"message": "Failed to open temporary file",
-		})
+		return 0, &apiError{fiber.StatusInternalServerError, "temp_file_failed", "Failed to open temporary file"}
 	}
 	defer file.Close()
 
-	// Write chunk to file
-	body := c.Body()
-	bytesWritten, err := file.Write(body)
+	// Stream chunk to file, never accepting more than the declared length.
+	// Without a length yet, allow one byte past the maximum to detect overflow.
+	body := requestBody(c)
+	if upload.FileSize.Valid {
+		body = io.LimitReader(body, upload.FileSize.Int64-upload.Offset)
+	} else {
+		body = io.LimitReader(body, h.cfg.MaxUploadSize-upload.Offset+1)
+	}
+	var dst io.Writer = file
+	if checksum != nil {
+		dst = io.MultiWriter(file, checksum)
+	}
+	bytesWritten, err := io.Copy(dst, body)
+	h.collector.AddBytesUploaded(bytesWritten)
+	middleware.RecordUploadBytes(c, bytesWritten)
 	if err != nil {
+		h.collector.IncrementUploadErrors()
 		logging.Error("Failed to write chunk", zap.Error(err))
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "write_failed",
-			"message": "Failed to write chunk",
-		})
+		// Keep what arrived so the client can resume from there, unless it
+		// can't be verified against the chunk's checksum
+		if checksum != nil {
+			file.Truncate(upload.Offset)
+		} else if bytesWritten > 0 {
+			if err := h.uploadRepo.UpdateOffset(upload.ID, upload.Offset+bytesWritten); err != nil {
+				logging.Error("Failed to update offset", zap.Error(err))
+			}
+		}
+		return 0, &apiError{fiber.StatusInternalServerError, "write_failed", "Failed to write chunk"}
+	}
+
+	newOffset := upload.Offset + bytesWritten
+	if !upload.FileSize.Valid && newOffset > h.cfg.MaxUploadSize {
+		file.Truncate(upload.Offset)
+		return 0, &apiError{fiber.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("File exceeds maximum size of %d bytes", h.cfg.MaxUploadSize)}
+	}
+
+	if checksum != nil && !bytes.Equal(checksum.Sum(nil), expected) {
+		file.Truncate(upload.Offset)
+		return 0, &apiError{statusChecksumMismatch, "checksum_mismatch", "Chunk does not match Upload-Checksum"}
 	}
 
 	// Update offset
-	newOffset := upload.Offset + int64(bytesWritten)
-	if err := h.uploadRepo.UpdateOffset(uploadID, newOffset); err != nil {
+	if err := h.uploadRepo.UpdateOffset(upload.ID, newOffset); err != nil {
+		h.collector.IncrementUploadErrors()
 		logging.Error("Failed to update offset", zap.Error(err))
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "update_failed",
-			"message": "Failed to update upload offset",
-		})
+		return 0, &apiError{fiber.StatusInternalServerError, "update_failed", "Failed to update upload offset"}
 	}
 
 	logging.Debug("Chunk uploaded",
-		zap.String("upload_id", uploadID),
-		zap.Int("bytes", bytesWritten),
+		zap.String("upload_id", upload.ID),
+		zap.Int64("bytes", bytesWritten),
 		zap.Int64("new_offset", newOffset),
 	)
 
-	// Check if upload is complete
-	if upload.FileSize.Valid && newOffset >= upload.FileSize.Int64 {
-		// Upload complete - process the file
-		go h.processCompletedUpload(uploadID, upload)
+	return newOffset, nil
+}
+
+// reconcileOffset re-reads an upload and corrects its offset to match the data
+// in its temp file, which differs when the server stopped between writing a
+// chunk and recording it. The caller must hold the upload's lock.
+func (h *TusHandler) reconcileOffset(c *fiber.Ctx, uploadID string) (*database.Upload, error) {
+	upload, err := h.uploadRepo.GetByID(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Status != database.UploadStatusUploading || strings.HasPrefix(upload.Concat.String, concatFinal) {
+		return upload, nil
+	}
+
+	tempPath := h.getTempPath(uploadID)
+	var size int64
+	info, err := os.Stat(tempPath)
+	switch {
+	case os.IsNotExist(err):
+		// The data is gone, so the upload starts over
+		file, err := os.Create(tempPath)
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+	case err != nil:
+		return nil, err
+	default:
+		size = info.Size()
+	}
+
+	if size == upload.Offset {
+		return upload, nil
+	}
+
+	offset := size
+	if upload.FileSize.Valid && offset > upload.FileSize.Int64 {
+		offset = upload.FileSize.Int64
+		if err := os.Truncate(tempPath, offset); err != nil {
+			return nil, err
+		}
+	}
+	if err := h.uploadRepo.UpdateOffset(uploadID, offset); err != nil {
+		return nil, err
 	}
 
+	logging.Warn("Reconciled upload offset with its data",
+		zap.String("upload_id", uploadID),
+		zap.Int64("recorded_offset", upload.Offset),
+		zap.Int64("offset", offset),
+	)
+	upload.Offset = offset
+
+	if err := h.completeIfDone(c, upload); err != nil {
+		logging.Error("Failed to start processing upload", zap.Error(err), zap.String("upload_id", uploadID))
+	}
+
+	return upload, nil
+}
+
+// uploadLockedResponse tells the client another request is writing to the
+// upload; tus clients retry after a delay
+func uploadLockedResponse(c *fiber.Ctx) error {
 	c.Set("Tus-Resumable", tusVersion)
-	c.Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
-	return c.SendStatus(fiber.StatusNoContent)
+	c.Set(fiber.HeaderRetryAfter, "1")
+	return c.Status(fiber.StatusLocked).JSON(fiber.Map{
+		"error":   "upload_locked",
+		"message": "Upload is being written by another request",
+	})
+}
+
+// checkOwnerQuota checks that the owner of an upload may store size more bytes
+func (h *TusHandler) checkOwnerQuota(upload *database.Upload, size int64) *apiError {
+	if !upload.OwnerID.Valid {
+		return nil
+	}
+
+	user, err := h.userRepo.GetByID(upload.OwnerID.String)
+	if err == sql.ErrNoRows {
+		// The account was deleted mid-upload; nothing left to enforce
+		return nil
+	}
+	if err != nil {
+		logging.Error("Failed to get upload owner", zap.Error(err), zap.String("upload_id", upload.ID))
+		return &apiError{fiber.StatusInternalServerError, "quota_check_failed", "Failed to check quota"}
+	}
+	return checkQuota(h.cfg, h.userRepo, user, size)
+}
+
+// completeIfDone starts processing an upload once all its data has arrived.
+// Partial uploads are only processed as part of a final upload. The response
+// to the request completing the upload carries the management token for the
+// file, which is only stored hashed.
+func (h *TusHandler) completeIfDone(c *fiber.Ctx, upload *database.Upload) error {
+	if !upload.FileSize.Valid || upload.Offset < upload.FileSize.Int64 || upload.Concat.String == concatPartial {
+		return nil
+	}
+
+	token, err := utils.GenerateManagementToken()
+	if err != nil {
+		return err
+	}
+	hash := utils.HashToken(token)
+	issued, err := h.uploadRepo.SetManagementTokenHash(upload.ID, hash)
+	if err != nil {
+		return err
+	}
+	if issued {
+		upload.ManagementTokenHash = sql.NullString{String: hash, Valid: true}
+		c.Set(middleware.ManagementTokenHeader, token)
+	}
+
+	_, err = h.startProcessing(upload.ID, upload)
+	return err
 }
 
 // Delete handles DELETE requests to cancel an upload
@@ -300,7 +946,7 @@ func (h *TusHandler) Delete(c *fiber.Ctx) error {
 	}
 
 	// Check if upload exists
-	_, err := h.uploadRepo.GetByID(uploadID)
+	upload, err := h.uploadRepo.GetByID(uploadID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
@@ -315,6 +961,28 @@ func (h *TusHandler) Delete(c *fiber.Ctx) error {
 		})
 	}
 
+	// The data is still being read while the upload is processed
+	if upload.Status == database.UploadStatusProcessing {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":   "upload_processing",
+			"message": "Upload is being processed and cannot be cancelled",
+		})
+	}
+
+	// Don't remove data a chunk is being written to
+	release, err := h.locks.acquire(uploadID)
+	if err != nil {
+		if errors.Is(err, errUploadLocked) {
+			return uploadLockedResponse(c)
+		}
+		logging.Error("Failed to lock upload", zap.Error(err), zap.String("upload_id", uploadID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "lock_failed",
+			"message": "Failed to lock upload",
+		})
+	}
+	defer release()
+
 	// Delete temp file
 	tempPath := h.getTempPath(uploadID)
 	os.Remove(tempPath)
@@ -334,130 +1002,335 @@ func (h *TusHandler) Delete(c *fiber.Ctx) error {
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
-// processCompletedUpload handles the completed upload asynchronously
-func (h *TusHandler) processCompletedUpload(uploadID string, upload *database.Upload) {
-	logging.Info("Processing completed upload", zap.String("upload_id", uploadID))
+// Result reports whether a completed upload has been stored and returns the
+// resulting file once it has
+func (h *TusHandler) Result(c *fiber.Ctx) error {
+	uploadID := c.Params("id")
+	if uploadID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "missing_id",
+			"message": "Upload ID is required",
+		})
+	}
 
-	tempPath := h.getTempPath(uploadID)
-	defer func() {
-		// Clean up temp file and upload record
-		os.Remove(tempPath)
-		h.uploadRepo.Delete(uploadID)
-	}()
+	upload, err := h.uploadRepo.GetByID(uploadID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   "not_found",
+				"message": "Upload not found",
+			})
+		}
+		logging.Error("Failed to get upload", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "get_failed",
+			"message": "Failed to get upload",
+		})
+	}
 
-	// Check WhatsApp connection
-	if !h.waClient.IsConnected() {
-		logging.Error("WhatsApp not connected, cannot process upload", zap.String("upload_id", uploadID))
-		return
+	resp, err := h.toUploadResultResponse(upload)
+	if err != nil {
+		logging.Error("Failed to get uploaded file", zap.Error(err), zap.String("upload_id", uploadID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "get_failed",
+			"message": "Failed to get uploaded file",
+		})
+	}
+
+	if upload.Status == database.UploadStatusProcessing {
+		c.Set(fiber.HeaderRetryAfter, "2")
+		return c.Status(fiber.StatusAccepted).JSON(resp)
+	}
+	return c.JSON(resp)
+}
+
+// Retry processes a failed upload again from its retained data
+func (h *TusHandler) Retry(c *fiber.Ctx) error {
+	uploadID := c.Params("id")
+	if uploadID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "missing_id",
+			"message": "Upload ID is required",
+		})
 	}
 
-	// Read file
-	fileData, err := os.ReadFile(tempPath)
+	upload, err := h.uploadRepo.GetByID(uploadID)
 	if err != nil {
-		logging.Error("Failed to read temp file", zap.Error(err), zap.String("upload_id", uploadID))
-		return
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   "not_found",
+				"message": "Upload not found",
+			})
+		}
+		logging.Error("Failed to get upload", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "get_failed",
+			"message": "Failed to get upload",
+		})
 	}
 
-	// Calculate hash for tracking purposes
-	fileHash := utils.HashFile(fileData)
+	if upload.Status != database.UploadStatusFailed {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":   "not_failed",
+			"message": "Only failed uploads can be retried",
+		})
+	}
 
-	// Parse metadata
-	metadata := parseUploadMetadata(upload.Metadata.String)
-	filename := utils.SanitizeFilename(metadata["filename"])
-	if filename == "" {
-		filename = "unnamed_file"
+	if _, err := os.Stat(h.getTempPath(uploadID)); err != nil {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error":   "data_missing",
+			"message": "Upload data is no longer available",
+		})
+	}
+
+	started, err := h.startProcessing(uploadID, upload)
+	if err != nil {
+		logging.Error("Failed to start processing upload", zap.Error(err), zap.String("upload_id", uploadID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "update_failed",
+			"message": "Failed to start processing upload",
+		})
+	}
+	if !started {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":   "not_failed",
+			"message": "Only failed uploads can be retried",
+		})
 	}
-	description := metadata["description"]
-	password := metadata["password"]
 
-	// Calculate expiry
-	expiryDays := h.cfg.DefaultExpiryDays
-	if expStr := metadata["expires_in"]; expStr != "" {
-		if seconds, err := strconv.ParseInt(expStr, 10, 64); err == nil && seconds > 0 {
-			days := int(seconds / 86400)
-			if days > 0 && days <= h.cfg.MaxExpiryDays {
-				expiryDays = days
+	logging.Info("Retrying upload", zap.String("upload_id", uploadID))
+
+	upload.Status = database.UploadStatusProcessing
+	upload.Error = sql.NullString{}
+	resp, _ := h.toUploadResultResponse(upload)
+	return c.Status(fiber.StatusAccepted).JSON(resp)
+}
+
+// UploadResultResponse reports the processing state of a chunked upload
+type UploadResultResponse struct {
+	ID            string        `json:"id"`
+	Status        string        `json:"status"`
+	Offset        int64         `json:"offset"`
+	Length        *int64        `json:"length,omitempty"`
+	FailureReason string        `json:"failure_reason,omitempty"`
+	File          *FileResponse `json:"file,omitempty"`
+
+	// SlugTaken reports that the chosen slug was taken before the upload was
+	// stored, so the file got a generated ID instead
+	SlugTaken bool `json:"slug_taken,omitempty"`
+}
+
+// toUploadResultResponse converts an upload to a result response, including
+// the created file if it still exists
+func (h *TusHandler) toUploadResultResponse(u *database.Upload) (UploadResultResponse, error) {
+	resp := UploadResultResponse{
+		ID:     u.ID,
+		Status: u.Status,
+		Offset: u.Offset,
+	}
+
+	if u.FileSize.Valid {
+		resp.Length = &u.FileSize.Int64
+	}
+	if u.Status == database.UploadStatusFailed {
+		resp.FailureReason = u.Error.String
+	}
+
+	if u.Status == database.UploadStatusSucceeded && u.FileID.Valid {
+		file, err := h.fileRepo.GetByID(u.FileID.String)
+		if err != nil && err != sql.ErrNoRows {
+			return resp, err
+		}
+		if file != nil {
+			fileResp := toFileResponse(file, u.Duplicate)
+			resp.File = &fileResp
+			if slug := parseUploadMetadata(u.Metadata.String)["slug"]; slug != "" && slug != file.ID {
+				resp.SlugTaken = true
 			}
 		}
 	}
-	expiresAt := time.Now().Add(time.Duration(expiryDays) * 24 * time.Hour)
 
-	// Parse max downloads
-	var maxDownloads sql.NullInt64
-	if maxStr := metadata["max_downloads"]; maxStr != "" {
-		if val, err := strconv.ParseInt(maxStr, 10, 64); err == nil && val > 0 {
-			maxDownloads = sql.NullInt64{Int64: val, Valid: true}
-		}
+	return resp, nil
+}
+
+// startProcessing hands a fully received upload to processCompletedUpload.
+// It returns false if the upload is already being processed or has succeeded.
+func (h *TusHandler) startProcessing(uploadID string, upload *database.Upload) (bool, error) {
+	started, err := h.uploadRepo.StartProcessing(uploadID)
+	if err != nil || !started {
+		return false, err
 	}
+	// Counted before the goroutine starts so shutdown waits for it
+	h.collector.IncrementActiveUploads()
+	go h.processCompletedUpload(uploadID, upload)
+	return true, nil
+}
 
-	// Hash password if provided
-	var passwordHash sql.NullString
-	if password != "" {
-		hash, err := utils.HashPassword(password)
-		if err != nil {
-			logging.Error("Failed to hash password", zap.Error(err))
-		} else {
-			passwordHash = sql.NullString{String: hash, Valid: true}
+// processCompletedUpload stores a completed upload and records the result.
+// The temp file is only removed once the file exists, so failed uploads can
+// be retried.
+func (h *TusHandler) processCompletedUpload(uploadID string, upload *database.Upload) {
+	defer h.collector.DecrementActiveUploads()
+
+	logging.Info("Processing completed upload", zap.String("upload_id", uploadID))
+
+	dbFile, duplicate, err := h.storeUpload(uploadID, upload)
+	if err != nil {
+		h.collector.IncrementUploadErrors()
+		logging.Error("Failed to process upload", zap.Error(err), zap.String("upload_id", uploadID))
+		if err := h.uploadRepo.MarkFailed(uploadID, err.Error()); err != nil {
+			logging.Error("Failed to record upload failure", zap.Error(err), zap.String("upload_id", uploadID))
 		}
+		return
 	}
 
-	// Detect MIME type
-	mimeType := http.DetectContentType(fileData)
-	if mimeType == "application/octet-stream" {
-		mimeType = "application/octet-stream"
+	h.collector.IncrementUploads()
+	webhooks.Get().Emit(webhooks.EventFileUploaded, webhooks.NewFile(dbFile))
+	broadcast.Get().Publish(broadcast.EventUpload, toFileResponse(dbFile, duplicate))
+
+	if err := h.uploadRepo.MarkSucceeded(uploadID, dbFile.ID, duplicate); err != nil {
+		logging.Error("Failed to record upload result", zap.Error(err), zap.String("upload_id", uploadID))
 	}
+	os.Remove(h.getTempPath(uploadID))
 
-	// Get correct media type for WhatsApp
-	mediaType := utils.GetMediaType(mimeType)
+	logging.Info("Chunked upload completed successfully",
+		zap.String("upload_id", uploadID),
+		zap.String("file_id", dbFile.ID),
+		zap.String("filename", dbFile.Filename),
+		zap.Int64("size", dbFile.FileSize),
+		zap.Bool("duplicate", duplicate),
+	)
+}
 
-	// Upload to WhatsApp
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-	defer cancel()
+// storeUpload stores the data of a completed upload and creates its file record
+func (h *TusHandler) storeUpload(uploadID string, upload *database.Upload) (*database.File, bool, error) {
+	tempPath := h.getTempPath(uploadID)
 
-	uploadResp, err := h.waClient.Upload(ctx, fileData, mediaType)
+	// Pick where the file will be stored
+	backend, err := h.storage.ForUpload()
 	if err != nil {
-		logging.Error("Failed to upload to WhatsApp", zap.Error(err), zap.String("upload_id", uploadID))
-		return
+		return nil, false, err
 	}
 
-	// Generate file ID
-	fileID, err := utils.GenerateShortID(h.cfg.ShortIDLength)
+	// Open file
+	file, err := os.Open(tempPath)
 	if err != nil {
-		logging.Error("Failed to generate file ID", zap.Error(err))
-		return
+		return nil, false, fmt.Errorf("failed to open upload data: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read upload data: %w", err)
+	}
+	fileSize := info.Size()
+
+	// Hash the file first so identical content can be deduplicated
+	fileHash, err := utils.HashReader(file)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read upload data: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, false, fmt.Errorf("failed to read upload data: %w", err)
+	}
+
+	// Parse metadata
+	metadata := parseUploadMetadata(upload.Metadata.String)
+	filename := utils.SanitizeFilename(metadata["filename"])
+	if filename == "" {
+		filename = "unnamed_file"
+	}
+	opts, apiErr := parseUploadOptions(h.cfg, func(key string) string { return metadata[key] })
+	if apiErr != nil {
+		return nil, false, errors.New(apiErr.message)
+	}
+
+	// Detect MIME type from the start of the file
+	mimeType, fileReader, err := utils.DetectContentType(file)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read upload data: %w", err)
+	}
+
+	// Reuse content already in storage for identical uploads
+	existing := findReusableMedia(h.fileRepo, h.cfg, fileHash, opts.expiresAt)
+
+	var obj *storage.Object
+	backendName := backend.Name()
+	mediaUploadedAt := time.Now()
+	if existing != nil {
+		// The media keys depend on the media type, so keep the original MIME type
+		mimeType = existing.MimeType
+		obj = objectFromFile(existing)
+		backendName = existing.Backend
+		mediaUploadedAt = existing.MediaUploadedAt
+	} else {
+		// Upload to storage
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+
+		obj, err = backend.Put(ctx, fileReader, fileSize, mimeType)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to upload to %s storage: %w", backendName, err)
+		}
 	}
 
 	// Create file record
+	now := time.Now()
 	dbFile := &database.File{
-		ID:            fileID,
 		Filename:      filename,
 		MimeType:      mimeType,
-		FileSize:      int64(len(fileData)),
+		FileSize:      fileSize,
 		FileHash:      fileHash,
-		Description:   sql.NullString{String: description, Valid: description != ""},
-		DirectPath:    uploadResp.DirectPath,
-		MediaKey:      uploadResp.MediaKey,
-		FileEncHash:   uploadResp.FileEncHash,
-		FileSHA256:    uploadResp.FileSHA256,
-		PasswordHash:  passwordHash,
-		MaxDownloads:  maxDownloads,
+		Description:   opts.description,
+		DirectPath:    obj.Key,
+		MediaKey:      obj.MediaKey,
+		FileEncHash:   obj.FileEncHash,
+		FileSHA256:    obj.FileSHA256,
+		PasswordHash:  opts.passwordHash,
+		MaxDownloads:  opts.maxDownloads,
 		DownloadCount: 0,
-		CreatedAt:     time.Now(),
-		ExpiresAt:     expiresAt,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		ExpiresAt:     opts.expiresAt,
 		Status:        "active",
+		Backend:       backendName,
+		Account:       sql.NullString{String: obj.Account, Valid: obj.Account != ""},
+		OwnerID:       upload.OwnerID,
+
+		ManagementTokenHash: upload.ManagementTokenHash,
+
+		MediaUploadedAt: mediaUploadedAt,
 	}
 
-	if err := h.fileRepo.Create(dbFile); err != nil {
-		logging.Error("Failed to save file record", zap.Error(err), zap.String("upload_id", uploadID))
-		return
+	create := func(id string) error {
+		dbFile.ID = id
+		return h.fileRepo.Create(dbFile)
+	}
+	err = createWithID(h.cfg, opts.slug, create)
+	if opts.slug != "" && errors.Is(err, database.ErrDuplicateID) {
+		// The slug was free when the upload was created but has been taken
+		// since. Failing would leave the upload stuck, so the file gets a
+		// generated ID and the result reports slug_taken.
+		logging.Warn("Slug taken before upload was stored, using a generated ID",
+			zap.String("upload_id", uploadID), zap.String("slug", opts.slug))
+		err = createWithID(h.cfg, "", create)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to save file record: %w", err)
 	}
 
-	logging.Info("Chunked upload completed successfully",
-		zap.String("upload_id", uploadID),
-		zap.String("file_id", fileID),
-		zap.String("filename", filename),
-		zap.Int("size", len(fileData)),
-	)
+	return dbFile, existing != nil, nil
+}
+
+// expiresAt returns when an upload last active at lastActive is removed
+func (h *TusHandler) expiresAt(lastActive time.Time) time.Time {
+	return lastActive.Add(h.cfg.IncompleteUploadTTL)
+}
+
+// expired reports whether an unfinished upload has outlived its expiry and is
+// only waiting for the cleanup job
+func (h *TusHandler) expired(upload *database.Upload) bool {
+	return upload.Status == database.UploadStatusUploading && time.Now().After(h.expiresAt(upload.UpdatedAt))
 }
 
 // getTempPath returns the temp file path for an upload
@@ -465,6 +1338,15 @@ func (h *TusHandler) getTempPath(uploadID string) string {
 	return filepath.Join(h.cfg.TempDir, uploadID+".tmp")
 }
 
+// requestBody returns the request body as a reader, streaming it when fasthttp
+// has not buffered it in memory
+func requestBody(c *fiber.Ctx) io.Reader {
+	if stream := c.Context().RequestBodyStream(); stream != nil {
+		return stream
+	}
+	return bytes.NewReader(c.Body())
+}
+
 // parseUploadMetadata parses the Upload-Metadata header
 func parseUploadMetadata(header string) map[string]string {
 	metadata := make(map[string]string)
@@ -491,3 +1373,45 @@ func parseUploadMetadata(header string) map[string]string {
 
 	return metadata
 }
+
+// parseUploadChecksum parses the Upload-Checksum header into a hash of the
+// named algorithm and the expected digest. It returns a nil hash if the
+// header is absent.
+func parseUploadChecksum(header string) (hash.Hash, []byte, error) {
+	if header == "" {
+		return nil, nil, nil
+	}
+
+	algorithm, encoded, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		return nil, nil, fmt.Errorf("expected an algorithm and a base64 digest")
+	}
+
+	var checksum hash.Hash
+	switch algorithm {
+	case "md5":
+		checksum = md5.New()
+	case "sha1":
+		checksum = sha1.New()
+	case "sha256":
+		checksum = sha256.New()
+	default:
+		return nil, nil, fmt.Errorf("unsupported algorithm %q, supported: %s", algorithm, tusChecksumAlgorithms)
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(expected) != checksum.Size() {
+		return nil, nil, fmt.Errorf("invalid %s digest", algorithm)
+	}
+
+	return checksum, expected, nil
+}
+
+// uploadIDFromURL returns the upload ID at the end of an upload URL, which may
+// be absolute or a path
+func uploadIDFromURL(uploadURL string) string {
+	if u, err := url.Parse(uploadURL); err == nil {
+		uploadURL = u.Path
+	}
+	return path.Base(strings.TrimSuffix(uploadURL, "/"))
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/utils"
+	"go.uber.org/zap"
+)
+
+// uploadLeaseTTL is how long an upload's database lease lasts without renewal.
+// A lease left behind by a crashed server blocks the upload for at most this long.
+const uploadLeaseTTL = time.Minute
+
+// errUploadLocked is returned when another request is writing to the upload
+var errUploadLocked = errors.New("upload is locked")
+
+// uploadLocks gives one request at a time exclusive access to an upload's
+// data. Requests to this server are serialised in memory; the lease stored
+// with the upload also covers other servers sharing the database.
+type uploadLocks struct {
+	repo *database.UploadRepository
+
+	mu   sync.Mutex
+	held map[string]struct{}
+}
+
+func newUploadLocks(repo *database.UploadRepository) *uploadLocks {
+	return &uploadLocks{
+		repo: repo,
+		held: make(map[string]struct{}),
+	}
+}
+
+// acquire locks an upload without waiting and returns the function releasing
+// it. It fails with errUploadLocked if the upload is already locked.
+func (l *uploadLocks) acquire(id string) (func(), error) {
+	l.mu.Lock()
+	if _, ok := l.held[id]; ok {
+		l.mu.Unlock()
+		return nil, errUploadLocked
+	}
+	l.held[id] = struct{}{}
+	l.mu.Unlock()
+
+	unlock := func() {
+		l.mu.Lock()
+		delete(l.held, id)
+		l.mu.Unlock()
+	}
+
+	owner, err := utils.GenerateShortID(16)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	acquired, err := l.repo.AcquireLease(id, owner, time.Now().Add(uploadLeaseTTL))
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	if !acquired {
+		unlock()
+		return nil, errUploadLocked
+	}
+
+	// Keep the lease while a long chunk is streamed
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(uploadLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := l.repo.RenewLease(id, owner, time.Now().Add(uploadLeaseTTL)); err != nil {
+					logging.Warn("Failed to renew upload lease", zap.Error(err), zap.String("upload_id", id))
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			if err := l.repo.ReleaseLease(id, owner); err != nil {
+				logging.Warn("Failed to release upload lease", zap.Error(err), zap.String("upload_id", id))
+			}
+			unlock()
+		})
+	}, nil
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"mime"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/storage"
+	"github.com/salman0ansari/whatsbox/internal/utils"
+	"github.com/salman0ansari/whatsbox/internal/whatsapp"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxFilenameLength is the longest filename most filesystems accept
+	maxFilenameLength = 255
+
+	// maxDescriptionLength caps file and collection descriptions
+	maxDescriptionLength = 1000
+)
+
+// uploadOptions are the optional settings an uploader can give a file or collection
+type uploadOptions struct {
+	description  sql.NullString
+	passwordHash sql.NullString
+	maxDownloads sql.NullInt64
+	expiresAt    time.Time
+
+	// slug is the ID chosen by the uploader, if any
+	slug string
+
+	password string
+}
+
+// parseUploadOptions reads the description, password, max_downloads,
+// expires_in and slug settings using get, which looks up form fields or tus metadata,
+// and hashes the password
+func parseUploadOptions(cfg *config.Config, get func(key string) string) (uploadOptions, *apiError) {
+	opts, apiErr := validateUploadOptions(cfg, get)
+	if apiErr != nil {
+		return opts, apiErr
+	}
+
+	// Hash password if provided
+	if opts.password != "" {
+		hash, err := utils.HashPassword(opts.password)
+		if err != nil {
+			logging.Error("Failed to hash password", zap.Error(err))
+			return opts, &apiError{fiber.StatusInternalServerError, "password_hash_failed", "Failed to process password"}
+		}
+		opts.passwordHash = sql.NullString{String: hash, Valid: true}
+	}
+
+	return opts, nil
+}
+
+// validateUploadOptions is parseUploadOptions without hashing the password,
+// for rejecting bad settings before any data is received
+func validateUploadOptions(cfg *config.Config, get func(key string) string) (uploadOptions, *apiError) {
+	var opts uploadOptions
+
+	if description := get("description"); description != "" {
+		if apiErr := validateDescription(description); apiErr != nil {
+			return opts, apiErr
+		}
+		opts.description = sql.NullString{String: description, Valid: true}
+	}
+
+	if maxStr := get("max_downloads"); maxStr != "" {
+		val, err := strconv.ParseInt(maxStr, 10, 64)
+		if err != nil {
+			return opts, &apiError{fiber.StatusBadRequest, "invalid_max_downloads", "max_downloads must be a whole number"}
+		}
+		if opts.maxDownloads, err = maxDownloadsValue(val); err != nil {
+			return opts, &apiError{fiber.StatusBadRequest, "invalid_max_downloads", err.Error()}
+		}
+	}
+
+	// Expiry is given in seconds from now
+	opts.expiresAt = time.Now().Add(time.Duration(cfg.DefaultExpiryDays) * 24 * time.Hour)
+	if expStr := get("expires_in"); expStr != "" {
+		seconds, err := strconv.ParseInt(expStr, 10, 64)
+		if err != nil || seconds < 0 {
+			return opts, &apiError{fiber.StatusBadRequest, "invalid_expires_in", "expires_in must be a number of seconds"}
+		}
+		if seconds > 0 {
+			seconds = min(seconds, int64(cfg.MaxExpiryDays)*86400)
+			opts.expiresAt = time.Now().Add(time.Duration(seconds) * time.Second)
+		}
+	}
+
+	if slug := get("slug"); slug != "" {
+		if !cfg.CustomSlugsEnabled {
+			return opts, &apiError{fiber.StatusForbidden, "slugs_disabled", "Custom slugs are disabled on this server"}
+		}
+		if err := utils.ValidateSlug(slug); err != nil {
+			return opts, &apiError{fiber.StatusBadRequest, "invalid_slug", err.Error()}
+		}
+		opts.slug = slug
+	}
+
+	opts.password = get("password")
+	return opts, nil
+}
+
+// validateFilename sanitizes a filename and checks its length
+func validateFilename(filename string) (string, *apiError) {
+	filename = utils.SanitizeFilename(filename)
+	if len(filename) > maxFilenameLength {
+		return "", &apiError{fiber.StatusBadRequest, "invalid_filename",
+			fmt.Sprintf("Filename must be at most %d bytes", maxFilenameLength)}
+	}
+	return filename, nil
+}
+
+// validateDescription checks a description's length
+func validateDescription(description string) *apiError {
+	if len(description) > maxDescriptionLength {
+		return &apiError{fiber.StatusBadRequest, "invalid_description",
+			fmt.Sprintf("Description must be at most %d bytes", maxDescriptionLength)}
+	}
+	return nil
+}
+
+// maxDownloadsValue converts a download limit to its stored form; 0 means no limit
+func maxDownloadsValue(val int64) (sql.NullInt64, error) {
+	if val < 0 {
+		return sql.NullInt64{}, fmt.Errorf("max_downloads must not be negative")
+	}
+	return sql.NullInt64{Int64: val, Valid: val > 0}, nil
+}
+
+// clampExpiry limits an expiry to MAX_EXPIRY_DAYS from now
+func clampExpiry(cfg *config.Config, expiresAt time.Time) time.Time {
+	latest := time.Now().Add(time.Duration(cfg.MaxExpiryDays) * 24 * time.Hour)
+	if expiresAt.After(latest) {
+		return latest
+	}
+	return expiresAt
+}
+
+// clampFileExpiry is clampExpiry for an existing file, whose WhatsApp media
+// lapses after its retention period unless the refresh job renews it
+func clampFileExpiry(cfg *config.Config, f *database.File, expiresAt time.Time) time.Time {
+	expiresAt = clampExpiry(cfg, expiresAt)
+	if f.Backend == storage.BackendWhatsApp && !cfg.MediaRefreshEnabled {
+		if lapses := f.MediaUploadedAt.Add(whatsapp.MediaRetention); expiresAt.After(lapses) {
+			return lapses
+		}
+	}
+	return expiresAt
+}
+
+// validateMimeType normalizes a MIME type. WhatsApp media is encrypted with
+// keys derived from its media type, so it can only change within that type.
+func validateMimeType(f *database.File, mimeType string) (string, *apiError) {
+	mediaType, params, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return "", &apiError{fiber.StatusBadRequest, "invalid_mime_type", "Invalid MIME type"}
+	}
+	mimeType = mime.FormatMediaType(mediaType, params)
+
+	if f.Backend == storage.BackendWhatsApp && !whatsapp.SameMediaType(f.MimeType, mimeType) {
+		return "", &apiError{fiber.StatusBadRequest, "invalid_mime_type",
+			"The MIME type of WhatsApp media can't change between image, video, audio and document types"}
+	}
+	return mimeType, nil
+}
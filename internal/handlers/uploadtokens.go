@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/utils"
+	"go.uber.org/zap"
+)
+
+// UploadTokenHandler handles upload token management endpoints
+type UploadTokenHandler struct {
+	tokenRepo *database.UploadTokenRepository
+	cfg       *config.Config
+}
+
+// NewUploadTokenHandler creates a new upload token handler
+func NewUploadTokenHandler(cfg *config.Config) *UploadTokenHandler {
+	return &UploadTokenHandler{
+		tokenRepo: database.NewUploadTokenRepository(),
+		cfg:       cfg,
+	}
+}
+
+// UploadTokenResponse represents an upload token in API responses. The token
+// itself is only included when it is created.
+type UploadTokenResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	MaxUses    *int64     `json:"max_uses,omitempty"`
+	Uses       int64      `json:"uses"`
+	Active     bool       `json:"active"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// List returns every upload token
+func (h *UploadTokenHandler) List(c *fiber.Ctx) error {
+	tokens, err := h.tokenRepo.List()
+	if err != nil {
+		logging.Error("Failed to list upload tokens", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "list_failed",
+			"message": "Failed to list upload tokens",
+		})
+	}
+
+	responses := make([]UploadTokenResponse, len(tokens))
+	for i, t := range tokens {
+		responses[i] = toUploadTokenResponse(t)
+	}
+
+	return c.JSON(fiber.Map{
+		"upload_tokens": responses,
+		"upload_policy": h.cfg.UploadPolicy,
+	})
+}
+
+// Create creates an upload token and returns it. The token cannot be retrieved again.
+func (h *UploadTokenHandler) Create(c *fiber.Ctx) error {
+	// max_uses defaults to a one-time token; 0 allows unlimited uses until expiry
+	var req struct {
+		Name          string `json:"name"`
+		MaxUses       *int64 `json:"max_uses"`
+		ExpiresInDays int    `json:"expires_in_days"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_request",
+			"message": "Invalid request body",
+		})
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_name",
+			"message": "Name is required and must be at most 100 characters",
+		})
+	}
+
+	maxUses := sql.NullInt64{Int64: 1, Valid: true}
+	if req.MaxUses != nil {
+		if *req.MaxUses < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid_max_uses",
+				"message": "max_uses must not be negative",
+			})
+		}
+		maxUses = sql.NullInt64{Int64: *req.MaxUses, Valid: *req.MaxUses > 0}
+	}
+
+	if req.ExpiresInDays < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_expiry",
+			"message": "expires_in_days must not be negative",
+		})
+	}
+	var expiresAt sql.NullTime
+	if req.ExpiresInDays > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour), Valid: true}
+	}
+
+	id, token, err := utils.GenerateUploadToken()
+	if err != nil {
+		logging.Error("Failed to generate upload token", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "token_generation_failed",
+			"message": "Failed to generate upload token",
+		})
+	}
+
+	uploadToken := &database.UploadToken{
+		ID:        id,
+		Name:      name,
+		TokenHash: utils.HashToken(token),
+		MaxUses:   maxUses,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+
+	if err := h.tokenRepo.Create(uploadToken); err != nil {
+		logging.Error("Failed to save upload token", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "create_failed",
+			"message": "Failed to create upload token",
+		})
+	}
+
+	logging.Info("Upload token created",
+		zap.String("token_id", id),
+		zap.String("name", name),
+		zap.Int64("max_uses", maxUses.Int64),
+	)
+
+	resp := toUploadTokenResponse(uploadToken)
+	resp.Token = token
+	return c.Status(fiber.StatusCreated).JSON(resp)
+}
+
+// Revoke revokes an upload token
+func (h *UploadTokenHandler) Revoke(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if id == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "missing_id",
+			"message": "Upload token ID is required",
+		})
+	}
+
+	revoked, err := h.tokenRepo.Revoke(id)
+	if err != nil {
+		logging.Error("Failed to revoke upload token", zap.Error(err), zap.String("token_id", id))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "revoke_failed",
+			"message": "Failed to revoke upload token",
+		})
+	}
+	if !revoked {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error":   "not_found",
+			"message": "Upload token not found or already revoked",
+		})
+	}
+
+	logging.Info("Upload token revoked", zap.String("token_id", id))
+
+	return c.JSON(fiber.Map{
+		"message": "Upload token revoked successfully",
+		"id":      id,
+	})
+}
+
+// toUploadTokenResponse converts a database upload token to an API response
+func toUploadTokenResponse(t *database.UploadToken) UploadTokenResponse {
+	resp := UploadTokenResponse{
+		ID:        t.ID,
+		Name:      t.Name,
+		Uses:      t.Uses,
+		Active:    t.Active(),
+		CreatedAt: t.CreatedAt,
+	}
+
+	if t.MaxUses.Valid {
+		resp.MaxUses = &t.MaxUses.Int64
+	}
+	if t.ExpiresAt.Valid {
+		resp.ExpiresAt = &t.ExpiresAt.Time
+	}
+	if t.LastUsedAt.Valid {
+		resp.LastUsedAt = &t.LastUsedAt.Time
+	}
+	if t.RevokedAt.Valid {
+		resp.RevokedAt = &t.RevokedAt.Time
+	}
+
+	return resp
+}
@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/middleware"
+	"github.com/salman0ansari/whatsbox/internal/ratelimit"
+	"github.com/salman0ansari/whatsbox/internal/utils"
+	"go.uber.org/zap"
+)
+
+// bandwidthWindow is the period over which uploaded bytes count towards a user's bandwidth quota
+const bandwidthWindow = 30 * 24 * time.Hour
+
+const minPasswordLength = 8
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+// UserHandler handles user accounts
+type UserHandler struct {
+	userRepo *database.UserRepository
+	cfg      *config.Config
+}
+
+// NewUserHandler creates a new user handler
+func NewUserHandler(cfg *config.Config) *UserHandler {
+	return &UserHandler{
+		userRepo: database.NewUserRepository(),
+		cfg:      cfg,
+	}
+}
+
+// UserResponse represents a user in API responses
+type UserResponse struct {
+	ID             string              `json:"id"`
+	Username       string              `json:"username"`
+	Role           string              `json:"role"`
+	Disabled       bool                `json:"disabled"`
+	CreatedAt      time.Time           `json:"created_at"`
+	LastLoginAt    *time.Time          `json:"last_login_at,omitempty"`
+	StorageQuota   int64               `json:"storage_quota"`
+	BandwidthQuota int64               `json:"bandwidth_quota"`
+	Usage          *database.UserUsage `json:"usage,omitempty"`
+}
+
+// Register creates a user account when registration is enabled and signs it in
+func (h *UserHandler) Register(c *fiber.Ctx) error {
+	if !h.cfg.RegistrationEnabled {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error":   "registration_disabled",
+			"message": "Registration is disabled. Ask an admin for an account.",
+		})
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_request",
+			"message": "Invalid request body",
+		})
+	}
+
+	user, apiErr := h.createUser(req.Username, req.Password, database.RoleUser)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	if err := middleware.IssueSession(c, h.cfg, user.ID); err != nil {
+		logging.Error("Failed to start session", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "token_generation_failed",
+			"message": "Failed to generate session token",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(h.toUserResponse(user, false))
+}
+
+// Login signs a user in
+func (h *UserHandler) Login(c *fiber.Ctx) error {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_request",
+			"message": "Invalid request body",
+		})
+	}
+
+	username := strings.TrimSpace(req.Username)
+
+	// Slow down password guessing
+	limiter := ratelimit.Get()
+	subject := middleware.PasswordSubject(c, "user:"+strings.ToLower(username))
+	if wait := limiter.Locked(ratelimit.ScopeLogin, subject); wait > 0 {
+		return middleware.RateLimited(c, wait, "too_many_attempts", "Too many failed login attempts. Try again later.")
+	}
+
+	user, err := h.userRepo.GetByUsername(username)
+	if err != nil && err != sql.ErrNoRows {
+		logging.Error("Failed to get user", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "login_failed",
+			"message": "Failed to sign in",
+		})
+	}
+	if user == nil || !utils.CheckPassword(req.Password, user.PasswordHash) {
+		if lockout := limiter.Fail(ratelimit.ScopeLogin, subject); lockout > 0 {
+			logging.Warn("User login locked out after failed attempts",
+				zap.String("username", username), zap.String("ip", c.IP()), zap.Duration("lockout", lockout))
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error":   "invalid_credentials",
+			"message": "Invalid username or password",
+		})
+	}
+	limiter.Succeed(ratelimit.ScopeLogin, subject)
+	if user.Disabled {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error":   "account_disabled",
+			"message": "This account has been disabled",
+		})
+	}
+
+	if err := middleware.IssueSession(c, h.cfg, user.ID); err != nil {
+		logging.Error("Failed to start session", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "token_generation_failed",
+			"message": "Failed to generate session token",
+		})
+	}
+
+	if err := h.userRepo.RecordLogin(user.ID); err != nil {
+		logging.Warn("Failed to record login", zap.Error(err), zap.String("user_id", user.ID))
+	}
+
+	return c.JSON(h.toUserResponse(user, false))
+}
+
+// Me returns the signed-in user with their usage and quotas
+func (h *UserHandler) Me(c *fiber.Ctx) error {
+	return c.JSON(h.toUserResponse(middleware.GetUser(c), true))
+}
+
+// List returns every user with their usage
+func (h *UserHandler) List(c *fiber.Ctx) error {
+	users, err := h.userRepo.List()
+	if err != nil {
+		logging.Error("Failed to list users", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "list_failed",
+			"message": "Failed to list users",
+		})
+	}
+
+	responses := make([]UserResponse, len(users))
+	for i, u := range users {
+		responses[i] = h.toUserResponse(u, true)
+	}
+
+	return c.JSON(fiber.Map{
+		"users":                responses,
+		"registration_enabled": h.cfg.RegistrationEnabled,
+	})
+}
+
+// Create creates a user account regardless of whether registration is enabled
+func (h *UserHandler) Create(c *fiber.Ctx) error {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_request",
+			"message": "Invalid request body",
+		})
+	}
+
+	role := req.Role
+	if role == "" {
+		role = database.RoleUser
+	}
+
+	user, apiErr := h.createUser(req.Username, req.Password, role)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(h.toUserResponse(user, false))
+}
+
+// Update changes a user's role, password, quotas or disabled flag
+func (h *UserHandler) Update(c *fiber.Ctx) error {
+	user, err := h.userRepo.GetByID(c.Params("id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   "not_found",
+				"message": "User not found",
+			})
+		}
+		logging.Error("Failed to get user", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "get_failed",
+			"message": "Failed to get user",
+		})
+	}
+
+	// Quotas are bytes; null restores the configured default
+	var req struct {
+		Role           *string `json:"role"`
+		Password       *string `json:"password"`
+		Disabled       *bool   `json:"disabled"`
+		StorageQuota   *int64  `json:"storage_quota"`
+		BandwidthQuota *int64  `json:"bandwidth_quota"`
+		ResetStorage   bool    `json:"reset_storage_quota"`
+		ResetBandwidth bool    `json:"reset_bandwidth_quota"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_request",
+			"message": "Invalid request body",
+		})
+	}
+
+	if req.Role != nil {
+		if *req.Role != database.RoleAdmin && *req.Role != database.RoleUser {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid_role",
+				"message": "Role must be admin or user",
+			})
+		}
+		user.Role = *req.Role
+	}
+	if req.Password != nil {
+		if len(*req.Password) < minPasswordLength {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid_password",
+				"message": fmt.Sprintf("Password must be at least %d characters", minPasswordLength),
+			})
+		}
+		hash, err := utils.HashPassword(*req.Password)
+		if err != nil {
+			logging.Error("Failed to hash password", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":   "password_hash_failed",
+				"message": "Failed to process password",
+			})
+		}
+		user.PasswordHash = hash
+	}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+	}
+	for _, q := range []struct {
+		value *int64
+		reset bool
+		field *sql.NullInt64
+	}{
+		{req.StorageQuota, req.ResetStorage, &user.StorageQuota},
+		{req.BandwidthQuota, req.ResetBandwidth, &user.BandwidthQuota},
+	} {
+		switch {
+		case q.reset:
+			*q.field = sql.NullInt64{}
+		case q.value != nil:
+			if *q.value < 0 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error":   "invalid_quota",
+					"message": "Quotas must not be negative",
+				})
+			}
+			*q.field = sql.NullInt64{Int64: *q.value, Valid: true}
+		}
+	}
+
+	if err := h.userRepo.Update(user); err != nil {
+		logging.Error("Failed to update user", zap.Error(err), zap.String("user_id", user.ID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "update_failed",
+			"message": "Failed to update user",
+		})
+	}
+
+	logging.Info("User updated", zap.String("user_id", user.ID), zap.String("username", user.Username))
+
+	return c.JSON(h.toUserResponse(user, true))
+}
+
+// Delete removes a user account. Their files remain until they expire.
+func (h *UserHandler) Delete(c *fiber.Ctx) error {
+	id := c.Params("id")
+	deleted, err := h.userRepo.Delete(id)
+	if err != nil {
+		logging.Error("Failed to delete user", zap.Error(err), zap.String("user_id", id))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "delete_failed",
+			"message": "Failed to delete user",
+		})
+	}
+	if !deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error":   "not_found",
+			"message": "User not found",
+		})
+	}
+
+	logging.Info("User deleted", zap.String("user_id", id))
+
+	return c.JSON(fiber.Map{
+		"message": "User deleted successfully",
+		"id":      id,
+	})
+}
+
+// createUser validates and stores a new user
+func (h *UserHandler) createUser(username, password, role string) (*database.User, *apiError) {
+	username = strings.TrimSpace(username)
+	if !usernamePattern.MatchString(username) {
+		return nil, &apiError{fiber.StatusBadRequest, "invalid_username", "Username must be 3-32 letters, digits, '.', '_' or '-'"}
+	}
+	if len(password) < minPasswordLength {
+		return nil, &apiError{fiber.StatusBadRequest, "invalid_password", fmt.Sprintf("Password must be at least %d characters", minPasswordLength)}
+	}
+	if role != database.RoleAdmin && role != database.RoleUser {
+		return nil, &apiError{fiber.StatusBadRequest, "invalid_role", "Role must be admin or user"}
+	}
+
+	if _, err := h.userRepo.GetByUsername(username); err == nil {
+		return nil, &apiError{fiber.StatusConflict, "username_taken", "Username is already taken"}
+	} else if err != sql.ErrNoRows {
+		logging.Error("Failed to get user", zap.Error(err))
+		return nil, &apiError{fiber.StatusInternalServerError, "create_failed", "Failed to create user"}
+	}
+
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		logging.Error("Failed to hash password", zap.Error(err))
+		return nil, &apiError{fiber.StatusInternalServerError, "password_hash_failed", "Failed to process password"}
+	}
+
+	id, err := utils.GenerateShortID(12)
+	if err != nil {
+		logging.Error("Failed to generate user ID", zap.Error(err))
+		return nil, &apiError{fiber.StatusInternalServerError, "id_generation_failed", "Failed to generate user ID"}
+	}
+
+	user := &database.User{
+		ID:           id,
+		Username:     username,
+		PasswordHash: hash,
+		Role:         role,
+		CreatedAt:    time.Now(),
+	}
+	if err := h.userRepo.Create(user); err != nil {
+		logging.Error("Failed to create user", zap.Error(err))
+		return nil, &apiError{fiber.StatusInternalServerError, "create_failed", "Failed to create user"}
+	}
+
+	logging.Info("User created",
+		zap.String("user_id", id),
+		zap.String("username", username),
+		zap.String("role", role),
+	)
+
+	return user, nil
+}
+
+// toUserResponse converts a database user to an API response, optionally with usage
+func (h *UserHandler) toUserResponse(u *database.User, withUsage bool) UserResponse {
+	resp := UserResponse{
+		ID:             u.ID,
+		Username:       u.Username,
+		Role:           u.Role,
+		Disabled:       u.Disabled,
+		CreatedAt:      u.CreatedAt,
+		StorageQuota:   storageQuota(h.cfg, u),
+		BandwidthQuota: bandwidthQuota(h.cfg, u),
+	}
+
+	if u.LastLoginAt.Valid {
+		resp.LastLoginAt = &u.LastLoginAt.Time
+	}
+
+	if withUsage {
+		usage, err := h.userRepo.Usage(u.ID, time.Now().Add(-bandwidthWindow))
+		if err != nil {
+			logging.Warn("Failed to get user usage", zap.Error(err), zap.String("user_id", u.ID))
+		}
+		resp.Usage = usage
+	}
+
+	return resp
+}
+
+// storageQuota returns the bytes a user may store, or 0 for unlimited
+func storageQuota(cfg *config.Config, u *database.User) int64 {
+	if u.StorageQuota.Valid {
+		return u.StorageQuota.Int64
+	}
+	return cfg.UserStorageQuota
+}
+
+// bandwidthQuota returns the bytes a user may upload per bandwidthWindow, or 0 for unlimited
+func bandwidthQuota(cfg *config.Config, u *database.User) int64 {
+	if u.BandwidthQuota.Valid {
+		return u.BandwidthQuota.Int64
+	}
+	return cfg.UserBandwidthQuota
+}
+
+// checkQuota returns an error if uploading size more bytes would exceed the
+// user's storage or bandwidth quota
+func checkQuota(cfg *config.Config, userRepo *database.UserRepository, u *database.User, size int64) *apiError {
+	storageLimit, bandwidthLimit := storageQuota(cfg, u), bandwidthQuota(cfg, u)
+	if storageLimit == 0 && bandwidthLimit == 0 {
+		return nil
+	}
+
+	usage, err := userRepo.Usage(u.ID, time.Now().Add(-bandwidthWindow))
+	if err != nil {
+		logging.Error("Failed to get user usage", zap.Error(err), zap.String("user_id", u.ID))
+		return &apiError{fiber.StatusInternalServerError, "quota_check_failed", "Failed to check quota"}
+	}
+
+	if storageLimit > 0 && usage.StoredBytes+size > storageLimit {
+		return &apiError{fiber.StatusForbidden, "storage_quota_exceeded",
+			fmt.Sprintf("Upload would exceed your storage quota of %d bytes (%d bytes used)", storageLimit, usage.StoredBytes)}
+	}
+	if bandwidthLimit > 0 && usage.UploadedBytes+size > bandwidthLimit {
+		return &apiError{fiber.StatusForbidden, "bandwidth_quota_exceeded",
+			fmt.Sprintf("Upload would exceed your quota of %d bytes per 30 days (%d bytes used)", bandwidthLimit, usage.UploadedBytes)}
+	}
+	return nil
+}
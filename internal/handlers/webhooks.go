@@ -0,0 +1,469 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/utils"
+	"github.com/salman0ansari/whatsbox/internal/webhooks"
+	"go.uber.org/zap"
+)
+
+// WebhookHandler handles webhook management endpoints
+type WebhookHandler struct {
+	webhookRepo *database.WebhookRepository
+}
+
+// NewWebhookHandler creates a new webhook handler
+func NewWebhookHandler() *WebhookHandler {
+	return &WebhookHandler{
+		webhookRepo: database.NewWebhookRepository(),
+	}
+}
+
+// WebhookResponse represents a webhook in API responses. The secret is only
+// included when it is set.
+type WebhookResponse struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Secret      string    `json:"secret,omitempty"`
+	Events      []string  `json:"events"`
+	Description string    `json:"description,omitempty"`
+	Enabled     bool      `json:"enabled"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// WebhookDeliveryResponse represents a webhook delivery in API responses
+type WebhookDeliveryResponse struct {
+	ID             int64      `json:"id"`
+	Event          string     `json:"event"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	Payload        string     `json:"payload"`
+	ResponseStatus *int64     `json:"response_status,omitempty"`
+	ResponseBody   string     `json:"response_body,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// List returns every webhook
+func (h *WebhookHandler) List(c *fiber.Ctx) error {
+	list, err := h.webhookRepo.List()
+	if err != nil {
+		logging.Error("Failed to list webhooks", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "list_failed",
+			"message": "Failed to list webhooks",
+		})
+	}
+
+	responses := make([]WebhookResponse, len(list))
+	for i, w := range list {
+		responses[i] = toWebhookResponse(w)
+	}
+
+	return c.JSON(fiber.Map{
+		"webhooks": responses,
+		"events":   webhooks.Events,
+	})
+}
+
+// Get returns a webhook
+func (h *WebhookHandler) Get(c *fiber.Ctx) error {
+	w, apiErr := h.getWebhook(c)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+	return c.JSON(toWebhookResponse(w))
+}
+
+// Create creates a webhook and returns it with its signing secret
+func (h *WebhookHandler) Create(c *fiber.Ctx) error {
+	// events defaults to every event; the secret is generated unless given
+	var req struct {
+		URL         string   `json:"url"`
+		Events      []string `json:"events"`
+		Secret      string   `json:"secret"`
+		Description string   `json:"description"`
+		Enabled     *bool    `json:"enabled"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_request",
+			"message": "Invalid request body",
+		})
+	}
+
+	webhookURL, apiErr := validateWebhookURL(req.URL)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	events := []string{database.WebhookEventAll}
+	if req.Events != nil {
+		if events, apiErr = validateWebhookEvents(req.Events); apiErr != nil {
+			return apiErr.send(c)
+		}
+	}
+
+	secret, apiErr := webhookSecret(req.Secret)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	id, err := utils.GenerateShortID(12)
+	if err != nil {
+		logging.Error("Failed to generate webhook ID", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "id_generation_failed",
+			"message": "Failed to generate webhook ID",
+		})
+	}
+
+	description := strings.TrimSpace(req.Description)
+	now := time.Now()
+	w := &database.Webhook{
+		ID:          id,
+		URL:         webhookURL,
+		Secret:      secret,
+		Events:      events,
+		Description: sql.NullString{String: description, Valid: description != ""},
+		Enabled:     req.Enabled == nil || *req.Enabled,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	if err := h.webhookRepo.Create(w); err != nil {
+		logging.Error("Failed to save webhook", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "create_failed",
+			"message": "Failed to create webhook",
+		})
+	}
+
+	logging.Info("Webhook created",
+		zap.String("webhook_id", id),
+		zap.String("url", webhookURL),
+		zap.Strings("events", events),
+	)
+
+	resp := toWebhookResponse(w)
+	resp.Secret = secret
+	return c.Status(fiber.StatusCreated).JSON(resp)
+}
+
+// Update changes a webhook's URL, events, description, enabled flag or secret
+func (h *WebhookHandler) Update(c *fiber.Ctx) error {
+	w, apiErr := h.getWebhook(c)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	// Set rotate_secret to generate a new secret, or secret to choose one
+	var req struct {
+		URL          *string  `json:"url"`
+		Events       []string `json:"events"`
+		Secret       *string  `json:"secret"`
+		RotateSecret bool     `json:"rotate_secret"`
+		Description  *string  `json:"description"`
+		Enabled      *bool    `json:"enabled"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "invalid_request",
+			"message": "Invalid request body",
+		})
+	}
+
+	if req.URL != nil {
+		if w.URL, apiErr = validateWebhookURL(*req.URL); apiErr != nil {
+			return apiErr.send(c)
+		}
+	}
+	if req.Events != nil {
+		if w.Events, apiErr = validateWebhookEvents(req.Events); apiErr != nil {
+			return apiErr.send(c)
+		}
+	}
+
+	secretChanged := req.RotateSecret || req.Secret != nil
+	if secretChanged {
+		var secret string
+		if req.Secret != nil {
+			secret = *req.Secret
+		}
+		if w.Secret, apiErr = webhookSecret(secret); apiErr != nil {
+			return apiErr.send(c)
+		}
+	}
+
+	if req.Description != nil {
+		description := strings.TrimSpace(*req.Description)
+		w.Description = sql.NullString{String: description, Valid: description != ""}
+	}
+	if req.Enabled != nil {
+		w.Enabled = *req.Enabled
+	}
+	w.UpdatedAt = time.Now()
+
+	if err := h.webhookRepo.Update(w); err != nil {
+		logging.Error("Failed to update webhook", zap.Error(err), zap.String("webhook_id", w.ID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "update_failed",
+			"message": "Failed to update webhook",
+		})
+	}
+
+	logging.Info("Webhook updated",
+		zap.String("webhook_id", w.ID),
+		zap.Bool("secret_changed", secretChanged),
+	)
+
+	resp := toWebhookResponse(w)
+	if secretChanged {
+		resp.Secret = w.Secret
+	}
+	return c.JSON(resp)
+}
+
+// Delete removes a webhook and its delivery log
+func (h *WebhookHandler) Delete(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	deleted, err := h.webhookRepo.Delete(id)
+	if err != nil {
+		logging.Error("Failed to delete webhook", zap.Error(err), zap.String("webhook_id", id))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "delete_failed",
+			"message": "Failed to delete webhook",
+		})
+	}
+	if !deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error":   "not_found",
+			"message": "Webhook not found",
+		})
+	}
+
+	logging.Info("Webhook deleted", zap.String("webhook_id", id))
+
+	return c.JSON(fiber.Map{
+		"message": "Webhook deleted successfully",
+		"id":      id,
+	})
+}
+
+// Test queues a ping event for a webhook, even if it is disabled or not
+// subscribed to anything
+func (h *WebhookHandler) Test(c *fiber.Ctx) error {
+	w, apiErr := h.getWebhook(c)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	deliveryID, err := webhooks.Get().Send(w, webhooks.EventPing, fiber.Map{
+		"webhook_id": w.ID,
+	})
+	if err != nil {
+		logging.Error("Failed to queue webhook test", zap.Error(err), zap.String("webhook_id", w.ID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "test_failed",
+			"message": "Failed to queue test delivery",
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message":     "Test delivery queued",
+		"delivery_id": deliveryID,
+	})
+}
+
+// Deliveries returns a page of a webhook's delivery log, newest first
+func (h *WebhookHandler) Deliveries(c *fiber.Ctx) error {
+	w, apiErr := h.getWebhook(c)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	limit := c.QueryInt("limit", 50)
+	if limit < 1 || limit > 100 {
+		limit = 50
+	}
+	offset := c.QueryInt("offset", 0)
+	if offset < 0 {
+		offset = 0
+	}
+
+	deliveries, err := h.webhookRepo.ListDeliveries(w.ID, limit, offset)
+	if err != nil {
+		logging.Error("Failed to list webhook deliveries", zap.Error(err), zap.String("webhook_id", w.ID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "list_failed",
+			"message": "Failed to list webhook deliveries",
+		})
+	}
+
+	responses := make([]WebhookDeliveryResponse, len(deliveries))
+	for i, d := range deliveries {
+		responses[i] = toWebhookDeliveryResponse(d)
+	}
+
+	return c.JSON(fiber.Map{
+		"deliveries": responses,
+		"limit":      limit,
+		"offset":     offset,
+	})
+}
+
+// Redeliver queues a finished delivery to be sent again
+func (h *WebhookHandler) Redeliver(c *fiber.Ctx) error {
+	w, apiErr := h.getWebhook(c)
+	if apiErr != nil {
+		return apiErr.send(c)
+	}
+
+	deliveryID, err := c.ParamsInt("delivery_id")
+	notFound := &apiError{fiber.StatusNotFound, "not_found", "Delivery not found or still pending"}
+	if err != nil {
+		return notFound.send(c)
+	}
+
+	delivery, err := h.webhookRepo.GetDelivery(int64(deliveryID))
+	if err == sql.ErrNoRows || (err == nil && delivery.WebhookID != w.ID) {
+		return notFound.send(c)
+	}
+	if err != nil {
+		logging.Error("Failed to get webhook delivery", zap.Error(err), zap.Int("delivery_id", deliveryID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "get_failed",
+			"message": "Failed to get webhook delivery",
+		})
+	}
+
+	queued, err := webhooks.Get().Redeliver(delivery.ID)
+	if err != nil {
+		logging.Error("Failed to redeliver webhook", zap.Error(err), zap.Int64("delivery_id", delivery.ID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "redeliver_failed",
+			"message": "Failed to queue delivery",
+		})
+	}
+	if !queued {
+		return notFound.send(c)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message":     "Delivery queued",
+		"delivery_id": delivery.ID,
+	})
+}
+
+// getWebhook looks up the webhook named in the :id route parameter
+func (h *WebhookHandler) getWebhook(c *fiber.Ctx) (*database.Webhook, *apiError) {
+	id := c.Params("id")
+	w, err := h.webhookRepo.GetByID(id)
+	if err == sql.ErrNoRows {
+		return nil, &apiError{fiber.StatusNotFound, "not_found", "Webhook not found"}
+	}
+	if err != nil {
+		logging.Error("Failed to get webhook", zap.Error(err), zap.String("webhook_id", id))
+		return nil, &apiError{fiber.StatusInternalServerError, "get_failed", "Failed to get webhook"}
+	}
+	return w, nil
+}
+
+// validateWebhookURL checks a webhook URL is an absolute http(s) URL
+func validateWebhookURL(raw string) (string, *apiError) {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(raw) > 2048 {
+		return "", &apiError{fiber.StatusBadRequest, "invalid_url", "url must be an absolute http or https URL"}
+	}
+	return raw, nil
+}
+
+// validateWebhookEvents checks every event is known and removes duplicates
+func validateWebhookEvents(requested []string) ([]string, *apiError) {
+	if len(requested) == 0 {
+		return nil, &apiError{fiber.StatusBadRequest, "invalid_events", "At least one event is required"}
+	}
+	var events []string
+	for _, event := range requested {
+		if event != database.WebhookEventAll && !slices.Contains(webhooks.Events, event) {
+			return nil, &apiError{fiber.StatusBadRequest, "invalid_events", "Unknown event: " + event}
+		}
+		if !slices.Contains(events, event) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// webhookSecret returns the chosen secret, or generates one if none was given
+func webhookSecret(secret string) (string, *apiError) {
+	if secret != "" {
+		if len(secret) < 16 || len(secret) > 256 {
+			return "", &apiError{fiber.StatusBadRequest, "invalid_secret", "secret must be between 16 and 256 characters"}
+		}
+		return secret, nil
+	}
+
+	secret, err := utils.GenerateWebhookSecret()
+	if err != nil {
+		logging.Error("Failed to generate webhook secret", zap.Error(err))
+		return "", &apiError{fiber.StatusInternalServerError, "secret_generation_failed", "Failed to generate webhook secret"}
+	}
+	return secret, nil
+}
+
+// toWebhookResponse converts a database webhook to an API response
+func toWebhookResponse(w *database.Webhook) WebhookResponse {
+	return WebhookResponse{
+		ID:          w.ID,
+		URL:         w.URL,
+		Events:      w.Events,
+		Description: w.Description.String,
+		Enabled:     w.Enabled,
+		CreatedAt:   w.CreatedAt,
+		UpdatedAt:   w.UpdatedAt,
+	}
+}
+
+// toWebhookDeliveryResponse converts a database webhook delivery to an API response
+func toWebhookDeliveryResponse(d *database.WebhookDelivery) WebhookDeliveryResponse {
+	resp := WebhookDeliveryResponse{
+		ID:           d.ID,
+		Event:        d.Event,
+		Status:       d.Status,
+		Attempts:     d.Attempts,
+		Payload:      d.Payload,
+		ResponseBody: d.ResponseBody.String,
+		Error:        d.Error.String,
+		CreatedAt:    d.CreatedAt,
+	}
+
+	if d.ResponseStatus.Valid {
+		resp.ResponseStatus = &d.ResponseStatus.Int64
+	}
+	if d.LastAttemptAt.Valid {
+		resp.LastAttemptAt = &d.LastAttemptAt.Time
+	}
+	if d.NextAttemptAt.Valid {
+		resp.NextAttemptAt = &d.NextAttemptAt.Time
+	}
+	if d.DeliveredAt.Valid {
+		resp.DeliveredAt = &d.DeliveredAt.Time
+	}
+
+	return resp
+}
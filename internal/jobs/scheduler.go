@@ -1,26 +1,35 @@
 package jobs
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/salman0ansari/whatsbox/internal/config"
 	"github.com/salman0ansari/whatsbox/internal/database"
 	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/ratelimit"
 	"github.com/salman0ansari/whatsbox/internal/stats"
+	"github.com/salman0ansari/whatsbox/internal/storage"
+	"github.com/salman0ansari/whatsbox/internal/webhooks"
+	"github.com/salman0ansari/whatsbox/internal/whatsapp"
 	"go.uber.org/zap"
 )
 
 // Scheduler manages background jobs
 type Scheduler struct {
-	cfg           *config.Config
-	collector     *stats.Collector
-	fileRepo      *database.FileRepository
-	uploadRepo    *database.UploadRepository
-	statsRepo     *database.StatsRepository
-	accessLogRepo *database.AccessLogRepository
+	cfg            *config.Config
+	waPool         *whatsapp.Pool
+	storage        *storage.Manager
+	collector      *stats.Collector
+	fileRepo       *database.FileRepository
+	collectionRepo *database.CollectionRepository
+	uploadRepo     *database.UploadRepository
+	statsRepo      *database.StatsRepository
+	accessLogRepo  *database.AccessLogRepository
 
 	stopCh  chan struct{}
 	wg      sync.WaitGroup
@@ -29,15 +38,18 @@ type Scheduler struct {
 }
 
 // NewScheduler creates a new job scheduler
-func NewScheduler(cfg *config.Config) *Scheduler {
+func NewScheduler(cfg *config.Config, waPool *whatsapp.Pool, storageManager *storage.Manager) *Scheduler {
 	return &Scheduler{
-		cfg:           cfg,
-		collector:     stats.Get(),
-		fileRepo:      database.NewFileRepository(),
-		uploadRepo:    database.NewUploadRepository(),
-		statsRepo:     database.NewStatsRepository(),
-		accessLogRepo: database.NewAccessLogRepository(),
-		stopCh:        make(chan struct{}),
+		cfg:            cfg,
+		waPool:         waPool,
+		storage:        storageManager,
+		collector:      stats.Get(),
+		fileRepo:       database.NewFileRepository(),
+		collectionRepo: database.NewCollectionRepository(),
+		uploadRepo:     database.NewUploadRepository(),
+		statsRepo:      database.NewStatsRepository(),
+		accessLogRepo:  database.NewAccessLogRepository(),
+		stopCh:         make(chan struct{}),
 	}
 }
 
@@ -54,11 +66,18 @@ func (s *Scheduler) Start() {
 	logging.Info("Starting background job scheduler")
 
 	// Start individual job goroutines
-	s.wg.Add(4)
+	s.wg.Add(6)
 	go s.runExpiredFilesJob()
 	go s.runIncompleteUploadsJob()
 	go s.runStatsAggregationJob()
 	go s.runAccessLogCleanupJob()
+	go s.runRateLimitJob()
+	go s.runWebhookDeliveryJob()
+
+	if s.cfg.MediaRefreshEnabled {
+		s.wg.Add(1)
+		go s.runMediaRefreshJob()
+	}
 }
 
 // Stop gracefully stops all background jobs
@@ -77,7 +96,7 @@ func (s *Scheduler) Stop() {
 	logging.Info("Background job scheduler stopped")
 }
 
-// runExpiredFilesJob marks expired files every hour
+// runExpiredFilesJob marks expired files and purges their content every hour
 func (s *Scheduler) runExpiredFilesJob() {
 	defer s.wg.Done()
 
@@ -98,13 +117,68 @@ func (s *Scheduler) runExpiredFilesJob() {
 }
 
 func (s *Scheduler) markExpiredFiles() {
-	count, err := s.fileRepo.MarkExpired()
+	files, err := s.fileRepo.MarkExpired()
 	if err != nil {
 		logging.Error("Failed to mark expired files", zap.Error(err))
 		return
 	}
-	if count > 0 {
-		logging.Info("Marked expired files", zap.Int64("count", count))
+	if len(files) > 0 {
+		logging.Info("Marked expired files", zap.Int("count", len(files)))
+	}
+	for _, f := range files {
+		webhooks.Get().Emit(webhooks.EventFileExpired, webhooks.NewFile(f))
+	}
+
+	collections, err := s.collectionRepo.MarkExpired()
+	if err != nil {
+		logging.Error("Failed to mark expired collections", zap.Error(err))
+	} else if collections > 0 {
+		logging.Info("Marked expired collections", zap.Int64("count", collections))
+	}
+
+	s.purgeUnreferencedObjects()
+}
+
+// purgeBatchSize is the maximum number of objects purged per run
+const purgeBatchSize = 100
+
+// purgeUnreferencedObjects deletes content of expired and deleted files from
+// backends that store it until told otherwise
+func (s *Scheduler) purgeUnreferencedObjects() {
+	files, err := s.fileRepo.ListUnreferencedObjects(purgeBatchSize)
+	if err != nil {
+		logging.Error("Failed to list unreferenced objects", zap.Error(err))
+		return
+	}
+
+	var purged int
+	for _, f := range files {
+		backend, err := s.storage.Get(f.Backend)
+		if err != nil {
+			logging.Warn("Cannot purge object", zap.String("file_id", f.ID), zap.Error(err))
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err = backend.Delete(ctx, &storage.Object{Key: f.DirectPath, Size: f.FileSize, MimeType: f.MimeType})
+		cancel()
+		if err != nil {
+			logging.Error("Failed to purge object",
+				zap.String("backend", f.Backend),
+				zap.String("key", f.DirectPath),
+				zap.Error(err))
+			continue
+		}
+
+		if err := s.fileRepo.MarkPurged(f.Backend, f.DirectPath); err != nil {
+			logging.Error("Failed to mark object purged", zap.Error(err))
+			continue
+		}
+		purged++
+	}
+
+	if purged > 0 {
+		logging.Info("Purged unreferenced objects", zap.Int("count", purged))
 	}
 }
 
@@ -129,8 +203,9 @@ func (s *Scheduler) runIncompleteUploadsJob() {
 }
 
 func (s *Scheduler) cleanIncompleteUploads() {
-	// Delete uploads older than 24 hours
-	before := time.Now().Add(-24 * time.Hour)
+	// Delete uploads, including failed ones awaiting a retry, once they have
+	// been left untouched for the TTL
+	before := time.Now().Add(-s.cfg.IncompleteUploadTTL)
 	count, err := s.uploadRepo.DeleteOld(before)
 	if err != nil {
 		logging.Error("Failed to delete old uploads", zap.Error(err))
@@ -170,6 +245,13 @@ func (s *Scheduler) cleanOrphanedTempFiles() {
 			continue
 		}
 
+		// Keep data of uploads that still exist, such as failed ones awaiting a retry
+		if id, ok := strings.CutSuffix(file.Name(), ".tmp"); ok {
+			if _, err := s.uploadRepo.GetByID(id); err == nil {
+				continue
+			}
+		}
+
 		// Remove orphaned temp file
 		path := filepath.Join(s.cfg.TempDir, file.Name())
 		if err := os.Remove(path); err != nil {
@@ -186,12 +268,13 @@ func (s *Scheduler) cleanOrphanedTempFiles() {
 	}
 }
 
-// runStatsAggregationJob aggregates hourly stats to daily at midnight
+// runStatsAggregationJob flushes stats to the database every STATS_FLUSH_INTERVAL
+// and aggregates hourly stats to daily at midnight
 func (s *Scheduler) runStatsAggregationJob() {
 	defer s.wg.Done()
 
-	// Flush current stats on startup
-	s.collector.FlushHourly()
+	flushTicker := time.NewTicker(s.cfg.StatsFlushInterval)
+	defer flushTicker.Stop()
 
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
@@ -200,22 +283,25 @@ func (s *Scheduler) runStatsAggregationJob() {
 		select {
 		case <-s.stopCh:
 			// Flush stats before shutting down
-			s.collector.FlushHourly()
+			s.flushStats()
 			return
+		case <-flushTicker.C:
+			s.flushStats()
 		case <-ticker.C:
 			s.aggregateStats()
 		}
 	}
 }
 
-func (s *Scheduler) aggregateStats() {
-	// Flush current hourly stats
+func (s *Scheduler) flushStats() {
 	if err := s.collector.FlushHourly(); err != nil {
 		logging.Error("Failed to flush hourly stats", zap.Error(err))
 	}
+}
 
-	// Reset counters after flush
-	s.collector.Reset()
+func (s *Scheduler) aggregateStats() {
+	// Include everything recorded so far
+	s.flushStats()
 
 	// At midnight, aggregate previous day's hourly stats to daily
 	now := time.Now()
@@ -269,3 +355,198 @@ func (s *Scheduler) cleanAccessLogs() {
 		logging.Info("Deleted old access logs", zap.Int64("count", count))
 	}
 }
+
+// runRateLimitJob drops stale rate limiter state and persists the rest every minute
+func (s *Scheduler) runRateLimitJob() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			// Persist state before shutting down
+			s.flushRateLimits()
+			return
+		case <-ticker.C:
+			s.flushRateLimits()
+		}
+	}
+}
+
+func (s *Scheduler) flushRateLimits() {
+	limiter := ratelimit.Get()
+	limiter.Sweep()
+	if err := limiter.Flush(); err != nil {
+		logging.Error("Failed to persist rate limits", zap.Error(err))
+	}
+}
+
+// runWebhookDeliveryJob sends queued webhook deliveries as they are queued or
+// become due for a retry, and trims the delivery log every hour
+func (s *Scheduler) runWebhookDeliveryJob() {
+	defer s.wg.Done()
+
+	dispatcher := webhooks.Get()
+	if dispatcher == nil {
+		return
+	}
+
+	// Cancel deliveries in progress on shutdown; they are retried on startup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.stopCh
+		cancel()
+	}()
+
+	// Send deliveries left over from before a restart
+	s.deliverWebhooks(ctx, dispatcher)
+	s.cleanWebhookDeliveries(dispatcher)
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	cleanupTicker := time.NewTicker(1 * time.Hour)
+	defer cleanupTicker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-dispatcher.Wake():
+			s.deliverWebhooks(ctx, dispatcher)
+		case <-ticker.C:
+			s.deliverWebhooks(ctx, dispatcher)
+		case <-cleanupTicker.C:
+			s.cleanWebhookDeliveries(dispatcher)
+		}
+	}
+}
+
+func (s *Scheduler) deliverWebhooks(ctx context.Context, dispatcher *webhooks.Dispatcher) {
+	// Keep going while full batches are due
+	for ctx.Err() == nil {
+		count, err := dispatcher.DeliverDue(ctx)
+		if err != nil {
+			logging.Error("Failed to deliver webhooks", zap.Error(err))
+			return
+		}
+		if count < webhooks.DeliveryBatchSize {
+			return
+		}
+	}
+}
+
+func (s *Scheduler) cleanWebhookDeliveries(dispatcher *webhooks.Dispatcher) {
+	count, err := dispatcher.DeleteOld()
+	if err != nil {
+		logging.Error("Failed to delete old webhook deliveries", zap.Error(err))
+		return
+	}
+	if count > 0 {
+		logging.Info("Deleted old webhook deliveries", zap.Int64("count", count))
+	}
+}
+
+// mediaRefreshBatchSize is the maximum number of files refreshed per run
+const mediaRefreshBatchSize = 50
+
+// runMediaRefreshJob re-uploads media that WhatsApp would drop before its files expire
+func (s *Scheduler) runMediaRefreshJob() {
+	defer s.wg.Done()
+
+	// Run immediately on startup
+	s.refreshMedia()
+
+	ticker := time.NewTicker(s.cfg.MediaRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			s.refreshMedia()
+		}
+	}
+}
+
+func (s *Scheduler) refreshMedia() {
+	if !s.waPool.IsConnected() {
+		logging.Debug("Skipping media refresh, WhatsApp not connected")
+		return
+	}
+
+	files, err := s.fileRepo.ListMediaDueForRefresh(time.Now().Add(-s.cfg.MediaRefreshAge), whatsapp.MediaRetention,
+		s.cfg.MediaRefreshMaxFailures, mediaRefreshBatchSize)
+	if err != nil {
+		logging.Error("Failed to list files for media refresh", zap.Error(err))
+		return
+	}
+
+	// Deduplicated files share media, so each direct path is refreshed once
+	var refreshed, failed int
+	seen := make(map[string]bool)
+	for _, f := range files {
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+
+		if seen[f.DirectPath] {
+			continue
+		}
+		seen[f.DirectPath] = true
+
+		if err := s.refreshFile(f); err != nil {
+			logging.Error("Failed to refresh media",
+				zap.String("file_id", f.ID),
+				zap.String("direct_path", f.DirectPath),
+				zap.Int64("failures", f.RefreshFailures+1),
+				zap.Error(err))
+			if err := s.fileRepo.RecordRefreshFailure(f.DirectPath, err.Error()); err != nil {
+				logging.Error("Failed to record media refresh failure", zap.Error(err))
+			}
+			failed++
+			continue
+		}
+		refreshed++
+	}
+
+	if refreshed > 0 || failed > 0 {
+		logging.Info("Refreshed media", zap.Int("refreshed", refreshed), zap.Int("failed", failed))
+	}
+}
+
+// refreshFile re-uploads a file's media and points every file sharing it at the new copy
+func (s *Scheduler) refreshFile(f *database.File) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	uploadResp, err := s.waPool.Reupload(ctx, &whatsapp.DownloadRequest{
+		Account:     f.Account.String,
+		DirectPath:  f.DirectPath,
+		MediaKey:    f.MediaKey,
+		FileEncHash: f.FileEncHash,
+		FileSHA256:  f.FileSHA256,
+		FileLength:  uint64(f.FileSize),
+		MimeType:    f.MimeType,
+	})
+	if err != nil {
+		return err
+	}
+
+	count, err := s.fileRepo.UpdateMedia(f.DirectPath, uploadResp.Account, uploadResp.DirectPath, uploadResp.MediaKey, uploadResp.FileEncHash, time.Now())
+	if err != nil {
+		return err
+	}
+
+	logging.Info("Media refreshed",
+		zap.String("file_id", f.ID),
+		zap.String("direct_path", uploadResp.DirectPath),
+		zap.Int64("files", count))
+	return nil
+}
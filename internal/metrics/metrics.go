@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/stats"
+	"github.com/salman0ansari/whatsbox/internal/whatsapp"
+	"go.uber.org/zap"
+)
+
+const namespace = "whatsbox"
+
+// Registry holds every WhatsBox metric
+var Registry = prometheus.NewRegistry()
+
+var requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "http_request_duration_seconds",
+	Help:      "HTTP request latency by method, route and status.",
+	Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+}, []string{"method", "route", "status"})
+
+func init() {
+	Registry.MustRegister(
+		requestDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// ObserveRequest records the latency of a handled request. route is the
+// matched route pattern rather than the path so IDs don't create new series.
+func ObserveRequest(method, route string, status int, duration time.Duration) {
+	// Fiber reuses request buffers, so labels kept by new series must be copies
+	requestDuration.WithLabelValues(strings.Clone(method), strings.Clone(route), strconv.Itoa(status)).
+		Observe(duration.Seconds())
+}
+
+// Register adds the metrics read from the stats collector, the WhatsApp
+// accounts and the database on every scrape
+func Register(waPool *whatsapp.Pool) {
+	Registry.MustRegister(&collector{
+		stats:    stats.Get(),
+		waPool:   waPool,
+		fileRepo: database.NewFileRepository(),
+	})
+}
+
+var (
+	uploadsDesc         = newDesc("uploads_total", "Files uploaded.")
+	downloadsDesc       = newDesc("downloads_total", "Files downloaded.")
+	uploadBytesDesc     = newDesc("upload_bytes_total", "Bytes uploaded.")
+	downloadBytesDesc   = newDesc("download_bytes_total", "Bytes downloaded.")
+	uploadErrorsDesc    = newDesc("upload_errors_total", "Failed uploads.")
+	downloadErrorsDesc  = newDesc("download_errors_total", "Failed downloads.")
+	activeUploadsDesc   = newDesc("active_uploads", "Uploads in progress.")
+	activeDownloadsDesc = newDesc("active_downloads", "Downloads in progress.")
+	filesDesc           = newDesc("files", "Files by status.", "status")
+	storedBytesDesc     = newDesc("stored_bytes", "Total size of active files.")
+	waConnectedDesc     = newDesc("whatsapp_connected", "Whether the WhatsApp account is connected and healthy.", "account")
+	waReconnectsDesc    = newDesc("whatsapp_reconnects_total", "WhatsApp reconnections.", "account")
+)
+
+func newDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil)
+}
+
+// collector exposes WhatsBox state as Prometheus metrics
+type collector struct {
+	stats    *stats.Collector
+	waPool   *whatsapp.Pool
+	fileRepo *database.FileRepository
+}
+
+// Describe implements prometheus.Collector
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		uploadsDesc, downloadsDesc, uploadBytesDesc, downloadBytesDesc, uploadErrorsDesc, downloadErrorsDesc,
+		activeUploadsDesc, activeDownloadsDesc, filesDesc, storedBytesDesc, waConnectedDesc, waReconnectsDesc,
+	} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	totals := c.stats.GetTotals()
+	ch <- counter(uploadsDesc, totals.Uploads)
+	ch <- counter(downloadsDesc, totals.Downloads)
+	ch <- counter(uploadBytesDesc, totals.BytesUploaded)
+	ch <- counter(downloadBytesDesc, totals.BytesDownloaded)
+	ch <- counter(uploadErrorsDesc, totals.UploadErrors)
+	ch <- counter(downloadErrorsDesc, totals.DownloadErrors)
+
+	current := c.stats.GetStats()
+	ch <- gauge(activeUploadsDesc, current.ActiveUploads)
+	ch <- gauge(activeDownloadsDesc, current.ActiveDownloads)
+
+	if counts, err := c.fileRepo.CountByStatus(); err != nil {
+		logging.Warn("Failed to count files for metrics", zap.Error(err))
+	} else {
+		for status, count := range counts {
+			ch <- gauge(filesDesc, count, status)
+		}
+	}
+	if size, err := c.fileRepo.TotalSize(); err != nil {
+		logging.Warn("Failed to sum file sizes for metrics", zap.Error(err))
+	} else {
+		ch <- gauge(storedBytesDesc, size)
+	}
+
+	for _, account := range c.waPool.GetStatus().Accounts {
+		connected := int64(0)
+		if account.Connected && account.Healthy {
+			connected = 1
+		}
+		ch <- gauge(waConnectedDesc, connected, account.ID)
+		ch <- counter(waReconnectsDesc, account.ReconnectCount, account.ID)
+	}
+}
+
+func counter(desc *prometheus.Desc, value int64, labels ...string) prometheus.Metric {
+	return prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+}
+
+func gauge(desc *prometheus.Desc, value int64, labels ...string) prometheus.Metric {
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value), labels...)
+}
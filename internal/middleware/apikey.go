@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// apiKeyLocal is the fiber.Ctx local holding the authenticated API key
+	apiKeyLocal = "api_key"
+
+	// apiKeyUseInterval limits how often last-used tracking writes to the database
+	apiKeyUseInterval = time.Minute
+)
+
+// GetAPIKey returns the API key the request was authenticated with, or nil
+func GetAPIKey(c *fiber.Ctx) *database.APIKey {
+	if key, ok := c.Locals(apiKeyLocal).(*database.APIKey); ok {
+		return key
+	}
+	return nil
+}
+
+// bearerToken returns the token from an Authorization: Bearer header
+func bearerToken(c *fiber.Ctx) (string, bool) {
+	scheme, token, ok := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// authenticateAPIKey validates an API key and checks it grants one of scopes
+func authenticateAPIKey(c *fiber.Ctx, repo *database.APIKeyRepository, token string, scopes []string) error {
+	key := lookupAPIKey(repo, token)
+	if key == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error":   "invalid_api_key",
+			"message": "Invalid, expired or revoked API key",
+		})
+	}
+
+	allowed := false
+	for _, scope := range scopes {
+		if key.HasScope(scope) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error":   "insufficient_scope",
+			"message": "API key requires one of the scopes: " + strings.Join(scopes, ", "),
+		})
+	}
+
+	if !key.LastUsedAt.Valid || time.Since(key.LastUsedAt.Time) > apiKeyUseInterval {
+		if err := repo.RecordUse(key.ID, c.IP()); err != nil {
+			logging.Warn("Failed to record API key use", zap.Error(err), zap.String("key_id", key.ID))
+		}
+	}
+
+	c.Locals(apiKeyLocal, key)
+	return c.Next()
+}
+
+// lookupAPIKey returns the active API key matching token, or nil
+func lookupAPIKey(repo *database.APIKeyRepository, token string) *database.APIKey {
+	id, ok := utils.ParseAPIKeyID(token)
+	if !ok {
+		return nil
+	}
+
+	key, err := repo.GetByID(id)
+	if err != nil {
+		return nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(utils.HashToken(token)), []byte(key.KeyHash)) != 1 {
+		return nil
+	}
+	if !key.Active() {
+		return nil
+	}
+	return key
+}
+
+// OptionalAPIKey authenticates requests that present an API key, which must
+// grant scope, and lets anonymous requests through
+func OptionalAPIKey(scope string) fiber.Handler {
+	apiKeys := database.NewAPIKeyRepository()
+
+	return func(c *fiber.Ctx) error {
+		if token, ok := bearerToken(c); ok {
+			return authenticateAPIKey(c, apiKeys, token, []string{scope})
+		}
+		return c.Next()
+	}
+}
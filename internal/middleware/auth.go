@@ -7,26 +7,46 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/ratelimit"
+	"go.uber.org/zap"
 )
 
 const (
 	authCookieName = "whatsbox_admin_session"
+
+	// adminSubject is the session subject of the ADMIN_PASSWORD login;
+	// user sessions use the user's ID
+	adminSubject = "admin"
 )
 
-// AdminAuth creates an admin authentication middleware
-func AdminAuth(cfg *config.Config) fiber.Handler {
+// AdminAuth creates an admin authentication middleware. Besides the admin
+// session, it accepts an API key in an Authorization: Bearer header granting
+// one of scopes, or the admin scope if none are given.
+func AdminAuth(cfg *config.Config, scopes ...string) fiber.Handler {
+	if len(scopes) == 0 {
+		scopes = []string{database.ScopeAdmin}
+	}
+	apiKeys := database.NewAPIKeyRepository()
+	users := database.NewUserRepository()
+
 	return func(c *fiber.Ctx) error {
-		// If no admin password is set, deny all access
-		if cfg.AdminPassword == "" {
-			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
-				"error":   "auth_not_configured",
-				"message": "Admin authentication is not configured. Set ADMIN_PASSWORD environment variable.",
-			})
+		// API keys authenticate scripts without a session
+		if token, ok := bearerToken(c); ok {
+			return authenticateAPIKey(c, apiKeys, token, scopes)
 		}
 
 		// Get session token from cookie
 		token := c.Cookies(authCookieName)
 		if token == "" {
+			// If no admin password is set, only admin users can sign in
+			if cfg.AdminPassword == "" {
+				return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+					"error":   "auth_not_configured",
+					"message": "Admin authentication is not configured. Set ADMIN_PASSWORD environment variable.",
+				})
+			}
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error":   "unauthorized",
 				"message": "Authentication required",
@@ -34,32 +54,55 @@ func AdminAuth(cfg *config.Config) fiber.Handler {
 		}
 
 		// Validate JWT token
-		claims := &jwt.RegisteredClaims{}
-		parsedToken, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
-			return []byte(cfg.AdminSessionSecret), nil
-		})
-
-		if err != nil || !parsedToken.Valid {
+		claims, ok := parseSession(cfg, token)
+		if !ok {
 			// Clear invalid cookie
-			c.Cookie(&fiber.Cookie{
-				Name:     authCookieName,
-				Value:    "",
-				Expires:  time.Now().Add(-1 * time.Hour),
-				HTTPOnly: true,
-				Secure:   c.Protocol() == "https",
-				SameSite: "Lax",
-				Path:     "/",
-			})
+			clearSession(c)
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error":   "unauthorized",
 				"message": "Invalid or expired session",
 			})
 		}
 
+		// Users need the admin role
+		if claims.Subject != adminSubject || cfg.AdminPassword == "" {
+			user := sessionUser(users, claims)
+			if user == nil {
+				clearSession(c)
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error":   "unauthorized",
+					"message": "Invalid or expired session",
+				})
+			}
+			if user.Role != database.RoleAdmin {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+					"error":   "forbidden",
+					"message": "Admin access required",
+				})
+			}
+			c.Locals(userLocal, user)
+		}
+
 		return c.Next()
 	}
 }
 
+// ManagementTokenHeader is the header carrying a file's management token
+const ManagementTokenHeader = "X-Management-Token"
+
+// AdminAuthOrManagementToken is AdminAuth for file routes that an uploader
+// may also call with the file's management token. Requests carrying one are
+// passed on for the handler to check against the file.
+func AdminAuthOrManagementToken(cfg *config.Config, scopes ...string) fiber.Handler {
+	adminAuth := AdminAuth(cfg, scopes...)
+	return func(c *fiber.Ctx) error {
+		if c.Get(ManagementTokenHeader) != "" {
+			return c.Next()
+		}
+		return adminAuth(c)
+	}
+}
+
 // Login handles admin login
 func Login(cfg *config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -82,40 +125,34 @@ func Login(cfg *config.Config) fiber.Handler {
 			})
 		}
 
+		// Slow down password guessing
+		limiter := ratelimit.Get()
+		subject := PasswordSubject(c, adminSubject)
+		if wait := limiter.Locked(ratelimit.ScopeLogin, subject); wait > 0 {
+			return RateLimited(c, wait, "too_many_attempts", "Too many failed login attempts. Try again later.")
+		}
+
 		// Validate password using constant-time comparison
 		if subtle.ConstantTimeCompare([]byte(req.Password), []byte(cfg.AdminPassword)) != 1 {
+			if lockout := limiter.Fail(ratelimit.ScopeLogin, subject); lockout > 0 {
+				logging.Warn("Admin login locked out after failed attempts",
+					zap.String("ip", c.IP()), zap.Duration("lockout", lockout))
+			}
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error":   "invalid_credentials",
 				"message": "Invalid password",
 			})
 		}
+		limiter.Succeed(ratelimit.ScopeLogin, subject)
 
-		// Generate JWT token
-		claims := &jwt.RegisteredClaims{
-			Subject:   "admin",
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(cfg.AdminSessionMaxAge) * time.Second)),
-		}
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err := token.SignedString([]byte(cfg.AdminSessionSecret))
-		if err != nil {
+		// Start the admin session
+		if err := IssueSession(c, cfg, adminSubject); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error":   "token_generation_failed",
 				"message": "Failed to generate session token",
 			})
 		}
 
-		// Set HTTP-only cookie
-		c.Cookie(&fiber.Cookie{
-			Name:     authCookieName,
-			Value:    tokenString,
-			Expires:  time.Now().Add(time.Duration(cfg.AdminSessionMaxAge) * time.Second),
-			HTTPOnly: true,
-			Secure:   c.Protocol() == "https",
-			SameSite: "Lax",
-			Path:     "/",
-		})
-
 		return c.JSON(fiber.Map{
 			"success": true,
 			"message": "Logged in successfully",
@@ -127,15 +164,7 @@ func Login(cfg *config.Config) fiber.Handler {
 func LogoutSession() fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		// Clear the session cookie
-		c.Cookie(&fiber.Cookie{
-			Name:     authCookieName,
-			Value:    "",
-			Expires:  time.Now().Add(-1 * time.Hour),
-			HTTPOnly: true,
-			Secure:   c.Protocol() == "https",
-			SameSite: "Lax",
-			Path:     "/",
-		})
+		clearSession(c)
 
 		return c.JSON(fiber.Map{
 			"success": true,
@@ -146,41 +175,110 @@ func LogoutSession() fiber.Handler {
 
 // CheckAuth returns the current authentication status
 func CheckAuth(cfg *config.Config) fiber.Handler {
+	users := database.NewUserRepository()
+
 	return func(c *fiber.Ctx) error {
-		// If no admin password is set, authentication is required but not possible
-		if cfg.AdminPassword == "" {
+		// Get session token from cookie
+		token := c.Cookies(authCookieName)
+		if token == "" {
+			// If no admin password is set, only admin users can sign in
+			if cfg.AdminPassword == "" {
+				return c.JSON(fiber.Map{
+					"authenticated": false,
+					"auth_required": true,
+					"message":       "Admin authentication is not configured. Set ADMIN_PASSWORD environment variable.",
+				})
+			}
 			return c.JSON(fiber.Map{
 				"authenticated": false,
 				"auth_required": true,
-				"message":       "Admin authentication is not configured. Set ADMIN_PASSWORD environment variable.",
 			})
 		}
 
-		// Get session token from cookie
-		token := c.Cookies(authCookieName)
-		if token == "" {
+		// Validate JWT token
+		claims, ok := parseSession(cfg, token)
+		if !ok {
 			return c.JSON(fiber.Map{
 				"authenticated": false,
 				"auth_required": true,
 			})
 		}
 
-		// Validate JWT token
-		claims := &jwt.RegisteredClaims{}
-		parsedToken, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
-			return []byte(cfg.AdminSessionSecret), nil
-		})
-
-		if err != nil || !parsedToken.Valid {
+		if claims.Subject == adminSubject && cfg.AdminPassword != "" {
 			return c.JSON(fiber.Map{
-				"authenticated": false,
+				"authenticated": true,
 				"auth_required": true,
 			})
 		}
 
+		user := sessionUser(users, claims)
 		return c.JSON(fiber.Map{
-			"authenticated": true,
+			"authenticated": user != nil && user.Role == database.RoleAdmin,
 			"auth_required": true,
 		})
 	}
 }
+
+// IssueSession signs a session token for subject and sets it as the session cookie
+func IssueSession(c *fiber.Ctx, cfg *config.Config, subject string) error {
+	claims := &jwt.RegisteredClaims{
+		Subject:   subject,
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(cfg.AdminSessionMaxAge) * time.Second)),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString([]byte(cfg.AdminSessionSecret))
+	if err != nil {
+		return err
+	}
+
+	// Set HTTP-only cookie
+	c.Cookie(&fiber.Cookie{
+		Name:     authCookieName,
+		Value:    tokenString,
+		Expires:  time.Now().Add(time.Duration(cfg.AdminSessionMaxAge) * time.Second),
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: "Lax",
+		Path:     "/",
+	})
+	return nil
+}
+
+// parseSession validates a session token and returns its claims
+func parseSession(cfg *config.Config, token string) (*jwt.RegisteredClaims, bool) {
+	claims := &jwt.RegisteredClaims{}
+	parsedToken, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(cfg.AdminSessionSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+	if err != nil || !parsedToken.Valid {
+		return nil, false
+	}
+	return claims, true
+}
+
+// clearSession removes the session cookie
+func clearSession(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     authCookieName,
+		Value:    "",
+		Expires:  time.Now().Add(-1 * time.Hour),
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: "Lax",
+		Path:     "/",
+	})
+}
+
+// hasAdminSession reports whether the request carries a valid ADMIN_PASSWORD session
+func hasAdminSession(c *fiber.Ctx, cfg *config.Config) bool {
+	if cfg.AdminPassword == "" {
+		return false
+	}
+	token := c.Cookies(authCookieName)
+	if token == "" {
+		return false
+	}
+	claims, ok := parseSession(cfg, token)
+	return ok && claims.Subject == adminSubject
+}
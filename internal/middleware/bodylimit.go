@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/config"
+)
+
+// MaxBodySize caps request bodies other than uploads, which are small JSON or
+// form documents
+const MaxBodySize = 1 << 20 // 1MB
+
+// BodyLimit caps request bodies before any handler reads them. Uploads are
+// streamed by their handlers and may be up to MaxUploadSize; multipart uploads
+// must declare their length, which bounds the stream. Any other body is read
+// here, so handlers never buffer more than MaxBodySize.
+func BodyLimit(cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		length := c.Request().Header.ContentLength()
+
+		switch {
+		case isTusRequest(c):
+			// Tus handlers stop reading at the upload's length
+			if int64(length) > cfg.MaxUploadSize {
+				return bodyTooLarge(c, cfg.MaxUploadSize)
+			}
+			return c.Next()
+		case isMultipartUpload(c):
+			if length < 0 {
+				c.Context().SetConnectionClose()
+				return c.Status(fiber.StatusLengthRequired).JSON(fiber.Map{
+					"error":   "length_required",
+					"message": "Multipart uploads must set Content-Length",
+				})
+			}
+			if int64(length) > cfg.MaxUploadSize {
+				return bodyTooLarge(c, cfg.MaxUploadSize)
+			}
+			return c.Next()
+		}
+
+		if length > MaxBodySize {
+			return bodyTooLarge(c, MaxBodySize)
+		}
+		stream := c.Context().RequestBodyStream()
+		if stream == nil {
+			return c.Next()
+		}
+
+		// Chunked bodies have no declared length, so read one byte past the
+		// limit to tell whether they exceed it
+		body, err := io.ReadAll(io.LimitReader(stream, MaxBodySize+1))
+		if err != nil {
+			c.Context().SetConnectionClose()
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "invalid_body",
+				"message": "Failed to read request body",
+			})
+		}
+		if len(body) > MaxBodySize {
+			return bodyTooLarge(c, MaxBodySize)
+		}
+		c.Request().SetBody(body)
+		return c.Next()
+	}
+}
+
+// isTusRequest reports whether a request goes to the tus upload routes
+func isTusRequest(c *fiber.Ctx) bool {
+	path := strings.TrimSuffix(c.Path(), "/")
+	return path == "/api/upload" || strings.HasPrefix(path, "/api/upload/")
+}
+
+// isMultipartUpload reports whether a request uploads files as a multipart form
+func isMultipartUpload(c *fiber.Ctx) bool {
+	if c.Method() != fiber.MethodPost || !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		return false
+	}
+	path := strings.TrimSuffix(c.Path(), "/")
+	return path == "/api/files" || path == "/api/collections"
+}
+
+// bodyTooLarge responds with 413 Request Entity Too Large. The unread body is
+// left on the connection, so it is closed after the response.
+func bodyTooLarge(c *fiber.Ctx, limit int64) error {
+	c.Context().SetConnectionClose()
+	return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+		"error":   "request_too_large",
+		"message": "Request body exceeds maximum size of " + strconv.FormatInt(limit, 10) + " bytes",
+	})
+}
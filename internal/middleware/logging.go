@@ -5,6 +5,8 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/metrics"
+	"github.com/salman0ansari/whatsbox/internal/stats"
 	"go.uber.org/zap"
 )
 
@@ -25,6 +27,9 @@ func Logger() fiber.Handler {
 		// Determine log level based on status
 		status := c.Response().StatusCode()
 
+		metrics.ObserveRequest(c.Method(), c.Route().Path, status, duration)
+		stats.Get().IncrementRequests()
+
 		fields := []zap.Field{
 			zap.String("request_id", requestID),
 			zap.String("method", c.Method()),
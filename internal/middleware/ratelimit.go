@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/ratelimit"
+)
+
+// ClientKey identifies the client for rate limiting: the API key or user if
+// the request is authenticated, otherwise the IP address
+func ClientKey(c *fiber.Ctx) string {
+	if key := GetAPIKey(c); key != nil {
+		return "key:" + key.ID
+	}
+	if user := GetUser(c); user != nil {
+		return "user:" + user.ID
+	}
+	return "ip:" + c.IP()
+}
+
+// RateLimited responds with 429 Too Many Requests and a Retry-After header
+func RateLimited(c *fiber.Ctx, wait time.Duration, code, message string) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"error":       code,
+		"message":     message,
+		"retry_after": int(math.Ceil(wait.Seconds())),
+	})
+}
+
+// uploadBytesKey holds the bytes a handler read from a request body
+const uploadBytesKey = "upload_bytes"
+
+// UploadRateLimit limits how many uploads and bytes a client may send. New
+// uploads count towards the upload limit; every request body counts towards
+// the byte limit, so tus chunks are charged as they arrive. Bodies without a
+// Content-Length are charged after the handler with the bytes it recorded
+// with RecordUploadBytes. It must run after OptionalAPIKey and OptionalUser.
+func UploadRateLimit() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// Concatenating finished partial uploads adds no data
+		countUpload := c.Method() == fiber.MethodPost && !strings.HasPrefix(c.Get("Upload-Concat"), "final;")
+		// Chunked bodies have a length of -1
+		size := int64(max(c.Request().Header.ContentLength(), -1))
+
+		key := ClientKey(c)
+		if ok, wait := ratelimit.Get().AllowUpload(key, size, countUpload); !ok {
+			return RateLimited(c, wait, "upload_rate_limited", "Upload limit reached. Try again later.")
+		}
+		if size >= 0 {
+			return c.Next()
+		}
+
+		err := c.Next()
+		if n, ok := c.Locals(uploadBytesKey).(int64); ok {
+			ratelimit.Get().ChargeUploadBytes(key, n)
+		}
+		return err
+	}
+}
+
+// RecordUploadBytes records how many bytes a handler read from the request
+// body, for UploadRateLimit to charge bodies sent without a Content-Length
+func RecordUploadBytes(c *fiber.Ctx, n int64) {
+	c.Locals(uploadBytesKey, n)
+}
+
+// rangeDeferredKey marks a request whose charge DownloadRateLimit left to the handler
+const rangeDeferredKey = "range_deferred"
+
+// DownloadRateLimit limits how many downloads a client may start. Range
+// requests that leave out the start of the file are charged by the handler
+// with AllowDeferredDownload once it knows the file.
+func DownloadRateLimit() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if skipsStart(c) {
+			c.Locals(rangeDeferredKey, true)
+			return c.Next()
+		}
+
+		if ok, wait := ratelimit.Get().AllowDownload(ClientKey(c)); !ok {
+			return RateLimited(c, wait, "download_rate_limited", "Download limit reached. Try again later.")
+		}
+		return c.Next()
+	}
+}
+
+// AllowDeferredDownload charges a range request DownloadRateLimit left to the
+// handler. If counted, the request counts as a download; otherwise the n bytes
+// served add to what the client has fetched of the file, and a download is
+// taken each time that reaches size, so seeking and resuming are free but
+// fetching a file in pieces isn't.
+func AllowDeferredDownload(c *fiber.Ctx, fileID string, counted bool, n, size int64) (bool, time.Duration) {
+	if deferred, _ := c.Locals(rangeDeferredKey).(bool); !deferred {
+		return true, 0
+	}
+	if counted {
+		return ratelimit.Get().AllowDownload(ClientKey(c))
+	}
+	return ratelimit.Get().AllowRange(ClientKey(c), fileID, n, size)
+}
+
+// skipsStart reports whether a request only asks for byte ranges that leave
+// out the first byte. Suffix ranges, malformed headers and If-Range requests,
+// which may be answered with the whole file, are assumed to include it.
+func skipsStart(c *fiber.Ctx) bool {
+	spec, ok := strings.CutPrefix(c.Get(fiber.HeaderRange), "bytes=")
+	if !ok || c.Get(fiber.HeaderIfRange) != "" {
+		return false
+	}
+	for _, r := range strings.Split(spec, ",") {
+		start, _, ok := strings.Cut(strings.TrimSpace(r), "-")
+		if !ok {
+			return false
+		}
+		if n, err := strconv.ParseInt(start, 10, 64); err != nil || n == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// PasswordSubject identifies a client guessing the password of target, so
+// lockouts and resets apply to that target only
+func PasswordSubject(c *fiber.Ctx, target string) string {
+	return c.IP() + "|" + target
+}
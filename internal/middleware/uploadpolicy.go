@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/utils"
+	"go.uber.org/zap"
+)
+
+// Upload policies
+const (
+	// UploadPolicyPublic lets anyone upload
+	UploadPolicyPublic = "public"
+	// UploadPolicyAuthenticated requires a user or admin session, or an API key with the upload scope
+	UploadPolicyAuthenticated = "authenticated"
+	// UploadPolicyToken additionally accepts upload tokens
+	UploadPolicyToken = "token"
+	// UploadPolicyAllowlist additionally accepts upload tokens and requests from allowed networks
+	UploadPolicyAllowlist = "allowlist"
+)
+
+// UploadTokenHeader is the request header carrying an upload token
+const UploadTokenHeader = "X-Upload-Token"
+
+// UploadPolicy enforces cfg.UploadPolicy on requests that create uploads. It
+// must run after OptionalAPIKey and OptionalUser. A token use is given back if
+// the upload is rejected.
+func UploadPolicy(cfg *config.Config) (fiber.Handler, error) {
+	var allowed []netip.Prefix
+	switch cfg.UploadPolicy {
+	case UploadPolicyPublic, UploadPolicyAuthenticated, UploadPolicyToken:
+	case UploadPolicyAllowlist:
+		for _, entry := range cfg.UploadAllowedIPs {
+			prefix, err := parseAllowedIP(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid UPLOAD_ALLOWED_IPS entry %q: %w", entry, err)
+			}
+			allowed = append(allowed, prefix)
+		}
+		if len(allowed) == 0 {
+			logging.Warn("UPLOAD_POLICY is allowlist but UPLOAD_ALLOWED_IPS is empty; only authenticated uploads and upload tokens are accepted")
+		}
+	default:
+		return nil, fmt.Errorf("unknown upload policy %q", cfg.UploadPolicy)
+	}
+
+	tokens := database.NewUploadTokenRepository()
+
+	return func(c *fiber.Ctx) error {
+		if cfg.UploadPolicy == UploadPolicyPublic {
+			return c.Next()
+		}
+
+		// Concatenating finished partial uploads adds no data
+		if strings.HasPrefix(c.Get("Upload-Concat"), "final;") {
+			return c.Next()
+		}
+
+		if GetAPIKey(c) != nil || GetUser(c) != nil || hasAdminSession(c, cfg) {
+			return c.Next()
+		}
+
+		if cfg.UploadPolicy == UploadPolicyAllowlist && ipAllowed(c.IP(), allowed) {
+			return c.Next()
+		}
+
+		if cfg.UploadPolicy == UploadPolicyAuthenticated {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error":   "authentication_required",
+				"message": "Sign in or use an API key to upload files",
+			})
+		}
+
+		token := c.Get(UploadTokenHeader)
+		if token == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error":   "upload_token_required",
+				"message": "An upload token is required to upload files",
+			})
+		}
+
+		uploadToken := lookupUploadToken(tokens, token)
+		if uploadToken == nil {
+			return invalidUploadToken(c)
+		}
+		used, err := tokens.Use(uploadToken.ID)
+		if err != nil {
+			logging.Error("Failed to record upload token use", zap.Error(err), zap.String("token_id", uploadToken.ID))
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":   "upload_token_failed",
+				"message": "Failed to check upload token",
+			})
+		}
+		if !used {
+			// Used up by a concurrent upload
+			return invalidUploadToken(c)
+		}
+
+		err = c.Next()
+		if err != nil || c.Response().StatusCode() >= fiber.StatusBadRequest {
+			if releaseErr := tokens.Release(uploadToken.ID); releaseErr != nil {
+				logging.Warn("Failed to release upload token use", zap.Error(releaseErr), zap.String("token_id", uploadToken.ID))
+			}
+		}
+		return err
+	}, nil
+}
+
+// lookupUploadToken returns the active upload token matching token, or nil
+func lookupUploadToken(repo *database.UploadTokenRepository, token string) *database.UploadToken {
+	id, ok := utils.ParseUploadTokenID(token)
+	if !ok {
+		return nil
+	}
+
+	uploadToken, err := repo.GetByID(id)
+	if err != nil {
+		return nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(utils.HashToken(token)), []byte(uploadToken.TokenHash)) != 1 {
+		return nil
+	}
+	if !uploadToken.Active() {
+		return nil
+	}
+	return uploadToken
+}
+
+func invalidUploadToken(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"error":   "invalid_upload_token",
+		"message": "Invalid, expired, revoked or used up upload token",
+	})
+}
+
+// parseAllowedIP parses an IP address or CIDR range
+func parseAllowedIP(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// ipAllowed reports whether ip falls within one of the allowed ranges
+func ipAllowed(ip string, allowed []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/database"
+)
+
+// userLocal is the fiber.Ctx local holding the signed-in user
+const userLocal = "user"
+
+// GetUser returns the signed-in user, or nil
+func GetUser(c *fiber.Ctx) *database.User {
+	if user, ok := c.Locals(userLocal).(*database.User); ok {
+		return user
+	}
+	return nil
+}
+
+// UserAuth requires a signed-in user account
+func UserAuth(cfg *config.Config) fiber.Handler {
+	users := database.NewUserRepository()
+
+	return func(c *fiber.Ctx) error {
+		token := c.Cookies(authCookieName)
+		if token == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error":   "unauthorized",
+				"message": "Authentication required",
+			})
+		}
+
+		claims, ok := parseSession(cfg, token)
+		if !ok {
+			clearSession(c)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error":   "unauthorized",
+				"message": "Invalid or expired session",
+			})
+		}
+
+		// The ADMIN_PASSWORD session isn't a user and owns no files
+		if claims.Subject == adminSubject {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error":   "user_required",
+				"message": "Sign in with a user account",
+			})
+		}
+
+		user := sessionUser(users, claims)
+		if user == nil {
+			clearSession(c)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error":   "unauthorized",
+				"message": "Invalid or expired session",
+			})
+		}
+
+		c.Locals(userLocal, user)
+		return c.Next()
+	}
+}
+
+// OptionalUser identifies the signed-in user, if any, so their uploads are
+// attributed to them. Requests without a valid user session pass anonymously.
+func OptionalUser(cfg *config.Config) fiber.Handler {
+	users := database.NewUserRepository()
+
+	return func(c *fiber.Ctx) error {
+		if token := c.Cookies(authCookieName); token != "" {
+			if claims, ok := parseSession(cfg, token); ok && claims.Subject != adminSubject {
+				if user := sessionUser(users, claims); user != nil {
+					c.Locals(userLocal, user)
+				}
+			}
+		}
+		return c.Next()
+	}
+}
+
+// sessionUser returns the enabled user a session belongs to, or nil
+func sessionUser(users *database.UserRepository, claims *jwt.RegisteredClaims) *database.User {
+	user, err := users.GetByID(claims.Subject)
+	if err != nil || user.Disabled {
+		return nil
+	}
+	return user
+}
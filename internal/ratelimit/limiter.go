@@ -0,0 +1,386 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"go.uber.org/zap"
+)
+
+// Password scopes, each with its own failure count and lockout
+const (
+	ScopeLogin        = "login"
+	ScopeFilePassword = "file_password"
+)
+
+// Bucket policies
+const (
+	policyUploads     = "uploads"
+	policyUploadBytes = "upload_bytes"
+	policyDownloads   = "downloads"
+)
+
+// limitPeriod is the period over which a bucket refills completely
+const limitPeriod = time.Hour
+
+// entry is the state of a token bucket or a password lockout
+type entry struct {
+	tokens      float64
+	failures    int
+	lockedUntil time.Time
+	updated     time.Time
+	// expires is when the entry no longer affects anything and can be dropped
+	expires time.Time
+}
+
+// Limiter throttles uploads and downloads per client with token buckets and
+// locks clients out after repeated password failures. State is kept in memory
+// and optionally persisted to SQLite so restarts don't reset it.
+type Limiter struct {
+	cfg  *config.Config
+	repo *database.RateLimitRepository
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	// dirty holds keys changed or removed since the last Flush
+	dirty map[string]bool
+	// ranges holds the bytes of each file served to a client by range
+	// requests not yet counted as a download. It is not persisted.
+	ranges map[string]*rangeEntry
+}
+
+// rangeEntry tracks the bytes of a file served to a client in pieces
+type rangeEntry struct {
+	served  int64
+	expires time.Time
+}
+
+// Global limiter instance
+var limiter *Limiter
+
+// Init initializes the global limiter, restoring persisted state if enabled
+func Init(cfg *config.Config) *Limiter {
+	l := &Limiter{
+		cfg:     cfg,
+		entries: make(map[string]*entry),
+		dirty:   make(map[string]bool),
+		ranges:  make(map[string]*rangeEntry),
+	}
+
+	if cfg.RateLimitEnabled && cfg.RateLimitPersist {
+		l.repo = database.NewRateLimitRepository()
+		limits, err := l.repo.ListActive(time.Now())
+		if err != nil {
+			logging.Error("Failed to load rate limits", zap.Error(err))
+		}
+		for _, rl := range limits {
+			l.entries[rl.Key] = &entry{
+				tokens:      rl.Tokens,
+				failures:    rl.Failures,
+				lockedUntil: rl.LockedUntil.Time,
+				updated:     rl.UpdatedAt,
+				expires:     rl.ExpiresAt,
+			}
+		}
+		logging.Info("Rate limiter state restored", zap.Int("entries", len(limits)))
+	}
+
+	limiter = l
+	return l
+}
+
+// Get returns the global limiter, or nil if it wasn't initialized
+func Get() *Limiter {
+	return limiter
+}
+
+func (l *Limiter) enabled() bool {
+	return l != nil && l.cfg.RateLimitEnabled
+}
+
+// AllowUpload takes one upload and size bytes from the client's buckets. If
+// either is exhausted nothing is taken and the wait until a retry is returned.
+// countUpload is false for further chunks of an upload already counted. A size
+// of -1 means the length is unknown: the byte bucket must not be empty, and the
+// bytes are charged with ChargeUploadBytes once they have been read.
+func (l *Limiter) AllowUpload(subject string, size int64, countUpload bool) (bool, time.Duration) {
+	if !l.enabled() {
+		return true, 0
+	}
+
+	var takes []take
+	if countUpload && l.cfg.RateLimitUploads > 0 {
+		takes = append(takes, take{policyUploads + ":" + subject, l.cfg.RateLimitUploads, 1})
+	}
+	if size != 0 && l.cfg.RateLimitUploadBytes > 0 {
+		takes = append(takes, take{policyUploadBytes + ":" + subject, l.cfg.RateLimitUploadBytes, max(size, 0)})
+	}
+	return l.takeAll(takes)
+}
+
+// ChargeUploadBytes takes n bytes from the client's byte bucket after they
+// were read, leaving it in debt if it holds fewer
+func (l *Limiter) ChargeUploadBytes(subject string, n int64) {
+	if !l.enabled() || n <= 0 || l.cfg.RateLimitUploadBytes <= 0 {
+		return
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := policyUploadBytes + ":" + subject
+	e := l.refill(key, l.cfg.RateLimitUploadBytes, now)
+	e.tokens -= float64(n)
+	e.expires = now.Add(refillTime(float64(l.cfg.RateLimitUploadBytes)-e.tokens, l.cfg.RateLimitUploadBytes))
+	l.dirty[key] = true
+}
+
+// AllowDownload takes one download from the client's bucket
+func (l *Limiter) AllowDownload(subject string) (bool, time.Duration) {
+	if !l.enabled() || l.cfg.RateLimitDownloads <= 0 {
+		return true, 0
+	}
+	return l.takeAll([]take{{policyDownloads + ":" + subject, l.cfg.RateLimitDownloads, 1}})
+}
+
+// AllowRange adds n bytes of fileID served by a range request to what the
+// client has fetched of it in pieces, and takes a download each time that adds
+// up to size, so fetching a file piece by piece counts like downloading it.
+func (l *Limiter) AllowRange(subject, fileID string, n, size int64) (bool, time.Duration) {
+	if !l.enabled() || l.cfg.RateLimitDownloads <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := subject + ":" + fileID
+	r, ok := l.ranges[key]
+	if !ok || !now.Before(r.expires) {
+		r = &rangeEntry{}
+		l.ranges[key] = r
+	}
+
+	served := r.served + n
+	if served >= size {
+		if ok, wait := l.takeLocked([]take{{policyDownloads + ":" + subject, l.cfg.RateLimitDownloads, 1}}, now); !ok {
+			return false, wait
+		}
+		served = 0
+	}
+	r.served = served
+	r.expires = now.Add(limitPeriod)
+	return true, 0
+}
+
+// take is a request for n tokens from the bucket at key, which holds up to limit tokens
+type take struct {
+	key   string
+	limit int64
+	n     int64
+}
+
+// takeAll takes tokens from every bucket, or from none if any would have to wait.
+// A request larger than a bucket is allowed once it is full and leaves it in debt;
+// one for no tokens still needs a bucket that is not empty.
+func (l *Limiter) takeAll(takes []take) (bool, time.Duration) {
+	if len(takes) == 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.takeLocked(takes, time.Now())
+}
+
+// takeLocked is takeAll for callers holding l.mu
+func (l *Limiter) takeLocked(takes []take, now time.Time) (bool, time.Duration) {
+	var wait time.Duration
+	for _, t := range takes {
+		e := l.refill(t.key, t.limit, now)
+		need := float64(min(max(t.n, 1), t.limit))
+		if e.tokens < need {
+			wait = max(wait, refillTime(need-e.tokens, t.limit))
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	for _, t := range takes {
+		e := l.entries[t.key]
+		e.tokens -= float64(t.n)
+		e.expires = now.Add(refillTime(float64(t.limit)-e.tokens, t.limit))
+		l.dirty[t.key] = true
+	}
+	return true, 0
+}
+
+// refill returns the bucket at key topped up for the time since it was last updated
+func (l *Limiter) refill(key string, limit int64, now time.Time) *entry {
+	e, ok := l.entries[key]
+	if !ok {
+		e = &entry{tokens: float64(limit), updated: now, expires: now}
+		l.entries[key] = e
+		return e
+	}
+
+	elapsed := now.Sub(e.updated)
+	if elapsed > 0 {
+		e.tokens = math.Min(float64(limit), e.tokens+elapsed.Seconds()*float64(limit)/limitPeriod.Seconds())
+		e.updated = now
+	}
+	return e
+}
+
+// refillTime returns how long a bucket holding limit tokens takes to refill tokens
+func refillTime(tokens float64, limit int64) time.Duration {
+	return time.Duration(tokens / float64(limit) * float64(limitPeriod))
+}
+
+// Locked returns how long the client remains locked out of scope, or 0
+func (l *Limiter) Locked(scope, subject string) time.Duration {
+	if !l.enabled() || l.cfg.RateLimitPasswordAttempts <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.entries[scope+":"+subject]; ok {
+		if wait := time.Until(e.lockedUntil); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// Fail records a wrong password and returns the lockout it triggered, if any.
+// Once the allowed attempts are used up, every further failure doubles the
+// lockout up to RateLimitMaxLockout.
+func (l *Limiter) Fail(scope, subject string) time.Duration {
+	if !l.enabled() || l.cfg.RateLimitPasswordAttempts <= 0 {
+		return 0
+	}
+
+	key := scope + ":" + subject
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok {
+		e = &entry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.updated = now
+
+	var lockout time.Duration
+	if excess := e.failures - l.cfg.RateLimitPasswordAttempts; excess >= 0 {
+		lockout = l.cfg.RateLimitLockout
+		for i := 0; i < excess && lockout < l.cfg.RateLimitMaxLockout; i++ {
+			lockout *= 2
+		}
+		lockout = min(lockout, l.cfg.RateLimitMaxLockout)
+		e.lockedUntil = now.Add(lockout)
+	}
+
+	// Failures are forgotten after a quiet period as long as the longest lockout
+	e.expires = now.Add(lockout + l.cfg.RateLimitMaxLockout)
+	l.dirty[key] = true
+	return lockout
+}
+
+// Succeed clears the client's failures after a correct password
+func (l *Limiter) Succeed(scope, subject string) {
+	if !l.enabled() {
+		return
+	}
+
+	key := scope + ":" + subject
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.entries[key]; ok {
+		delete(l.entries, key)
+		l.dirty[key] = true
+	}
+}
+
+// Sweep drops entries that no longer affect anything
+func (l *Limiter) Sweep() {
+	if !l.enabled() {
+		return
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, e := range l.entries {
+		if !now.Before(e.expires) {
+			delete(l.entries, key)
+			l.dirty[key] = true
+		}
+	}
+	for key, r := range l.ranges {
+		if !now.Before(r.expires) {
+			delete(l.ranges, key)
+		}
+	}
+}
+
+// Flush writes changed entries to the database when persistence is enabled
+func (l *Limiter) Flush() error {
+	if !l.enabled() || l.repo == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	var limits []*database.RateLimit
+	var deleted []string
+	for key := range l.dirty {
+		e, ok := l.entries[key]
+		if !ok {
+			deleted = append(deleted, key)
+			continue
+		}
+		limits = append(limits, &database.RateLimit{
+			Key:         key,
+			Tokens:      e.tokens,
+			Failures:    e.failures,
+			LockedUntil: sql.NullTime{Time: e.lockedUntil, Valid: !e.lockedUntil.IsZero()},
+			UpdatedAt:   e.updated,
+			ExpiresAt:   e.expires,
+		})
+	}
+	dirty := l.dirty
+	l.dirty = make(map[string]bool)
+	l.mu.Unlock()
+
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	if err := l.repo.Save(limits, deleted); err != nil {
+		// Try again on the next flush
+		l.mu.Lock()
+		for key := range dirty {
+			l.dirty[key] = true
+		}
+		l.mu.Unlock()
+		return err
+	}
+
+	_, err := l.repo.DeleteExpired(time.Now())
+	return err
+}
@@ -0,0 +1,216 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/salman0ansari/whatsbox/internal/config"
+)
+
+// newTestLimiter returns an in-memory limiter without touching the global one
+func newTestLimiter(uploads, uploadBytes, downloads int64) *Limiter {
+	return &Limiter{
+		cfg: &config.Config{
+			RateLimitEnabled:     true,
+			RateLimitUploads:     uploads,
+			RateLimitUploadBytes: uploadBytes,
+			RateLimitDownloads:   downloads,
+		},
+		entries: make(map[string]*entry),
+		dirty:   make(map[string]bool),
+		ranges:  make(map[string]*rangeEntry),
+	}
+}
+
+// takeStep takes n tokens at a time after the start and expects ok and wait
+type takeStep struct {
+	at   time.Duration
+	n    int64
+	ok   bool
+	wait time.Duration
+}
+
+func TestTakeLocked(t *testing.T) {
+	start := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	const limit = 60 // one token a minute
+
+	tests := []struct {
+		name  string
+		steps []takeStep
+	}{
+		{
+			name: "drain and refill",
+			steps: []takeStep{
+				{0, limit, true, 0},
+				{0, 1, false, time.Minute},
+				{30 * time.Second, 1, false, 30 * time.Second},
+				{time.Minute, 1, true, 0},
+				{time.Minute, 1, false, time.Minute},
+			},
+		},
+		{
+			name: "refill stops at the limit",
+			steps: []takeStep{
+				{0, 1, true, 0},
+				{10 * time.Hour, limit, true, 0},
+				{10 * time.Hour, 1, false, time.Minute},
+			},
+		},
+		{
+			name: "oversized take waits for a full bucket and leaves debt",
+			steps: []takeStep{
+				{0, 1, true, 0},
+				{0, 2 * limit, false, time.Minute},
+				{time.Minute, 2 * limit, true, 0},
+				// limit tokens of debt take a period to repay, plus a minute for the next token
+				{time.Minute, 1, false, time.Hour + time.Minute},
+				{2*time.Hour + time.Minute, 1, true, 0},
+			},
+		},
+		{
+			name: "empty take needs a token",
+			steps: []takeStep{
+				{0, 0, true, 0},
+				{0, limit, true, 0},
+				{0, 0, false, time.Minute},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLimiter(0, 0, 0)
+			for i, step := range tt.steps {
+				ok, wait := l.takeLocked([]take{{"test", limit, step.n}}, start.Add(step.at))
+				if ok != step.ok || wait.Round(time.Second) != step.wait {
+					t.Fatalf("step %d: take %d at %s = %v, %s; want %v, %s", i, step.n, step.at, ok, wait, step.ok, step.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestTakeLockedAllOrNothing(t *testing.T) {
+	l := newTestLimiter(0, 0, 0)
+	now := time.Now()
+
+	if ok, _ := l.takeLocked([]take{{"a", 10, 10}}, now); !ok {
+		t.Fatal("first take from a was refused")
+	}
+	if ok, _ := l.takeLocked([]take{{"a", 10, 1}, {"b", 10, 5}}, now); ok {
+		t.Fatal("take from empty a and full b was allowed")
+	}
+	if tokens := l.entries["b"].tokens; tokens != 10 {
+		t.Errorf("b holds %v tokens after a refused take, want 10", tokens)
+	}
+}
+
+func TestAllowUpload(t *testing.T) {
+	l := newTestLimiter(2, 100, 0)
+
+	if ok, _ := l.AllowUpload("client", 60, true); !ok {
+		t.Fatal("first upload refused")
+	}
+	// A further chunk of the same upload only takes bytes
+	if ok, _ := l.AllowUpload("client", 40, false); !ok {
+		t.Fatal("further chunk refused")
+	}
+	if ok, wait := l.AllowUpload("client", 10, true); ok || wait <= 0 {
+		t.Fatalf("upload over the byte limit = %v, %s; want refused with a wait", ok, wait)
+	}
+	if tokens := l.entries[policyUploads+":client"].tokens; tokens < 1 || tokens > 1.01 {
+		t.Errorf("refused upload took from the upload bucket, which holds %v", tokens)
+	}
+
+	// Another client has its own buckets
+	if ok, _ := l.AllowUpload("other", 100, true); !ok {
+		t.Fatal("upload from another client refused")
+	}
+}
+
+func TestAllowUploadUnknownSize(t *testing.T) {
+	l := newTestLimiter(0, 100, 0)
+
+	if ok, _ := l.AllowUpload("client", -1, true); !ok {
+		t.Fatal("upload of unknown size refused with a full bucket")
+	}
+	if tokens := l.entries[policyUploadBytes+":client"].tokens; tokens != 100 {
+		t.Errorf("upload of unknown size took %v bytes before they were read", 100-tokens)
+	}
+
+	l.ChargeUploadBytes("client", 150)
+	if tokens := l.entries[policyUploadBytes+":client"].tokens; tokens > -49 {
+		t.Errorf("bucket holds %v after charging 150 bytes, want about -50", tokens)
+	}
+	if ok, wait := l.AllowUpload("client", -1, true); ok || wait < 30*time.Minute {
+		t.Fatalf("upload with the bucket in debt = %v, %s; want refused for over half a period", ok, wait)
+	}
+}
+
+func TestAllowDownload(t *testing.T) {
+	l := newTestLimiter(0, 0, 2)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.AllowDownload("client"); !ok {
+			t.Fatalf("download %d refused", i+1)
+		}
+	}
+	if ok, wait := l.AllowDownload("client"); ok || wait.Round(time.Minute) != 30*time.Minute {
+		t.Fatalf("third download = %v, %s; want refused for 30m", ok, wait)
+	}
+}
+
+func TestAllowRange(t *testing.T) {
+	l := newTestLimiter(0, 0, 1)
+
+	// Pieces of a 100 byte file take a download once they add up to it
+	for i, n := range []int64{40, 40} {
+		if ok, _ := l.AllowRange("client", "file", n, 100); !ok {
+			t.Fatalf("piece %d refused", i+1)
+		}
+	}
+	if _, ok := l.entries[policyDownloads+":client"]; ok {
+		t.Fatal("a download was taken before the pieces added up to the file")
+	}
+	if ok, _ := l.AllowRange("client", "file", 40, 100); !ok {
+		t.Fatal("piece completing the file refused")
+	}
+	if tokens := l.entries[policyDownloads+":client"].tokens; tokens > 0.01 {
+		t.Errorf("download bucket holds %v after the file was completed, want 0", tokens)
+	}
+
+	// The count starts over, so the next complete file is refused
+	if ok, _ := l.AllowRange("client", "file", 60, 100); !ok {
+		t.Fatal("piece of the second copy refused")
+	}
+	if ok, wait := l.AllowRange("client", "file", 60, 100); ok || wait <= 0 {
+		t.Fatalf("piece completing the second copy = %v, %s; want refused", ok, wait)
+	}
+	if served := l.ranges["client:file"].served; served != 60 {
+		t.Errorf("refused piece changed the bytes served to %d, want 60", served)
+	}
+
+	// Pieces of different files are counted apart
+	if ok, _ := l.AllowRange("client", "other", 50, 100); !ok {
+		t.Fatal("piece of another file refused")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	l := newTestLimiter(1, 1, 1)
+	l.cfg.RateLimitEnabled = false
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.AllowUpload("client", 10, true); !ok {
+			t.Fatal("upload refused with rate limiting disabled")
+		}
+		if ok, _ := l.AllowDownload("client"); !ok {
+			t.Fatal("download refused with rate limiting disabled")
+		}
+	}
+
+	var nilLimiter *Limiter
+	if ok, _ := nilLimiter.AllowDownload("client"); !ok {
+		t.Fatal("download refused by a nil limiter")
+	}
+}
@@ -10,33 +10,43 @@ import (
 	"go.uber.org/zap"
 )
 
-// Collector tracks real-time statistics for the service
+// Collector tracks real-time statistics for the service.
+//
+// Every event is counted twice: in totals, which only grow while the server
+// runs, and in pending, the changes per hour not yet added to stats_hourly.
+// FlushHourly hands pending over to the database, so each event is stored
+// exactly once no matter how often it runs or when the server restarts.
 type Collector struct {
-	// Counters (use atomic for thread safety)
-	uploadsTotal    int64
-	downloadsTotal  int64
-	bytesUploaded   int64
-	bytesDownloaded int64
+	// Counters since startup, never reset (use atomic for thread safety)
+	totals Totals
 
 	// Gauges (current values)
 	activeUploads   int64
 	activeDownloads int64
 
-	// Error counters
-	uploadErrors   int64
-	downloadErrors int64
-
 	// Session stats (reset on restart)
 	startTime time.Time
 
 	// For persisting to database
 	statsRepo *database.StatsRepository
-	mu        sync.RWMutex
+	mu        sync.Mutex
+	pending   map[time.Time]*database.StatsHourly
+}
+
+// Totals are counters accumulated since the server started
+type Totals struct {
+	Uploads         int64
+	Downloads       int64
+	BytesUploaded   int64
+	BytesDownloaded int64
+	UploadErrors    int64
+	DownloadErrors  int64
+	Requests        int64
 }
 
 // Stats represents a snapshot of current statistics
 type Stats struct {
-	// Counters
+	// Counters since startup
 	UploadsTotal    int64 `json:"uploads_total"`
 	DownloadsTotal  int64 `json:"downloads_total"`
 	BytesUploaded   int64 `json:"bytes_uploaded"`
@@ -50,6 +60,8 @@ type Stats struct {
 	UploadErrors   int64 `json:"upload_errors"`
 	DownloadErrors int64 `json:"download_errors"`
 
+	Requests int64 `json:"requests"`
+
 	// Session info
 	UptimeSeconds int64  `json:"uptime_seconds"`
 	StartTime     string `json:"start_time"`
@@ -67,6 +79,7 @@ func Init() *Collector {
 		collector = &Collector{
 			startTime: time.Now(),
 			statsRepo: database.NewStatsRepository(),
+			pending:   make(map[time.Time]*database.StatsHourly),
 		}
 		logging.Info("Stats collector initialized")
 	})
@@ -81,24 +94,49 @@ func Get() *Collector {
 	return collector
 }
 
+// record adds an event to the current hour's pending stats
+func (c *Collector) record(update func(*database.StatsHourly)) {
+	hour := time.Now().Truncate(time.Hour)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.pending[hour]
+	if !ok {
+		s = &database.StatsHourly{Hour: hour}
+		c.pending[hour] = s
+	}
+	update(s)
+}
+
 // IncrementUploads increments the upload counter
 func (c *Collector) IncrementUploads() {
-	atomic.AddInt64(&c.uploadsTotal, 1)
+	atomic.AddInt64(&c.totals.Uploads, 1)
+	c.record(func(s *database.StatsHourly) { s.Uploads++ })
 }
 
 // IncrementDownloads increments the download counter
 func (c *Collector) IncrementDownloads() {
-	atomic.AddInt64(&c.downloadsTotal, 1)
+	atomic.AddInt64(&c.totals.Downloads, 1)
+	c.record(func(s *database.StatsHourly) { s.Downloads++ })
 }
 
 // AddBytesUploaded adds to the bytes uploaded counter
 func (c *Collector) AddBytesUploaded(bytes int64) {
-	atomic.AddInt64(&c.bytesUploaded, bytes)
+	if bytes <= 0 {
+		return
+	}
+	atomic.AddInt64(&c.totals.BytesUploaded, bytes)
+	c.record(func(s *database.StatsHourly) { s.UploadBytes += bytes })
 }
 
 // AddBytesDownloaded adds to the bytes downloaded counter
 func (c *Collector) AddBytesDownloaded(bytes int64) {
-	atomic.AddInt64(&c.bytesDownloaded, bytes)
+	if bytes <= 0 {
+		return
+	}
+	atomic.AddInt64(&c.totals.BytesDownloaded, bytes)
+	c.record(func(s *database.StatsHourly) { s.DownloadBytes += bytes })
 }
 
 // IncrementActiveUploads increments active upload count
@@ -123,67 +161,97 @@ func (c *Collector) DecrementActiveDownloads() {
 
 // IncrementUploadErrors increments upload error count
 func (c *Collector) IncrementUploadErrors() {
-	atomic.AddInt64(&c.uploadErrors, 1)
+	atomic.AddInt64(&c.totals.UploadErrors, 1)
+	c.record(func(s *database.StatsHourly) { s.FailedUploads++ })
 }
 
 // IncrementDownloadErrors increments download error count
 func (c *Collector) IncrementDownloadErrors() {
-	atomic.AddInt64(&c.downloadErrors, 1)
+	atomic.AddInt64(&c.totals.DownloadErrors, 1)
+	c.record(func(s *database.StatsHourly) { s.FailedDownloads++ })
+}
+
+// IncrementRequests increments the handled request count
+func (c *Collector) IncrementRequests() {
+	atomic.AddInt64(&c.totals.Requests, 1)
+	c.record(func(s *database.StatsHourly) { s.Requests++ })
 }
 
 // GetStats returns a snapshot of current statistics
 func (c *Collector) GetStats() *Stats {
+	totals := c.GetTotals()
 	return &Stats{
-		UploadsTotal:    atomic.LoadInt64(&c.uploadsTotal),
-		DownloadsTotal:  atomic.LoadInt64(&c.downloadsTotal),
-		BytesUploaded:   atomic.LoadInt64(&c.bytesUploaded),
-		BytesDownloaded: atomic.LoadInt64(&c.bytesDownloaded),
+		UploadsTotal:    totals.Uploads,
+		DownloadsTotal:  totals.Downloads,
+		BytesUploaded:   totals.BytesUploaded,
+		BytesDownloaded: totals.BytesDownloaded,
 		ActiveUploads:   atomic.LoadInt64(&c.activeUploads),
 		ActiveDownloads: atomic.LoadInt64(&c.activeDownloads),
-		UploadErrors:    atomic.LoadInt64(&c.uploadErrors),
-		DownloadErrors:  atomic.LoadInt64(&c.downloadErrors),
+		UploadErrors:    totals.UploadErrors,
+		DownloadErrors:  totals.DownloadErrors,
+		Requests:        totals.Requests,
 		UptimeSeconds:   int64(time.Since(c.startTime).Seconds()),
 		StartTime:       c.startTime.Format(time.RFC3339),
 	}
 }
 
+// GetTotals returns the counters accumulated since the server started
+func (c *Collector) GetTotals() Totals {
+	return Totals{
+		Uploads:         atomic.LoadInt64(&c.totals.Uploads),
+		Downloads:       atomic.LoadInt64(&c.totals.Downloads),
+		BytesUploaded:   atomic.LoadInt64(&c.totals.BytesUploaded),
+		BytesDownloaded: atomic.LoadInt64(&c.totals.BytesDownloaded),
+		UploadErrors:    atomic.LoadInt64(&c.totals.UploadErrors),
+		DownloadErrors:  atomic.LoadInt64(&c.totals.DownloadErrors),
+		Requests:        atomic.LoadInt64(&c.totals.Requests),
+	}
+}
+
 // GetActiveTransfers returns total active transfers (uploads + downloads)
 func (c *Collector) GetActiveTransfers() int64 {
 	return atomic.LoadInt64(&c.activeUploads) + atomic.LoadInt64(&c.activeDownloads)
 }
 
-// FlushHourly persists hourly stats to the database
+// FlushHourly adds the stats recorded since the last flush to stats_hourly.
+// Stats that fail to save are kept and retried on the next flush.
 func (c *Collector) FlushHourly() error {
-	stats := c.GetStats()
-	hourStart := time.Now().Truncate(time.Hour)
-
-	hourlyStats := &database.StatsHourly{
-		Hour:            hourStart,
-		Uploads:         stats.UploadsTotal,
-		Downloads:       stats.DownloadsTotal,
-		UploadBytes:     stats.BytesUploaded,
-		DownloadBytes:   stats.BytesDownloaded,
-		FailedUploads:   stats.UploadErrors,
-		FailedDownloads: stats.DownloadErrors,
-		Requests:        0, // Can be tracked via middleware if needed
-	}
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[time.Time]*database.StatsHourly)
+	c.mu.Unlock()
 
-	if err := c.statsRepo.SaveHourly(hourlyStats); err != nil {
-		logging.Error("Failed to save hourly stats", zap.Error(err))
-		return err
+	var firstErr error
+	for hour, s := range pending {
+		if err := c.statsRepo.SaveHourly(s); err != nil {
+			logging.Error("Failed to save hourly stats", zap.Error(err), zap.Time("hour", hour))
+			c.restore(s)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		logging.Debug("Hourly stats flushed", zap.Time("hour", hour))
 	}
 
-	logging.Debug("Hourly stats flushed", zap.Time("hour", hourStart))
-	return nil
+	return firstErr
 }
 
-// Reset resets all counters (typically after flushing)
-func (c *Collector) Reset() {
-	atomic.StoreInt64(&c.uploadsTotal, 0)
-	atomic.StoreInt64(&c.downloadsTotal, 0)
-	atomic.StoreInt64(&c.bytesUploaded, 0)
-	atomic.StoreInt64(&c.bytesDownloaded, 0)
-	atomic.StoreInt64(&c.uploadErrors, 0)
-	atomic.StoreInt64(&c.downloadErrors, 0)
-	// Note: active counters are not reset as they represent current state
+// restore merges stats that couldn't be saved back into pending
+func (c *Collector) restore(s *database.StatsHourly) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pending[s.Hour]
+	if !ok {
+		c.pending[s.Hour] = s
+		return
+	}
+	p.Uploads += s.Uploads
+	p.Downloads += s.Downloads
+	p.UploadBytes += s.UploadBytes
+	p.DownloadBytes += s.DownloadBytes
+	p.FailedUploads += s.FailedUploads
+	p.FailedDownloads += s.FailedDownloads
+	p.Requests += s.Requests
 }
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// DiskBackend stores files on the local filesystem
+type DiskBackend struct {
+	dir string
+}
+
+// NewDiskBackend creates a backend storing files under dir
+func NewDiskBackend(dir string) *DiskBackend {
+	return &DiskBackend{dir: dir}
+}
+
+// Name implements Backend
+func (b *DiskBackend) Name() string {
+	return BackendDisk
+}
+
+// Available implements Backend
+func (b *DiskBackend) Available() bool {
+	return true
+}
+
+// Put implements Backend. The file is written under a temporary name and only
+// renamed into place once complete.
+func (b *DiskBackend) Put(ctx context.Context, r io.Reader, size int64, mimeType string) (*Object, error) {
+	key := uuid.NewString()
+	path, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write file: %w", err)
+	}
+	if size >= 0 && written != size {
+		return nil, fmt.Errorf("wrote %d bytes, expected %d", written, size)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, fmt.Errorf("failed to store file: %w", err)
+	}
+
+	return &Object{Key: key, Size: written, MimeType: mimeType}, nil
+}
+
+// Get implements Backend
+func (b *DiskBackend) Get(ctx context.Context, obj *Object) (io.ReadCloser, error) {
+	return b.open(obj)
+}
+
+// GetRange implements Backend
+func (b *DiskBackend) GetRange(ctx context.Context, obj *Object, offset, length int64) (io.ReadCloser, error) {
+	file, err := b.open(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek: %w", err)
+	}
+
+	return &limitedReadCloser{Reader: io.LimitReader(file, length), Closer: file}, nil
+}
+
+// Stat implements Backend
+func (b *DiskBackend) Stat(ctx context.Context, obj *Object) (*Info, error) {
+	path, err := b.path(obj.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &Info{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete implements Backend
+func (b *DiskBackend) Delete(ctx context.Context, obj *Object) error {
+	path, err := b.path(obj.Key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// open opens the file holding an object
+func (b *DiskBackend) open(obj *Object) (*os.File, error) {
+	path, err := b.path(obj.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// path returns where an object is stored, spreading files over subdirectories
+func (b *DiskBackend) path(key string) (string, error) {
+	if len(key) < 2 || strings.ContainsAny(key, `/\.`) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(b.dir, key[:2], key), nil
+}
@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/salman0ansari/whatsbox/internal/config"
+)
+
+const (
+	// unsignedPayload skips hashing request bodies, which would need a second pass
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// s3TimeFormat is the timestamp format used by AWS Signature Version 4
+	s3TimeFormat = "20060102T150405Z"
+)
+
+// S3Backend stores files in an S3-compatible bucket such as AWS S3 or MinIO
+type S3Backend struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+}
+
+// NewS3Backend creates a backend for the bucket described by the configuration
+func NewS3Backend(cfg *config.Config) (*S3Backend, error) {
+	if cfg.S3Endpoint == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT is required when S3_BUCKET is set")
+	}
+	if cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+		return nil, fmt.Errorf("S3_ACCESS_KEY and S3_SECRET_KEY are required when S3_BUCKET is set")
+	}
+
+	scheme := "https"
+	if !cfg.S3UseSSL {
+		scheme = "http"
+	}
+
+	// Accept the endpoint with or without a scheme
+	host := strings.TrimSuffix(cfg.S3Endpoint, "/")
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	return &S3Backend{
+		endpoint:  &url.URL{Scheme: scheme, Host: host},
+		region:    cfg.S3Region,
+		bucket:    cfg.S3Bucket,
+		accessKey: cfg.S3AccessKey,
+		secretKey: cfg.S3SecretKey,
+		pathStyle: cfg.S3PathStyle,
+		client:    &http.Client{},
+	}, nil
+}
+
+// Name implements Backend
+func (b *S3Backend) Name() string {
+	return BackendS3
+}
+
+// Available implements Backend
+func (b *S3Backend) Available() bool {
+	return true
+}
+
+// Put implements Backend
+func (b *S3Backend) Put(ctx context.Context, r io.Reader, size int64, mimeType string) (*Object, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("object size must be known for S3 uploads")
+	}
+
+	key := uuid.NewString()
+	header := http.Header{}
+	if mimeType != "" {
+		header.Set("Content-Type", mimeType)
+	}
+
+	// A zero length body with a reader would be sent chunked
+	body := r
+	if size == 0 {
+		body = http.NoBody
+	}
+
+	resp, cancel, err := b.do(ctx, http.MethodPut, key, body, size, header)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp)
+	}
+
+	return &Object{Key: key, Size: size, MimeType: mimeType}, nil
+}
+
+// Get implements Backend
+func (b *S3Backend) Get(ctx context.Context, obj *Object) (io.ReadCloser, error) {
+	_, body, err := b.get(ctx, obj.Key, "")
+	return body, err
+}
+
+// GetRange implements Backend. If the server ignores the range and sends the
+// whole object, the bytes before the range are skipped.
+func (b *S3Backend) GetRange(ctx context.Context, obj *Object, offset, length int64) (io.ReadCloser, error) {
+	byteRange := fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	resp, body, err := b.get(ctx, obj.Key, byteRange)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", offset, offset+length-1)) {
+			body.Close()
+			return nil, fmt.Errorf("unexpected Content-Range %q for %s", resp.Header.Get("Content-Range"), byteRange)
+		}
+	} else if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+		body.Close()
+		return nil, fmt.Errorf("failed to skip to range start: %w", err)
+	}
+
+	return &limitedReadCloser{Reader: io.LimitReader(body, length), Closer: body}, nil
+}
+
+// get opens an object, optionally limited to byteRange. The response is
+// returned for its status and headers; its body is read through the returned reader.
+func (b *S3Backend) get(ctx context.Context, key, byteRange string) (*http.Response, io.ReadCloser, error) {
+	header := http.Header{}
+	if byteRange != "" {
+		header.Set("Range", byteRange)
+	}
+
+	resp, cancel, err := b.do(ctx, http.MethodGet, key, nil, 0, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer cancel()
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, s3Error(resp)
+	}
+
+	return resp, &limitedReadCloser{Reader: resp.Body, Closer: closerFunc(func() error {
+		err := resp.Body.Close()
+		cancel()
+		return err
+	})}, nil
+}
+
+// Stat implements Backend
+func (b *S3Backend) Stat(ctx context.Context, obj *Object) (*Info, error) {
+	resp, cancel, err := b.do(ctx, http.MethodHead, obj.Key, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	default:
+		return nil, s3Error(resp)
+	}
+
+	info := &Info{Size: resp.ContentLength}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info, nil
+}
+
+// Delete implements Backend
+func (b *S3Backend) Delete(ctx context.Context, obj *Object) error {
+	resp, cancel, err := b.do(ctx, http.MethodDelete, obj.Key, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// do sends a signed request for an object. The response body outlives ctx once
+// the headers have been received; the returned cancel func releases it.
+func (b *S3Backend) do(ctx context.Context, method, key string, body io.Reader, size int64, header http.Header) (*http.Response, context.CancelFunc, error) {
+	reqCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+
+	req, err := http.NewRequestWithContext(reqCtx, method, b.objectURL(key).String(), body)
+	if err != nil {
+		stop()
+		cancel()
+		return nil, nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	b.sign(req, unsignedPayload, time.Now())
+
+	resp, err := b.client.Do(req)
+	if !stop() && err == nil {
+		// ctx expired while the response was arriving
+		resp.Body.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("s3 %s failed: %w", method, err)
+	}
+
+	return resp, cancel, nil
+}
+
+// objectURL returns the URL of an object using path or virtual-host style addressing
+func (b *S3Backend) objectURL(key string) *url.URL {
+	u := *b.endpoint
+	if b.pathStyle {
+		u.Path = "/" + b.bucket + "/" + key
+	} else {
+		u.Host = b.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	return &u
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req
+func (b *S3Backend) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3TimeFormat)
+	date := amzDate[:8]
+	scope := date + "/" + b.region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Sign the host plus every x-amz-*, content-type and range header
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+b.secretKey), date)
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 computes an HMAC-SHA256 of data
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Error describes an unexpected S3 response
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		msg = strconv.Itoa(resp.StatusCode)
+	}
+	return fmt.Errorf("s3 returned %s: %s", resp.Status, msg)
+}
+
+// closerFunc adapts a function to io.Closer
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
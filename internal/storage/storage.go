@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/whatsapp"
+)
+
+// Backend names as stored in the files table
+const (
+	BackendWhatsApp = "whatsapp"
+	BackendDisk     = "disk"
+	BackendS3       = "s3"
+)
+
+var (
+	// ErrUnavailable is returned when no backend can accept uploads
+	ErrUnavailable = errors.New("no storage backend available")
+
+	// ErrNotFound is returned when a stored object no longer exists
+	ErrNotFound = errors.New("object not found")
+)
+
+// Object locates stored content and carries what is needed to read it back.
+// WhatsApp media is addressed by its direct path and decrypted with its keys;
+// other backends only use Key.
+type Object struct {
+	Key         string
+	Account     string
+	MediaKey    []byte
+	FileEncHash []byte
+	FileSHA256  []byte
+	Size        int64
+	MimeType    string
+}
+
+// Info describes a stored object
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend stores file contents.
+//
+// Readers returned by Get and GetRange stream the content; the context only
+// bounds establishing the stream and the caller must Close the reader.
+type Backend interface {
+	// Name returns the backend name recorded for files stored in it
+	Name() string
+
+	// Available reports whether the backend can currently store and serve files
+	Available() bool
+
+	// Put stores size bytes read from r and returns the new object
+	Put(ctx context.Context, r io.Reader, size int64, mimeType string) (*Object, error)
+
+	// Get opens the whole object for reading
+	Get(ctx context.Context, obj *Object) (io.ReadCloser, error)
+
+	// GetRange opens length bytes of the object starting at offset
+	GetRange(ctx context.Context, obj *Object, offset, length int64) (io.ReadCloser, error)
+
+	// Stat checks that the object exists and describes it
+	Stat(ctx context.Context, obj *Object) (*Info, error)
+
+	// Delete removes the object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, obj *Object) error
+}
+
+// Manager holds the configured backends and picks one for new uploads
+type Manager struct {
+	backends map[string]Backend
+	primary  Backend
+	fallback Backend
+}
+
+// NewManager creates the backends described by the configuration
+func NewManager(cfg *config.Config, waPool *whatsapp.Pool) (*Manager, error) {
+	m := &Manager{
+		backends: map[string]Backend{
+			BackendWhatsApp: NewWhatsAppBackend(waPool),
+			BackendDisk:     NewDiskBackend(cfg.DiskStoragePath),
+		},
+	}
+
+	if cfg.S3Bucket != "" {
+		s3, err := NewS3Backend(cfg)
+		if err != nil {
+			return nil, err
+		}
+		m.backends[BackendS3] = s3
+	}
+
+	primary, err := m.Get(cfg.StorageBackend)
+	if err != nil {
+		return nil, fmt.Errorf("invalid STORAGE_BACKEND: %w", err)
+	}
+	m.primary = primary
+
+	if cfg.StorageFallback != "" && cfg.StorageFallback != cfg.StorageBackend {
+		fallback, err := m.Get(cfg.StorageFallback)
+		if err != nil {
+			return nil, fmt.Errorf("invalid STORAGE_FALLBACK: %w", err)
+		}
+		m.fallback = fallback
+	}
+
+	return m, nil
+}
+
+// Get returns the backend with the given name
+func (m *Manager) Get(name string) (Backend, error) {
+	backend, ok := m.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("storage backend %q is not configured", name)
+	}
+	return backend, nil
+}
+
+// ForUpload returns the backend new files should be stored in, falling back
+// when the primary backend is unavailable
+func (m *Manager) ForUpload() (Backend, error) {
+	if m.primary.Available() {
+		return m.primary, nil
+	}
+	if m.fallback != nil && m.fallback.Available() {
+		return m.fallback, nil
+	}
+	return nil, ErrUnavailable
+}
+
+// Available reports whether new uploads can currently be stored
+func (m *Manager) Available() bool {
+	_, err := m.ForUpload()
+	return err == nil
+}
+
+// limitedReadCloser pairs a reader with the closer of the stream it reads from
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"github.com/salman0ansari/whatsbox/internal/utils"
+	"github.com/salman0ansari/whatsbox/internal/whatsapp"
+)
+
+// WhatsAppBackend stores files as encrypted media on WhatsApp's CDN
+type WhatsAppBackend struct {
+	pool *whatsapp.Pool
+}
+
+// NewWhatsAppBackend creates a backend that uploads through the linked accounts
+func NewWhatsAppBackend(pool *whatsapp.Pool) *WhatsAppBackend {
+	return &WhatsAppBackend{pool: pool}
+}
+
+// Name implements Backend
+func (b *WhatsAppBackend) Name() string {
+	return BackendWhatsApp
+}
+
+// Available implements Backend
+func (b *WhatsAppBackend) Available() bool {
+	return b.pool.IsConnected()
+}
+
+// Put implements Backend
+func (b *WhatsAppBackend) Put(ctx context.Context, r io.Reader, size int64, mimeType string) (*Object, error) {
+	resp, err := b.pool.UploadFromReader(ctx, r, utils.GetMediaType(mimeType))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Object{
+		Key:         resp.DirectPath,
+		Account:     resp.Account,
+		MediaKey:    resp.MediaKey,
+		FileEncHash: resp.FileEncHash,
+		FileSHA256:  resp.FileSHA256,
+		Size:        int64(resp.FileLength),
+		MimeType:    mimeType,
+	}, nil
+}
+
+// Get implements Backend
+func (b *WhatsAppBackend) Get(ctx context.Context, obj *Object) (io.ReadCloser, error) {
+	return b.pool.DownloadStream(ctx, downloadRequest(obj))
+}
+
+// GetRange implements Backend
+func (b *WhatsAppBackend) GetRange(ctx context.Context, obj *Object, offset, length int64) (io.ReadCloser, error) {
+	return b.pool.DownloadRange(ctx, downloadRequest(obj), offset, length)
+}
+
+// Stat implements Backend by fetching the first block of the media
+func (b *WhatsAppBackend) Stat(ctx context.Context, obj *Object) (*Info, error) {
+	var reader io.ReadCloser
+	var err error
+	if obj.Size > 0 {
+		reader, err = b.GetRange(ctx, obj, 0, 1)
+	} else {
+		reader, err = b.Get(ctx, obj)
+	}
+	if err != nil {
+		return nil, err
+	}
+	reader.Close()
+
+	return &Info{Size: obj.Size}, nil
+}
+
+// Delete implements Backend. WhatsApp media cannot be deleted; it disappears
+// from the CDN once its retention period lapses.
+func (b *WhatsAppBackend) Delete(ctx context.Context, obj *Object) error {
+	return nil
+}
+
+// downloadRequest converts an object to a WhatsApp download request
+func downloadRequest(obj *Object) *whatsapp.DownloadRequest {
+	return &whatsapp.DownloadRequest{
+		Account:     obj.Account,
+		DirectPath:  obj.Key,
+		MediaKey:    obj.MediaKey,
+		FileEncHash: obj.FileEncHash,
+		FileSHA256:  obj.FileSHA256,
+		FileLength:  uint64(obj.Size),
+		MimeType:    obj.MimeType,
+	}
+}
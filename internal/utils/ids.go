@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ID schemes for file and collection IDs
+const (
+	// IDSchemeShort generates SHORT_ID_LENGTH characters from the short ID alphabet
+	IDSchemeShort = "short"
+
+	// IDSchemeLong generates IDs too long to guess, for links that must stay private
+	IDSchemeLong = "long"
+
+	IDSchemeUUID = "uuid"
+	IDSchemeULID = "ulid"
+)
+
+const (
+	// longIDLength gives long IDs about 128 bits of randomness
+	longIDLength = 22
+
+	// MinSlugLength and MaxSlugLength bound user-chosen IDs
+	MinSlugLength = 3
+	MaxSlugLength = 64
+)
+
+// reservedSlugs can't be chosen as IDs since they name routes or could
+// mislead visitors of a link
+var reservedSlugs = map[string]bool{
+	"admin": true, "api": true, "archive": true, "auth": true, "collections": true,
+	"download": true, "events": true, "f": true, "files": true, "health": true,
+	"login": true, "logout": true, "me": true, "metrics": true, "new": true,
+	"ready": true, "result": true, "retry": true, "settings": true, "stats": true,
+	"status": true, "upload": true, "uploads": true, "whatsbox": true,
+}
+
+// crockfordChars is the Crockford base32 alphabet used by ULIDs
+const crockfordChars = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ValidateIDScheme checks that scheme is a known ID scheme
+func ValidateIDScheme(scheme string) error {
+	switch scheme {
+	case IDSchemeShort, IDSchemeLong, IDSchemeUUID, IDSchemeULID:
+		return nil
+	}
+	return fmt.Errorf("unknown ID scheme %q, must be short, long, uuid or ulid", scheme)
+}
+
+// GenerateID generates an ID using scheme. attempt counts the IDs already
+// found in use; short IDs grow by a character every second attempt so retries
+// move to a sparser space as the table fills up.
+func GenerateID(scheme string, shortLength, attempt int) (string, error) {
+	switch scheme {
+	case IDSchemeShort:
+		return GenerateShortID(shortLength + attempt/2)
+	case IDSchemeLong:
+		return GenerateShortID(longIDLength)
+	case IDSchemeUUID:
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return "", err
+		}
+		return id.String(), nil
+	case IDSchemeULID:
+		return generateULID(time.Now())
+	}
+	return "", ValidateIDScheme(scheme)
+}
+
+// generateULID generates a ULID: a 48-bit millisecond timestamp followed by
+// 80 random bits, so IDs sort by creation time
+func generateULID(t time.Time) (string, error) {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(t.UnixMilli())<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+
+	n := new(big.Int).SetBytes(b[:])
+	mask := big.NewInt(31)
+	out := make([]byte, 26)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockfordChars[new(big.Int).And(n, mask).Int64()]
+		n.Rsh(n, 5)
+	}
+	return string(out), nil
+}
+
+// ValidateSlug checks an ID chosen by an uploader. Slugs use the short ID
+// alphabet, so they look like generated IDs, and can't be reserved words.
+func ValidateSlug(slug string) error {
+	if len(slug) < MinSlugLength || len(slug) > MaxSlugLength {
+		return fmt.Errorf("slug must be %d to %d characters long", MinSlugLength, MaxSlugLength)
+	}
+	for _, r := range slug {
+		if !strings.ContainsRune(shortIDChars, r) {
+			return fmt.Errorf("slug may only contain letters and digits other than 0, 1, l, I and O")
+		}
+	}
+	if reservedSlugs[strings.ToLower(slug)] {
+		return fmt.Errorf("slug %q is reserved", slug)
+	}
+	return nil
+}
@@ -1,10 +1,13 @@
 package utils
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"io"
 	"math/big"
+	"net/http"
 	"path/filepath"
 	"strings"
 
@@ -37,6 +40,106 @@ func HashFile(data []byte) string {
 	return hex.EncodeToString(hash[:])
 }
 
+// Prefixes mark WhatsBox credentials so they are recognisable in configs and secret scanners
+const (
+	apiKeyPrefix        = "wbx_"
+	uploadTokenPrefix   = "wbu_"
+	webhookSecretPrefix = "wbs_"
+	managementPrefix    = "wbm_"
+)
+
+// GenerateAPIKey generates a new API key and the public ID embedded in it
+func GenerateAPIKey() (id, key string, err error) {
+	return generateToken(apiKeyPrefix)
+}
+
+// ParseAPIKeyID returns the public ID embedded in an API key
+func ParseAPIKeyID(key string) (string, bool) {
+	return parseTokenID(apiKeyPrefix, key)
+}
+
+// GenerateUploadToken generates a new upload token and the public ID embedded in it
+func GenerateUploadToken() (id, token string, err error) {
+	return generateToken(uploadTokenPrefix)
+}
+
+// ParseUploadTokenID returns the public ID embedded in an upload token
+func ParseUploadTokenID(token string) (string, bool) {
+	return parseTokenID(uploadTokenPrefix, token)
+}
+
+// GenerateWebhookSecret generates a secret for signing webhook payloads
+func GenerateWebhookSecret() (string, error) {
+	secret, err := GenerateShortID(32)
+	if err != nil {
+		return "", err
+	}
+	return webhookSecretPrefix + secret, nil
+}
+
+// GenerateManagementToken generates a token that lets an uploader manage
+// their file without an account
+func GenerateManagementToken() (string, error) {
+	secret, err := GenerateShortID(32)
+	if err != nil {
+		return "", err
+	}
+	return managementPrefix + secret, nil
+}
+
+// generateToken generates a secret token of the form <prefix><id>_<secret>
+func generateToken(prefix string) (id, token string, err error) {
+	id, err = GenerateShortID(12)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := GenerateShortID(32)
+	if err != nil {
+		return "", "", err
+	}
+	return id, prefix + id + "_" + secret, nil
+}
+
+// parseTokenID returns the ID from a token generated by generateToken
+func parseTokenID(prefix, token string) (string, bool) {
+	rest, ok := strings.CutPrefix(token, prefix)
+	if !ok {
+		return "", false
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return "", false
+	}
+	return id, true
+}
+
+// HashToken hashes a high-entropy secret token for storage
+func HashToken(token string) string {
+	return HashFile([]byte(token))
+}
+
+// HashReader computes SHA256 hash of everything read from r and returns hex string
+func HashReader(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// DetectContentType sniffs the MIME type from the start of r.
+// The returned reader yields the full stream including the sniffed bytes.
+func DetectContentType(r io.Reader) (string, io.Reader, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	head = head[:n]
+
+	return http.DetectContentType(head), io.MultiReader(bytes.NewReader(head), r), nil
+}
+
 // HashPassword hashes a password using bcrypt
 func HashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
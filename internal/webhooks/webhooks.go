@@ -0,0 +1,387 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/database"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/utils"
+	"go.uber.org/zap"
+)
+
+// Events webhooks can subscribe to
+const (
+	EventFileUploaded         = "file.uploaded"
+	EventFileDownloaded       = "file.downloaded"
+	EventFileExpired          = "file.expired"
+	EventFileLimitReached     = "file.limit_reached"
+	EventFileDeleted          = "file.deleted"
+	EventWhatsAppDisconnected = "whatsapp.disconnected"
+	EventWhatsAppBanned       = "whatsapp.banned"
+
+	// EventPing is only sent when testing a webhook
+	EventPing = "ping"
+)
+
+// Events lists every event webhooks can subscribe to
+var Events = []string{
+	EventFileUploaded, EventFileDownloaded, EventFileExpired, EventFileLimitReached,
+	EventFileDeleted, EventWhatsAppDisconnected, EventWhatsAppBanned,
+}
+
+// Request headers sent with every delivery
+const (
+	HeaderEvent     = "X-WhatsBox-Event"
+	HeaderDelivery  = "X-WhatsBox-Delivery"
+	HeaderTimestamp = "X-WhatsBox-Timestamp"
+	HeaderSignature = "X-WhatsBox-Signature"
+)
+
+const (
+	// DeliveryBatchSize is the maximum number of deliveries sent per DeliverDue call
+	DeliveryBatchSize = 50
+
+	// Retries back off exponentially from retryBaseDelay up to retryMaxDelay
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = 6 * time.Hour
+
+	// maxResponseBody is how much of an endpoint's response is kept in the delivery log
+	maxResponseBody = 1024
+)
+
+// Payload is the JSON body sent to webhooks. The ID is shared by every
+// delivery of the same event, so receivers can ignore repeats.
+type Payload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// File describes a file in event payloads
+type File struct {
+	ID            string    `json:"id"`
+	Filename      string    `json:"filename"`
+	MimeType      string    `json:"mime_type"`
+	FileSize      int64     `json:"file_size"`
+	DownloadURL   string    `json:"download_url"`
+	DownloadCount int64     `json:"download_count"`
+	MaxDownloads  *int64    `json:"max_downloads,omitempty"`
+	OwnerID       string    `json:"owner_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// NewFile describes a file for an event payload
+func NewFile(f *database.File) File {
+	file := File{
+		ID:            f.ID,
+		Filename:      f.Filename,
+		MimeType:      f.MimeType,
+		FileSize:      f.FileSize,
+		DownloadURL:   "/api/files/" + f.ID + "/download",
+		DownloadCount: f.DownloadCount,
+		OwnerID:       f.OwnerID.String,
+		CreatedAt:     f.CreatedAt,
+		ExpiresAt:     f.ExpiresAt,
+	}
+	if f.MaxDownloads.Valid {
+		file.MaxDownloads = &f.MaxDownloads.Int64
+	}
+	return file
+}
+
+// Dispatcher queues events for every subscribed webhook and delivers them.
+// The queue lives in SQLite, so deliveries survive restarts.
+type Dispatcher struct {
+	cfg    *config.Config
+	repo   *database.WebhookRepository
+	client *http.Client
+
+	// wake is signalled when deliveries are queued
+	wake chan struct{}
+}
+
+// Global dispatcher instance
+var dispatcher *Dispatcher
+
+// Init initializes the global dispatcher
+func Init(cfg *config.Config) *Dispatcher {
+	dispatcher = &Dispatcher{
+		cfg:  cfg,
+		repo: database.NewWebhookRepository(),
+		client: &http.Client{
+			Timeout: cfg.WebhookTimeout,
+			// A redirect is reported as a failed delivery rather than followed
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		wake: make(chan struct{}, 1),
+	}
+	return dispatcher
+}
+
+// Get returns the global dispatcher, or nil if it wasn't initialized
+func Get() *Dispatcher {
+	return dispatcher
+}
+
+// Emit queues an event for every enabled webhook subscribed to it.
+// It is safe to call on a nil dispatcher.
+func (d *Dispatcher) Emit(event string, data interface{}) {
+	if d == nil {
+		return
+	}
+
+	webhooks, err := d.repo.ListEnabled()
+	if err != nil {
+		logging.Error("Failed to list webhooks", zap.Error(err), zap.String("event", event))
+		return
+	}
+
+	var payload string
+	for _, w := range webhooks {
+		if !w.Subscribed(event) {
+			continue
+		}
+		if payload == "" {
+			if payload, err = newPayload(event, data); err != nil {
+				logging.Error("Failed to encode webhook payload", zap.Error(err), zap.String("event", event))
+				return
+			}
+		}
+		if _, err := d.repo.Enqueue(w.ID, event, payload); err != nil {
+			logging.Error("Failed to queue webhook delivery", zap.Error(err),
+				zap.String("webhook_id", w.ID), zap.String("event", event))
+		}
+	}
+
+	if payload != "" {
+		d.notify()
+	}
+}
+
+// Send queues an event for one webhook, whether or not it subscribes to it
+func (d *Dispatcher) Send(w *database.Webhook, event string, data interface{}) (int64, error) {
+	payload, err := newPayload(event, data)
+	if err != nil {
+		return 0, err
+	}
+	id, err := d.repo.Enqueue(w.ID, event, payload)
+	if err != nil {
+		return 0, err
+	}
+	d.notify()
+	return id, nil
+}
+
+// Redeliver queues a finished delivery to be sent again
+func (d *Dispatcher) Redeliver(id int64) (bool, error) {
+	ok, err := d.repo.Redeliver(id)
+	if ok {
+		d.notify()
+	}
+	return ok, err
+}
+
+// Wake returns a channel signalled when deliveries are queued
+func (d *Dispatcher) Wake() <-chan struct{} {
+	return d.wake
+}
+
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// newPayload encodes an event as a JSON payload
+func newPayload(event string, data interface{}) (string, error) {
+	id, err := utils.GenerateShortID(16)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(Payload{
+		ID:        id,
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// DeliverDue sends pending deliveries that are due and returns how many were
+// attempted. Deliveries interrupted by ctx are left for the next run.
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	deliveries, err := d.repo.ListDue(time.Now(), DeliveryBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	// Look each webhook up once per batch
+	webhooks := make(map[string]*database.Webhook)
+	var attempted int
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			break
+		}
+
+		w, ok := webhooks[delivery.WebhookID]
+		if !ok {
+			w, err = d.repo.GetByID(delivery.WebhookID)
+			if err != nil && err != sql.ErrNoRows {
+				return attempted, err
+			}
+			webhooks[delivery.WebhookID] = w
+		}
+
+		if err := d.deliver(ctx, w, delivery); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return attempted, err
+		}
+		attempted++
+	}
+
+	return attempted, nil
+}
+
+// deliver makes one attempt to send a delivery and records the outcome
+func (d *Dispatcher) deliver(ctx context.Context, w *database.Webhook, delivery *database.WebhookDelivery) error {
+	now := time.Now()
+	delivery.Attempts++
+	delivery.LastAttemptAt = sql.NullTime{Time: now, Valid: true}
+	delivery.ResponseStatus = sql.NullInt64{}
+	delivery.ResponseBody = sql.NullString{}
+	delivery.Error = sql.NullString{}
+
+	var err error
+	switch {
+	case w == nil:
+		err = errors.New("webhook no longer exists")
+	case !w.Enabled:
+		err = errors.New("webhook is disabled")
+	default:
+		var status int
+		var body string
+		status, body, err = d.post(ctx, w, delivery)
+		if ctx.Err() != nil {
+			// Interrupted by shutdown; the attempt doesn't count
+			return ctx.Err()
+		}
+		if status != 0 {
+			delivery.ResponseStatus = sql.NullInt64{Int64: int64(status), Valid: true}
+			delivery.ResponseBody = sql.NullString{String: body, Valid: body != ""}
+		}
+		if err == nil && (status < 200 || status >= 300) {
+			err = fmt.Errorf("endpoint responded with status %d", status)
+		}
+	}
+
+	switch {
+	case err == nil:
+		delivery.Status = database.DeliveryStatusSucceeded
+		delivery.NextAttemptAt = sql.NullTime{}
+		delivery.DeliveredAt = sql.NullTime{Time: now, Valid: true}
+	case w == nil || !w.Enabled || delivery.Attempts >= d.cfg.WebhookMaxAttempts:
+		delivery.Status = database.DeliveryStatusFailed
+		delivery.NextAttemptAt = sql.NullTime{}
+		delivery.Error = sql.NullString{String: err.Error(), Valid: true}
+	default:
+		delivery.NextAttemptAt = sql.NullTime{Time: now.Add(backoff(delivery.Attempts)), Valid: true}
+		delivery.Error = sql.NullString{String: err.Error(), Valid: true}
+	}
+
+	if err != nil {
+		logging.Warn("Webhook delivery failed",
+			zap.Int64("delivery_id", delivery.ID),
+			zap.String("webhook_id", delivery.WebhookID),
+			zap.String("event", delivery.Event),
+			zap.Int("attempts", delivery.Attempts),
+			zap.String("status", delivery.Status),
+			zap.Error(err))
+	} else {
+		logging.Debug("Webhook delivered",
+			zap.Int64("delivery_id", delivery.ID),
+			zap.String("webhook_id", delivery.WebhookID),
+			zap.String("event", delivery.Event))
+	}
+
+	return d.repo.RecordAttempt(delivery)
+}
+
+// post sends a delivery's payload to its webhook, returning the response
+// status and the start of the response body
+func (d *Dispatcher) post(ctx context.Context, w *database.Webhook, delivery *database.WebhookDelivery) (int, string, error) {
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "WhatsBox-Webhook/1.0")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, "sha256="+Sign(w.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	// Drain the rest so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	return resp.StatusCode, string(respBody), nil
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the
+// webhook's secret. Receivers recompute it to verify a delivery.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns the delay before retrying after the given number of attempts
+func backoff(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= retryMaxDelay {
+			return retryMaxDelay
+		}
+	}
+	return delay
+}
+
+// DeleteOld removes finished deliveries older than the configured retention
+func (d *Dispatcher) DeleteOld() (int64, error) {
+	return d.repo.DeleteOldDeliveries(time.Now().Add(-d.cfg.WebhookLogRetention))
+}
@@ -4,50 +4,77 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
-	"os"
-	"path/filepath"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/salman0ansari/whatsbox/internal/broadcast"
 	"github.com/salman0ansari/whatsbox/internal/config"
 	"github.com/salman0ansari/whatsbox/internal/logging"
 	"github.com/skip2/go-qrcode"
 	"go.mau.fi/whatsmeow"
-	"go.mau.fi/whatsmeow/proto/waCompanionReg"
 	"go.mau.fi/whatsmeow/store"
-	"go.mau.fi/whatsmeow/store/sqlstore"
 	waLog "go.mau.fi/whatsmeow/util/log"
 	"go.uber.org/zap"
 )
 
-// Client wraps the whatsmeow client with additional functionality
+// Client wraps the whatsmeow client for a single linked account
 type Client struct {
-	client    *whatsmeow.Client
-	container *sqlstore.Container
-	cfg       *config.Config
+	client *whatsmeow.Client
+	cfg    *config.Config
+
+	// mediaHTTP is used for streaming media from the WhatsApp CDN
+	mediaHTTP *http.Client
 
 	mu             sync.RWMutex
-	connected      bool
+	state          string
 	connectedAt    time.Time
 	reconnectCount int64
 
+	// stateChanged wakes the supervisor when the connection state changes
+	stateChanged chan struct{}
+
 	qrChan   chan string
 	qrCancel context.CancelFunc
 
+	// Account health and upload volume
+	uploads       int64
+	bytesUploaded int64
+	activeUploads int64
+	lastError     string
+	lastErrorAt   time.Time
+	bannedUntil   time.Time
+
+	// onPaired is called once a new device finishes pairing
+	onPaired func(*Client)
+
+	// done stops background goroutines once the client is closed
+	done      chan struct{}
+	closeOnce sync.Once
+
 	// QR code caching to prevent excessive reconnections
 	cachedQR     *QRCode
 	cachedQRTime time.Time
 	qrGenerating bool
+
+	// pairing tracks the most recent attempt to link this device
+	pairing        PairingStatus
+	pairingAttempt int64
 }
 
 // Status represents the WhatsApp connection status
 type Status struct {
-	Connected      bool      `json:"connected"`
-	LoggedIn       bool      `json:"logged_in"`
-	ConnectedAt    time.Time `json:"connected_at,omitempty"`
-	ReconnectCount int64     `json:"reconnect_count"`
-	PhoneNumber    string    `json:"phone_number,omitempty"`
-	PushName       string    `json:"push_name,omitempty"`
+	Connected      bool       `json:"connected"`
+	LoggedIn       bool       `json:"logged_in"`
+	State          string     `json:"state"`
+	ConnectedAt    time.Time  `json:"connected_at,omitempty"`
+	ReconnectCount int64      `json:"reconnect_count"`
+	PhoneNumber    string     `json:"phone_number,omitempty"`
+	PushName       string     `json:"push_name,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`
+	BannedUntil    *time.Time `json:"banned_until,omitempty"`
 }
 
 // QRCode represents a QR code response
@@ -57,6 +84,13 @@ type QRCode struct {
 	Timeout int    `json:"timeout"`
 }
 
+// qrEvent is pushed to live subscribers when the pairing QR code rotates or
+// pairing ends, e.g. with "success" or "timeout"
+type qrEvent struct {
+	Event string `json:"event"`
+	*QRCode
+}
+
 // zapLogWrapper wraps zap logger for whatsmeow
 type zapLogWrapper struct {
 	logger *zap.Logger
@@ -82,52 +116,37 @@ func (z *zapLogWrapper) Sub(module string) waLog.Logger {
 	return &zapLogWrapper{logger: z.logger.With(zap.String("module", module))}
 }
 
-// NewClient creates a new WhatsApp client
-func NewClient(cfg *config.Config) (*Client, error) {
-	ctx := context.Background()
-
-	// Ensure session directory exists
-	sessionDir := filepath.Dir(cfg.WASessionPath)
-	if err := os.MkdirAll(sessionDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create session directory: %w", err)
+// newClient creates a client for a device from the session store
+func newClient(cfg *config.Config, deviceStore *store.Device, waLogger waLog.Logger, onPaired func(*Client)) *Client {
+	client := &Client{
+		client:       whatsmeow.NewClient(deviceStore, waLogger.Sub("client")),
+		cfg:          cfg,
+		mediaHTTP:    &http.Client{},
+		onPaired:     onPaired,
+		done:         make(chan struct{}),
+		state:        StateDisconnected,
+		stateChanged: make(chan struct{}, 1),
 	}
-
-	// Create logger wrapper
-	waLogger := &zapLogWrapper{logger: logging.Logger.With(zap.String("component", "whatsmeow"))}
-
-	// Create database container for session storage
-	container, err := sqlstore.New(ctx, "sqlite3", cfg.WASessionPath+"?_journal_mode=WAL&_foreign_keys=on", waLogger.Sub("store"))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create session store: %w", err)
+	if deviceStore.ID == nil {
+		client.state = StateLoggedOut
 	}
 
-	// Get or create device store
-	deviceStore, err := container.GetFirstDevice(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get device store: %w", err)
-	}
+	// Reconnecting is left to the supervisor, which knows about bans and
+	// logouts and backs off between attempts
+	client.client.EnableAutoReconnect = false
 
-	// Create whatsmeow client
-	waClient := whatsmeow.NewClient(deviceStore, waLogger.Sub("client"))
+	// Set up event handler
+	client.client.AddEventHandler(client.eventHandler)
 
-	// Set client properties
-	osName := "WhatsBox"
-	platformType := waCompanionReg.DeviceProps_CHROME
-	requireFullSync := false
-	store.DeviceProps.Os = &osName
-	store.DeviceProps.PlatformType = &platformType
-	store.DeviceProps.RequireFullSync = &requireFullSync
+	return client
+}
 
-	client := &Client{
-		client:    waClient,
-		container: container,
-		cfg:       cfg,
+// ID returns the account's device JID, or an empty string if it isn't paired yet
+func (c *Client) ID() string {
+	if c.client.Store.ID == nil {
+		return ""
 	}
-
-	// Set up event handler
-	waClient.AddEventHandler(client.eventHandler)
-
-	return client, nil
+	return c.client.Store.ID.String()
 }
 
 // Connect connects to WhatsApp
@@ -139,9 +158,13 @@ func (c *Client) Connect(ctx context.Context) error {
 	}
 
 	// Already have session, connect
+	c.setState(StateConnecting)
 	err := c.client.Connect()
 	if err != nil {
-		return fmt.Errorf("failed to connect: %w", err)
+		err = fmt.Errorf("failed to connect: %w", err)
+		c.recordError(err)
+		c.transition(StateDisconnected, StateConnecting)
+		return err
 	}
 
 	return nil
@@ -168,9 +191,12 @@ func (c *Client) GetQRChannel(ctx context.Context) (<-chan QRCode, error) {
 		return nil, fmt.Errorf("failed to get QR channel: %w", err)
 	}
 	resultChan := make(chan QRCode, 1)
+	attempt := c.startPairing(qrCtx)
 
 	go func() {
 		defer close(resultChan)
+		// The channel closes without a final event when the context ends
+		defer c.endPairing(attempt, PairingTimeout, "")
 		for evt := range qrChan {
 			if evt.Event == "code" {
 				// Generate QR code image
@@ -186,14 +212,40 @@ func (c *Client) GetQRChannel(ctx context.Context) (<-chan QRCode, error) {
 					Timeout: int(evt.Timeout.Seconds()),
 				}
 
+				// WhatsApp rotates the code until it is scanned, so keep the
+				// cache current and push each code to live subscribers
+				c.mu.Lock()
+				c.cachedQR = &qr
+				c.cachedQRTime = time.Now()
+				c.mu.Unlock()
+				broadcast.Get().Publish(broadcast.EventQR, qrEvent{Event: evt.Event, QRCode: &qr})
+
+				// Only the first code is waited for
 				select {
 				case resultChan <- qr:
-				case <-qrCtx.Done():
+				default:
+				}
+			} else {
+				broadcast.Get().Publish(broadcast.EventQR, qrEvent{Event: evt.Event})
+				switch evt.Event {
+				case "success":
+					logging.Info("WhatsApp login successful")
+					c.endPairing(attempt, PairingSuccess, "")
 					return
+				case "timeout":
+					c.endPairing(attempt, PairingTimeout, "")
+				default:
+					errMsg := evt.Event
+					if evt.Error != nil {
+						errMsg = evt.Error.Error()
+					}
+					c.endPairing(attempt, PairingFailed, errMsg)
 				}
-			} else if evt.Event == "success" {
-				logging.Info("QR code login successful")
-				return
+
+				// The login connection is gone, so its QR code can't be used anymore
+				c.mu.Lock()
+				c.cachedQR = nil
+				c.mu.Unlock()
 			}
 		}
 	}()
@@ -202,6 +254,7 @@ func (c *Client) GetQRChannel(ctx context.Context) (<-chan QRCode, error) {
 	err = c.client.Connect()
 	if err != nil {
 		cancel()
+		c.endPairing(attempt, PairingFailed, err.Error())
 		return nil, fmt.Errorf("failed to connect for QR: %w", err)
 	}
 
@@ -289,9 +342,7 @@ func (c *Client) GetQR(ctx context.Context) (*QRCode, error) {
 // Disconnect disconnects from WhatsApp
 func (c *Client) Disconnect() {
 	c.client.Disconnect()
-	c.mu.Lock()
-	c.connected = false
-	c.mu.Unlock()
+	c.transition(StateDisconnected, StateConnecting, StateConnected)
 }
 
 // Logout logs out and clears the session
@@ -306,9 +357,9 @@ func (c *Client) Logout(ctx context.Context) error {
 	}
 
 	c.mu.Lock()
-	c.connected = false
 	c.cachedQR = nil // Clear cached QR on logout
 	c.mu.Unlock()
+	c.setState(StateLoggedOut)
 
 	logging.Info("Logged out from WhatsApp")
 	return nil
@@ -318,7 +369,7 @@ func (c *Client) Logout(ctx context.Context) error {
 func (c *Client) IsConnected() bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.connected && c.client.IsConnected()
+	return c.state == StateConnected && c.client.IsConnected()
 }
 
 // IsLoggedIn returns whether there's a stored session
@@ -326,16 +377,41 @@ func (c *Client) IsLoggedIn() bool {
 	return c.client.Store.ID != nil
 }
 
+// IsHealthy returns whether the account is connected and not temporarily banned
+func (c *Client) IsHealthy() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state == StateConnected && c.client.IsConnected() && time.Now().After(c.bannedUntil)
+}
+
+// recordError remembers the most recent failure for account health reporting
+func (c *Client) recordError(err error) {
+	c.mu.Lock()
+	c.lastError = err.Error()
+	c.lastErrorAt = time.Now()
+	c.mu.Unlock()
+}
+
 // GetStatus returns the current connection status
 func (c *Client) GetStatus() Status {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
 	status := Status{
-		Connected:      c.connected && c.client.IsConnected(),
+		Connected:      c.state == StateConnected && c.client.IsConnected(),
 		LoggedIn:       c.client.Store.ID != nil,
+		State:          c.state,
 		ConnectedAt:    c.connectedAt,
 		ReconnectCount: c.reconnectCount,
+		LastError:      c.lastError,
+	}
+	if !c.lastErrorAt.IsZero() {
+		lastErrorAt := c.lastErrorAt
+		status.LastErrorAt = &lastErrorAt
+	}
+	if time.Now().Before(c.bannedUntil) {
+		bannedUntil := c.bannedUntil
+		status.BannedUntil = &bannedUntil
 	}
 
 	if c.client.Store.ID != nil {
@@ -348,13 +424,31 @@ func (c *Client) GetStatus() Status {
 	return status
 }
 
+// GetAccountStatus returns the account's status with its health and upload volume
+func (c *Client) GetAccountStatus() AccountStatus {
+	return AccountStatus{
+		Status:        c.GetStatus(),
+		ID:            c.ID(),
+		Healthy:       c.IsHealthy(),
+		Uploads:       atomic.LoadInt64(&c.uploads),
+		BytesUploaded: atomic.LoadInt64(&c.bytesUploaded),
+		ActiveUploads: atomic.LoadInt64(&c.activeUploads),
+	}
+}
+
+// uploadLoad is used to compare accounts for the least-used strategy
+func (c *Client) uploadLoad() int64 {
+	// Weigh in-flight uploads as if they were a gigabyte each so they are spread out
+	return atomic.LoadInt64(&c.bytesUploaded) + atomic.LoadInt64(&c.activeUploads)<<30
+}
+
 // GetClient returns the underlying whatsmeow client for direct operations
 func (c *Client) GetClient() *whatsmeow.Client {
 	return c.client
 }
 
-// Close closes the client and database connection
-func (c *Client) Close() error {
+// Close disconnects the client and stops its background goroutines
+func (c *Client) Close() {
+	c.closeOnce.Do(func() { close(c.done) })
 	c.Disconnect()
-	return c.container.Close()
 }
@@ -1,18 +1,34 @@
 package whatsapp
 
 import (
+	"bytes"
 	"context"
+	"crypto/aes"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"strings"
 
 	"github.com/salman0ansari/whatsbox/internal/logging"
-	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/socket"
 	"go.uber.org/zap"
 )
 
+// mmsTypes maps media types to the mms-type parameter expected by the CDN
+var mmsTypes = map[whatsmeow.MediaType]string{
+	whatsmeow.MediaImage:    "image",
+	whatsmeow.MediaVideo:    "video",
+	whatsmeow.MediaAudio:    "audio",
+	whatsmeow.MediaDocument: "document",
+}
+
 // DownloadRequest contains the parameters needed to download a file
 type DownloadRequest struct {
+	// Account is the account that uploaded the media, if known
+	Account     string
 	DirectPath  string
 	MediaKey    []byte
 	FileEncHash []byte
@@ -21,8 +37,13 @@ type DownloadRequest struct {
 	MimeType    string
 }
 
-// Download downloads a file from WhatsApp servers using the proper message-based approach
-func (c *Client) Download(ctx context.Context, req *DownloadRequest) ([]byte, error) {
+// DownloadStream opens a streaming download of a file from WhatsApp servers.
+//
+// The returned reader fetches the encrypted media from the CDN and decrypts and
+// verifies it incrementally, so memory use does not grow with the file size.
+// The context only bounds establishing the connection; the caller must Close
+// the reader once done with it.
+func (c *Client) DownloadStream(ctx context.Context, req *DownloadRequest) (io.ReadCloser, error) {
 	if !c.IsConnected() {
 		return nil, fmt.Errorf("not connected to WhatsApp")
 	}
@@ -33,75 +54,234 @@ func (c *Client) Download(ctx context.Context, req *DownloadRequest) ([]byte, er
 		zap.Uint64("file_length", req.FileLength),
 	)
 
-	var data []byte
-	var err error
-
-	// Detect media type and download with appropriate message object
-	if isImageType(req.MimeType) {
-		msg := &waE2E.ImageMessage{
-			DirectPath:    &req.DirectPath,
-			MediaKey:      req.MediaKey,
-			Mimetype:      &req.MimeType,
-			FileEncSHA256: req.FileEncHash,
-			FileSHA256:    req.FileSHA256,
-			FileLength:    &req.FileLength,
+	mediaType := mediaTypeForMime(req.MimeType)
+
+	resp, cancel, err := c.fetchMedia(ctx, req, mediaType, "")
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := newDecryptReader(resp.Body, cancel, req, mediaType)
+	if err != nil {
+		resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// DownloadRange opens a streaming download of length bytes starting at offset.
+//
+// Only the ciphertext blocks covering the range are fetched from the CDN; the
+// block preceding the range serves as the CBC IV. The HMAC and checksums cover
+// the whole file and cannot be verified for a partial read. If the CDN ignores
+// the range, the whole file is streamed and verified: the bytes outside the
+// range are discarded, and a file that fails verification fails the final Read.
+func (c *Client) DownloadRange(ctx context.Context, req *DownloadRequest, offset, length int64) (io.ReadCloser, error) {
+	if !c.IsConnected() {
+		return nil, fmt.Errorf("not connected to WhatsApp")
+	}
+
+	if offset < 0 || length <= 0 || (req.FileLength > 0 && uint64(offset+length) > req.FileLength) {
+		return nil, fmt.Errorf("invalid range %d+%d for file of %d bytes", offset, length, req.FileLength)
+	}
+
+	logging.Debug("Downloading file range from WhatsApp",
+		zap.String("direct_path", req.DirectPath),
+		zap.Int64("offset", offset),
+		zap.Int64("length", length),
+	)
+
+	encStart, encEnd := cipherRange(offset, length)
+	byteRange := fmt.Sprintf("bytes=%d-%d", encStart, encEnd)
+
+	mediaType := mediaTypeForMime(req.MimeType)
+
+	resp, cancel, err := c.fetchMedia(ctx, req, mediaType, byteRange)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", encStart, encEnd)) {
+			resp.Body.Close()
+			cancel()
+			return nil, fmt.Errorf("unexpected Content-Range %q for %s", resp.Header.Get("Content-Range"), byteRange)
 		}
-		data, err = c.client.Download(ctx, msg)
-	} else if isVideoType(req.MimeType) {
-		msg := &waE2E.VideoMessage{
-			DirectPath:    &req.DirectPath,
-			MediaKey:      req.MediaKey,
-			Mimetype:      &req.MimeType,
-			FileEncSHA256: req.FileEncHash,
-			FileSHA256:    req.FileSHA256,
-			FileLength:    &req.FileLength,
+
+		reader, err := newRangeReader(resp.Body, cancel, req.MediaKey, mediaType, offset, length)
+		if err != nil {
+			resp.Body.Close()
+			cancel()
+			return nil, err
 		}
-		data, err = c.client.Download(ctx, msg)
-	} else if isAudioType(req.MimeType) {
-		msg := &waE2E.AudioMessage{
-			DirectPath:    &req.DirectPath,
-			MediaKey:      req.MediaKey,
-			Mimetype:      &req.MimeType,
-			FileEncSHA256: req.FileEncHash,
-			FileSHA256:    req.FileSHA256,
-			FileLength:    &req.FileLength,
+		return reader, nil
+	}
+
+	// The CDN sent the whole file, so decrypt it all and trim to the range
+	reader, err := newDecryptReader(resp.Body, cancel, req, mediaType)
+	if err != nil {
+		resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+	return newTrimmedReader(reader, offset, length)
+}
+
+// cipherRange returns the first and last byte of the ciphertext holding length
+// bytes of plaintext at offset. It starts one block early, when there is one,
+// so the previous ciphertext block can act as the IV.
+func cipherRange(offset, length int64) (start, end int64) {
+	firstBlock := offset / aes.BlockSize
+	lastBlock := (offset + length - 1) / aes.BlockSize
+
+	start = firstBlock * aes.BlockSize
+	if firstBlock > 0 {
+		start -= aes.BlockSize
+	}
+	return start, (lastBlock+1)*aes.BlockSize - 1
+}
+
+// fetchMedia requests encrypted media from each CDN host in turn until one responds
+func (c *Client) fetchMedia(ctx context.Context, req *DownloadRequest, mediaType whatsmeow.MediaType, byteRange string) (*http.Response, context.CancelFunc, error) {
+	if !strings.HasPrefix(req.DirectPath, "/") {
+		return nil, nil, fmt.Errorf("media download path does not start with slash: %s", req.DirectPath)
+	}
+
+	mediaConn, err := c.client.DangerousInternals().RefreshMediaConn(ctx, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to refresh media connections: %w", err)
+	}
+
+	for i, host := range mediaConn.Hosts {
+		mediaURL := fmt.Sprintf("https://%s%s&hash=%s&mms-type=%s&__wa-mms=",
+			host.Hostname, req.DirectPath, base64.URLEncoding.EncodeToString(req.FileEncHash), mmsTypes[mediaType])
+
+		resp, cancel, err := c.openMedia(ctx, mediaURL, byteRange)
+		if err == nil {
+			return resp, cancel, nil
 		}
-		data, err = c.client.Download(ctx, msg)
-	} else {
-		// Default to document for all other types
-		msg := &waE2E.DocumentMessage{
-			DirectPath:    &req.DirectPath,
-			MediaKey:      req.MediaKey,
-			Mimetype:      &req.MimeType,
-			FileEncSHA256: req.FileEncHash,
-			FileSHA256:    req.FileSHA256,
-			FileLength:    &req.FileLength,
+
+		if errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith403) ||
+			errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) ||
+			errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410) ||
+			errors.Is(err, context.Canceled) ||
+			i >= len(mediaConn.Hosts)-1 {
+			logging.Error("Failed to download from WhatsApp", zap.Error(err))
+			return nil, nil, fmt.Errorf("download failed: %w", err)
 		}
-		data, err = c.client.Download(ctx, msg)
+
+		logging.Warn("Failed to download media, trying next host",
+			zap.String("host", host.Hostname),
+			zap.Error(err),
+		)
 	}
 
+	return nil, nil, fmt.Errorf("download failed: no media hosts available")
+}
+
+// openMedia starts a GET request for encrypted media, optionally limited to byteRange.
+// The request outlives ctx once the response headers have been received.
+func (c *Client) openMedia(ctx context.Context, mediaURL, byteRange string) (*http.Response, context.CancelFunc, error) {
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, mediaURL, nil)
+	if err != nil {
+		stop()
+		cancel()
+		return nil, nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("Origin", socket.Origin)
+	req.Header.Set("Referer", socket.Origin+"/")
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+
+	resp, err := c.mediaHTTP.Do(req)
+	if !stop() && err == nil {
+		// ctx expired while the response was arriving
+		resp.Body.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		cancel()
+		return nil, nil, whatsmeow.DownloadHTTPError{Response: resp}
+	}
+
+	return resp, cancel, nil
+}
+
+// Download downloads a file from WhatsApp servers into memory
+func (c *Client) Download(ctx context.Context, req *DownloadRequest) ([]byte, error) {
+	reader, err := c.DownloadStream(ctx, req)
 	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var buf bytes.Buffer
+	buf.Grow(int(req.FileLength))
+	if _, err := buf.ReadFrom(reader); err != nil {
 		logging.Error("Failed to download from WhatsApp", zap.Error(err))
 		return nil, fmt.Errorf("download failed: %w", err)
 	}
 
 	logging.Info("File downloaded from WhatsApp",
 		zap.String("direct_path", req.DirectPath),
-		zap.Int("size", len(data)),
+		zap.Int("size", buf.Len()),
 	)
 
-	return data, nil
+	return buf.Bytes(), nil
 }
 
-// DownloadToWriter downloads a file and writes it to the provided writer
+// DownloadToWriter downloads a file and streams it to the provided writer
 func (c *Client) DownloadToWriter(ctx context.Context, req *DownloadRequest, w io.Writer) error {
-	data, err := c.Download(ctx, req)
+	reader, err := c.DownloadStream(ctx, req)
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
+
+	written, err := io.Copy(w, reader)
+	if err != nil {
+		logging.Error("Failed to download from WhatsApp", zap.Error(err))
+		return fmt.Errorf("download failed: %w", err)
+	}
 
-	_, err = w.Write(data)
-	return err
+	logging.Info("File downloaded from WhatsApp",
+		zap.String("direct_path", req.DirectPath),
+		zap.Int64("size", written),
+	)
+
+	return nil
+}
+
+// SameMediaType reports whether two MIME types map to the same media type, so
+// media uploaded as one can be downloaded as the other
+func SameMediaType(a, b string) bool {
+	return mediaTypeForMime(a) == mediaTypeForMime(b)
+}
+
+// mediaTypeForMime returns the media type a file was encrypted with based on its mime type
+func mediaTypeForMime(mimeType string) whatsmeow.MediaType {
+	if isImageType(mimeType) {
+		return whatsmeow.MediaImage
+	}
+	if isVideoType(mimeType) {
+		return whatsmeow.MediaVideo
+	}
+	if isAudioType(mimeType) {
+		return whatsmeow.MediaAudio
+	}
+	// Default to document for all other types
+	return whatsmeow.MediaDocument
 }
 
 // Helper functions to detect media types
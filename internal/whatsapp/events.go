@@ -1,9 +1,13 @@
 package whatsapp
 
 import (
+	"fmt"
 	"time"
 
+	"github.com/salman0ansari/whatsbox/internal/broadcast"
 	"github.com/salman0ansari/whatsbox/internal/logging"
+	"github.com/salman0ansari/whatsbox/internal/webhooks"
+	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/types/events"
 	"go.uber.org/zap"
 )
@@ -12,49 +16,79 @@ import (
 func (c *Client) eventHandler(evt interface{}) {
 	switch v := evt.(type) {
 	case *events.Connected:
-		c.mu.Lock()
-		c.connected = true
-		c.connectedAt = time.Now()
-		c.mu.Unlock()
-		logging.Info("WhatsApp connected")
+		c.setState(StateConnected)
+		logging.Info("WhatsApp connected", zap.String("account", c.ID()))
+		c.publishState("connected")
 
 	case *events.Disconnected:
-		c.mu.Lock()
-		c.connected = false
-		c.mu.Unlock()
-		logging.Warn("WhatsApp disconnected")
+		c.transition(StateDisconnected, StateConnecting, StateConnected)
+		logging.Warn("WhatsApp disconnected", zap.String("account", c.ID()))
+		c.emitDisconnected("disconnected")
+		c.publishState("disconnected")
 
 	case *events.LoggedOut:
-		c.mu.Lock()
-		c.connected = false
-		c.mu.Unlock()
+		c.setState(StateLoggedOut)
+		c.recordError(fmt.Errorf("logged out: %s", v.Reason.String()))
 		logging.Warn("WhatsApp logged out",
+			zap.String("account", c.ID()),
 			zap.Bool("on_connect", v.OnConnect),
 			zap.String("reason", v.Reason.String()),
 		)
+		c.emitDisconnected("logged_out")
+		c.publishState("logged_out")
 
 	case *events.StreamReplaced:
-		c.mu.Lock()
-		c.connected = false
-		c.mu.Unlock()
+		c.transition(StateDisconnected, StateConnecting, StateConnected)
 		logging.Warn("WhatsApp stream replaced (logged in elsewhere)")
+		c.emitDisconnected("stream_replaced")
+		c.publishState("stream_replaced")
 
 	case *events.TemporaryBan:
+		c.mu.Lock()
+		c.bannedUntil = time.Now().Add(v.Expire)
+		c.lastError = v.String()
+		c.lastErrorAt = time.Now()
+		c.setStateLocked(StateBanned)
+		c.mu.Unlock()
 		logging.Error("WhatsApp temporary ban",
+			zap.String("account", c.ID()),
 			zap.String("code", v.Code.String()),
 			zap.Duration("duration", v.Expire),
 		)
+		webhooks.Get().Emit(webhooks.EventWhatsAppBanned, map[string]interface{}{
+			"account":      c.ID(),
+			"code":         v.Code.String(),
+			"banned_until": time.Now().Add(v.Expire).UTC(),
+		})
+		c.publishState("banned")
 
 	case *events.ConnectFailure:
-		c.mu.Lock()
-		c.connected = false
-		c.mu.Unlock()
+		c.transition(StateDisconnected, StateConnecting, StateConnected)
+		c.recordError(fmt.Errorf("connection failure: %s", v.Reason.String()))
 		logging.Error("WhatsApp connection failure",
+			zap.String("account", c.ID()),
 			zap.String("reason", v.Reason.String()),
 		)
+		c.publishState("connect_failure")
 
 	case *events.ClientOutdated:
+		c.setState(StateOutdated)
+		c.recordError(fmt.Errorf("client outdated"))
 		logging.Error("WhatsApp client outdated, update required")
+		c.publishState("outdated")
+
+	case *events.KeepAliveTimeout:
+		// The connection is open but WhatsApp stopped answering; the
+		// supervisor replaces it once it has been silent for too long
+		if time.Since(v.LastSuccess) > whatsmeow.KeepAliveMaxFailTime &&
+			c.transition(StateDisconnected, StateConnected) {
+			c.recordError(fmt.Errorf("keep-alive timed out"))
+			logging.Warn("WhatsApp keep-alive timed out",
+				zap.String("account", c.ID()),
+				zap.Int("errors", v.ErrorCount),
+			)
+			c.publishState("disconnected")
+		}
 
 	case *events.StreamError:
 		logging.Error("WhatsApp stream error",
@@ -68,11 +102,19 @@ func (c *Client) eventHandler(evt interface{}) {
 		logging.Info("WhatsApp pairing successful",
 			zap.String("id", v.ID.String()),
 		)
+		c.endPairing(0, PairingSuccess, "")
+		// WhatsApp has the new device reconnect to finish logging in
+		c.setState(StateConnecting)
+		if c.onPaired != nil {
+			c.onPaired(c)
+		}
+		c.publishState("paired")
 
 	case *events.PairError:
 		logging.Error("WhatsApp pairing error",
 			zap.Error(v.Error),
 		)
+		c.endPairing(0, PairingFailed, v.Error.Error())
 
 	case *events.QR:
 		// QR events are handled separately via GetQRChannel
@@ -90,25 +132,19 @@ func (c *Client) eventHandler(evt interface{}) {
 	}
 }
 
-// AutoReconnect attempts to reconnect when disconnected
-func (c *Client) AutoReconnect() {
-	go func() {
-		for {
-			if !c.IsConnected() && c.IsLoggedIn() {
-				logging.Info("Attempting to reconnect to WhatsApp...")
-
-				c.mu.Lock()
-				c.reconnectCount++
-				c.mu.Unlock()
-
-				err := c.client.Connect()
-				if err != nil {
-					logging.Error("Reconnection failed", zap.Error(err))
-					time.Sleep(30 * time.Second)
-					continue
-				}
-			}
-			time.Sleep(5 * time.Second)
-		}
-	}()
+// emitDisconnected notifies webhooks that the account lost its connection
+func (c *Client) emitDisconnected(reason string) {
+	webhooks.Get().Emit(webhooks.EventWhatsAppDisconnected, map[string]interface{}{
+		"account": c.ID(),
+		"reason":  reason,
+	})
+}
+
+// publishState pushes a connection state change and the account's status to
+// live subscribers
+func (c *Client) publishState(state string) {
+	broadcast.Get().Publish(broadcast.EventWhatsApp, map[string]interface{}{
+		"event":   state,
+		"account": c.GetAccountStatus(),
+	})
 }
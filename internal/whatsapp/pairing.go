@@ -0,0 +1,161 @@
+package whatsapp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/salman0ansari/whatsbox/internal/broadcast"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"go.mau.fi/whatsmeow"
+	"go.uber.org/zap"
+)
+
+// Pairing states
+const (
+	PairingIdle    = "idle"
+	PairingPending = "pending"
+	PairingSuccess = "success"
+	PairingFailed  = "failed"
+	PairingTimeout = "timeout"
+)
+
+// Pairing methods
+const (
+	PairingMethodQR    = "qr"
+	PairingMethodPhone = "phone"
+)
+
+// pairingWindow is how long a login connection stays open: WhatsApp closes
+// it once the QR codes run out, which also ends any pairing code requested on it
+const pairingWindow = 160 * time.Second
+
+// pairClientDisplayName is shown on the phone for a pairing code. WhatsApp only
+// accepts common "Browser (OS)" combinations.
+const pairClientDisplayName = "Chrome (Linux)"
+
+// PairingStatus describes the most recent attempt to link an account
+type PairingStatus struct {
+	State     string     `json:"state"`
+	Method    string     `json:"method,omitempty"`
+	Phone     string     `json:"phone,omitempty"`
+	Code      string     `json:"code,omitempty"`
+	Account   string     `json:"account,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// PairPhone requests an 8-character pairing code for linking the phone number
+// as this device. The code is entered on the phone under Linked devices > Link
+// with phone number instead.
+func (c *Client) PairPhone(ctx context.Context, phone string) (PairingStatus, error) {
+	if c.client.Store.ID != nil {
+		return PairingStatus{}, fmt.Errorf("already logged in")
+	}
+
+	// Check the number the way whatsmeow does before opening a connection for it
+	digits := strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, phone)
+	if len(digits) <= 6 {
+		return PairingStatus{}, whatsmeow.ErrPhoneNumberTooShort
+	}
+	if strings.HasPrefix(digits, "0") {
+		return PairingStatus{}, whatsmeow.ErrPhoneNumberIsNotInternational
+	}
+
+	// Pairing codes are requested over the login connection, which is ready
+	// once it has delivered its first QR code
+	if _, err := c.GetQR(ctx); err != nil {
+		return PairingStatus{}, err
+	}
+
+	code, err := c.client.PairPhone(ctx, phone, true, whatsmeow.PairClientChrome, pairClientDisplayName)
+	if err != nil {
+		return PairingStatus{}, err
+	}
+
+	status := c.updatePairing(func(p *PairingStatus) {
+		p.State = PairingPending
+		p.Method = PairingMethodPhone
+		p.Phone = digits
+		p.Code = code
+		p.Error = ""
+	})
+	logging.Info("WhatsApp pairing code requested", zap.String("phone", digits))
+
+	return status, nil
+}
+
+// PairingStatus returns the state of the most recent pairing attempt
+func (c *Client) PairingStatus() PairingStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.pairing.State == "" {
+		return PairingStatus{State: PairingIdle}
+	}
+	return c.pairing
+}
+
+// startPairing records a new login connection, which QR codes and pairing
+// codes can be used on until it expires. It returns the attempt's number for
+// endPairing.
+func (c *Client) startPairing(ctx context.Context) int64 {
+	now := time.Now()
+	expiresAt := now.Add(pairingWindow)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(expiresAt) {
+		expiresAt = deadline
+	}
+
+	var attempt int64
+	c.updatePairing(func(p *PairingStatus) {
+		c.pairingAttempt++
+		attempt = c.pairingAttempt
+		*p = PairingStatus{
+			State:     PairingPending,
+			Method:    PairingMethodQR,
+			StartedAt: &now,
+			ExpiresAt: &expiresAt,
+		}
+	})
+	return attempt
+}
+
+// endPairing records how a pending pairing attempt ended. Outcomes reported
+// after the attempt already ended or was replaced by a new one, such as the
+// login connection closing after success, are ignored. An attempt of zero
+// matches the current one.
+func (c *Client) endPairing(attempt int64, state, errMsg string) {
+	c.mu.Lock()
+	if c.pairing.State != PairingPending || (attempt != 0 && attempt != c.pairingAttempt) {
+		c.mu.Unlock()
+		return
+	}
+	c.pairing.State = state
+	c.pairing.Error = errMsg
+	c.pairing.Code = ""
+	if state == PairingSuccess {
+		c.pairing.Account = c.ID()
+	}
+	status := c.pairing
+	c.mu.Unlock()
+
+	broadcast.Get().Publish(broadcast.EventPairing, status)
+}
+
+// updatePairing changes the pairing status and pushes it to live subscribers
+func (c *Client) updatePairing(update func(*PairingStatus)) PairingStatus {
+	c.mu.Lock()
+	update(&c.pairing)
+	status := c.pairing
+	c.mu.Unlock()
+
+	broadcast.Get().Publish(broadcast.EventPairing, status)
+	return status
+}
@@ -0,0 +1,444 @@
+package whatsapp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/salman0ansari/whatsbox/internal/config"
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waCompanionReg"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	waLog "go.mau.fi/whatsmeow/util/log"
+	"go.uber.org/zap"
+)
+
+// Account selection strategies for uploads
+const (
+	StrategyRoundRobin = "round_robin"
+	StrategyLeastUsed  = "least_used"
+)
+
+var (
+	// ErrNoAccount is returned when no linked account can serve a request
+	ErrNoAccount = errors.New("no connected WhatsApp account")
+
+	// ErrAccountNotFound is returned when an account ID is unknown
+	ErrAccountNotFound = errors.New("WhatsApp account not found")
+)
+
+// Pool manages every account linked from the session store and spreads
+// uploads across the healthy ones
+type Pool struct {
+	cfg       *config.Config
+	container *sqlstore.Container
+	waLogger  waLog.Logger
+
+	mu         sync.RWMutex
+	clients    []*Client
+	pending    *Client
+	lastPaired *Client
+	next       int
+
+	// supervisor is set once Supervise is called, so accounts linked later are supervised too
+	supervisor context.Context
+}
+
+// PoolStatus is the combined status of all accounts. The embedded status
+// describes the first connected account for single-account clients.
+type PoolStatus struct {
+	Status
+	Accounts []AccountStatus `json:"accounts"`
+}
+
+// AccountStatus describes the health and upload volume of a linked account
+type AccountStatus struct {
+	Status
+	ID            string `json:"id"`
+	Healthy       bool   `json:"healthy"`
+	Uploads       int64  `json:"uploads"`
+	BytesUploaded int64  `json:"bytes_uploaded"`
+	ActiveUploads int64  `json:"active_uploads"`
+}
+
+// NewPool opens the session store and creates a client for every linked device
+func NewPool(cfg *config.Config) (*Pool, error) {
+	ctx := context.Background()
+
+	// Ensure session directory exists
+	sessionDir := filepath.Dir(cfg.WASessionPath)
+	if err := os.MkdirAll(sessionDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %w", err)
+	}
+
+	// Create logger wrapper
+	waLogger := &zapLogWrapper{logger: logging.Logger.With(zap.String("component", "whatsmeow"))}
+
+	// Create database container for session storage
+	container, err := sqlstore.New(ctx, "sqlite3", cfg.WASessionPath+"?_journal_mode=WAL&_foreign_keys=on", waLogger.Sub("store"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session store: %w", err)
+	}
+
+	devices, err := container.GetAllDevices(ctx)
+	if err != nil {
+		container.Close()
+		return nil, fmt.Errorf("failed to get device stores: %w", err)
+	}
+
+	// Set client properties
+	osName := "WhatsBox"
+	platformType := waCompanionReg.DeviceProps_CHROME
+	requireFullSync := false
+	store.DeviceProps.Os = &osName
+	store.DeviceProps.PlatformType = &platformType
+	store.DeviceProps.RequireFullSync = &requireFullSync
+
+	p := &Pool{
+		cfg:       cfg,
+		container: container,
+		waLogger:  waLogger,
+	}
+
+	for _, device := range devices {
+		p.clients = append(p.clients, newClient(cfg, device, waLogger, p.paired))
+	}
+
+	logging.Info("Loaded WhatsApp accounts", zap.Int("count", len(p.clients)))
+
+	return p, nil
+}
+
+// Connect connects every linked account
+func (p *Pool) Connect(ctx context.Context) error {
+	var errs []error
+	for _, c := range p.Accounts() {
+		if err := c.Connect(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.ID(), err))
+		}
+	}
+	if len(p.Accounts()) == 0 {
+		logging.Info("No WhatsApp account linked, QR code required")
+	}
+	return errors.Join(errs...)
+}
+
+// Supervise keeps every linked account connected, including ones added
+// later, until ctx is cancelled
+func (p *Pool) Supervise(ctx context.Context) {
+	p.mu.Lock()
+	p.supervisor = ctx
+	clients := append([]*Client(nil), p.clients...)
+	p.mu.Unlock()
+
+	for _, c := range clients {
+		go c.supervise(ctx)
+	}
+}
+
+// Accounts returns the linked accounts in the order they were added
+func (p *Pool) Accounts() []*Client {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Client(nil), p.clients...)
+}
+
+// Get returns the account with the given ID
+func (p *Pool) Get(id string) (*Client, error) {
+	for _, c := range p.Accounts() {
+		if c.ID() == id {
+			return c, nil
+		}
+	}
+	return nil, ErrAccountNotFound
+}
+
+// PairingClient returns the client used to link a new account, creating a new
+// device in the session store if no pairing is in progress
+func (p *Pool) PairingClient() *Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pending == nil {
+		p.pending = newClient(p.cfg, p.container.NewDevice(), p.waLogger, p.paired)
+	}
+	return p.pending
+}
+
+// PairPhone starts linking a new account by phone number and returns the
+// pairing code to enter on that phone
+func (p *Pool) PairPhone(ctx context.Context, phone string) (PairingStatus, error) {
+	return p.PairingClient().PairPhone(ctx, phone)
+}
+
+// PairingStatus returns the state of the current pairing, or of the last
+// completed one if none is in progress
+func (p *Pool) PairingStatus() PairingStatus {
+	p.mu.RLock()
+	c := p.pending
+	if c == nil || c.PairingStatus().State == PairingIdle {
+		if p.lastPaired != nil {
+			c = p.lastPaired
+		}
+	}
+	p.mu.RUnlock()
+
+	if c == nil {
+		return PairingStatus{State: PairingIdle}
+	}
+	return c.PairingStatus()
+}
+
+// paired moves a newly linked device from pending into the pool
+func (p *Pool) paired(c *Client) {
+	p.mu.Lock()
+	if p.pending == c {
+		p.pending = nil
+	}
+	p.lastPaired = c
+	p.clients = append(p.clients, c)
+	supervisor := p.supervisor
+	p.mu.Unlock()
+
+	logging.Info("WhatsApp account added", zap.String("account", c.ID()))
+
+	if supervisor != nil {
+		go c.supervise(supervisor)
+	}
+}
+
+// Remove unlinks an account and deletes its session
+func (p *Pool) Remove(ctx context.Context, id string) error {
+	c, err := p.Get(id)
+	if err != nil {
+		return err
+	}
+
+	// Logging out tells WhatsApp to unlink the device; a disconnected
+	// account can only be forgotten locally
+	if c.IsConnected() {
+		if err := c.Logout(ctx); err != nil {
+			return err
+		}
+	} else if c.IsLoggedIn() {
+		if err := c.client.Store.Delete(ctx); err != nil {
+			return fmt.Errorf("failed to delete session: %w", err)
+		}
+	}
+	c.Close()
+
+	p.mu.Lock()
+	for i, client := range p.clients {
+		if client == c {
+			p.clients = append(p.clients[:i], p.clients[i+1:]...)
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	logging.Info("WhatsApp account removed", zap.String("account", id))
+	return nil
+}
+
+// Logout logs out every linked account
+func (p *Pool) Logout(ctx context.Context) error {
+	var errs []error
+	for _, c := range p.Accounts() {
+		if err := p.Remove(ctx, c.ID()); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.ID(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// IsConnected returns whether any account can currently serve requests
+func (p *Pool) IsConnected() bool {
+	for _, c := range p.Accounts() {
+		if c.IsHealthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLoggedIn returns whether any account is linked
+func (p *Pool) IsLoggedIn() bool {
+	for _, c := range p.Accounts() {
+		if c.IsLoggedIn() {
+			return true
+		}
+	}
+	return false
+}
+
+// GetStatus returns the status of every account
+func (p *Pool) GetStatus() PoolStatus {
+	status := PoolStatus{Accounts: []AccountStatus{}}
+
+	connected := -1
+	for _, c := range p.Accounts() {
+		account := c.GetAccountStatus()
+		status.Accounts = append(status.Accounts, account)
+
+		status.ReconnectCount += account.ReconnectCount
+		status.LoggedIn = status.LoggedIn || account.LoggedIn
+		if account.Connected && connected < 0 {
+			connected = len(status.Accounts) - 1
+		}
+	}
+
+	// Describe the first connected account, or else why the first account isn't connected
+	switch {
+	case connected >= 0:
+		account := status.Accounts[connected]
+		status.Connected = true
+		status.State = StateConnected
+		status.ConnectedAt = account.ConnectedAt
+		status.PhoneNumber = account.PhoneNumber
+		status.PushName = account.PushName
+	case len(status.Accounts) > 0:
+		first := status.Accounts[0]
+		status.State = first.State
+		status.LastError = first.LastError
+		status.LastErrorAt = first.LastErrorAt
+		status.BannedUntil = first.BannedUntil
+	default:
+		status.State = StateLoggedOut
+	}
+
+	return status
+}
+
+// Disconnect disconnects every account
+func (p *Pool) Disconnect() {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, c := range p.clients {
+		c.Disconnect()
+	}
+	if p.pending != nil {
+		p.pending.Disconnect()
+	}
+}
+
+// Close closes every account and the session store
+func (p *Pool) Close() error {
+	p.mu.RLock()
+	for _, c := range p.clients {
+		c.Close()
+	}
+	if p.pending != nil {
+		p.pending.Close()
+	}
+	p.mu.RUnlock()
+
+	return p.container.Close()
+}
+
+// pick chooses the account for the next upload
+func (p *Pool) pick() (*Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *Client
+	for i := range p.clients {
+		idx := (p.next + i) % len(p.clients)
+		c := p.clients[idx]
+		if !c.IsHealthy() {
+			continue
+		}
+
+		if p.cfg.WAAccountStrategy != StrategyLeastUsed {
+			p.next = idx + 1
+			return c, nil
+		}
+		if best == nil || c.uploadLoad() < best.uploadLoad() {
+			best = c
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNoAccount
+	}
+	return best, nil
+}
+
+// downloader returns the account that uploaded the media if it is healthy.
+// CDN downloads don't depend on the session, so any healthy account will do otherwise.
+func (p *Pool) downloader(account string) (*Client, error) {
+	if account != "" {
+		if c, err := p.Get(account); err == nil && c.IsHealthy() {
+			return c, nil
+		}
+	}
+
+	for _, c := range p.Accounts() {
+		if c.IsHealthy() {
+			return c, nil
+		}
+	}
+	return nil, ErrNoAccount
+}
+
+// UploadFromReader uploads a file through the next account chosen by the strategy
+func (p *Pool) UploadFromReader(ctx context.Context, reader io.Reader, mediaType whatsmeow.MediaType) (*UploadResponse, error) {
+	c, err := p.pick()
+	if err != nil {
+		return nil, err
+	}
+	return c.UploadFromReader(ctx, reader, mediaType)
+}
+
+// DownloadStream opens a streaming download, preferring the account that uploaded the media
+func (p *Pool) DownloadStream(ctx context.Context, req *DownloadRequest) (io.ReadCloser, error) {
+	c, err := p.downloader(req.Account)
+	if err != nil {
+		return nil, err
+	}
+	return c.DownloadStream(ctx, req)
+}
+
+// DownloadRange opens a streaming download of a byte range, preferring the account that uploaded the media
+func (p *Pool) DownloadRange(ctx context.Context, req *DownloadRequest, offset, length int64) (io.ReadCloser, error) {
+	c, err := p.downloader(req.Account)
+	if err != nil {
+		return nil, err
+	}
+	return c.DownloadRange(ctx, req, offset, length)
+}
+
+// Reupload streams stored media back from the CDN and uploads it again through the
+// next account, resetting its retention period. The returned media has new keys
+// but the same plaintext.
+func (p *Pool) Reupload(ctx context.Context, req *DownloadRequest) (*UploadResponse, error) {
+	reader, err := p.DownloadStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	resp, err := p.UploadFromReader(ctx, reader, mediaTypeForMime(req.MimeType))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.FileSHA256) > 0 && !bytes.Equal(resp.FileSHA256, req.FileSHA256) {
+		return nil, fmt.Errorf("re-uploaded media does not match the original checksum")
+	}
+
+	logging.Info("Media re-uploaded to WhatsApp",
+		zap.String("old_direct_path", req.DirectPath),
+		zap.String("direct_path", resp.DirectPath),
+		zap.String("account", resp.Account),
+	)
+
+	return resp, nil
+}
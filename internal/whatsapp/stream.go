@@ -0,0 +1,369 @@
+package whatsapp
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/util/hkdfutil"
+)
+
+const (
+	// mediaHMACLength is the length of the truncated HMAC appended to encrypted media
+	mediaHMACLength = 10
+
+	// streamBufferSize is the amount of encrypted data read from the CDN at a time
+	streamBufferSize = 64 * 1024
+)
+
+// mediaKeys expands a media key into the IV, cipher key and MAC key for a media type
+func mediaKeys(mediaKey []byte, mediaType whatsmeow.MediaType) (iv, cipherKey, macKey []byte) {
+	expanded := hkdfutil.SHA256(mediaKey, nil, []byte(mediaType), 112)
+	return expanded[:16], expanded[16:48], expanded[48:80]
+}
+
+// decryptReader decrypts WhatsApp media while it is being read from the CDN.
+//
+// The ciphertext is AES-256-CBC followed by a 10 byte HMAC-SHA256. The last
+// ciphertext block and the HMAC are held back until the source is exhausted so
+// that the padding can be stripped and every checksum verified before the final
+// plaintext bytes are released. A corrupted file therefore never reaches the
+// reader in full.
+type decryptReader struct {
+	body   io.ReadCloser
+	cancel context.CancelFunc
+
+	cbc       cipher.BlockMode
+	mac       hash.Hash
+	encHash   hash.Hash
+	plainHash hash.Hash
+
+	expectedEncHash []byte
+	expectedSHA256  []byte
+	expectedLength  int64
+
+	buf     []byte
+	pending []byte
+	out     []byte
+	length  int64
+	done    bool
+	err     error
+}
+
+// newDecryptReader wraps an encrypted media body in a verifying, decrypting reader
+func newDecryptReader(body io.ReadCloser, cancel context.CancelFunc, req *DownloadRequest, mediaType whatsmeow.MediaType) (*decryptReader, error) {
+	iv, cipherKey, macKey := mediaKeys(req.MediaKey, mediaType)
+
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(iv)
+
+	expectedLength := int64(-1)
+	if req.FileLength > 0 {
+		expectedLength = int64(req.FileLength)
+	}
+
+	return &decryptReader{
+		body:            body,
+		cancel:          cancel,
+		cbc:             cipher.NewCBCDecrypter(block, iv),
+		mac:             mac,
+		encHash:         sha256.New(),
+		plainHash:       sha256.New(),
+		expectedEncHash: req.FileEncHash,
+		expectedSHA256:  req.FileSHA256,
+		expectedLength:  expectedLength,
+		buf:             make([]byte, streamBufferSize),
+	}, nil
+}
+
+// Read implements io.Reader
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.fill()
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill reads the next piece of ciphertext and decrypts everything that is safe to release.
+// It is only called once all previously decrypted data has been consumed.
+func (r *decryptReader) fill() {
+	n, err := r.body.Read(r.buf)
+	if n > 0 {
+		r.encHash.Write(r.buf[:n])
+		r.pending = append(r.pending, r.buf[:n]...)
+	}
+
+	if err == io.EOF {
+		r.finish()
+		return
+	}
+	if err != nil {
+		r.err = fmt.Errorf("failed to read media: %w", err)
+		return
+	}
+
+	// Keep the final block and the HMAC in reserve until EOF
+	ready := len(r.pending) - mediaHMACLength - aes.BlockSize
+	ready -= ready % aes.BlockSize
+	if ready <= 0 {
+		return
+	}
+
+	r.decrypt(r.pending[:ready])
+	r.pending = append(r.pending[:0], r.pending[ready:]...)
+}
+
+// finish verifies the trailing HMAC and checksums and releases the final block
+func (r *decryptReader) finish() {
+	r.done = true
+
+	if len(r.pending) < mediaHMACLength+aes.BlockSize {
+		r.err = whatsmeow.ErrTooShortFile
+		return
+	}
+
+	ciphertext := r.pending[:len(r.pending)-mediaHMACLength]
+	mac := r.pending[len(r.pending)-mediaHMACLength:]
+	if len(ciphertext)%aes.BlockSize != 0 {
+		r.err = fmt.Errorf("ciphertext is not a multiple of the block size")
+		return
+	}
+
+	if len(r.expectedEncHash) == sha256.Size && !bytes.Equal(r.encHash.Sum(nil), r.expectedEncHash) {
+		r.err = whatsmeow.ErrInvalidMediaEncSHA256
+		return
+	}
+
+	r.mac.Write(ciphertext)
+	if !hmac.Equal(r.mac.Sum(nil)[:mediaHMACLength], mac) {
+		r.err = whatsmeow.ErrInvalidMediaHMAC
+		return
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	r.cbc.CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(plaintext) {
+		r.err = fmt.Errorf("invalid padding length %d", padding)
+		return
+	}
+	plaintext = plaintext[:len(plaintext)-padding]
+
+	r.plainHash.Write(plaintext)
+	r.length += int64(len(plaintext))
+
+	if r.expectedLength >= 0 && r.length != r.expectedLength {
+		r.err = fmt.Errorf("%w: expected %d, got %d", whatsmeow.ErrFileLengthMismatch, r.expectedLength, r.length)
+		return
+	}
+	if len(r.expectedSHA256) == sha256.Size && !bytes.Equal(r.plainHash.Sum(nil), r.expectedSHA256) {
+		r.err = whatsmeow.ErrInvalidMediaSHA256
+		return
+	}
+
+	r.out = plaintext
+}
+
+// decrypt decrypts whole blocks that are known not to be the final one
+func (r *decryptReader) decrypt(ciphertext []byte) {
+	r.mac.Write(ciphertext)
+
+	plaintext := make([]byte, len(ciphertext))
+	r.cbc.CryptBlocks(plaintext, ciphertext)
+
+	r.plainHash.Write(plaintext)
+	r.length += int64(len(plaintext))
+	r.out = plaintext
+}
+
+// Close closes the underlying CDN response
+func (r *decryptReader) Close() error {
+	err := r.body.Close()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	return err
+}
+
+// rangeReader decrypts a block aligned slice of ciphertext and trims it to a byte range.
+//
+// When iv is nil the first ciphertext block of the body is used as the IV, which
+// lets decryption start anywhere in a CBC stream.
+type rangeReader struct {
+	body   io.ReadCloser
+	cancel context.CancelFunc
+
+	block cipher.Block
+	cbc   cipher.BlockMode
+
+	skip      int64
+	remaining int64
+
+	buf     []byte
+	pending []byte
+	out     []byte
+	err     error
+}
+
+// newRangeReader wraps the ciphertext returned by cipherRange for length bytes
+// at offset in a decrypting reader
+func newRangeReader(body io.ReadCloser, cancel context.CancelFunc, mediaKey []byte, mediaType whatsmeow.MediaType, offset, length int64) (*rangeReader, error) {
+	mediaIV, cipherKey, _ := mediaKeys(mediaKey, mediaType)
+
+	// The first block is decrypted with the media IV, any other with the
+	// ciphertext block before it, which starts the body
+	var iv []byte
+	firstBlock := offset / aes.BlockSize
+	if firstBlock == 0 {
+		iv = mediaIV
+	}
+	skip := offset - firstBlock*aes.BlockSize
+
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	r := &rangeReader{
+		body:      body,
+		cancel:    cancel,
+		block:     block,
+		skip:      skip,
+		remaining: length,
+		buf:       make([]byte, streamBufferSize),
+	}
+	if iv != nil {
+		r.cbc = cipher.NewCBCDecrypter(block, iv)
+	}
+	return r, nil
+}
+
+// Read implements io.Reader
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.remaining == 0 {
+			return 0, io.EOF
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill reads the next piece of ciphertext and decrypts all complete blocks
+func (r *rangeReader) fill() {
+	n, err := r.body.Read(r.buf)
+	r.pending = append(r.pending, r.buf[:n]...)
+
+	if r.cbc == nil && len(r.pending) >= aes.BlockSize {
+		r.cbc = cipher.NewCBCDecrypter(r.block, r.pending[:aes.BlockSize])
+		r.pending = append(r.pending[:0], r.pending[aes.BlockSize:]...)
+	}
+
+	if r.cbc != nil {
+		ready := len(r.pending) - len(r.pending)%aes.BlockSize
+		if ready > 0 {
+			plaintext := make([]byte, ready)
+			r.cbc.CryptBlocks(plaintext, r.pending[:ready])
+			r.pending = append(r.pending[:0], r.pending[ready:]...)
+
+			if r.skip > 0 {
+				skipped := min(r.skip, int64(len(plaintext)))
+				plaintext = plaintext[skipped:]
+				r.skip -= skipped
+			}
+			if int64(len(plaintext)) > r.remaining {
+				plaintext = plaintext[:r.remaining]
+			}
+			r.remaining -= int64(len(plaintext))
+			r.out = plaintext
+		}
+	}
+
+	if err == io.EOF {
+		if r.remaining > 0 {
+			r.err = io.ErrUnexpectedEOF
+		}
+	} else if err != nil {
+		r.err = fmt.Errorf("failed to read media: %w", err)
+	}
+}
+
+// Close closes the underlying CDN response
+func (r *rangeReader) Close() error {
+	err := r.body.Close()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	return err
+}
+
+// trimmedReader returns a range of a verifying reader. The bytes after the range
+// are read and discarded once it has been returned, so a corrupted file fails
+// the final Read instead of ending the range cleanly.
+type trimmedReader struct {
+	src       io.ReadCloser
+	remaining int64
+}
+
+// Read implements io.Reader
+func (r *trimmedReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		if _, err := io.Copy(io.Discard, r.src); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.src.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// newTrimmedReader skips to offset in a verifying reader and returns length
+// bytes from there
+func newTrimmedReader(src io.ReadCloser, offset, length int64) (*trimmedReader, error) {
+	if _, err := io.CopyN(io.Discard, src, offset); err != nil {
+		src.Close()
+		return nil, fmt.Errorf("failed to skip to range start: %w", err)
+	}
+	return &trimmedReader{src: src, remaining: length}, nil
+}
+
+// Close closes the underlying reader
+func (r *trimmedReader) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,341 @@
+package whatsapp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/util/cbcutil"
+	"go.mau.fi/whatsmeow/util/hkdfutil"
+)
+
+const testMediaType = whatsmeow.MediaDocument
+
+// testMedia is a file encrypted the way WhatsApp clients upload it
+type testMedia struct {
+	plaintext []byte
+	body      []byte // ciphertext followed by the truncated HMAC
+	req       *DownloadRequest
+}
+
+// ciphertext returns the body without its HMAC
+func (m *testMedia) ciphertext() []byte {
+	return m.body[:len(m.body)-mediaHMACLength]
+}
+
+// testKeys expands a media key as whatsmeow does, independently of mediaKeys
+func testKeys(mediaKey []byte) (iv, cipherKey, macKey []byte) {
+	expanded := hkdfutil.SHA256(mediaKey, nil, []byte(testMediaType), 112)
+	return expanded[:16], expanded[16:48], expanded[48:80]
+}
+
+// sealMedia appends the HMAC of iv and ciphertext and describes the result
+func sealMedia(mediaKey, plaintext, ciphertext []byte) *testMedia {
+	iv, _, macKey := testKeys(mediaKey)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	body := append(bytes.Clone(ciphertext), mac.Sum(nil)[:mediaHMACLength]...)
+
+	encHash := sha256.Sum256(body)
+	plainHash := sha256.Sum256(plaintext)
+	return &testMedia{
+		plaintext: plaintext,
+		body:      body,
+		req: &DownloadRequest{
+			MediaKey:    mediaKey,
+			FileEncHash: encHash[:],
+			FileSHA256:  plainHash[:],
+			FileLength:  uint64(len(plaintext)),
+		},
+	}
+}
+
+// encryptMedia encrypts size random bytes with a random media key
+func encryptMedia(t *testing.T, size int) *testMedia {
+	t.Helper()
+
+	rng := rand.New(rand.NewSource(int64(size)))
+	mediaKey := make([]byte, 32)
+	rng.Read(mediaKey)
+	plaintext := make([]byte, size)
+	rng.Read(plaintext)
+
+	iv, cipherKey, _ := testKeys(mediaKey)
+	ciphertext, err := cbcutil.Encrypt(cipherKey, iv, plaintext)
+	if err != nil {
+		t.Fatalf("failed to encrypt fixture: %v", err)
+	}
+	return sealMedia(mediaKey, plaintext, ciphertext)
+}
+
+// encryptUnpadded encrypts whole blocks without adding PKCS#7 padding, so the
+// last plaintext byte is read as the padding length
+func encryptUnpadded(t *testing.T, media *testMedia, last byte) *testMedia {
+	t.Helper()
+
+	plaintext := bytes.Clone(media.plaintext[:len(media.plaintext)/aes.BlockSize*aes.BlockSize])
+	plaintext[len(plaintext)-1] = last
+
+	iv, cipherKey, _ := testKeys(media.req.MediaKey)
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+	return sealMedia(media.req.MediaKey, plaintext, ciphertext)
+}
+
+// fixtureSizes cover a lone partial block, a whole block that gets a full
+// block of padding, and a file spanning several stream buffers
+var fixtureSizes = []int{1, aes.BlockSize, 2*streamBufferSize + 1007}
+
+func TestDecryptReader(t *testing.T) {
+	for _, size := range fixtureSizes {
+		media := encryptMedia(t, size)
+
+		bodies := map[string]func() io.Reader{
+			"whole":    func() io.Reader { return bytes.NewReader(media.body) },
+			"one byte": func() io.Reader { return iotest.OneByteReader(bytes.NewReader(media.body)) },
+		}
+		for name, body := range bodies {
+			reader, err := newDecryptReader(io.NopCloser(body()), nil, media.req, testMediaType)
+			if err != nil {
+				t.Fatalf("size %d, %s: newDecryptReader: %v", size, name, err)
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("size %d, %s: read: %v", size, name, err)
+			}
+			if !bytes.Equal(got, media.plaintext) {
+				t.Errorf("size %d, %s: decrypted %d bytes that differ from the plaintext", size, name, len(got))
+			}
+		}
+	}
+}
+
+func TestDecryptReaderRejectsCorruptMedia(t *testing.T) {
+	media := encryptMedia(t, fixtureSizes[2])
+
+	tests := []struct {
+		name  string
+		media func() *testMedia
+		want  error // nil accepts any error
+	}{
+		{
+			name: "tampered hmac",
+			media: func() *testMedia {
+				m := *media
+				m.body = bytes.Clone(media.body)
+				m.body[len(m.body)-1] ^= 1
+				m.req = &DownloadRequest{MediaKey: media.req.MediaKey, FileSHA256: media.req.FileSHA256, FileLength: media.req.FileLength}
+				return &m
+			},
+			want: whatsmeow.ErrInvalidMediaHMAC,
+		},
+		{
+			name: "tampered ciphertext",
+			media: func() *testMedia {
+				m := *media
+				m.body = bytes.Clone(media.body)
+				m.body[len(media.ciphertext())-1] ^= 1
+				return &m
+			},
+			want: whatsmeow.ErrInvalidMediaEncSHA256,
+		},
+		{
+			name:  "zero padding",
+			media: func() *testMedia { return encryptUnpadded(t, media, 0) },
+		},
+		{
+			name:  "padding longer than a block",
+			media: func() *testMedia { return encryptUnpadded(t, media, aes.BlockSize+1) },
+		},
+		{
+			name: "truncated by a block",
+			media: func() *testMedia {
+				m := *media
+				m.body = append(bytes.Clone(media.ciphertext()[:len(media.ciphertext())-aes.BlockSize]), media.body[len(media.body)-mediaHMACLength:]...)
+				m.req = &DownloadRequest{MediaKey: media.req.MediaKey}
+				return &m
+			},
+			want: whatsmeow.ErrInvalidMediaHMAC,
+		},
+		{
+			name: "truncated mid block",
+			media: func() *testMedia {
+				m := *media
+				m.body = media.body[:len(media.body)-5]
+				return &m
+			},
+		},
+		{
+			name: "truncated to less than a block",
+			media: func() *testMedia {
+				m := *media
+				m.body = media.body[:aes.BlockSize]
+				return &m
+			},
+			want: whatsmeow.ErrTooShortFile,
+		},
+		{
+			name: "wrong length",
+			media: func() *testMedia {
+				m := *media
+				m.req = &DownloadRequest{MediaKey: media.req.MediaKey, FileLength: media.req.FileLength + 1}
+				return &m
+			},
+			want: whatsmeow.ErrFileLengthMismatch,
+		},
+		{
+			name: "wrong sha256",
+			media: func() *testMedia {
+				m := *media
+				m.req = &DownloadRequest{MediaKey: media.req.MediaKey, FileSHA256: make([]byte, sha256.Size)}
+				return &m
+			},
+			want: whatsmeow.ErrInvalidMediaSHA256,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.media()
+			reader, err := newDecryptReader(io.NopCloser(bytes.NewReader(m.body)), nil, m.req, testMediaType)
+			if err != nil {
+				t.Fatalf("newDecryptReader: %v", err)
+			}
+
+			got, err := io.ReadAll(reader)
+			if err == nil {
+				t.Fatal("read succeeded")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+			// Only blocks before the final one are released ahead of the checks
+			if len(got) >= len(m.plaintext) || !bytes.Equal(got, m.plaintext[:len(got)]) {
+				t.Errorf("released %d bytes before failing, want a strict prefix of %d", len(got), len(m.plaintext))
+			}
+		})
+	}
+}
+
+// testRanges are offset and length pairs within a fixtureSizes[2] file
+var testRanges = []struct {
+	name           string
+	offset, length int64
+}{
+	{"first byte", 0, 1},
+	{"first block", 0, aes.BlockSize},
+	{"inside a block", 5, 10},
+	{"across blocks", 10, 30},
+	{"second block", aes.BlockSize, aes.BlockSize},
+	{"across buffers", streamBufferSize - 3, 2*aes.BlockSize + 7},
+	{"last byte", int64(fixtureSizes[2]) - 1, 1},
+	{"tail", int64(fixtureSizes[2]) - 40, 40},
+	{"whole file", 0, int64(fixtureSizes[2])},
+}
+
+func TestRangeReader(t *testing.T) {
+	media := encryptMedia(t, fixtureSizes[2])
+	ciphertext := media.ciphertext()
+
+	for _, tt := range testRanges {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := cipherRange(tt.offset, tt.length)
+			if start%aes.BlockSize != 0 || (end+1)%aes.BlockSize != 0 || end >= int64(len(ciphertext)) {
+				t.Fatalf("cipherRange(%d, %d) = %d-%d, not whole blocks of the ciphertext", tt.offset, tt.length, start, end)
+			}
+
+			body := io.NopCloser(iotest.HalfReader(bytes.NewReader(ciphertext[start : end+1])))
+			reader, err := newRangeReader(body, nil, media.req.MediaKey, testMediaType, tt.offset, tt.length)
+			if err != nil {
+				t.Fatalf("newRangeReader: %v", err)
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if want := media.plaintext[tt.offset : tt.offset+tt.length]; !bytes.Equal(got, want) {
+				t.Errorf("got %d bytes that differ from the %d bytes of plaintext at %d", len(got), len(want), tt.offset)
+			}
+		})
+	}
+}
+
+func TestRangeReaderTruncated(t *testing.T) {
+	media := encryptMedia(t, fixtureSizes[2])
+
+	offset, length := int64(10), int64(100)
+	start, end := cipherRange(offset, length)
+	body := io.NopCloser(bytes.NewReader(media.ciphertext()[start : end+1-aes.BlockSize]))
+
+	reader, err := newRangeReader(body, nil, media.req.MediaKey, testMediaType, offset, length)
+	if err != nil {
+		t.Fatalf("newRangeReader: %v", err)
+	}
+	if _, err := io.ReadAll(reader); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestTrimmedReader(t *testing.T) {
+	media := encryptMedia(t, fixtureSizes[2])
+
+	for _, tt := range testRanges {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := newDecryptReader(io.NopCloser(bytes.NewReader(media.body)), nil, media.req, testMediaType)
+			if err != nil {
+				t.Fatalf("newDecryptReader: %v", err)
+			}
+			reader, err := newTrimmedReader(src, tt.offset, tt.length)
+			if err != nil {
+				t.Fatalf("newTrimmedReader: %v", err)
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if want := media.plaintext[tt.offset : tt.offset+tt.length]; !bytes.Equal(got, want) {
+				t.Errorf("got %d bytes that differ from the %d bytes of plaintext at %d", len(got), len(want), tt.offset)
+			}
+		})
+	}
+}
+
+func TestTrimmedReaderRejectsCorruptMedia(t *testing.T) {
+	media := encryptMedia(t, fixtureSizes[2])
+	body := bytes.Clone(media.body)
+	body[len(body)-1] ^= 1
+	req := &DownloadRequest{MediaKey: media.req.MediaKey, FileLength: media.req.FileLength}
+
+	for _, tt := range testRanges {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := newDecryptReader(io.NopCloser(bytes.NewReader(body)), nil, req, testMediaType)
+			if err != nil {
+				t.Fatalf("newDecryptReader: %v", err)
+			}
+			reader, err := newTrimmedReader(src, tt.offset, tt.length)
+			if err != nil {
+				// Ranges in the final block fail while skipping to them
+				if !errors.Is(err, whatsmeow.ErrInvalidMediaHMAC) {
+					t.Fatalf("newTrimmedReader: got error %v, want %v", err, whatsmeow.ErrInvalidMediaHMAC)
+				}
+				return
+			}
+			if _, err := io.ReadAll(reader); !errors.Is(err, whatsmeow.ErrInvalidMediaHMAC) {
+				t.Errorf("got error %v, want %v", err, whatsmeow.ErrInvalidMediaHMAC)
+			}
+		})
+	}
+}
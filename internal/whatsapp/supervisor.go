@@ -0,0 +1,185 @@
+package whatsapp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/salman0ansari/whatsbox/internal/logging"
+	"go.uber.org/zap"
+)
+
+// Connection states of an account
+const (
+	// StateDisconnected means the connection dropped and a reconnect is pending
+	StateDisconnected = "disconnected"
+	// StateConnecting means a connection attempt is in progress
+	StateConnecting = "connecting"
+	// StateConnected means the account is connected and authenticated
+	StateConnected = "connected"
+	// StateLoggedOut means the device was unlinked, or was never linked
+	StateLoggedOut = "logged_out"
+	// StateBanned means the account is temporarily banned until banned_until
+	StateBanned = "banned"
+	// StateOutdated means WhatsApp rejected this client version and the server needs an update
+	StateOutdated = "outdated"
+)
+
+const (
+	// reconnectMinDelay is the delay before the first reconnect attempt. It
+	// doubles with every failed attempt up to reconnectMaxDelay.
+	reconnectMinDelay = 2 * time.Second
+	reconnectMaxDelay = 5 * time.Minute
+
+	// connectTimeout is how long a connection attempt may take to be
+	// confirmed before it is abandoned and retried
+	connectTimeout = time.Minute
+)
+
+// setState moves the account to a new connection state and wakes its supervisor
+func (c *Client) setState(state string) {
+	c.mu.Lock()
+	c.setStateLocked(state)
+	c.mu.Unlock()
+}
+
+// transition moves the account to a new connection state if it is in one of
+// the given states, so e.g. the disconnect following a ban doesn't hide the ban
+func (c *Client) transition(state string, from ...string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !slices.Contains(from, c.state) {
+		return false
+	}
+	c.setStateLocked(state)
+	return true
+}
+
+// setStateLocked is setState for callers holding c.mu
+func (c *Client) setStateLocked(state string) {
+	c.state = state
+	if state == StateConnected {
+		c.connectedAt = time.Now()
+	}
+
+	select {
+	case c.stateChanged <- struct{}{}:
+	default:
+	}
+}
+
+// State returns the account's connection state
+func (c *Client) State() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state
+}
+
+// supervise keeps the account connected until ctx is cancelled or the client
+// is closed. Failed attempts are retried with exponential backoff, a banned
+// account waits for its ban to expire, and an account that was logged out or
+// is running an outdated client is given up on.
+func (c *Client) supervise(ctx context.Context) {
+	// attempts counts reconnects since the account was last connected
+	attempts := 0
+
+	for {
+		c.mu.RLock()
+		state := c.state
+		bannedUntil := c.bannedUntil
+		c.mu.RUnlock()
+
+		var wait <-chan time.Time
+		switch state {
+		case StateConnected:
+			attempts = 0
+		case StateConnecting:
+			wait = time.After(connectTimeout)
+		case StateDisconnected:
+			wait = time.After(reconnectDelay(attempts))
+		case StateBanned:
+			wait = time.After(time.Until(bannedUntil))
+		case StateLoggedOut, StateOutdated:
+			logging.Warn("WhatsApp account needs attention, not reconnecting",
+				zap.String("account", c.ID()),
+				zap.String("state", state),
+			)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		case <-c.stateChanged:
+			continue
+		case <-wait:
+		}
+
+		switch state {
+		case StateConnecting:
+			// The connection was never confirmed; drop it and start over
+			logging.Warn("WhatsApp connection attempt timed out", zap.String("account", c.ID()))
+			c.recordError(errors.New("connection attempt timed out"))
+			c.client.Disconnect()
+			c.transition(StateDisconnected, StateConnecting)
+
+		case StateBanned:
+			logging.Info("WhatsApp temporary ban expired", zap.String("account", c.ID()))
+			attempts = 0
+			c.transition(StateDisconnected, StateBanned)
+
+		case StateDisconnected:
+			attempts++
+			if err := c.reconnect(); err != nil {
+				logging.Error("Reconnection failed",
+					zap.Error(err),
+					zap.String("account", c.ID()),
+					zap.Int("attempts", attempts),
+				)
+			}
+		}
+	}
+}
+
+// reconnect makes one connection attempt. Success is confirmed by the
+// Connected event, or refuted by a ban, logout or connect failure event.
+func (c *Client) reconnect() error {
+	logging.Info("Attempting to reconnect to WhatsApp...", zap.String("account", c.ID()))
+
+	if !c.transition(StateConnecting, StateDisconnected) {
+		// An event moved the account on while we were waiting
+		return nil
+	}
+
+	c.mu.Lock()
+	c.reconnectCount++
+	c.mu.Unlock()
+
+	// A connection that stopped answering keep-alives is still open
+	c.client.Disconnect()
+
+	if err := c.client.Connect(); err != nil {
+		err = fmt.Errorf("failed to connect: %w", err)
+		c.recordError(err)
+		c.transition(StateDisconnected, StateConnecting)
+		return err
+	}
+	return nil
+}
+
+// reconnectDelay returns how long to wait before the next attempt after the
+// given number of unsuccessful ones. The delay is randomized over its upper
+// half so accounts and servers that dropped together don't retry in step.
+func reconnectDelay(attempts int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempts < 16 {
+		delay = min(reconnectMinDelay<<attempts, reconnectMaxDelay)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
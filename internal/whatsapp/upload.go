@@ -4,14 +4,21 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/salman0ansari/whatsbox/internal/logging"
 	"go.mau.fi/whatsmeow"
 	"go.uber.org/zap"
 )
 
+// MediaRetention is how long WhatsApp keeps uploaded media available on its CDN
+const MediaRetention = 30 * 24 * time.Hour
+
 // UploadResponse contains the result of uploading a file to WhatsApp
 type UploadResponse struct {
+	Account     string
 	DirectPath  string
 	MediaKey    []byte
 	FileEncHash []byte
@@ -32,9 +39,11 @@ func (c *Client) Upload(ctx context.Context, data []byte, mediaType whatsmeow.Me
 
 	resp, err := c.client.Upload(ctx, data, mediaType)
 	if err != nil {
-		logging.Error("Failed to upload to WhatsApp", zap.Error(err))
+		logging.Error("Failed to upload to WhatsApp", zap.Error(err), zap.String("account", c.ID()))
+		c.recordError(err)
 		return nil, fmt.Errorf("upload failed: %w", err)
 	}
+	c.recordUpload(resp.FileLength)
 
 	logging.Info("File uploaded to WhatsApp",
 		zap.String("direct_path", resp.DirectPath),
@@ -42,6 +51,7 @@ func (c *Client) Upload(ctx context.Context, data []byte, mediaType whatsmeow.Me
 	)
 
 	return &UploadResponse{
+		Account:     c.ID(),
 		DirectPath:  resp.DirectPath,
 		MediaKey:    resp.MediaKey,
 		FileEncHash: resp.FileEncSHA256,
@@ -50,17 +60,68 @@ func (c *Client) Upload(ctx context.Context, data []byte, mediaType whatsmeow.Me
 	}, nil
 }
 
-// UploadFromReader uploads a file from a reader to WhatsApp servers
+// UploadFromReader uploads a file from a reader to WhatsApp servers.
+//
+// The plaintext is encrypted and hashed in a single streaming pass into a
+// temporary file under TempDir, which is then sent to the CDN, so memory use
+// stays constant regardless of the file size.
 func (c *Client) UploadFromReader(ctx context.Context, reader io.Reader, mediaType whatsmeow.MediaType) (*UploadResponse, error) {
 	if !c.IsConnected() {
 		return nil, fmt.Errorf("not connected to WhatsApp")
 	}
 
-	// Read all data from reader
-	data, err := io.ReadAll(reader)
+	tempFile, err := os.CreateTemp(c.cfg.TempDir, "wa-upload-*.enc")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+	}()
+
+	logging.Debug("Uploading file to WhatsApp from reader",
+		zap.String("media_type", string(mediaType)),
+		zap.String("account", c.ID()),
+	)
+
+	atomic.AddInt64(&c.activeUploads, 1)
+	resp, err := c.client.UploadReader(ctx, reader, tempFile, mediaType)
+	atomic.AddInt64(&c.activeUploads, -1)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read data: %w", err)
+		logging.Error("Failed to upload to WhatsApp", zap.Error(err), zap.String("account", c.ID()))
+		c.recordError(err)
+		return nil, fmt.Errorf("upload failed: %w", err)
 	}
+	c.recordUpload(resp.FileLength)
+
+	logging.Info("File uploaded to WhatsApp",
+		zap.String("direct_path", resp.DirectPath),
+		zap.Uint64("file_length", resp.FileLength),
+	)
+
+	return &UploadResponse{
+		Account:     c.ID(),
+		DirectPath:  resp.DirectPath,
+		MediaKey:    resp.MediaKey,
+		FileEncHash: resp.FileEncSHA256,
+		FileSHA256:  resp.FileSHA256,
+		FileLength:  resp.FileLength,
+	}, nil
+}
+
+// UploadFile uploads the file at path to WhatsApp servers without loading it into memory
+func (c *Client) UploadFile(ctx context.Context, path string, mediaType whatsmeow.MediaType) (*UploadResponse, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	return c.UploadFromReader(ctx, file, mediaType)
+}
 
-	return c.Upload(ctx, data, mediaType)
+// recordUpload adds a successful upload to the account's volume
+func (c *Client) recordUpload(size uint64) {
+	atomic.AddInt64(&c.uploads, 1)
+	atomic.AddInt64(&c.bytesUploaded, int64(size))
 }
@@ -2,12 +2,15 @@ import { type ReactNode } from 'react';
 import { Toaster } from 'sonner';
 import { Sidebar } from './Sidebar';
 import { MobileNav } from './MobileNav';
+import { useAdminEvents } from '@/hooks/useAdmin';
 
 export interface AdminLayoutProps {
   children: ReactNode;
 }
 
 export function AdminLayout({ children }: AdminLayoutProps) {
+  useAdminEvents();
+
   return (
     <div className="min-h-screen bg-background flex">
       <Sidebar className="hidden lg:flex" />
@@ -12,4 +12,5 @@ export {
   useStats,
   useHourlyStats,
   useDailyStats,
+  useAdminEvents,
 } from './useAdmin';
@@ -1,3 +1,4 @@
+import { useEffect } from 'react';
 import { useQuery, useMutation, useQueryClient } from '@tanstack/react-query';
 import { useNavigate } from '@tanstack/react-router';
 import { toast } from 'sonner';
@@ -14,6 +15,7 @@ import {
   getDailyStats,
 } from '@/api/admin';
 import { getErrorMessage } from '@/api/client';
+import type { ConnectionStatus, QREvent, QRResponse, RealtimeStats, Stats, StatsDelta } from '@/types';
 
 // Auth hooks
 export function useAuth() {
@@ -74,7 +76,7 @@ export function useStatus() {
   return useQuery({
     queryKey: ['status'],
     queryFn: getStatus,
-    refetchInterval: 10000, // Refetch every 10 seconds
+    refetchInterval: 60000, // Fallback; changes are pushed by useAdminEvents
   });
 }
 
@@ -85,7 +87,7 @@ export function useQRCode() {
     queryKey: ['qr'],
     queryFn: getQRCode,
     enabled: status?.logged_in === false,
-    refetchInterval: 20000, // Refetch every 20 seconds while waiting for scan
+    refetchInterval: 60000, // Fallback; new codes are pushed by useAdminEvents
   });
 }
 
@@ -110,7 +112,7 @@ export function useStats() {
   return useQuery({
     queryKey: ['stats'],
     queryFn: getStats,
-    refetchInterval: 30000, // Refetch every 30 seconds
+    refetchInterval: 5 * 60 * 1000, // Fallback; counters are pushed by useAdminEvents
   });
 }
 
@@ -129,3 +131,69 @@ export function useDailyStats(days = 30) {
     refetchInterval: 5 * 60 * 1000, // Refetch every 5 minutes
   });
 }
+
+// Live updates from /api/admin/events keep the status, QR code and stats
+// queries current without polling
+export function useAdminEvents() {
+  const queryClient = useQueryClient();
+
+  useEffect(() => {
+    const source = new EventSource('/api/admin/events', { withCredentials: true });
+    const on = <T,>(event: string, handle: (data: T) => void) => {
+      source.addEventListener(event, (e) => handle(JSON.parse((e as MessageEvent).data)));
+    };
+
+    on<ConnectionStatus>('status', (status) => {
+      queryClient.setQueryData(['status'], status);
+    });
+
+    on('whatsapp', () => {
+      queryClient.invalidateQueries({ queryKey: ['status'] });
+      queryClient.invalidateQueries({ queryKey: ['publicStatus'] });
+    });
+
+    on<QREvent>('qr', (qr) => {
+      if (qr.event === 'code' && qr.image) {
+        queryClient.setQueryData<QRResponse>(['qr'], { qr_code: qr.image });
+        return;
+      }
+      // Pairing ended: show the new account, or start over with a new code
+      queryClient.invalidateQueries({ queryKey: ['status'] });
+      queryClient.invalidateQueries({ queryKey: ['qr'] });
+    });
+
+    on<RealtimeStats>('realtime', (realtime) => {
+      queryClient.setQueryData<Stats>(['stats'], (stats) => stats && { ...stats, realtime });
+    });
+
+    on<StatsDelta>('stats', (delta) => {
+      queryClient.setQueryData<Stats>(['stats'], (stats) =>
+        stats && {
+          ...stats,
+          realtime: {
+            ...stats.realtime,
+            uploads_total: stats.realtime.uploads_total + delta.uploads,
+            downloads_total: stats.realtime.downloads_total + delta.downloads,
+            bytes_uploaded: stats.realtime.bytes_uploaded + delta.bytes_uploaded,
+            bytes_downloaded: stats.realtime.bytes_downloaded + delta.bytes_downloaded,
+            upload_errors: stats.realtime.upload_errors + delta.upload_errors,
+            download_errors: stats.realtime.download_errors + delta.download_errors,
+            requests: stats.realtime.requests + delta.requests,
+            active_uploads: delta.active_uploads,
+            active_downloads: delta.active_downloads,
+          },
+        }
+      );
+    });
+
+    // Uploads and downloads change the file list and storage totals
+    const refreshFiles = () => {
+      queryClient.invalidateQueries({ queryKey: ['files'] });
+      queryClient.invalidateQueries({ queryKey: ['stats'], exact: true });
+    };
+    on('upload', refreshFiles);
+    on('download', refreshFiles);
+
+    return () => source.close();
+  }, [queryClient]);
+}
@@ -10,8 +10,10 @@ export interface FileItem {
   max_downloads?: number;
   download_count: number;
   created_at: string;
+  updated_at: string;
   expires_at: string;
   status: 'active' | 'expired' | 'deleted';
+  management_token?: string; // only returned to the uploader
 }
 
 export interface FileListResponse {
@@ -38,13 +40,25 @@ export interface UploadResponse {
 }
 
 // Admin types
+export type ConnectionState =
+  | 'disconnected'
+  | 'connecting'
+  | 'connected'
+  | 'logged_out'
+  | 'banned'
+  | 'outdated';
+
 export interface ConnectionStatus {
   connected: boolean;
   logged_in: boolean;
+  state: ConnectionState;
   connected_at?: string;
   reconnect_count: number;
   phone_number?: string;
   push_name?: string;
+  last_error?: string;
+  last_error_at?: string;
+  banned_until?: string;
 }
 
 export interface QRResponse {
@@ -60,10 +74,32 @@ export interface RealtimeStats {
   active_downloads: number;
   upload_errors: number;
   download_errors: number;
+  requests: number;
   uptime_seconds: number;
   start_time: string;
 }
 
+// Change in the realtime counters pushed by the live events stream
+export interface StatsDelta {
+  uploads: number;
+  downloads: number;
+  bytes_uploaded: number;
+  bytes_downloaded: number;
+  upload_errors: number;
+  download_errors: number;
+  requests: number;
+  active_uploads: number;
+  active_downloads: number;
+}
+
+// Pairing QR code rotation, or how pairing ended
+export interface QREvent {
+  event: string;
+  code?: string;
+  image?: string;
+  timeout?: number;
+}
+
 export interface StorageStats {
   total_files: number;
   active_files: number;